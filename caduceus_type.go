@@ -9,8 +9,6 @@ import (
 
 	"github.com/go-kit/kit/metrics"
 	"github.com/xmidt-org/ancla"
-
-	"github.com/xmidt-org/wrp-go/v3"
 )
 
 // Below is the struct we're using to contain the data from a provided config file
@@ -20,6 +18,11 @@ type CaduceusConfig struct {
 	NumWorkerThreads int
 	JobQueueSize     int
 	Sender           SenderConfig
+	Stream           StreamConfig
+	Subscriptions    SubscriptionConfig
+	Retention        RetentionConfig
+	WebhookProfiles  []WebhookProfile
+	Redaction        []RedactionRule
 	JWTValidators    []JWTValidator
 	Webhook          ancla.Config
 	Listener         ancla.ListenerConfig
@@ -31,6 +34,8 @@ type SenderConfig struct {
 	QueueSizePerSender              int
 	CutOffPeriod                    time.Duration
 	Linger                          time.Duration
+	RemovalGracePeriod              time.Duration
+	ShareURLWorkers                 bool
 	ClientTimeout                   time.Duration
 	DisableClientHostnameValidation bool
 	ResponseHeaderTimeout           time.Duration
@@ -39,6 +44,15 @@ type SenderConfig struct {
 	DeliveryInterval                time.Duration
 	CustomPIDs                      []string
 	DisablePartnerIDs               bool
+	OrderedDelivery                 bool
+	PriorityClasses                 []PriorityClass
+	QOS                             QOSConfig
+	Verification                    VerificationConfig
+	ExpiryWarning                   ExpiryWarningConfig
+	Notifications                   NotificationConfig
+	Spill                           SpillConfig
+	GRPC                            GRPCConfig
+	File                            FileConfig
 }
 
 type CaduceusMetricsRegistry interface {
@@ -48,7 +62,7 @@ type CaduceusMetricsRegistry interface {
 }
 
 type RequestHandler interface {
-	HandleRequest(workerID int, msg *wrp.Message)
+	HandleRequest(workerID int, msg *outboundEvent)
 }
 
 type CaduceusHandler struct {
@@ -56,7 +70,7 @@ type CaduceusHandler struct {
 	*zap.Logger
 }
 
-func (ch *CaduceusHandler) HandleRequest(workerID int, msg *wrp.Message) {
+func (ch *CaduceusHandler) HandleRequest(workerID int, msg *outboundEvent) {
 	ch.Logger.Info("Worker received a request, now passing to sender", zap.Int("workerId", workerID))
 	ch.senderWrapper.Queue(msg)
 }
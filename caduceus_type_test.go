@@ -15,7 +15,7 @@ func TestCaduceusHandler(t *testing.T) {
 	logger := adapter.DefaultLogger().Logger
 
 	fakeSenderWrapper := new(mockSenderWrapper)
-	fakeSenderWrapper.On("Queue", mock.AnythingOfType("*wrp.Message")).Return().Once()
+	fakeSenderWrapper.On("Queue", mock.AnythingOfType("*main.outboundEvent")).Return().Once()
 
 	testHandler := CaduceusHandler{
 		senderWrapper: fakeSenderWrapper,
@@ -23,7 +23,7 @@ func TestCaduceusHandler(t *testing.T) {
 	}
 
 	t.Run("TestHandleRequest", func(t *testing.T) {
-		testHandler.HandleRequest(0, &wrp.Message{})
+		testHandler.HandleRequest(0, newOutboundEvent(&wrp.Message{}, nil))
 
 		fakeSenderWrapper.AssertExpectations(t)
 	})
@@ -0,0 +1,167 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// The webhook content types that deliver events as CloudEvents 1.0.  Binary
+// mode sends the payload as the body with the attributes as ce- headers,
+// structured mode sends a JSON document holding both.
+const (
+	cloudEventsBinary     = "cloudevents"
+	cloudEventsStructured = "application/cloudevents+json"
+
+	cloudEventsSpecVersion = "1.0"
+
+	// cloudEventsExtPrefix starts the names of the extension attributes
+	// carrying WRP fields that have no CloudEvents equivalent.
+	cloudEventsExtPrefix = "wrp"
+
+	// cloudEventsPartnerIDs is the extension attribute of the partner ids.
+	cloudEventsPartnerIDs = cloudEventsExtPrefix + "partnerids"
+
+	// maxExtensionNameLength is the longest extension attribute name the
+	// CloudEvents spec asks for.
+	maxExtensionNameLength = 20
+)
+
+// isCloudEvents reports whether a webhook content type asks for CloudEvents.
+func isCloudEvents(acceptType string) bool {
+	return cloudEventsBinary == acceptType || cloudEventsStructured == acceptType
+}
+
+// cloudEvent holds the CloudEvents attributes of a WRP event:
+//
+//	id              - the transaction uuid, or a new uuid if there isn't one
+//	source          - the source
+//	type            - the destination without "event:"
+//	subject         - the full destination
+//	datacontenttype - the content type
+//	time            - when the event is delivered
+//
+// The partner ids and each metadata value become extension attributes named
+// "wrp" followed by the lower case letters and digits of their name, like
+// wrppartnerids and wrphwmodel for "/hw-model".  Metadata names that are too
+// long, or that end up the same as the name of an attribute that's already
+// set, are shortened and given a hash of the metadata key instead, see
+// hashedExtensionName.
+type cloudEvent struct {
+	attributes map[string]string
+	data       []byte
+}
+
+func newCloudEvent(msg *wrp.Message) cloudEvent {
+	id := msg.TransactionUUID
+	if "" == id {
+		id = uuid.NewV4().String()
+	}
+
+	attributes := map[string]string{
+		"specversion": cloudEventsSpecVersion,
+		"id":          id,
+		"source":      msg.Source,
+		"type":        strings.TrimPrefix(msg.Destination, "event:"),
+		"subject":     msg.Destination,
+		"time":        time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if "" != msg.ContentType {
+		attributes["datacontenttype"] = msg.ContentType
+	}
+	if 0 < len(msg.PartnerIDs) {
+		attributes[cloudEventsPartnerIDs] = strings.Join(msg.PartnerIDs, ",")
+	}
+
+	// Go through the keys in order so the same metadata always gets the
+	// same names.
+	keys := make([]string, 0, len(msg.Metadata))
+	for k := range msg.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := extensionName(k)
+		if "" == name {
+			continue
+		}
+		if _, taken := attributes[name]; taken || cloudEventsPartnerIDs == name || maxExtensionNameLength < len(name) {
+			name = hashedExtensionName(name, k)
+		}
+		if _, taken := attributes[name]; taken {
+			// The hashes collide too, there's no good name left.
+			continue
+		}
+		attributes[name] = msg.Metadata[k]
+	}
+	return cloudEvent{attributes: attributes, data: msg.Payload}
+}
+
+// extensionName turns a metadata key into a valid extension attribute name,
+// or an empty string if there's nothing left of it.
+func extensionName(key string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(key) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	if 0 == b.Len() {
+		return ""
+	}
+	return cloudEventsExtPrefix + b.String()
+}
+
+// hashedExtensionName cuts name short enough to end it with the hash of the
+// metadata key it came from, which tells apart keys with the same name.
+func hashedExtensionName(name, key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	hash := fmt.Sprintf("%08x", h.Sum32())
+	if max := maxExtensionNameLength - len(hash); max < len(name) {
+		name = name[:max]
+	}
+	return name + hash
+}
+
+// binary returns the body and content type of a binary mode request, and
+// sets the attributes as ce- headers.
+func (ce cloudEvent) binary(header http.Header) ([]byte, string) {
+	for k, v := range ce.attributes {
+		if "datacontenttype" != k {
+			header.Set("ce-"+k, v)
+		}
+	}
+	return ce.data, ce.attributes["datacontenttype"]
+}
+
+// structured returns the body of a structured mode request.  JSON data is
+// embedded as is, text as a string, and anything else base64 encoded.
+func (ce cloudEvent) structured() ([]byte, error) {
+	doc := make(map[string]interface{}, len(ce.attributes)+1)
+	for k, v := range ce.attributes {
+		doc[k] = v
+	}
+
+	contentType := ce.attributes["datacontenttype"]
+	switch {
+	case 0 == len(ce.data):
+	case isJSONContentType(contentType) && json.Valid(ce.data):
+		doc["data"] = json.RawMessage(ce.data)
+	case strings.HasPrefix(contentType, "text/"):
+		doc["data"] = string(ce.data)
+	default:
+		doc["data_base64"] = base64.StdEncoding.EncodeToString(ce.data)
+	}
+	return json.Marshal(doc)
+}
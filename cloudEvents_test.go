@@ -0,0 +1,127 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestCloudEventAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := matcherTestMessage()
+	msg.TransactionUUID = "1234"
+	ce := newCloudEvent(msg)
+
+	assert.Equal("1.0", ce.attributes["specversion"])
+	assert.Equal("1234", ce.attributes["id"])
+	assert.Equal("mac:112233445566", ce.attributes["source"])
+	assert.Equal("device-status/mac:112233445566/online", ce.attributes["type"])
+	assert.Equal("event:device-status/mac:112233445566/online", ce.attributes["subject"])
+	assert.Equal(wrp.MimeTypeJson, ce.attributes["datacontenttype"])
+	assert.Equal("comcast,sky", ce.attributes["wrppartnerids"])
+	assert.Equal("TG1682", ce.attributes["wrphwmodel"])
+	assert.Equal("1234", ce.attributes["wrpboottime"])
+	_, err := time.Parse(time.RFC3339Nano, ce.attributes["time"])
+	assert.NoError(err)
+
+	// Events without a transaction uuid get a new id.
+	msg.TransactionUUID = ""
+	assert.NotEmpty(newCloudEvent(msg).attributes["id"])
+
+	assert.Equal("", extensionName("/-/"))
+	assert.Equal("wrpfwname2", extensionName("/FW-Name_2"))
+}
+
+func TestCloudEventExtensionNames(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := matcherTestMessage()
+	msg.Metadata = map[string]string{
+		"/hw-model":                 "first",
+		"/hwmodel":                  "second",
+		"/partner-ids":              "spoofed",
+		"/a-very-long-metadata-key": "long",
+	}
+	ce := newCloudEvent(msg)
+
+	// Keys are named in order, so "/hw-model" keeps its plain name.
+	assert.Equal("first", ce.attributes["wrphwmodel"])
+	assert.Equal("second", ce.attributes[hashedExtensionName("wrphwmodel", "/hwmodel")])
+	assert.Equal("comcast,sky", ce.attributes["wrppartnerids"])
+	assert.Equal("spoofed", ce.attributes[hashedExtensionName("wrppartnerids", "/partner-ids")])
+
+	long := hashedExtensionName("wrpaverylongmetadatakey", "/a-very-long-metadata-key")
+	assert.Len(long, maxExtensionNameLength)
+	assert.Equal("long", ce.attributes[long])
+
+	for k := range ce.attributes {
+		assert.LessOrEqual(len(k), maxExtensionNameLength)
+	}
+	// Every metadata value is there.
+	assert.Len(ce.attributes, 8+len(msg.Metadata))
+}
+
+func TestCloudEventBinary(t *testing.T) {
+	assert := assert.New(t)
+
+	header := http.Header{}
+	body, contentType := newCloudEvent(matcherTestMessage()).binary(header)
+	assert.Equal(`{"id":"112233445566"}`, string(body))
+	assert.Equal(wrp.MimeTypeJson, contentType)
+	assert.Equal("1.0", header.Get("ce-specversion"))
+	assert.Equal("mac:112233445566", header.Get("ce-source"))
+	assert.Equal("TG1682", header.Get("ce-wrphwmodel"))
+	assert.Empty(header.Get("ce-datacontenttype"))
+}
+
+func TestCloudEventStructured(t *testing.T) {
+	tests := []struct {
+		desc        string
+		contentType string
+		payload     string
+		key         string
+		expected    interface{}
+	}{
+		{desc: "json", contentType: wrp.MimeTypeJson, payload: `{"a":1}`, key: "data", expected: map[string]interface{}{"a": 1.0}},
+		{desc: "invalid json", contentType: wrp.MimeTypeJson, payload: `{"a"`, key: "data_base64", expected: "eyJhIg=="},
+		{desc: "text", contentType: "text/plain", payload: "hello", key: "data", expected: "hello"},
+		{desc: "binary", contentType: wrp.MimeTypeOctetStream, payload: "hi", key: "data_base64", expected: "aGk="},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+
+			msg := matcherTestMessage()
+			msg.ContentType = tc.contentType
+			msg.Payload = []byte(tc.payload)
+			body, err := newCloudEvent(msg).structured()
+			require.NoError(t, err)
+
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal(body, &doc))
+			assert.Equal("1.0", doc["specversion"])
+			assert.Equal(tc.contentType, doc["datacontenttype"])
+			assert.Equal(tc.expected, doc[tc.key])
+		})
+	}
+
+	// Events without a payload have no data.
+	msg := matcherTestMessage()
+	msg.Payload = nil
+	body, err := newCloudEvent(msg).structured()
+	require.NoError(t, err)
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &doc))
+	assert.NotContains(t, doc, "data")
+	assert.NotContains(t, doc, "data_base64")
+}
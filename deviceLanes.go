@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"sync"
+
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// delivery is a dequeued event along with the webhook settings captured by
+// the dispatcher when it was pulled off of the queue.
+type delivery struct {
+	urls   *ring.Ring
+	secret string
+	accept string
+	msg    *outboundEvent
+}
+
+// deviceLanes partitions dequeued events by the device that sent them so that
+// each device has at most one delivery in flight at a time.  Events that
+// arrive for a device while one of its events is being delivered wait in that
+// device's lane and are delivered in the order they were dequeued.
+type deviceLanes struct {
+	mutex   sync.Mutex
+	drained *sync.Cond
+	lanes   map[device.ID][]delivery
+	waiting int
+	limit   int
+}
+
+func newDeviceLanes(limit int) *deviceLanes {
+	if limit < 1 {
+		limit = 1
+	}
+
+	l := &deviceLanes{
+		lanes: make(map[device.ID][]delivery),
+		limit: limit,
+	}
+	l.drained = sync.NewCond(&l.mutex)
+	return l
+}
+
+// laneID returns the key used to partition events, which is the device id of
+// the event's source without any trailing service.
+func laneID(msg *wrp.Message) device.ID {
+	id, err := device.ParseID(msg.Source)
+	if nil != err {
+		return device.ID(msg.Source)
+	}
+	return id
+}
+
+// add places d in the lane for id.  If the device has no delivery in flight a
+// new lane is opened, false is returned, and the caller is responsible for
+// delivering d and then draining the lane using next().  If the device already
+// has a delivery in flight, d waits in the lane and true is returned.
+//
+// The number of waiting deliveries across all lanes is bounded; add blocks
+// until there is room so the backpressure reaches the sender's queue.
+func (l *deviceLanes) add(id device.ID, d delivery) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for {
+		backlog, active := l.lanes[id]
+		if !active {
+			l.lanes[id] = nil
+			return false
+		}
+
+		if l.waiting < l.limit {
+			l.lanes[id] = append(backlog, d)
+			l.waiting++
+			return true
+		}
+
+		l.drained.Wait()
+	}
+}
+
+// next removes and returns the next waiting delivery for id.  When the lane is
+// empty it is closed and false is returned.
+func (l *deviceLanes) next(id device.ID) (delivery, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	backlog := l.lanes[id]
+	if 0 == len(backlog) {
+		delete(l.lanes, id)
+		l.drained.Broadcast()
+		return delivery{}, false
+	}
+
+	d := backlog[0]
+	backlog[0] = delivery{}
+	l.lanes[id] = backlog[1:]
+	l.waiting--
+	l.drained.Broadcast()
+
+	return d, true
+}
+
+// drain removes and returns the waiting deliveries that keep doesn't approve
+// of, or all of them when keep is nil.  The lanes stay open for the
+// deliveries in flight, which find them empty.  A nil deviceLanes has nothing
+// to drain.
+func (l *deviceLanes) drain(keep func(*wrp.Message) bool) []delivery {
+	if nil == l {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var drained []delivery
+	for id, backlog := range l.lanes {
+		kept := backlog[:0]
+		for _, d := range backlog {
+			if nil != keep && keep(d.msg.Message) {
+				kept = append(kept, d)
+				continue
+			}
+			drained = append(drained, d)
+		}
+		for i := len(kept); i < len(backlog); i++ {
+			backlog[i] = delivery{}
+		}
+		l.lanes[id] = kept
+	}
+
+	if 0 < len(drained) {
+		l.waiting -= len(drained)
+		l.drained.Broadcast()
+	}
+	return drained
+}
+
+// len returns the number of deliveries waiting behind in-flight deliveries.
+func (l *deviceLanes) len() int {
+	if nil == l {
+		return 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.waiting
+}
@@ -0,0 +1,115 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestLaneID(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(device.ID("mac:112233445566"), laneID(&wrp.Message{Source: "mac:112233445566/lmlite"}))
+	assert.Equal(device.ID("mac:112233445566"), laneID(&wrp.Message{Source: "MAC:11:22:33:44:55:66"}))
+	assert.Equal(device.ID("not a device"), laneID(&wrp.Message{Source: "not a device"}))
+}
+
+func TestDeviceLanes(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newDeviceLanes(10)
+	id := device.ID("mac:112233445566")
+	other := device.ID("mac:112233445565")
+
+	// The first event for a device opens a lane.
+	assert.False(l.add(id, delivery{msg: newOutboundEvent(&wrp.Message{TransactionUUID: "1"}, nil)}))
+	assert.False(l.add(other, delivery{msg: newOutboundEvent(&wrp.Message{TransactionUUID: "a"}, nil)}))
+
+	// Later events wait behind it.
+	assert.True(l.add(id, delivery{msg: newOutboundEvent(&wrp.Message{TransactionUUID: "2"}, nil)}))
+	assert.True(l.add(id, delivery{msg: newOutboundEvent(&wrp.Message{TransactionUUID: "3"}, nil)}))
+	assert.Equal(2, l.len())
+
+	d, ok := l.next(id)
+	assert.True(ok)
+	assert.Equal("2", d.msg.TransactionUUID)
+	d, ok = l.next(id)
+	assert.True(ok)
+	assert.Equal("3", d.msg.TransactionUUID)
+	_, ok = l.next(id)
+	assert.False(ok)
+	assert.Equal(0, l.len())
+
+	// Once drained the lane is closed and the next event opens a new one.
+	assert.False(l.add(id, delivery{msg: newOutboundEvent(&wrp.Message{TransactionUUID: "4"}, nil)}))
+
+	_, ok = l.next(other)
+	assert.False(ok)
+}
+
+func TestDeviceLanesLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newDeviceLanes(1)
+	id := device.ID("mac:112233445566")
+
+	assert.False(l.add(id, delivery{}))
+	assert.True(l.add(id, delivery{}))
+
+	added := make(chan bool)
+	go func() {
+		added <- l.add(id, delivery{})
+	}()
+
+	select {
+	case <-added:
+		assert.Fail("add should block while the lanes are full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, ok := l.next(id)
+	assert.True(ok)
+	assert.True(<-added)
+	assert.Equal(1, l.len())
+}
+
+func TestDeviceLanesDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newDeviceLanes(10)
+	id := device.ID("mac:112233445566")
+	event := func(tid string, qos wrp.QOSValue) delivery {
+		return delivery{msg: newOutboundEvent(&wrp.Message{TransactionUUID: tid, QualityOfService: qos}, nil)}
+	}
+
+	assert.False(l.add(id, event("1", wrp.QOSLowValue)))
+	assert.True(l.add(id, event("2", wrp.QOSLowValue)))
+	assert.True(l.add(id, event("3", wrp.QOSCriticalValue)))
+	assert.True(l.add(id, event("4", wrp.QOSLowValue)))
+
+	critical := func(msg *wrp.Message) bool { return wrp.QOSCritical == msg.QualityOfService.Level() }
+	drained := l.drain(critical)
+	assert.Len(drained, 2)
+	assert.Equal(1, l.len())
+
+	d, ok := l.next(id)
+	assert.True(ok)
+	assert.Equal("3", d.msg.TransactionUUID)
+
+	assert.True(l.add(id, event("5", wrp.QOSLowValue)))
+	assert.Len(l.drain(nil), 1)
+	assert.Equal(0, l.len())
+
+	// The lane stays open for the delivery in flight.
+	_, ok = l.next(id)
+	assert.False(ok)
+
+	var none *deviceLanes
+	assert.Empty(none.drain(nil))
+	assert.Equal(0, none.len())
+}
@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// eventQueue is the bounded queue of events waiting for a sender's dispatcher.
+// Events are held in one lane per priority class, lane 0 being the highest
+// priority.  The dispatcher pulls from the lanes using smooth weighted round
+// robin so that a busy lane can't starve the others, and a full queue makes
+// room for an event by evicting from the lowest priority lane below it.
+//
+// When byQOS is set, a full queue instead evicts the event with the lowest
+// WRP QOS level, so an event is never dropped while one of lower QOS waits.
+type eventQueue struct {
+	mutex   sync.Mutex
+	ready   *sync.Cond
+	lanes   []lane
+	weights []int
+	credits []int
+	size    int
+	count   int
+	closed  bool
+	woken   bool
+	byQOS   bool
+}
+
+// lane is a FIFO of events of a single priority.
+type lane struct {
+	events []*outboundEvent
+	head   int
+}
+
+func (l *lane) len() int {
+	return len(l.events) - l.head
+}
+
+func (l *lane) push(msg *outboundEvent) {
+	l.events = append(l.events, msg)
+}
+
+func (l *lane) pop() *outboundEvent {
+	msg := l.events[l.head]
+	l.events[l.head] = nil
+	l.head++
+	if l.head == len(l.events) {
+		l.events = l.events[:0]
+		l.head = 0
+	}
+	return msg
+}
+
+// remove takes the event at index i of the underlying slice out of the lane.
+func (l *lane) remove(i int) *outboundEvent {
+	if i == l.head {
+		return l.pop()
+	}
+
+	msg := l.events[i]
+	copy(l.events[i:], l.events[i+1:])
+	l.events[len(l.events)-1] = nil
+	l.events = l.events[:len(l.events)-1]
+	return msg
+}
+
+// newEventQueue creates a queue holding up to size events with one lane per
+// weight.  A queue with no weights has a single lane.
+func newEventQueue(size int, weights []int) *eventQueue {
+	if 0 == len(weights) {
+		weights = []int{1}
+	}
+
+	q := &eventQueue{
+		lanes:   make([]lane, len(weights)),
+		weights: make([]int, len(weights)),
+		credits: make([]int, len(weights)),
+		size:    size,
+	}
+	for i, w := range weights {
+		if w < 1 {
+			w = 1
+		}
+		q.weights[i] = w
+	}
+	q.ready = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push adds msg to the given lane.  If the queue is full, the oldest event in
+// the lowest priority lane below the given lane is evicted to make room and
+// returned.  If there is nothing of lower priority to evict, or the queue has
+// been closed, msg is not added and false is returned.
+func (q *eventQueue) push(msg *outboundEvent, priority int) (evicted *outboundEvent, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return nil, false
+	}
+
+	if priority < 0 || priority >= len(q.lanes) {
+		priority = len(q.lanes) - 1
+	}
+
+	if q.count >= q.size {
+		if evicted = q.evict(msg, priority); nil == evicted {
+			return nil, false
+		}
+		q.count--
+	}
+
+	q.lanes[priority].push(msg)
+	q.count++
+	q.ready.Signal()
+	return evicted, true
+}
+
+// evict removes and returns the event that should make room for msg, or nil
+// if nothing queued is less important than msg.
+func (q *eventQueue) evict(msg *outboundEvent, priority int) *outboundEvent {
+	if !q.byQOS {
+		for i := len(q.lanes) - 1; i > priority; i-- {
+			if 0 < q.lanes[i].len() {
+				return q.lanes[i].pop()
+			}
+		}
+		return nil
+	}
+
+	// Find the lowest QOS event in any lane, preferring lower priority lanes
+	// and older events when there is a tie.  Events of the same QOS as msg can
+	// only be evicted from a lower priority lane.
+	level := msg.QualityOfService.Level()
+	victimLane, victim := -1, -1
+	var victimLevel wrp.QOSLevel
+	for i := len(q.lanes) - 1; i >= 0; i-- {
+		l := &q.lanes[i]
+		for j := l.head; j < len(l.events); j++ {
+			vl := l.events[j].QualityOfService.Level()
+			if vl > level || (vl == level && i <= priority) {
+				continue
+			}
+			if victimLane < 0 || vl < victimLevel {
+				victimLane, victim, victimLevel = i, j, vl
+			}
+		}
+	}
+	if victimLane < 0 {
+		return nil
+	}
+	return q.lanes[victimLane].remove(victim)
+}
+
+// pop removes the next event to deliver, blocking until one is available.
+// False is returned once the queue is closed and empty.  A pop on an empty
+// queue woken by wake returns a nil event and true.
+func (q *eventQueue) pop() (*outboundEvent, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for 0 == q.count {
+		if q.closed {
+			return nil, false
+		}
+		if q.woken {
+			q.woken = false
+			return nil, true
+		}
+		q.ready.Wait()
+	}
+
+	next, total := -1, 0
+	for i := range q.lanes {
+		if 0 == q.lanes[i].len() {
+			continue
+		}
+		q.credits[i] += q.weights[i]
+		total += q.weights[i]
+		if next < 0 || q.credits[i] > q.credits[next] {
+			next = i
+		}
+	}
+	q.credits[next] -= total
+
+	q.count--
+	return q.lanes[next].pop(), true
+}
+
+// close marks the queue as closed.  Events already queued can still be
+// popped, after which pop reports the queue is done.
+func (q *eventQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.woken = true
+	q.ready.Broadcast()
+	q.mutex.Unlock()
+}
+
+// wake wakes up whoever is waiting on the queue in pop or sleep, so they can
+// look for events elsewhere.
+func (q *eventQueue) wake() {
+	q.mutex.Lock()
+	q.woken = true
+	q.ready.Broadcast()
+	q.mutex.Unlock()
+}
+
+// sleep blocks for d, or until the queue is woken or closed.
+func (q *eventQueue) sleep(d time.Duration) {
+	t := time.AfterFunc(d, q.wake)
+	defer t.Stop()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for !q.woken {
+		q.ready.Wait()
+	}
+	q.woken = false
+}
+
+// isClosed reports whether the queue has been closed.
+func (q *eventQueue) isClosed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closed
+}
+
+// drain removes and returns every event in the queue.
+func (q *eventQueue) drain() []*outboundEvent {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	events := make([]*outboundEvent, 0, q.count)
+	for i := range q.lanes {
+		for 0 < q.lanes[i].len() {
+			events = append(events, q.lanes[i].pop())
+		}
+	}
+	q.count = 0
+	return events
+}
+
+// len returns the number of events in the queue.
+func (q *eventQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.count
+}
+
+// room returns the number of events that can be pushed before the queue is
+// full, which is none once it's closed.
+func (q *eventQueue) room() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed || q.size <= q.count {
+		return 0
+	}
+	return q.size - q.count
+}
@@ -0,0 +1,214 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func queuedIDs(q *eventQueue, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		msg, ok := q.pop()
+		if !ok {
+			break
+		}
+		ids = append(ids, msg.TransactionUUID)
+	}
+	return ids
+}
+
+func TestEventQueueSingleLane(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newEventQueue(2, nil)
+	_, ok := q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "1"}, nil), 0)
+	assert.True(ok)
+	_, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "2"}, nil), 0)
+	assert.True(ok)
+
+	// Full, with nothing of lower priority to evict.
+	evicted, ok := q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "3"}, nil), 0)
+	assert.False(ok)
+	assert.Nil(evicted)
+	assert.Equal(2, q.len())
+
+	assert.Equal([]string{"1", "2"}, queuedIDs(q, 2))
+	assert.Equal(0, q.len())
+}
+
+func TestEventQueueWeights(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newEventQueue(20, []int{3, 1})
+	for i := 0; i < 6; i++ {
+		q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high"}, nil), 0)
+		q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "low"}, nil), 1)
+	}
+
+	// The high lane gets three turns for every one the low lane gets, and the
+	// low lane gets the rest once the high lane is empty.
+	assert.Equal([]string{"high", "high", "low", "high", "high", "high", "low", "high", "low", "low", "low", "low"}, queuedIDs(q, 12))
+}
+
+func TestEventQueueEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newEventQueue(3, []int{1, 1, 1})
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "mid"}, nil), 1)
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "low-1"}, nil), 2)
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "low-2"}, nil), 2)
+
+	// The oldest event of the lowest priority lane makes room.
+	evicted, ok := q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high"}, nil), 0)
+	assert.True(ok)
+	assert.Equal("low-1", evicted.TransactionUUID)
+
+	evicted, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "mid-2"}, nil), 1)
+	assert.True(ok)
+	assert.Equal("low-2", evicted.TransactionUUID)
+
+	// Nothing below the mid lane is left, so the queue is full.
+	_, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "mid-3"}, nil), 1)
+	assert.False(ok)
+	_, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "low-3"}, nil), 2)
+	assert.False(ok)
+
+	// Out of range priorities are treated as the lowest.
+	_, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "other"}, nil), 7)
+	assert.False(ok)
+
+	evicted, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high-2"}, nil), 0)
+	assert.True(ok)
+	assert.Equal("mid", evicted.TransactionUUID)
+	assert.Equal(3, q.len())
+}
+
+func TestEventQueueClose(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newEventQueue(2, nil)
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "1"}, nil), 0)
+
+	done := make(chan []string)
+	go func() {
+		done <- queuedIDs(q, 3)
+	}()
+
+	select {
+	case <-done:
+		assert.Fail("pop should block on an empty, open queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.close()
+	assert.Equal([]string{"1"}, <-done)
+
+	_, ok := q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "2"}, nil), 0)
+	assert.False(ok)
+	_, ok = q.pop()
+	assert.False(ok)
+}
+
+func TestEventQueueRoom(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newEventQueue(2, nil)
+	assert.Equal(2, q.room())
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "1"}, nil), 0)
+	assert.Equal(1, q.room())
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "2"}, nil), 0)
+	assert.Zero(q.room())
+
+	q.pop()
+	assert.Equal(1, q.room())
+	q.close()
+	assert.Zero(q.room())
+}
+
+func TestEventQueueWake(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newEventQueue(2, nil)
+	popped := make(chan bool)
+	go func() {
+		msg, ok := q.pop()
+		popped <- ok && nil == msg
+	}()
+
+	select {
+	case <-popped:
+		assert.Fail("pop should block until woken")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.wake()
+	assert.True(<-popped, "a woken pop returns no event")
+
+	start := time.Now()
+	q.sleep(20 * time.Millisecond)
+	assert.GreaterOrEqual(time.Since(start), 20*time.Millisecond)
+
+	slept := make(chan struct{})
+	go func() {
+		q.sleep(time.Minute)
+		close(slept)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.close()
+	<-slept
+	assert.True(q.isClosed())
+}
+
+func TestEventQueueEvictionByQOS(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newEventQueue(4, []int{1, 1})
+	q.byQOS = true
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high-lane-low", QualityOfService: wrp.QOSLowValue}, nil), 0)
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "low-lane-critical", QualityOfService: wrp.QOSCriticalValue}, nil), 1)
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "low-lane-medium", QualityOfService: wrp.QOSMediumValue}, nil), 1)
+	q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high-lane-medium", QualityOfService: wrp.QOSMediumValue}, nil), 0)
+
+	// The lowest QOS event goes first, even from a higher priority lane.
+	evicted, ok := q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high-1", QualityOfService: wrp.QOSHighValue}, nil), 1)
+	assert.True(ok)
+	assert.Equal("high-lane-low", evicted.TransactionUUID)
+
+	// Ties go to the lower priority lane.
+	evicted, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high-2", QualityOfService: wrp.QOSHighValue}, nil), 0)
+	assert.True(ok)
+	assert.Equal("low-lane-medium", evicted.TransactionUUID)
+
+	// An event of the same QOS in the same lane is never evicted.
+	_, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "medium", QualityOfService: wrp.QOSMediumValue}, nil), 0)
+	assert.False(ok)
+
+	evicted, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high-3", QualityOfService: wrp.QOSHighValue}, nil), 0)
+	assert.True(ok)
+	assert.Equal("high-lane-medium", evicted.TransactionUUID)
+
+	// An event of the same QOS in a lower priority lane can make room.
+	evicted, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high-4", QualityOfService: wrp.QOSHighValue}, nil), 0)
+	assert.True(ok)
+	assert.Equal("high-1", evicted.TransactionUUID)
+
+	// A critical event never makes room for a lower QOS one, regardless of
+	// the lane it is in.
+	_, ok = q.push(newOutboundEvent(&wrp.Message{TransactionUUID: "high-5", QualityOfService: wrp.QOSHighValue}, nil), 0)
+	assert.False(ok)
+
+	assert.ElementsMatch([]string{"low-lane-critical", "high-2", "high-3", "high-4"}, idsOf(q.drain()))
+	assert.Equal(0, q.len())
+}
+
+func idsOf(events []*outboundEvent) []string {
+	ids := make([]string, 0, len(events))
+	for _, msg := range events {
+		ids = append(ids, msg.TransactionUUID)
+	}
+	return ids
+}
@@ -0,0 +1,194 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileWrittenCode is the delivery metric code for events written to a file.
+const fileWrittenCode = "written"
+
+var errNoFileDirs = errors.New("file transport dirs are required")
+
+// FileConfig configures the file:// transport.  Anyone who can register a
+// webhook picks its url, so the transport is off unless the operator turns
+// it on, and then only writes under the directories they list.
+type FileConfig struct {
+	// Enabled adds the file:// transport.
+	Enabled bool
+
+	// Dirs are the directories file:// webhooks may write to, including
+	// their subdirectories.  Required when enabled.
+	Dirs []string
+}
+
+// NewFileTransportFactory returns the factory for file:// webhooks, or nil
+// when the file transport isn't enabled.
+func NewFileTransportFactory(c FileConfig) (TransportFactory, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	if 0 == len(c.Dirs) {
+		return nil, errNoFileDirs
+	}
+
+	dirs := make([]string, 0, len(c.Dirs))
+	for _, dir := range c.Dirs {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("file transport dir '%s' must be absolute", dir)
+		}
+		// The dirs may not exist yet, and are used as they are then.
+		dir = filepath.Clean(dir)
+		if real, err := resolvePath(dir); nil == err {
+			dir = real
+		}
+		dirs = append(dirs, dir)
+	}
+
+	return func(*CaduceusOutboundSender) (Transport, error) {
+		return &fileTransport{dirs: dirs, files: make(map[string]*os.File)}, nil
+	}, nil
+}
+
+// fileTransport appends events, one JSON encoded WRP message per line, to the
+// local file named by a file:// url.  It is meant for debugging and feeding
+// local tooling, so the secret and accept type are ignored.
+type fileTransport struct {
+	dirs  []string
+	mutex sync.Mutex
+	files map[string]*os.File
+}
+
+func (t *fileTransport) Deliver(urls *ring.Ring, _, _ string, msg *outboundEvent) (string, error) {
+	path, err := filePath(urls.Value.(string))
+	if nil != err {
+		return "", fmt.Errorf("%w: %v", errInvalidDestination, err)
+	}
+	data, err := msg.json()
+	if nil != err {
+		return "", err
+	}
+	// The encoding is shared with other deliveries, so it's copied rather
+	// than appended to.
+	line := make([]byte, 0, len(data)+1)
+	line = append(append(line, data...), '\n')
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	f, ok := t.files[path]
+	if !ok {
+		// The path is checked once its symlinks are followed, as one under
+		// an allowed directory could still point out of it.
+		real, err := resolvePath(path)
+		if nil != err {
+			return "", fmt.Errorf("%w: %v", errInvalidDestination, err)
+		}
+		if !t.allowed(real) {
+			return "", fmt.Errorf("%w: '%s' is not under an allowed directory", errInvalidDestination, real)
+		}
+		f, err = os.OpenFile(real, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if nil != err {
+			return "", err
+		}
+		t.files[path] = f
+	}
+
+	if _, err = f.Write(line); nil != err {
+		return "", err
+	}
+	return fileWrittenCode, nil
+}
+
+// Close closes every file the transport has written to.
+func (t *fileTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var err error
+	for path, f := range t.files {
+		if cerr := f.Close(); nil == err {
+			err = cerr
+		}
+		delete(t.files, path)
+	}
+	return err
+}
+
+// prune closes the files that aren't named by urls.
+func (t *fileTransport) prune(urls []string) {
+	keep := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		if path, err := filePath(u); nil == err {
+			keep[path] = true
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for path, f := range t.files {
+		if !keep[path] {
+			f.Close()
+			delete(t.files, path)
+		}
+	}
+}
+
+// allowed reports whether path is inside one of the transport's directories.
+func (t *fileTransport) allowed(path string) bool {
+	for _, dir := range t.dirs {
+		rel, err := filepath.Rel(dir, path)
+		if nil != err || "." == rel || ".." == rel || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// resolvePath follows the symlinks in path.  The file itself may not exist
+// yet, so when it doesn't only its directory is resolved.  A symlink that
+// can't be followed is an error, opening it could create a file anywhere.
+func resolvePath(path string) (string, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if nil == err {
+		return real, nil
+	}
+	if _, lerr := os.Lstat(path); !errors.Is(lerr, fs.ErrNotExist) {
+		return "", err
+	}
+
+	dir, file := filepath.Split(path)
+	if "" == dir || dir == path {
+		return path, nil
+	}
+	if dir, err = resolvePath(filepath.Clean(dir)); nil != err {
+		return "", err
+	}
+	return filepath.Join(dir, file), nil
+}
+
+// filePath returns the cleaned local path named by a file:// url.
+func filePath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if nil != err {
+		return "", err
+	}
+	if "" != u.Host && "localhost" != u.Host {
+		return "", fmt.Errorf("file url '%s' must be local", rawURL)
+	}
+	if "" == u.Path {
+		return "", fmt.Errorf("file url '%s' has no path", rawURL)
+	}
+	return filepath.Clean(u.Path), nil
+}
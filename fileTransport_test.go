@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"container/ring"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestFileTransport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+	urls := ring.New(1)
+	urls.Value = "file://" + path
+
+	factory, err := NewFileTransportFactory(FileConfig{Enabled: true, Dirs: []string{dir}})
+	require.NoError(err)
+	ft, err := factory(nil)
+	require.NoError(err)
+
+	for _, id := range []string{"1", "2"} {
+		msg := simpleRequest()
+		msg.TransactionUUID = id
+		code, err := ft.Deliver(urls, "secret", wrp.MimeTypeJson, newOutboundEvent(msg, nil))
+		assert.NoError(err)
+		assert.Equal(fileWrittenCode, code)
+	}
+	require.NoError(ft.Close())
+
+	contents, err := os.ReadFile(path)
+	require.NoError(err)
+	lines := bytes.Split(bytes.TrimSpace(contents), []byte("\n"))
+	require.Len(lines, 2)
+	for i, line := range lines {
+		var msg wrp.Message
+		require.NoError(wrp.NewDecoderBytes(line, wrp.JSON).Decode(&msg))
+		assert.Equal([]string{"1", "2"}[i], msg.TransactionUUID)
+		assert.Equal(simpleRequest().Destination, msg.Destination)
+	}
+}
+
+func TestFilePath(t *testing.T) {
+	tests := []struct {
+		url       string
+		expected  string
+		expectErr bool
+	}{
+		{url: "file:///tmp/events.jsonl", expected: "/tmp/events.jsonl"},
+		{url: "file://localhost/tmp/events.jsonl", expected: "/tmp/events.jsonl"},
+		{url: "file:///tmp/../etc/passwd", expected: "/etc/passwd"},
+		{url: "file://remote/tmp/events.jsonl", expectErr: true},
+		{url: "file://", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			assert := assert.New(t)
+			path, err := filePath(tc.url)
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expected, path)
+		})
+	}
+}
+
+func TestFileTransportInvalidDestination(t *testing.T) {
+	dir := t.TempDir()
+	factory, err := NewFileTransportFactory(FileConfig{Enabled: true, Dirs: []string{dir}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc string
+		url  string
+	}{
+		{desc: "remote", url: "file://remote/tmp/events.jsonl"},
+		{desc: "outside the dirs", url: "file:///tmp/events.jsonl"},
+		{desc: "escapes the dirs", url: "file://" + dir + "/../events.jsonl"},
+		{desc: "the dir itself", url: "file://" + dir},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			urls := ring.New(1)
+			urls.Value = tc.url
+
+			ft, _ := factory(nil)
+			_, err := ft.Deliver(urls, "", "", newOutboundEvent(simpleRequest(), nil))
+			assert.ErrorIs(t, err, errInvalidDestination)
+		})
+	}
+}
+
+func TestFileTransportSymlinks(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "out")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "events.jsonl"), filepath.Join(dir, "file.jsonl")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "missing", "events.jsonl"), filepath.Join(dir, "dangling.jsonl")))
+
+	// The configured dir may itself be a symlink.
+	linked := filepath.Join(t.TempDir(), "linked")
+	require.NoError(t, os.Symlink(dir, linked))
+	factory, err := NewFileTransportFactory(FileConfig{Enabled: true, Dirs: []string{linked}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		desc      string
+		path      string
+		expectErr bool
+	}{
+		{desc: "regular file", path: filepath.Join(linked, "events.jsonl")},
+		{desc: "linked dir", path: filepath.Join(linked, "out", "events.jsonl"), expectErr: true},
+		{desc: "linked file", path: filepath.Join(linked, "file.jsonl"), expectErr: true},
+		{desc: "dangling link", path: filepath.Join(linked, "dangling.jsonl"), expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			urls := ring.New(1)
+			urls.Value = "file://" + tc.path
+
+			ft, _ := factory(nil)
+			defer ft.Close()
+			_, err := ft.Deliver(urls, "", "", newOutboundEvent(simpleRequest(), nil))
+			if tc.expectErr {
+				assert.ErrorIs(t, err, errInvalidDestination)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	entries, err := os.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestNewFileTransportFactory(t *testing.T) {
+	assert := assert.New(t)
+
+	factory, err := NewFileTransportFactory(FileConfig{Dirs: []string{t.TempDir()}})
+	assert.Nil(factory)
+	assert.NoError(err)
+
+	_, err = NewFileTransportFactory(FileConfig{Enabled: true})
+	assert.ErrorIs(err, errNoFileDirs)
+
+	_, err = NewFileTransportFactory(FileConfig{Enabled: true, Dirs: []string{"relative"}})
+	assert.Error(err)
+}
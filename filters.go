@@ -0,0 +1,147 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// defaultFilterCostLimit bounds the work a filter does for each event.
+const defaultFilterCostLimit = 10000
+
+var errFilterNotBool = errors.New("filter must evaluate to a bool")
+
+var (
+	filterEnvOnce sync.Once
+	filterEnv     *cel.Env
+	filterEnvErr  error
+)
+
+// newFilterEnv declares what filter expressions can use:
+//
+//	event            - the event type, the destination without "event:"
+//	source           - the event source, usually the device id
+//	destination      - the full destination
+//	content_type     - the content type
+//	transaction_uuid - the transaction uuid
+//	partner_ids      - the list of partner ids
+//	headers          - the list of WRP headers
+//	metadata         - the metadata map
+//	qos              - the WRP quality of service value
+//	payload_size     - the payload size in bytes
+func newFilterEnv() (*cel.Env, error) {
+	filterEnvOnce.Do(func() {
+		filterEnv, filterEnvErr = cel.NewEnv(
+			cel.Variable("event", cel.StringType),
+			cel.Variable("source", cel.StringType),
+			cel.Variable("destination", cel.StringType),
+			cel.Variable("content_type", cel.StringType),
+			cel.Variable("transaction_uuid", cel.StringType),
+			cel.Variable("partner_ids", cel.ListType(cel.StringType)),
+			cel.Variable("headers", cel.ListType(cel.StringType)),
+			cel.Variable("metadata", cel.MapType(cel.StringType, cel.StringType)),
+			cel.Variable("qos", cel.IntType),
+			cel.Variable("payload_size", cel.IntType),
+		)
+	})
+	return filterEnv, filterEnvErr
+}
+
+// eventFilter is a compiled CEL filter expression.  Expressions can't have
+// side effects and each evaluation is limited in cost, so registrants can't
+// use them to tie up a sender.
+type eventFilter struct {
+	expr    string
+	program cel.Program
+}
+
+// newEventFilter compiles expr, limiting each evaluation to costLimit.  A
+// costLimit of 0 uses the default limit.
+func newEventFilter(expr string, costLimit uint64) (*eventFilter, error) {
+	env, err := newFilterEnv()
+	if nil != err {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expr)
+	if nil != issues && nil != issues.Err() {
+		return nil, fmt.Errorf("invalid filter: %w", issues.Err())
+	}
+	if cel.BoolType != ast.OutputType() {
+		return nil, errFilterNotBool
+	}
+
+	if 0 == costLimit {
+		costLimit = defaultFilterCostLimit
+	}
+	program, err := env.Program(ast, cel.CostLimit(costLimit))
+	if nil != err {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+	return &eventFilter{expr: expr, program: program}, nil
+}
+
+// filterProfile returns a profile that applies the filter expr, or nil if
+// expr is empty.  Streams and subscriptions use it for the filter given with
+// their request, which is rejected with the compile error.  Webhook
+// registrations can't bring one, ancla.Webhook has no field for it and drops
+// the fields it doesn't know, so webhooks get theirs from a WebhookProfile.
+func filterProfile(expr string) (*webhookProfile, error) {
+	if "" == expr {
+		return nil, nil
+	}
+	f, err := newEventFilter(expr, 0)
+	if nil != err {
+		return nil, err
+	}
+	return &webhookProfile{name: "filter", filter: f}, nil
+}
+
+// matches reports whether msg passes the filter.  A nil filter passes
+// everything.  Evaluation errors, like a missing metadata key or going over
+// the cost limit, are returned along with false.
+func (f *eventFilter) matches(msg *wrp.Message) (bool, error) {
+	if nil == f {
+		return true, nil
+	}
+
+	partnerIDs := msg.PartnerIDs
+	if nil == partnerIDs {
+		partnerIDs = []string{}
+	}
+	headers := msg.Headers
+	if nil == headers {
+		headers = []string{}
+	}
+	metadata := msg.Metadata
+	if nil == metadata {
+		metadata = map[string]string{}
+	}
+
+	out, _, err := f.program.Eval(map[string]interface{}{
+		"event":            strings.TrimPrefix(msg.Destination, "event:"),
+		"source":           msg.Source,
+		"destination":      msg.Destination,
+		"content_type":     msg.ContentType,
+		"transaction_uuid": msg.TransactionUUID,
+		"partner_ids":      partnerIDs,
+		"headers":          headers,
+		"metadata":         metadata,
+		"qos":              int64(msg.QualityOfService),
+		"payload_size":     int64(len(msg.Payload)),
+	})
+	if nil != err {
+		return false, err
+	}
+	pass, ok := out.Value().(bool)
+	if !ok {
+		return false, errFilterNotBool
+	}
+	return pass, nil
+}
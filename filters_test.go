@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestEventFilter(t *testing.T) {
+	tests := []struct {
+		desc      string
+		expr      string
+		expected  bool
+		expectErr bool
+	}{
+		{desc: "metadata", expr: `metadata["/hw-model"].startsWith("TG")`, expected: true},
+		{desc: "metadata mismatch", expr: `metadata["/hw-model"].startsWith("XB")`},
+		{desc: "metadata present", expr: `"/boot-time" in metadata && !("/fw-name" in metadata)`, expected: true},
+		{desc: "missing metadata key", expr: `metadata["/fw-name"] == "x"`, expectErr: true},
+		{desc: "event", expr: `event.matches("^device-status/.*/online$")`, expected: true},
+		{desc: "partner ids", expr: `"sky" in partner_ids`, expected: true},
+		{desc: "headers", expr: `headers.exists(h, h.startsWith("X-Region"))`, expected: true},
+		{desc: "payload size", expr: `payload_size < 100 && qos == 0`, expected: true},
+		{desc: "source", expr: `source == "mac:112233445566" && content_type == "application/json"`, expected: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			f, err := newEventFilter(tc.expr, 0)
+			require.NoError(t, err)
+
+			pass, err := f.matches(matcherTestMessage())
+			assert.Equal(tc.expected, pass)
+			if tc.expectErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+
+	var none *eventFilter
+	pass, err := none.matches(&wrp.Message{})
+	assert.True(t, pass)
+	assert.NoError(t, err)
+
+	// Empty fields are still usable.
+	f, err := newEventFilter(`size(partner_ids) == 0 && size(metadata) == 0`, 0)
+	require.NoError(t, err)
+	pass, err = f.matches(&wrp.Message{})
+	assert.True(t, pass)
+	assert.NoError(t, err)
+}
+
+func TestEventFilterInvalid(t *testing.T) {
+	tests := []struct {
+		desc      string
+		expr      string
+		expectErr error
+	}{
+		{desc: "syntax error", expr: `metadata["/hw-model"`},
+		{desc: "unknown variable", expr: `device == "x"`},
+		{desc: "not a bool", expr: `payload_size + 1`, expectErr: errFilterNotBool},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			f, err := newEventFilter(tc.expr, 0)
+			assert.Nil(f)
+			assert.Error(err)
+			if nil != tc.expectErr {
+				assert.ErrorIs(err, tc.expectErr)
+			}
+		})
+	}
+}
+
+func TestEventFilterCostLimit(t *testing.T) {
+	assert := assert.New(t)
+	expr := `headers.all(a, headers.all(b, headers.all(c, a + b + c != "")))`
+
+	msg := matcherTestMessage()
+	for i := 0; i < 50; i++ {
+		msg.Headers = append(msg.Headers, "X-Filler: value")
+	}
+
+	f, err := newEventFilter(expr, 100)
+	require.NoError(t, err)
+	pass, err := f.matches(msg)
+	assert.False(pass)
+	assert.Error(err)
+
+	f, err = newEventFilter(expr, 1<<30)
+	require.NoError(t, err)
+	pass, err = f.matches(msg)
+	assert.True(pass)
+	assert.NoError(err)
+}
@@ -0,0 +1,467 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/webpa-common/v2/xhttp"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	defaultGRPCAckTimeout          = 10 * time.Second
+	defaultGRPCMinReconnectBackoff = 100 * time.Millisecond
+	defaultGRPCMaxReconnectBackoff = 30 * time.Second
+
+	// grpcCodecName is the gRPC content subtype used by the event stream, so
+	// requests are sent as application/grpc+wrp.
+	grpcCodecName = "wrp"
+
+	grpcDeliverMethod = "/caduceus.v1.EventStream/Deliver"
+)
+
+var (
+	errAckTimeout     = errors.New("timed out waiting for ack")
+	errStreamClosed   = errors.New("event stream closed")
+	errTransportEnded = errors.New("transport closed")
+)
+
+// GRPCConfig configures delivery to grpc:// and grpcs:// webhooks.
+type GRPCConfig struct {
+	// AckTimeout is how long to wait for a consumer to acknowledge an event,
+	// including any time spent waiting for the stream to connect.
+	// (Optional) defaults to 10s.
+	AckTimeout time.Duration
+
+	// MinReconnectBackoff is the delay before the first attempt to reopen a
+	// broken stream.  It doubles with every failed attempt.
+	// (Optional) defaults to 100ms.
+	MinReconnectBackoff time.Duration
+
+	// MaxReconnectBackoff caps the delay between attempts to reopen a
+	// broken stream.  (Optional) defaults to 30s.
+	MaxReconnectBackoff time.Duration
+}
+
+// StreamEvent is the message sent to a consumer for every event.  Event is
+// the msgpack encoded WRP message.  Signature is the HMAC of Event keyed with
+// the webhook's secret, in the same form as the X-Webpa-Signature header of
+// http deliveries, and is left out when the webhook has no secret.  It's
+// carried with each event because gRPC metadata is only sent once per
+// stream.
+type StreamEvent struct {
+	ID        uint64 `wrp:"id"`
+	Event     []byte `wrp:"event"`
+	Signature string `wrp:"signature,omitempty"`
+}
+
+// StreamAck is the message a consumer sends back for every StreamEvent it
+// receives.  Status is an http style status code, where 0 is taken to mean
+// 200.  Events acked with a retryable status (408, 429, 504) are retried.
+type StreamAck struct {
+	ID      uint64 `wrp:"id"`
+	Status  int    `wrp:"status"`
+	Message string `wrp:"message,omitempty"`
+}
+
+// wrpCodec encodes the event stream messages using the WRP msgpack handle.
+type wrpCodec struct{}
+
+func (wrpCodec) Marshal(v interface{}) ([]byte, error) {
+	var b []byte
+	err := wrp.NewEncoderBytes(&b, wrp.Msgpack).Encode(v)
+	return b, err
+}
+
+func (wrpCodec) Unmarshal(data []byte, v interface{}) error {
+	return wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(v)
+}
+
+func (wrpCodec) Name() string {
+	return grpcCodecName
+}
+
+// eventStreamServer is what a consumer implements to receive events over
+// gRPC.  The stream carries StreamEvent messages to the consumer and
+// StreamAck messages back.
+type eventStreamServer interface {
+	Deliver(grpc.ServerStream) error
+}
+
+// eventStreamServiceDesc describes the consumer's side of the event stream so
+// it can be served without generated code.
+var eventStreamServiceDesc = grpc.ServiceDesc{
+	ServiceName: "caduceus.v1.EventStream",
+	HandlerType: (*eventStreamServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Deliver",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(eventStreamServer).Deliver(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// NewGRPCTransportFactory creates a TransportFactory for grpc:// (plain text)
+// and grpcs:// (TLS) webhooks.  Each sender holds one long lived,
+// bidirectional stream per destination and every event waits for its ack
+// before its worker is released, so the number of events in flight on a
+// stream is bound by the sender's workers and a slow consumer backs up the
+// sender's queue the same way a slow webhook does.
+func NewGRPCTransportFactory(c GRPCConfig, opts ...grpc.DialOption) TransportFactory {
+	if c.AckTimeout <= 0 {
+		c.AckTimeout = defaultGRPCAckTimeout
+	}
+	if c.MinReconnectBackoff <= 0 {
+		c.MinReconnectBackoff = defaultGRPCMinReconnectBackoff
+	}
+	if c.MaxReconnectBackoff < c.MinReconnectBackoff {
+		c.MaxReconnectBackoff = defaultGRPCMaxReconnectBackoff
+		if c.MaxReconnectBackoff < c.MinReconnectBackoff {
+			c.MaxReconnectBackoff = c.MinReconnectBackoff
+		}
+	}
+
+	return func(obs *CaduceusOutboundSender) (Transport, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &grpcTransport{
+			obs:      obs,
+			config:   c,
+			dialOpts: opts,
+			streams:  make(map[string]*grpcStream),
+			ctx:      ctx,
+			cancel:   cancel,
+		}, nil
+	}
+}
+
+// grpcTransport delivers events over gRPC event streams.
+type grpcTransport struct {
+	obs      *CaduceusOutboundSender
+	config   GRPCConfig
+	dialOpts []grpc.DialOption
+	mutex    sync.Mutex
+	streams  map[string]*grpcStream
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func (t *grpcTransport) Deliver(urls *ring.Ring, secret, _ string, msg *outboundEvent) (string, error) {
+	event, err := msg.msgpack()
+	if nil != err {
+		return "", err
+	}
+
+	var sig string
+	if "" != secret {
+		sig = signature(secret, event)
+	}
+
+	retries := t.obs.qos.deliveryRetries(msg.Message, t.obs.deliveryRetries)
+	for attempt := 0; ; attempt++ {
+		s, err := t.stream(urls.Value.(string))
+		if nil != err {
+			return "", err
+		}
+
+		var ack StreamAck
+		ack, err = s.send(s.ctx, StreamEvent{Event: event, Signature: sig}, t.config.AckTimeout)
+		if 0 == ack.Status {
+			ack.Status = 200
+		}
+		if (nil == err && !xhttp.RetryCodes(ack.Status)) || attempt >= retries || nil != s.ctx.Err() {
+			if nil != err {
+				return "", err
+			}
+			return strconv.Itoa(ack.Status), nil
+		}
+
+		t.obs.deliveryRetryCounter.With("url", t.obs.metricsLabel, "event", msg.FindEventStringSubMatch()).Add(1.0)
+		t.obs.logger.Debug("retrying event", zap.String("url", s.target), zap.Int("status", ack.Status), zap.Error(err))
+		timer := time.NewTimer(t.obs.deliveryInterval)
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			return "", errTransportEnded
+		case <-timer.C:
+		}
+		urls = urls.Next()
+	}
+}
+
+// Close shuts down every stream and waits for them to finish.
+func (t *grpcTransport) Close() error {
+	t.cancel()
+	t.wg.Wait()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var err error
+	for target, s := range t.streams {
+		if cerr := s.conn.Close(); nil == err {
+			err = cerr
+		}
+		delete(t.streams, target)
+	}
+	return err
+}
+
+// prune closes the streams to destinations that aren't in urls.
+func (t *grpcTransport) prune(urls []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	keep := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		keep[u] = true
+	}
+	for target, s := range t.streams {
+		if keep[target] {
+			continue
+		}
+		s.cancel()
+		if err := s.conn.Close(); nil != err {
+			t.obs.logger.Error("failed to close grpc connection", zap.String("url", target), zap.Error(err))
+		}
+		delete(t.streams, target)
+	}
+}
+
+// stream returns the stream for rawURL, starting it if needed.
+func (t *grpcTransport) stream(rawURL string) (*grpcStream, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if s, ok := t.streams[rawURL]; ok {
+		return s, nil
+	}
+	if nil != t.ctx.Err() {
+		return nil, errTransportEnded
+	}
+
+	u, err := url.Parse(rawURL)
+	if nil != err {
+		return nil, fmt.Errorf("%w: %v", errInvalidDestination, err)
+	}
+	if "" == u.Host {
+		return nil, fmt.Errorf("%w: grpc url '%s' has no host", errInvalidDestination, rawURL)
+	}
+
+	creds := insecure.NewCredentials()
+	if "grpcs" == urlScheme(rawURL) {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	opts := append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, t.dialOpts...)
+	conn, err := grpc.Dial(u.Host, opts...)
+	if nil != err {
+		return nil, fmt.Errorf("%w: %v", errInvalidDestination, err)
+	}
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	s := &grpcStream{
+		target:  rawURL,
+		conn:    conn,
+		ctx:     ctx,
+		cancel:  cancel,
+		config:  t.config,
+		logger:  t.obs.logger,
+		pending: make(map[uint64]chan ackResult),
+		up:      make(chan struct{}),
+	}
+	t.streams[rawURL] = s
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		s.run(ctx)
+	}()
+	return s, nil
+}
+
+type ackResult struct {
+	ack StreamAck
+	err error
+}
+
+// grpcStream keeps a single event stream to a destination open, reopening it
+// with exponential backoff whenever it breaks.
+type grpcStream struct {
+	target string
+	conn   *grpc.ClientConn
+	config GRPCConfig
+	logger *zap.Logger
+
+	// ctx ends when the transport closes or the destination is pruned.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// sendMutex serializes sends, which a gRPC stream doesn't allow
+	// concurrently.
+	sendMutex sync.Mutex
+
+	mutex   sync.Mutex
+	stream  grpc.ClientStream
+	up      chan struct{}
+	pending map[uint64]chan ackResult
+	nextID  uint64
+}
+
+// run opens the stream and receives acks until ctx is canceled.
+func (s *grpcStream) run(ctx context.Context) {
+	backoff := s.config.MinReconnectBackoff
+	for {
+		streamCtx, cancel := context.WithCancel(ctx)
+		stream, err := s.conn.NewStream(streamCtx, &eventStreamServiceDesc.Streams[0], grpcDeliverMethod, grpc.ForceCodec(wrpCodec{}))
+		if nil == err {
+			s.connected(stream)
+			var acked bool
+			acked, err = s.receive(stream)
+			s.disconnected(err)
+			if acked {
+				// The stream worked for a while, so start over with the
+				// shortest delay.
+				backoff = s.config.MinReconnectBackoff
+			}
+		}
+		cancel()
+
+		if nil != ctx.Err() {
+			s.disconnected(errTransportEnded)
+			return
+		}
+
+		s.logger.Error("grpc event stream failed, reconnecting", zap.String("url", s.target), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			s.disconnected(errTransportEnded)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.config.MaxReconnectBackoff {
+			backoff = s.config.MaxReconnectBackoff
+		}
+	}
+}
+
+// receive hands acks to the events waiting for them until the stream breaks,
+// and reports whether any ack was received.
+func (s *grpcStream) receive(stream grpc.ClientStream) (bool, error) {
+	var acked bool
+	for {
+		var ack StreamAck
+		if err := stream.RecvMsg(&ack); nil != err {
+			return acked, err
+		}
+		acked = true
+
+		s.mutex.Lock()
+		ch, ok := s.pending[ack.ID]
+		delete(s.pending, ack.ID)
+		s.mutex.Unlock()
+
+		if ok {
+			ch <- ackResult{ack: ack}
+		}
+	}
+}
+
+func (s *grpcStream) connected(stream grpc.ClientStream) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stream = stream
+	close(s.up)
+}
+
+// disconnected fails every event waiting for an ack on the broken stream.
+func (s *grpcStream) disconnected(err error) {
+	if nil == err {
+		err = errStreamClosed
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if nil != s.stream {
+		s.stream = nil
+		s.up = make(chan struct{})
+	}
+	for id, ch := range s.pending {
+		ch <- ackResult{err: fmt.Errorf("%w: %v", errStreamClosed, err)}
+		delete(s.pending, id)
+	}
+}
+
+// send writes event to the stream, with the next id, and waits for its ack.
+func (s *grpcStream) send(ctx context.Context, event StreamEvent, timeout time.Duration) (StreamAck, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	s.mutex.Lock()
+	up := s.up
+	s.mutex.Unlock()
+
+	select {
+	case <-up:
+	case <-timer.C:
+		return StreamAck{}, errAckTimeout
+	case <-ctx.Done():
+		return StreamAck{}, errTransportEnded
+	}
+
+	s.mutex.Lock()
+	stream := s.stream
+	if nil == stream {
+		// It broke again before we got to it.
+		s.mutex.Unlock()
+		return StreamAck{}, errStreamClosed
+	}
+	s.nextID++
+	id := s.nextID
+	event.ID = id
+	ch := make(chan ackResult, 1)
+	s.pending[id] = ch
+	s.mutex.Unlock()
+
+	s.sendMutex.Lock()
+	err := stream.SendMsg(&event)
+	s.sendMutex.Unlock()
+	if nil != err {
+		s.forget(id)
+		return StreamAck{}, err
+	}
+
+	select {
+	case r := <-ch:
+		return r.ack, r.err
+	case <-timer.C:
+		s.forget(id)
+		return StreamAck{}, errAckTimeout
+	case <-ctx.Done():
+		s.forget(id)
+		return StreamAck{}, errTransportEnded
+	}
+}
+
+func (s *grpcStream) forget(id uint64) {
+	s.mutex.Lock()
+	delete(s.pending, id)
+	s.mutex.Unlock()
+}
@@ -0,0 +1,329 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testConsumer is an in-process gRPC consumer that acks every event with the
+// status returned by ack.
+type testConsumer struct {
+	mutex      sync.Mutex
+	received   []string
+	signatures []string
+	ack        func(msg *wrp.Message, count int) (int, bool)
+}
+
+func (c *testConsumer) Deliver(stream grpc.ServerStream) error {
+	for {
+		var event StreamEvent
+		if err := stream.RecvMsg(&event); nil != err {
+			return err
+		}
+
+		var msg wrp.Message
+		if err := wrp.NewDecoderBytes(event.Event, wrp.Msgpack).Decode(&msg); nil != err {
+			return err
+		}
+
+		c.mutex.Lock()
+		c.received = append(c.received, msg.TransactionUUID)
+		c.signatures = append(c.signatures, event.Signature)
+		count := len(c.received)
+		c.mutex.Unlock()
+
+		status, send := 0, true
+		if nil != c.ack {
+			status, send = c.ack(&msg, count)
+		}
+		if !send {
+			continue
+		}
+		if err := stream.SendMsg(&StreamAck{ID: event.ID, Status: status}); nil != err {
+			return err
+		}
+	}
+}
+
+func (c *testConsumer) events() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.received...)
+}
+
+// bufServer runs consumers on in memory listeners that can be swapped out to
+// simulate the consumer restarting.
+type bufServer struct {
+	mutex    sync.Mutex
+	listener *bufconn.Listener
+	server   *grpc.Server
+}
+
+func (b *bufServer) start(c *testConsumer) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.listener = bufconn.Listen(1024 * 1024)
+	b.server = grpc.NewServer(grpc.ForceServerCodec(wrpCodec{}))
+	b.server.RegisterService(&eventStreamServiceDesc, c)
+	go b.server.Serve(b.listener)
+}
+
+func (b *bufServer) stop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.server.Stop()
+}
+
+func (b *bufServer) dial(ctx context.Context, _ string) (net.Conn, error) {
+	b.mutex.Lock()
+	l := b.listener
+	b.mutex.Unlock()
+	return l.DialContext(ctx)
+}
+
+func newTestGRPCTransport(t *testing.T, b *bufServer, c GRPCConfig, retries int) Transport {
+	obs := &CaduceusOutboundSender{
+		id:                   "grpc://bufnet",
+		metricsLabel:         "grpc://bufnet",
+		logger:               zap.NewNop(),
+		deliveryRetries:      retries,
+		deliveryInterval:     10 * time.Millisecond,
+		deliveryRetryCounter: discard.NewCounter(),
+	}
+	gt, err := NewGRPCTransportFactory(c, grpc.WithContextDialer(b.dial))(obs)
+	require.NoError(t, err)
+	return gt
+}
+
+func grpcURLs() *ring.Ring {
+	urls := ring.New(1)
+	urls.Value = "grpc://bufnet"
+	return urls
+}
+
+func grpcRequest(id string) *wrp.Message {
+	msg := simpleRequest()
+	msg.Type = wrp.SimpleEventMessageType
+	msg.TransactionUUID = id
+	return msg
+}
+
+func TestGRPCTransportDeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &testConsumer{}
+	b := &bufServer{}
+	b.start(consumer)
+	defer b.stop()
+
+	gt := newTestGRPCTransport(t, b, GRPCConfig{AckTimeout: 5 * time.Second}, 0)
+
+	// Deliver from several workers at once over the one stream.
+	var wg sync.WaitGroup
+	for _, id := range []string{"1", "2", "3", "4"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			code, err := gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest(id), nil))
+			assert.NoError(err)
+			assert.Equal("200", code)
+		}(id)
+	}
+	wg.Wait()
+
+	assert.NoError(gt.Close())
+	assert.ElementsMatch([]string{"1", "2", "3", "4"}, consumer.events())
+}
+
+// Events are signed with the webhook's secret like http deliveries are.
+func TestGRPCTransportSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &testConsumer{}
+	b := &bufServer{}
+	b.start(consumer)
+	defer b.stop()
+
+	gt := newTestGRPCTransport(t, b, GRPCConfig{AckTimeout: 5 * time.Second}, 0)
+
+	msg := newOutboundEvent(grpcRequest("1"), nil)
+	_, err := gt.Deliver(grpcURLs(), "123456", "", msg)
+	assert.NoError(err)
+	_, err = gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest("2"), nil))
+	assert.NoError(err)
+	assert.NoError(gt.Close())
+
+	event, err := msg.msgpack()
+	require.NoError(t, err)
+	h := hmac.New(sha1.New, []byte("123456"))
+	h.Write(event)
+
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	assert.Equal([]string{"sha1=" + hex.EncodeToString(h.Sum(nil)), ""}, consumer.signatures)
+}
+
+func TestGRPCTransportRetryStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &testConsumer{
+		ack: func(_ *wrp.Message, count int) (int, bool) {
+			if count < 3 {
+				return 429, true
+			}
+			return 202, true
+		},
+	}
+	b := &bufServer{}
+	b.start(consumer)
+	defer b.stop()
+
+	gt := newTestGRPCTransport(t, b, GRPCConfig{AckTimeout: 5 * time.Second}, 3)
+	defer gt.Close()
+
+	code, err := gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest("1"), nil))
+	assert.NoError(err)
+	assert.Equal("202", code)
+	assert.Equal([]string{"1", "1", "1"}, consumer.events())
+}
+
+func TestGRPCTransportReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	first := &testConsumer{}
+	b := &bufServer{}
+	b.start(first)
+
+	gt := newTestGRPCTransport(t, b, GRPCConfig{
+		AckTimeout:          5 * time.Second,
+		MinReconnectBackoff: 10 * time.Millisecond,
+		MaxReconnectBackoff: 50 * time.Millisecond,
+	}, 0)
+	defer gt.Close()
+
+	code, err := gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest("before"), nil))
+	assert.NoError(err)
+	assert.Equal("200", code)
+
+	// The consumer restarts, the stream is reopened once it is back.
+	b.stop()
+	second := &testConsumer{}
+	b.start(second)
+	defer b.stop()
+
+	assert.Eventually(func() bool {
+		_, err := gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest("after"), nil))
+		return nil == err
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Equal([]string{"before"}, first.events())
+	assert.Contains(second.events(), "after")
+}
+
+func TestGRPCTransportAckTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &testConsumer{
+		ack: func(*wrp.Message, int) (int, bool) { return 0, false },
+	}
+	b := &bufServer{}
+	b.start(consumer)
+	defer b.stop()
+
+	gt := newTestGRPCTransport(t, b, GRPCConfig{AckTimeout: 100 * time.Millisecond}, 0)
+	defer gt.Close()
+
+	_, err := gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest("1"), nil))
+	assert.ErrorIs(err, errAckTimeout)
+}
+
+func TestGRPCTransportInvalidDestination(t *testing.T) {
+	assert := assert.New(t)
+
+	gt := newTestGRPCTransport(t, &bufServer{}, GRPCConfig{}, 0)
+	defer gt.Close()
+
+	urls := ring.New(1)
+	urls.Value = "grpc:///no-host"
+	_, err := gt.Deliver(urls, "", "", newOutboundEvent(grpcRequest("1"), nil))
+	assert.ErrorIs(err, errInvalidDestination)
+}
+
+// Closing the transport ends the wait between retries.
+func TestGRPCTransportRetryWaitClosed(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &testConsumer{
+		ack: func(*wrp.Message, int) (int, bool) { return 429, true },
+	}
+	b := &bufServer{}
+	b.start(consumer)
+	defer b.stop()
+
+	gt := newTestGRPCTransport(t, b, GRPCConfig{AckTimeout: 5 * time.Second}, 3)
+	gt.(*grpcTransport).obs.deliveryInterval = time.Hour
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest("1"), nil))
+		done <- err
+	}()
+
+	assert.Eventually(func() bool { return 1 == len(consumer.events()) }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(gt.Close())
+	select {
+	case err := <-done:
+		assert.ErrorIs(err, errTransportEnded)
+	case <-time.After(5 * time.Second):
+		assert.Fail("delivery still waiting to retry")
+	}
+}
+
+// Streams to urls a webhook no longer delivers to are closed.
+func TestGRPCTransportPrune(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &testConsumer{}
+	b := &bufServer{}
+	b.start(consumer)
+	defer b.stop()
+
+	gt := newTestGRPCTransport(t, b, GRPCConfig{AckTimeout: 5 * time.Second}, 0)
+	defer gt.Close()
+	streams := func() int {
+		gt.(*grpcTransport).mutex.Lock()
+		defer gt.(*grpcTransport).mutex.Unlock()
+		return len(gt.(*grpcTransport).streams)
+	}
+
+	_, err := gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest("1"), nil))
+	assert.NoError(err)
+
+	gt.(urlPruner).prune([]string{"grpc://bufnet"})
+	assert.Equal(1, streams())
+
+	gt.(urlPruner).prune([]string{"grpc://elsewhere"})
+	assert.Equal(0, streams())
+
+	// It's opened again if the url comes back.
+	_, err = gt.Deliver(grpcURLs(), "", "", newOutboundEvent(grpcRequest("2"), nil))
+	assert.NoError(err)
+	assert.Equal([]string{"1", "2"}, consumer.events())
+}
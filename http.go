@@ -114,7 +114,15 @@ func (sh *ServerHandler) ServeHTTP(response http.ResponseWriter, request *http.R
 	}
 	eventType = msg.FindEventStringSubMatch()
 
-	sh.caduceusHandler.HandleRequest(0, sh.fixWrp(msg))
+	// Consumers that want the WRP get the bytes the device sent, unless
+	// they no longer match the event.  Anything after the message isn't
+	// part of it and is left out.
+	fixed := sh.fixWrp(msg)
+	var raw []byte
+	if counter, ok := decoder.(interface{ NumBytesRead() int }); ok && !fixed {
+		raw = payload[:counter.NumBytesRead()]
+	}
+	sh.caduceusHandler.HandleRequest(0, newOutboundEvent(msg, raw))
 
 	// return a 202
 	response.WriteHeader(http.StatusAccepted)
@@ -128,7 +136,9 @@ func (sh *ServerHandler) recordQueueLatencyToHistogram(startTime time.Time, even
 	sh.incomingQueueLatency.With("event", eventType).Observe(endTime.Sub(startTime).Seconds())
 }
 
-func (sh *ServerHandler) fixWrp(msg *wrp.Message) *wrp.Message {
+// fixWrp fills in the fields of msg that caduceus needs, and reports whether
+// it had to change anything.
+func (sh *ServerHandler) fixWrp(msg *wrp.Message) bool {
 	// "Fix" the WRP if needed.
 	var reason string
 
@@ -153,5 +163,5 @@ func (sh *ServerHandler) fixWrp(msg *wrp.Message) *wrp.Message {
 		sh.modifiedWRPCount.With("reason", reason).Add(1.0)
 	}
 
-	return msg
+	return reason != ""
 }
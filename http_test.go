@@ -13,6 +13,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 
 	"github.com/xmidt-org/webpa-common/v2/adapter"
 	"github.com/xmidt-org/wrp-go/v3"
@@ -91,8 +92,9 @@ func TestServerHandler(t *testing.T) {
 		logger := adapter.DefaultLogger().Logger
 		fakeHandler := new(mockHandler)
 		if !tc.throwStatusBadRequest {
+			// Unchanged events keep the bytes they were received as.
 			fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
-				mock.AnythingOfType("*wrp.Message")).Return().Times(1)
+				mock.MatchedBy(func(e *outboundEvent) bool { return 0 < len(e.raw) })).Return().Times(1)
 		}
 
 		fakeEmptyRequests := new(mockCounter)
@@ -147,8 +149,9 @@ func TestServerHandlerFixWrp(t *testing.T) {
 
 	logger := adapter.DefaultLogger().Logger
 	fakeHandler := new(mockHandler)
+	// Fixed events no longer match the bytes they were received as.
 	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
-		mock.AnythingOfType("*wrp.Message")).Return().Once()
+		mock.MatchedBy(func(e *outboundEvent) bool { return nil == e.raw })).Return().Once()
 
 	fakeEmptyRequests := new(mockCounter)
 	fakeErrorRequests := new(mockCounter)
@@ -200,6 +203,47 @@ func TestServerHandlerFixWrp(t *testing.T) {
 	})
 }
 
+// Bytes after the message aren't passed on with it.
+func TestServerHandlerTrailingBytes(t *testing.T) {
+	date1 := time.Date(2021, time.Month(2), 21, 1, 10, 30, 0, time.UTC)
+	date2 := time.Date(2021, time.Month(2), 21, 1, 10, 30, 45, time.UTC)
+
+	assert := assert.New(t)
+
+	body, err := io.ReadAll(exampleRequest(4).Body)
+	require.NoError(t, err)
+	request := httptest.NewRequest("POST", "localhost:8080", bytes.NewReader(append(append([]byte{}, body...), 0xc0)))
+	request.Header.Set("Content-Type", wrp.MimeTypeMsgpack)
+
+	fakeHandler := new(mockHandler)
+	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+		mock.MatchedBy(func(e *outboundEvent) bool { return bytes.Equal(body, e.raw) })).Return().Once()
+
+	fakeQueueDepth := new(mockGauge)
+	fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(2)
+
+	fakeHist := new(mockHistogram)
+	fakeHist.On("With", []string{"event", "bob"}).Return().Once()
+	fakeHist.On("Observe", date2.Sub(date1).Seconds()).Return().Once()
+
+	serverWrapper := &ServerHandler{
+		Logger:                   adapter.DefaultLogger().Logger,
+		caduceusHandler:          fakeHandler,
+		errorRequests:            new(mockCounter),
+		emptyRequests:            new(mockCounter),
+		invalidCount:             new(mockCounter),
+		incomingQueueDepthMetric: fakeQueueDepth,
+		maxOutstanding:           1,
+		incomingQueueLatency:     fakeHist,
+		now:                      mockTime(date1, date2),
+	}
+
+	w := httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, request)
+	assert.Equal(http.StatusAccepted, w.Result().StatusCode)
+	fakeHandler.AssertExpectations(t)
+}
+
 func TestServerHandlerFull(t *testing.T) {
 	date1 := time.Date(2021, time.Month(2), 21, 1, 10, 30, 0, time.UTC)
 	date2 := time.Date(2021, time.Month(2), 21, 1, 10, 30, 45, time.UTC)
@@ -209,7 +253,7 @@ func TestServerHandlerFull(t *testing.T) {
 	logger := adapter.DefaultLogger().Logger
 	fakeHandler := new(mockHandler)
 	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
-		mock.AnythingOfType("*wrp.Message")).WaitUntil(time.After(time.Second)).Times(2)
+		mock.AnythingOfType("*main.outboundEvent")).WaitUntil(time.After(time.Second)).Times(2)
 
 	fakeQueueDepth := new(mockGauge)
 	fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(4)
@@ -262,7 +306,7 @@ func TestServerEmptyPayload(t *testing.T) {
 	logger := adapter.DefaultLogger().Logger
 	fakeHandler := new(mockHandler)
 	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
-		mock.AnythingOfType("*wrp.Message")).WaitUntil(time.After(time.Second)).Times(2)
+		mock.AnythingOfType("*main.outboundEvent")).WaitUntil(time.After(time.Second)).Times(2)
 
 	fakeEmptyRequests := new(mockCounter)
 	fakeEmptyRequests.On("Add", mock.AnythingOfType("float64")).Return().Once()
@@ -317,7 +361,7 @@ func TestServerUnableToReadBody(t *testing.T) {
 	logger := adapter.DefaultLogger().Logger
 	fakeHandler := new(mockHandler)
 	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
-		mock.AnythingOfType("*wrp.Message")).WaitUntil(time.After(time.Second)).Once()
+		mock.AnythingOfType("*main.outboundEvent")).WaitUntil(time.After(time.Second)).Once()
 
 	fakeErrorRequests := new(mockCounter)
 	fakeErrorRequests.On("Add", mock.AnythingOfType("float64")).Return().Once()
@@ -371,7 +415,7 @@ func TestServerInvalidBody(t *testing.T) {
 	logger := adapter.DefaultLogger().Logger
 	fakeHandler := new(mockHandler)
 	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
-		mock.AnythingOfType("*wrp.Message")).WaitUntil(time.After(time.Second)).Once()
+		mock.AnythingOfType("*main.outboundEvent")).WaitUntil(time.After(time.Second)).Once()
 
 	fakeQueueDepth := new(mockGauge)
 	fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(4)
@@ -115,11 +115,31 @@ func caduceus(arguments []string) int {
 		otelhttp.WithTracerProvider(tracing.TracerProvider()),
 	)
 
+	transports := DefaultTransports()
+	grpcTransport := NewGRPCTransportFactory(caduceusConfig.Sender.GRPC)
+	transports["grpc"] = grpcTransport
+	transports["grpcs"] = grpcTransport
+	fileTransport, err := NewFileTransportFactory(caduceusConfig.Sender.File)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to configure the file transport: %s\n", err)
+		return 1
+	}
+	if nil != fileTransport {
+		transports["file"] = fileTransport
+	}
+
+	retention, err := newRetentionStore(caduceusConfig.Retention, metricsRegistry.NewCounter(RetentionDroppedCounter), logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open the event retention store: %s\n", err)
+		return 1
+	}
+
 	caduceusSenderWrapper, err := SenderWrapperFactory{
 		NumWorkersPerSender: caduceusConfig.Sender.NumWorkersPerSender,
 		QueueSizePerSender:  caduceusConfig.Sender.QueueSizePerSender,
 		CutOffPeriod:        caduceusConfig.Sender.CutOffPeriod,
 		Linger:              caduceusConfig.Sender.Linger,
+		RemovalGracePeriod:  caduceusConfig.Sender.RemovalGracePeriod,
 		DeliveryRetries:     caduceusConfig.Sender.DeliveryRetries,
 		DeliveryInterval:    caduceusConfig.Sender.DeliveryInterval,
 		MetricsRegistry:     metricsRegistry,
@@ -130,6 +150,18 @@ func caduceus(arguments []string) int {
 		}).Do),
 		CustomPIDs:        caduceusConfig.Sender.CustomPIDs,
 		DisablePartnerIDs: caduceusConfig.Sender.DisablePartnerIDs,
+		OrderedDelivery:   caduceusConfig.Sender.OrderedDelivery,
+		PriorityClasses:   caduceusConfig.Sender.PriorityClasses,
+		QOS:               caduceusConfig.Sender.QOS,
+		Verification:      caduceusConfig.Sender.Verification,
+		ExpiryWarning:     caduceusConfig.Sender.ExpiryWarning,
+		Notifications:     caduceusConfig.Sender.Notifications,
+		Spill:             caduceusConfig.Sender.Spill,
+		Retention:         retention,
+		Transports:        transports,
+		ShareURLWorkers:   caduceusConfig.Sender.ShareURLWorkers,
+		Profiles:          caduceusConfig.WebhookProfiles,
+		Redaction:         caduceusConfig.Redaction,
 	}.New()
 
 	if err != nil {
@@ -189,7 +221,35 @@ func caduceus(arguments []string) int {
 	}
 	rootRouter.Use(otelmux.Middleware("primary", otelMuxOptions...), candlelight.EchoFirstTraceNodeInfo(tracing.Propagator()))
 
-	primaryHandler, err := NewPrimaryHandler(logger, v, metricsRegistry, serverWrapper, svc, rootRouter, v.GetBool("previousVersionSupport"))
+	var (
+		streams       http.Handler
+		subscriptions *subscriptionHandler
+	)
+	if caduceusConfig.Stream.Enabled || caduceusConfig.Subscriptions.Enabled {
+		senders, ok := caduceusSenderWrapper.(streamSenders)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Sender wrapper does not support streaming\n")
+			return 1
+		}
+		if caduceusConfig.Stream.Enabled {
+			streams = newStreamHandler(caduceusConfig.Stream, senders, logger, caduceusConfig.Sender.DisablePartnerIDs)
+		}
+		if caduceusConfig.Subscriptions.Enabled {
+			subscriptions = newSubscriptionHandler(caduceusConfig.Subscriptions, senders, logger, caduceusConfig.Sender.DisablePartnerIDs)
+		}
+	}
+
+	var replays http.Handler
+	if nil != retention {
+		senders, ok := caduceusSenderWrapper.(replaySenders)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Sender wrapper does not support replays\n")
+			return 1
+		}
+		replays = newReplayHandler(retention, senders, logger, caduceusConfig.Sender.DisablePartnerIDs)
+	}
+
+	primaryHandler, err := NewPrimaryHandler(logger, v, metricsRegistry, serverWrapper, streams, subscriptions, replays, svc, rootRouter, v.GetBool("previousVersionSupport"))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Handler creation error: %v\n", err)
 		return 1
@@ -243,6 +303,9 @@ func caduceus(arguments []string) int {
 
 	// shutdown the sender wrapper gently so that all queued messages get serviced
 	caduceusSenderWrapper.Shutdown(true)
+	if err := retention.close(); nil != err {
+		logger.Error("unable to close the event retention store", zap.Error(err))
+	}
 	stopWatches()
 	return 0
 }
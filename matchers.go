@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// The fields of an event a MatcherConfig can match on.
+const (
+	matchMetadata    = "metadata"
+	matchHeader      = "header"
+	matchContentType = "content_type"
+	matchPartnerID   = "partner_id"
+	matchPayloadSize = "payload_size"
+)
+
+var (
+	errMatcherShape   = errors.New("matcher must have exactly one of all, any or field")
+	errMatcherKey     = errors.New("matcher needs a key")
+	errMatcherValue   = errors.New("matcher needs a value")
+	errMatcherSize    = errors.New("matcher size bounds are invalid")
+	errMatcherUnknown = errors.New("unknown matcher field")
+)
+
+// MatcherConfig is a condition on an event.  Conditions are combined with All
+// and Any, or compare one Field of the event:
+//
+//	metadata     - the metadata value named Key, matched against Value
+//	header       - the header named Key, matched against Value
+//	content_type - the content type, matched against Value
+//	partner_id   - any of the partner ids, matched against Value
+//	payload_size - the payload size, between MinSize and MaxSize
+//
+// Value is a regular expression.  For metadata and headers it is optional,
+// leaving it out only requires the key to be present.
+type MatcherConfig struct {
+	// All is a list of conditions that must all be met.
+	All []MatcherConfig
+
+	// Any is a list of conditions of which at least one must be met.
+	Any []MatcherConfig
+
+	// Not inverts the condition.
+	Not bool
+
+	Field   string
+	Key     string
+	Value   string
+	MinSize int
+	MaxSize int
+}
+
+// eventMatcher reports whether an event meets a condition.
+type eventMatcher func(*wrp.Message) bool
+
+// newEventMatcher compiles a MatcherConfig.
+func newEventMatcher(c MatcherConfig) (eventMatcher, error) {
+	m, err := compileMatcher(c)
+	if nil != err || !c.Not {
+		return m, err
+	}
+	return func(msg *wrp.Message) bool {
+		return !m(msg)
+	}, nil
+}
+
+func compileMatcher(c MatcherConfig) (eventMatcher, error) {
+	shapes := 0
+	for _, set := range []bool{0 < len(c.All), 0 < len(c.Any), "" != c.Field} {
+		if set {
+			shapes++
+		}
+	}
+	if 1 != shapes {
+		return nil, errMatcherShape
+	}
+
+	switch {
+	case 0 < len(c.All):
+		all, err := compileMatchers(c.All)
+		if nil != err {
+			return nil, err
+		}
+		return func(msg *wrp.Message) bool {
+			for _, m := range all {
+				if !m(msg) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case 0 < len(c.Any):
+		anyOf, err := compileMatchers(c.Any)
+		if nil != err {
+			return nil, err
+		}
+		return func(msg *wrp.Message) bool {
+			for _, m := range anyOf {
+				if m(msg) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	if matchPayloadSize == c.Field {
+		if c.MinSize < 0 || c.MaxSize < 0 || (0 < c.MaxSize && c.MaxSize < c.MinSize) {
+			return nil, errMatcherSize
+		}
+		return func(msg *wrp.Message) bool {
+			size := len(msg.Payload)
+			return c.MinSize <= size && (0 == c.MaxSize || size <= c.MaxSize)
+		}, nil
+	}
+
+	var value *regexp.Regexp
+	if "" != c.Value {
+		var err error
+		if value, err = regexp.Compile(c.Value); nil != err {
+			return nil, fmt.Errorf("invalid %s matcher value '%s': %w", c.Field, c.Value, err)
+		}
+	}
+
+	switch c.Field {
+	case matchMetadata:
+		if "" == c.Key {
+			return nil, errMatcherKey
+		}
+		return func(msg *wrp.Message) bool {
+			v, ok := msg.Metadata[c.Key]
+			return ok && (nil == value || value.MatchString(v))
+		}, nil
+	case matchHeader:
+		if "" == c.Key {
+			return nil, errMatcherKey
+		}
+		return func(msg *wrp.Message) bool {
+			for _, v := range headerValues(msg, c.Key) {
+				if nil == value || value.MatchString(v) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case matchContentType:
+		if nil == value {
+			return nil, errMatcherValue
+		}
+		return func(msg *wrp.Message) bool {
+			return value.MatchString(msg.ContentType)
+		}, nil
+	case matchPartnerID:
+		if nil == value {
+			return nil, errMatcherValue
+		}
+		return func(msg *wrp.Message) bool {
+			for _, pid := range msg.PartnerIDs {
+				if value.MatchString(pid) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, fmt.Errorf("%w '%s'", errMatcherUnknown, c.Field)
+}
+
+func compileMatchers(config []MatcherConfig) ([]eventMatcher, error) {
+	matchers := make([]eventMatcher, 0, len(config))
+	for _, c := range config {
+		m, err := newEventMatcher(c)
+		if nil != err {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// headerValues returns the values of the WRP headers named key.  WRP headers
+// are "Name: value" strings, names are compared case insensitively.
+func headerValues(msg *wrp.Message, key string) []string {
+	var values []string
+	for _, h := range msg.Headers {
+		name, value, ok := strings.Cut(h, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), key) {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	return values
+}
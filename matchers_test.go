@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func matcherTestMessage() *wrp.Message {
+	return &wrp.Message{
+		Source:      "mac:112233445566",
+		Destination: "event:device-status/mac:112233445566/online",
+		ContentType: wrp.MimeTypeJson,
+		PartnerIDs:  []string{"comcast", "sky"},
+		Headers:     []string{"X-Region: east", "X-Other:value"},
+		Metadata:    map[string]string{"/hw-model": "TG1682", "/boot-time": "1234"},
+		Payload:     []byte(`{"id":"112233445566"}`),
+	}
+}
+
+func TestEventMatcher(t *testing.T) {
+	tests := []struct {
+		desc     string
+		config   MatcherConfig
+		expected bool
+	}{
+		{desc: "metadata", config: MatcherConfig{Field: "metadata", Key: "/hw-model", Value: "^TG"}, expected: true},
+		{desc: "metadata mismatch", config: MatcherConfig{Field: "metadata", Key: "/hw-model", Value: "^XB"}},
+		{desc: "metadata present", config: MatcherConfig{Field: "metadata", Key: "/boot-time"}, expected: true},
+		{desc: "metadata missing", config: MatcherConfig{Field: "metadata", Key: "/fw-name"}},
+		{desc: "header", config: MatcherConfig{Field: "header", Key: "x-region", Value: "^east$"}, expected: true},
+		{desc: "header no space", config: MatcherConfig{Field: "header", Key: "X-Other", Value: "^value$"}, expected: true},
+		{desc: "header missing", config: MatcherConfig{Field: "header", Key: "X-Missing"}},
+		{desc: "content type", config: MatcherConfig{Field: "content_type", Value: "json"}, expected: true},
+		{desc: "content type mismatch", config: MatcherConfig{Field: "content_type", Value: "msgpack"}},
+		{desc: "partner id", config: MatcherConfig{Field: "partner_id", Value: "^sky$"}, expected: true},
+		{desc: "partner id mismatch", config: MatcherConfig{Field: "partner_id", Value: "^other$"}},
+		{desc: "payload size", config: MatcherConfig{Field: "payload_size", MinSize: 10, MaxSize: 100}, expected: true},
+		{desc: "payload too big", config: MatcherConfig{Field: "payload_size", MaxSize: 10}},
+		{desc: "payload too small", config: MatcherConfig{Field: "payload_size", MinSize: 100}},
+		{desc: "not", config: MatcherConfig{Not: true, Field: "partner_id", Value: "^other$"}, expected: true},
+		{
+			desc: "all",
+			config: MatcherConfig{All: []MatcherConfig{
+				{Field: "metadata", Key: "/hw-model", Value: "^TG"},
+				{Field: "partner_id", Value: "^comcast$"},
+			}},
+			expected: true,
+		},
+		{
+			desc: "all with a mismatch",
+			config: MatcherConfig{All: []MatcherConfig{
+				{Field: "metadata", Key: "/hw-model", Value: "^TG"},
+				{Field: "partner_id", Value: "^other$"},
+			}},
+		},
+		{
+			desc: "any",
+			config: MatcherConfig{Any: []MatcherConfig{
+				{Field: "metadata", Key: "/hw-model", Value: "^XB"},
+				{Field: "header", Key: "X-Region", Value: "east"},
+			}},
+			expected: true,
+		},
+		{
+			desc: "nested",
+			config: MatcherConfig{All: []MatcherConfig{
+				{Field: "content_type", Value: "json"},
+				{Not: true, Any: []MatcherConfig{
+					{Field: "metadata", Key: "/hw-model", Value: "^XB"},
+					{Field: "partner_id", Value: "^other$"},
+				}},
+			}},
+			expected: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			m, err := newEventMatcher(tc.config)
+			assert.NoError(err)
+			assert.Equal(tc.expected, m(matcherTestMessage()))
+		})
+	}
+}
+
+func TestEventMatcherInvalid(t *testing.T) {
+	tests := []struct {
+		desc      string
+		config    MatcherConfig
+		expectErr error
+	}{
+		{desc: "empty", expectErr: errMatcherShape},
+		{
+			desc:      "field and all",
+			config:    MatcherConfig{Field: "content_type", Value: "json", All: []MatcherConfig{{Field: "content_type", Value: "json"}}},
+			expectErr: errMatcherShape,
+		},
+		{desc: "unknown field", config: MatcherConfig{Field: "source", Value: "mac"}, expectErr: errMatcherUnknown},
+		{desc: "metadata without key", config: MatcherConfig{Field: "metadata", Value: "TG"}, expectErr: errMatcherKey},
+		{desc: "header without key", config: MatcherConfig{Field: "header"}, expectErr: errMatcherKey},
+		{desc: "content type without value", config: MatcherConfig{Field: "content_type"}, expectErr: errMatcherValue},
+		{desc: "partner id without value", config: MatcherConfig{Field: "partner_id"}, expectErr: errMatcherValue},
+		{desc: "negative size", config: MatcherConfig{Field: "payload_size", MinSize: -1}, expectErr: errMatcherSize},
+		{desc: "inverted sizes", config: MatcherConfig{Field: "payload_size", MinSize: 10, MaxSize: 5}, expectErr: errMatcherSize},
+		{desc: "bad regex", config: MatcherConfig{Field: "content_type", Value: "[[:123"}},
+		{desc: "bad nested matcher", config: MatcherConfig{Any: []MatcherConfig{{Field: "partner_id"}}}, expectErr: errMatcherValue},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			m, err := newEventMatcher(tc.config)
+			assert.Nil(m)
+			assert.Error(err)
+			if nil != tc.expectErr {
+				assert.ErrorIs(err, tc.expectErr)
+			}
+		})
+	}
+}
@@ -29,6 +29,16 @@ const (
 	ConsumerMaxDeliveryWorkersGauge = "consumer_delivery_workers_max"
 	QueryDurationHistogram          = "query_duration_histogram_seconds"
 	IncomingQueueLatencyHistogram   = "incoming_queue_latency_histogram_seconds"
+	QOSDroppedMsgCounter            = "qos_dropped_message_count"
+	WebhookRemovedCounter           = "webhook_removed_count"
+	RetentionDroppedCounter         = "retention_dropped_message_count"
+	PayloadFilterDroppedCounter     = "payload_filter_dropped_message_count"
+	SampledOutCounter               = "sampled_out_message_count"
+	WebhookVerificationCounter      = "webhook_verification_count"
+	NotificationCounter             = "webhook_notification_count"
+	SpilledMsgCounter               = "spilled_message_count"
+	SpillDepthGauge                 = "spill_depth"
+	WebhookRejectedCounter          = "webhook_rejected_count"
 )
 
 const (
@@ -39,6 +49,31 @@ const (
 	unknownEventType       = "unknown"
 )
 
+// Reasons an outbound event is dropped.
+const (
+	queueFullReason             = "queue_full"
+	priorityEvictedReason       = "priority_evicted"
+	expiredReason               = "expired"
+	expiredBeforeQueueingReason = "expired_before_queueing"
+	cutOffReason                = "cut_off"
+	invalidConfigReason         = "invalid_config"
+	unverifiedReason            = "unverified"
+	streamWriteReason           = "stream_write_err"
+	spillReadReason             = "spill_read_err"
+)
+
+// Reasons a webhook registration is rejected.
+const (
+	invalidFailureURLReason = "invalid_failure_url"
+	invalidEventsReason     = "invalid_events"
+	invalidMatcherReason    = "invalid_matcher"
+	invalidAltURLReason     = "invalid_alt_url"
+	invalidProfileReason    = "invalid_profile"
+	unsupportedSchemeReason = "unsupported_scheme"
+	unverifiableReason      = "unverifiable"
+	invalidReason           = "invalid"
+)
+
 func Metrics() []xmetrics.Metric {
 	return []xmetrics.Metric{
 		{
@@ -152,6 +187,65 @@ func Metrics() []xmetrics.Metric {
 			LabelNames: []string{"url", "code"},
 			Buckets:    []float64{0.0625, 0.125, .25, .5, 1, 5, 10, 20, 40, 80, 160},
 		},
+		{
+			Name:       QOSDroppedMsgCounter,
+			Help:       "Count of dropped messages by the WRP QOS level of the message",
+			Type:       "counter",
+			LabelNames: []string{"url", "reason", "qos"},
+		},
+		{
+			Name:       PayloadFilterDroppedCounter,
+			Help:       "Count of messages dropped by a webhook profile's payload conditions",
+			Type:       "counter",
+			LabelNames: []string{"url", "reason"},
+		},
+		{
+			Name:       SampledOutCounter,
+			Help:       "Count of messages left out of a webhook's sample, which aren't drops",
+			Type:       "counter",
+			LabelNames: []string{"url"},
+		},
+		{
+			Name:       WebhookVerificationCounter,
+			Help:       "Count of webhook verification handshakes by outcome",
+			Type:       "counter",
+			LabelNames: []string{"url", "outcome"},
+		},
+		{
+			Name:       NotificationCounter,
+			Help:       "Count of cut off, recovery and expiry notifications sent, by type and status code",
+			Type:       "counter",
+			LabelNames: []string{"url", "type", "code"},
+		},
+		{
+			Name:       SpilledMsgCounter,
+			Help:       "Count of messages spilled to disk because a webhook's queue was full",
+			Type:       "counter",
+			LabelNames: []string{"url"},
+		},
+		{
+			Name:       SpillDepthGauge,
+			Help:       "The number of messages spilled to disk per outgoing url.",
+			Type:       "gauge",
+			LabelNames: []string{"url"},
+		},
+		{
+			Name:       WebhookRemovedCounter,
+			Help:       "Count of senders retired because their webhook was no longer registered",
+			Type:       "counter",
+			LabelNames: []string{"url"},
+		},
+		{
+			Name:       WebhookRejectedCounter,
+			Help:       "Count of webhook registrations rejected because they are invalid",
+			Type:       "counter",
+			LabelNames: []string{"url", "reason"},
+		},
+		{
+			Name: RetentionDroppedCounter,
+			Help: "Count of events not retained because the retention queue was full",
+			Type: "counter",
+		},
 		{
 			Name:       IncomingQueueLatencyHistogram,
 			Help:       "A histogram of latencies for the incoming queue.",
@@ -165,22 +259,33 @@ func Metrics() []xmetrics.Metric {
 func CreateOutbounderMetrics(m CaduceusMetricsRegistry, c *CaduceusOutboundSender) {
 	c.deliveryCounter = m.NewCounter(DeliveryCounter)
 	c.deliveryRetryCounter = m.NewCounter(DeliveryRetryCounter)
-	c.deliveryRetryMaxGauge = m.NewGauge(DeliveryRetryMaxGauge).With("url", c.id)
-	c.cutOffCounter = m.NewCounter(SlowConsumerCounter).With("url", c.id)
-	c.droppedQueueFullCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "queue_full")
-	c.droppedExpiredCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "expired")
-	c.droppedExpiredBeforeQueueCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "expired_before_queueing")
+	c.deliveryRetryMaxGauge = m.NewGauge(DeliveryRetryMaxGauge).With("url", c.metricsLabel)
+	c.cutOffCounter = m.NewCounter(SlowConsumerCounter).With("url", c.metricsLabel)
+	c.droppedQueueFullCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", queueFullReason)
+	c.droppedPriorityCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", priorityEvictedReason)
+	c.droppedExpiredCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", expiredReason)
+	c.droppedExpiredBeforeQueueCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", expiredBeforeQueueingReason)
 
-	c.droppedCutoffCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "cut_off")
-	c.droppedInvalidConfig = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "invalid_config")
-	c.droppedNetworkErrCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", networkError)
-	c.droppedPanic = m.NewCounter(DropsDueToPanic).With("url", c.id)
-	c.queueDepthGauge = m.NewGauge(OutgoingQueueDepth).With("url", c.id)
-	c.renewalTimeGauge = m.NewGauge(ConsumerRenewalTimeGauge).With("url", c.id)
-	c.deliverUntilGauge = m.NewGauge(ConsumerDeliverUntilGauge).With("url", c.id)
-	c.dropUntilGauge = m.NewGauge(ConsumerDropUntilGauge).With("url", c.id)
-	c.currentWorkersGauge = m.NewGauge(ConsumerDeliveryWorkersGauge).With("url", c.id)
-	c.maxWorkersGauge = m.NewGauge(ConsumerMaxDeliveryWorkersGauge).With("url", c.id)
+	c.droppedCutoffCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", cutOffReason)
+	c.droppedInvalidConfig = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", invalidConfigReason)
+	c.droppedUnverifiedCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", unverifiedReason)
+	c.droppedNetworkErrCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", networkError)
+	c.droppedStreamWriteCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", streamWriteReason)
+	c.droppedSpillReadCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.metricsLabel, "reason", spillReadReason)
+	c.droppedPanic = m.NewCounter(DropsDueToPanic).With("url", c.metricsLabel)
+	c.droppedQOSCounter = m.NewCounter(QOSDroppedMsgCounter).With("url", c.metricsLabel)
+	c.droppedPayloadCounter = m.NewCounter(PayloadFilterDroppedCounter).With("url", c.metricsLabel)
+	c.sampledOutCounter = m.NewCounter(SampledOutCounter).With("url", c.metricsLabel)
+	c.verificationCounter = m.NewCounter(WebhookVerificationCounter)
+	c.notificationCounter = m.NewCounter(NotificationCounter)
+	c.spilledCounter = m.NewCounter(SpilledMsgCounter).With("url", c.metricsLabel)
+	c.spillDepthGauge = m.NewGauge(SpillDepthGauge).With("url", c.metricsLabel)
+	c.queueDepthGauge = m.NewGauge(OutgoingQueueDepth).With("url", c.metricsLabel)
+	c.renewalTimeGauge = m.NewGauge(ConsumerRenewalTimeGauge).With("url", c.metricsLabel)
+	c.deliverUntilGauge = m.NewGauge(ConsumerDeliverUntilGauge).With("url", c.metricsLabel)
+	c.dropUntilGauge = m.NewGauge(ConsumerDropUntilGauge).With("url", c.metricsLabel)
+	c.currentWorkersGauge = m.NewGauge(ConsumerDeliveryWorkersGauge).With("url", c.metricsLabel)
+	c.maxWorkersGauge = m.NewGauge(ConsumerMaxDeliveryWorkersGauge).With("url", c.metricsLabel)
 }
 
 func NewMetricWrapperMeasures(m CaduceusMetricsRegistry) metrics.Histogram {
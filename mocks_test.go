@@ -9,7 +9,6 @@ import (
 	"github.com/go-kit/kit/metrics"
 	"github.com/stretchr/testify/mock"
 	"github.com/xmidt-org/ancla"
-	"github.com/xmidt-org/wrp-go/v3"
 )
 
 // mockHandler only needs to mock the `HandleRequest` method
@@ -17,7 +16,7 @@ type mockHandler struct {
 	mock.Mock
 }
 
-func (m *mockHandler) HandleRequest(workerID int, msg *wrp.Message) {
+func (m *mockHandler) HandleRequest(workerID int, msg *outboundEvent) {
 	m.Called(workerID, msg)
 }
 
@@ -30,7 +29,7 @@ func (m *mockSenderWrapper) Update(list []ancla.InternalWebhook) {
 	m.Called(list)
 }
 
-func (m *mockSenderWrapper) Queue(msg *wrp.Message) {
+func (m *mockSenderWrapper) Queue(msg *outboundEvent) {
 	m.Called(msg)
 }
 
@@ -0,0 +1,265 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xmidt-org/ancla"
+)
+
+// The types of the notifications sent to webhooks, in their type field.
+const (
+	cutOffNotice   = "cut_off"
+	recoveryNotice = "recovered"
+	expiryNotice   = "expiring"
+)
+
+// expiryText is human readable text for the expiry warning message
+const expiryText = `Your webhook registration is about to expire.  Once it does, ` +
+	`no more events will be delivered to it.  Please renew the registration ` +
+	`before it expires to keep receiving events.`
+
+// recoveryText is human readable text for the recovery message
+const recoveryText = `Your endpoint was cut off because it wasn't able to keep ` +
+	`up with the traffic being sent to it.  The cut off is over and ` +
+	`notifications are being delivered again.`
+
+const (
+	defaultNotificationTimeout       = 10 * time.Second
+	defaultNotificationRetries       = 3
+	defaultNotificationRetryInterval = time.Second
+)
+
+// NotificationConfig configures how the cut off, recovery and expiry
+// notifications are sent.  They're sent in the background, so a slow
+// notification URL doesn't hold up event delivery.
+type NotificationConfig struct {
+	// Timeout limits each attempt at sending a notification.
+	// (Optional) defaults to 10s.
+	Timeout time.Duration
+
+	// Retries is the number of times a notification that fails with a
+	// network error, a 408, a 429 or a 5xx is retried.  (Optional) defaults
+	// to 3, use a negative value to never retry.
+	Retries int
+
+	// RetryInterval is the time before the first retry, doubled for each
+	// one after that.  (Optional) defaults to 1s.
+	RetryInterval time.Duration
+}
+
+// notificationPolicy is the compiled form of NotificationConfig.  A nil
+// policy sends notifications once, without a timeout of its own.
+type notificationPolicy struct {
+	attemptTimeout time.Duration
+	maxRetries     int
+	firstInterval  time.Duration
+}
+
+func newNotificationPolicy(c NotificationConfig) (*notificationPolicy, error) {
+	if c.Timeout < 0 || c.RetryInterval < 0 {
+		return nil, errors.New("notification timeout and retry interval must not be negative")
+	}
+
+	p := &notificationPolicy{
+		attemptTimeout: c.Timeout,
+		maxRetries:     c.Retries,
+		firstInterval:  c.RetryInterval,
+	}
+	if 0 == p.attemptTimeout {
+		p.attemptTimeout = defaultNotificationTimeout
+	}
+	if 0 == p.maxRetries {
+		p.maxRetries = defaultNotificationRetries
+	} else if p.maxRetries < 0 {
+		p.maxRetries = 0
+	}
+	if 0 == p.firstInterval {
+		p.firstInterval = defaultNotificationRetryInterval
+	}
+	return p, nil
+}
+
+// timeout returns the limit on each attempt, or 0 for none.
+func (p *notificationPolicy) timeout() time.Duration {
+	if nil == p {
+		return 0
+	}
+	return p.attemptTimeout
+}
+
+// retries returns the number of times a failed notification is retried.
+func (p *notificationPolicy) retries() int {
+	if nil == p {
+		return 0
+	}
+	return p.maxRetries
+}
+
+// retryInterval returns the time before the first retry.
+func (p *notificationPolicy) retryInterval() time.Duration {
+	if nil == p {
+		return 0
+	}
+	return p.firstInterval
+}
+
+// retryNotification reports whether a notification attempt that ended with
+// code or err is worth retrying.
+func retryNotification(code int, err error) bool {
+	if nil != err {
+		return true
+	}
+	return http.StatusRequestTimeout == code || http.StatusTooManyRequests == code || 500 <= code
+}
+
+// ExpiryWarningConfig configures the warning sent to webhooks a while before
+// their registration expires.
+type ExpiryWarningConfig struct {
+	// Before is how long before a registration expires the warning is sent.
+	// (Optional) when 0, no warnings are sent.
+	Before time.Duration
+
+	// NotifyURL sends warnings to the webhook's URL, rather than to its
+	// failure URL.  Without it, webhooks without a failure URL aren't
+	// warned.
+	NotifyURL bool
+}
+
+// ExpiryMessage is the warning sent to a webhook whose registration is about
+// to expire.
+type ExpiryMessage struct {
+	Text      string                `json:"text"`
+	Type      string                `json:"type"`
+	Original  ancla.InternalWebhook `json:"webhook_registration"`
+	ExpiresAt time.Time             `json:"expires_at"`
+	ExpiresIn string                `json:"expires_in"`
+}
+
+// RecoveryMessage is sent to the failure URL of a webhook that was cut off
+// once an event has been delivered to it after the cut off ended.
+type RecoveryMessage struct {
+	Text           string                `json:"text"`
+	Type           string                `json:"type"`
+	Original       ancla.InternalWebhook `json:"webhook_registration"`
+	CutOffAt       time.Time             `json:"cut_off_at"`
+	RecoveredAt    time.Time             `json:"recovered_at"`
+	CutOffDuration string                `json:"cut_off_duration"`
+	DroppedCount   int64                 `json:"dropped_count"`
+}
+
+// scheduleExpiryWarning arranges for the warning about the registration
+// expiring at until to be sent.  Each registration cycle is warned once:
+// scheduling the until that's already scheduled or warned about does
+// nothing.  A renewal that leaves less than Before is never warned about,
+// otherwise a registration whose lifetime is shorter than Before would be
+// warned right away on every renewal; only its first cycle is.  obs.mutex
+// must be held.
+func (obs *CaduceusOutboundSender) scheduleExpiryWarning(until time.Time) {
+	if 0 == obs.expiryWarning.Before || until.Equal(obs.expiryWarningFor) {
+		return
+	}
+	if nil != obs.expiryTimer {
+		obs.expiryTimer.Stop()
+		obs.expiryTimer = nil
+	}
+	renewed := !obs.expiryWarningFor.IsZero()
+	obs.expiryWarningFor = until
+
+	if until.IsZero() || !time.Now().Before(until) {
+		return
+	}
+	if renewed && time.Until(until) <= obs.expiryWarning.Before {
+		return
+	}
+	obs.expiryTimer = time.AfterFunc(time.Until(until.Add(-obs.expiryWarning.Before)), func() {
+		obs.warnExpiry(until)
+	})
+}
+
+// warnExpiry sends the expiry warning for the registration expiring at
+// until, unless it has been renewed since.
+func (obs *CaduceusOutboundSender) warnExpiry(until time.Time) {
+	obs.mutex.Lock()
+	if !until.Equal(obs.deliverUntil) || !until.Equal(obs.expiryWarningFor) {
+		obs.mutex.Unlock()
+		return
+	}
+	obs.expiryTimer = nil
+	notifyURL := obs.listener.Webhook.FailureURL
+	if obs.expiryWarning.NotifyURL {
+		notifyURL = obs.listener.Webhook.Config.URL
+	}
+	secret := obs.listener.Webhook.Config.Secret
+	msg := ExpiryMessage{
+		Text:      expiryText,
+		Type:      expiryNotice,
+		Original:  obs.failureMsg.Original,
+		ExpiresAt: until,
+		ExpiresIn: time.Until(until).Round(time.Second).String(),
+	}
+	obs.mutex.Unlock()
+
+	// Only http urls can be notified.
+	if "" == notifyURL || !sameTransport(urlScheme(notifyURL), "http") {
+		return
+	}
+	obs.notify(expiryNotice, notifyURL, secret, msg)
+}
+
+// countCutOffDrops counts events dropped because the webhook is cut off,
+// both in the metric and for the recovery message.
+func (obs *CaduceusOutboundSender) countCutOffDrops(n int) {
+	obs.droppedCutoffCounter.Add(float64(n))
+	obs.cutOffDropped.Add(int64(n))
+}
+
+// delivered reports whether a transport delivered an event.  Transports
+// that don't speak http report their own non numeric codes on success.
+func delivered(code string, err error) bool {
+	if nil != err {
+		return false
+	}
+	status, convErr := strconv.Atoi(code)
+	return nil != convErr || (200 <= status && status < 300)
+}
+
+// recovered is called after each successful delivery.  The first one after a
+// cut off ends sends the recovery message.
+func (obs *CaduceusOutboundSender) recovered() {
+	obs.mutex.RLock()
+	cutOff := !obs.cutOffAt.IsZero()
+	obs.mutex.RUnlock()
+	if !cutOff {
+		return
+	}
+
+	obs.mutex.Lock()
+	now := time.Now()
+	if obs.cutOffAt.IsZero() || now.Before(obs.dropUntil) {
+		obs.mutex.Unlock()
+		return
+	}
+	msg := RecoveryMessage{
+		Text:           recoveryText,
+		Type:           recoveryNotice,
+		Original:       obs.failureMsg.Original,
+		CutOffAt:       obs.cutOffAt,
+		RecoveredAt:    now,
+		CutOffDuration: now.Sub(obs.cutOffAt).Round(time.Millisecond).String(),
+		DroppedCount:   obs.cutOffDropped.Load(),
+	}
+	obs.cutOffAt = time.Time{}
+	failureURL := obs.listener.Webhook.FailureURL
+	secret := obs.listener.Webhook.Config.Secret
+	obs.mutex.Unlock()
+
+	if "" == failureURL {
+		return
+	}
+	obs.notify(recoveryNotice, failureURL, secret, msg)
+}
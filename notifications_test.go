@@ -0,0 +1,428 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// notificationRecorder records the notifications POSTed to it.
+type notificationRecorder struct {
+	mutex  sync.Mutex
+	urls   []string
+	bodies [][]byte
+	sigs   []string
+}
+
+func (r *notificationRecorder) transport() *transport {
+	return &transport{
+		fn: func(req *http.Request, _ int) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.urls = append(r.urls, req.URL.String())
+			r.bodies = append(r.bodies, body)
+			r.sigs = append(r.sigs, req.Header.Get("X-Webpa-Signature"))
+			return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+		},
+	}
+}
+
+func (r *notificationRecorder) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.urls)
+}
+
+func TestExpiryWarning(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	recorder := &notificationRecorder{}
+	obsf := simpleFactorySetup(recorder.transport(), time.Second, nil)
+	obsf.Listener.Webhook.FailureURL = "http://localhost:12345/bar"
+	obsf.Listener.Webhook.Until = time.Now().Add(time.Hour)
+	obsf.ExpiryWarning = ExpiryWarningConfig{Before: time.Hour - 20*time.Millisecond}
+
+	obs, err := obsf.New()
+	require.NoError(err)
+	defer obs.Shutdown(false)
+
+	require.Eventually(func() bool { return 1 == recorder.count() }, time.Second, time.Millisecond)
+
+	recorder.mutex.Lock()
+	assert.Equal("http://localhost:12345/bar", recorder.urls[0])
+	var msg ExpiryMessage
+	require.NoError(json.Unmarshal(recorder.bodies[0], &msg))
+	h := hmac.New(sha1.New, []byte("123456"))
+	h.Write(recorder.bodies[0])
+	assert.Equal("sha1="+hex.EncodeToString(h.Sum(nil)), recorder.sigs[0])
+	recorder.mutex.Unlock()
+
+	assert.Equal(expiryText, msg.Text)
+	assert.True(obsf.Listener.Webhook.Until.Equal(msg.ExpiresAt))
+	assert.NotEmpty(msg.ExpiresIn)
+	assert.Equal("XxxxxX", msg.Original.Webhook.Config.Secret)
+	assert.Equal(obsf.Listener.Webhook.Config.URL, msg.Original.Webhook.Config.URL)
+
+	// Updates that don't renew the registration don't warn again.
+	require.NoError(obs.Update(obsf.Listener))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(1, recorder.count())
+
+	// Renewing it starts a new cycle.
+	w := obsf.Listener
+	w.Webhook.Until = time.Now().Add(time.Hour)
+	require.NoError(obs.Update(w))
+	require.Eventually(func() bool { return 2 == recorder.count() }, time.Second, time.Millisecond)
+}
+
+func TestExpiryWarningRenewed(t *testing.T) {
+	recorder := &notificationRecorder{}
+	obsf := simpleFactorySetup(recorder.transport(), time.Second, nil)
+	obsf.Listener.Webhook.FailureURL = "http://localhost:12345/bar"
+	obsf.Listener.Webhook.Until = time.Now().Add(time.Hour)
+	obsf.ExpiryWarning = ExpiryWarningConfig{Before: time.Hour - 50*time.Millisecond}
+
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	defer obs.Shutdown(false)
+
+	// Renewing the registration before the warning is due cancels it.
+	w := obsf.Listener
+	w.Webhook.Until = time.Now().Add(2 * time.Hour)
+	require.NoError(t, obs.Update(w))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, recorder.count())
+}
+
+func TestExpiryWarningNotifyURL(t *testing.T) {
+	recorder := &notificationRecorder{}
+	obsf := simpleFactorySetup(recorder.transport(), time.Second, nil)
+	obsf.Listener.Webhook.Until = time.Now().Add(time.Hour)
+	obsf.ExpiryWarning = ExpiryWarningConfig{Before: 2 * time.Hour, NotifyURL: true}
+
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	defer obs.Shutdown(false)
+
+	// The warning is due already, so it's sent right away.
+	require.Eventually(t, func() bool { return 1 == recorder.count() }, time.Second, time.Millisecond)
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	assert.Equal(t, "http://localhost:9999/foo", recorder.urls[0])
+}
+
+func TestExpiryWarningShortLifetime(t *testing.T) {
+	recorder := &notificationRecorder{}
+	obsf := simpleFactorySetup(recorder.transport(), time.Second, nil)
+	obsf.Listener.Webhook.FailureURL = "http://localhost:12345/bar"
+	obsf.Listener.Webhook.Until = time.Now().Add(time.Minute)
+	obsf.ExpiryWarning = ExpiryWarningConfig{Before: time.Hour}
+
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	defer obs.Shutdown(false)
+
+	// The registration lives shorter than the warning lead time, so it's
+	// warned right away, but not again each time it's renewed.
+	require.Eventually(t, func() bool { return 1 == recorder.count() }, time.Second, time.Millisecond)
+	w := obsf.Listener
+	for i := 2; i <= 4; i++ {
+		w.Webhook.Until = time.Now().Add(time.Duration(i) * time.Minute)
+		require.NoError(t, obs.Update(w))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, recorder.count())
+	cobs := obs.(*CaduceusOutboundSender)
+	cobs.mutex.Lock()
+	defer cobs.mutex.Unlock()
+	assert.Nil(t, cobs.expiryTimer)
+}
+
+func TestExpiryWarningDisabled(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config ExpiryWarningConfig
+		failed string
+	}{
+		{desc: "not configured", failed: "http://localhost:12345/bar"},
+		{desc: "no failure url", config: ExpiryWarningConfig{Before: 2 * time.Hour}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			recorder := &notificationRecorder{}
+			obsf := simpleFactorySetup(recorder.transport(), time.Second, nil)
+			obsf.Listener.Webhook.FailureURL = tc.failed
+			obsf.Listener.Webhook.Until = time.Now().Add(time.Hour)
+			obsf.ExpiryWarning = tc.config
+
+			obs, err := obsf.New()
+			require.NoError(t, err)
+			time.Sleep(20 * time.Millisecond)
+			obs.Shutdown(false)
+
+			assert.Zero(t, recorder.count())
+		})
+	}
+}
+
+func TestCutOffRecovery(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	recorder := &notificationRecorder{}
+	trans := recorder.transport()
+	record := trans.fn
+	var deliveries int32
+	trans.fn = func(req *http.Request, i int) (*http.Response, error) {
+		if "http://localhost:12345/bar" == req.URL.String() {
+			return record(req, i)
+		}
+		atomic.AddInt32(&deliveries, 1)
+		return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+	}
+	obsf := simpleFactorySetup(trans, 50*time.Millisecond, nil)
+	obsf.Listener.Webhook.FailureURL = "http://localhost:12345/bar"
+	obs, err := obsf.New()
+	require.NoError(err)
+	defer obs.Shutdown(false)
+
+	queue := func() {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+
+	obs.(*CaduceusOutboundSender).queueOverflow()
+	require.Eventually(func() bool { return 1 == recorder.count() }, time.Second, time.Millisecond)
+
+	var cutOff FailureMessage
+	recorder.mutex.Lock()
+	require.NoError(json.Unmarshal(recorder.bodies[0], &cutOff))
+	recorder.mutex.Unlock()
+	assert.Equal(failureText, cutOff.Text)
+	assert.Equal(cutOffNotice, cutOff.Type)
+	assert.Equal(50*time.Millisecond, cutOff.CutOffUntil.Sub(cutOff.CutOffAt))
+	assert.Zero(cutOff.DroppedCount)
+	assert.Equal("XxxxxX", cutOff.Original.Webhook.Config.Secret)
+
+	// Events that arrive during the cut off are dropped and counted.
+	queue()
+	queue()
+	time.Sleep(60 * time.Millisecond)
+	assert.Zero(atomic.LoadInt32(&deliveries))
+
+	// The first delivery once it's over sends the recovery message.
+	queue()
+	require.Eventually(func() bool { return 2 == recorder.count() }, time.Second, time.Millisecond)
+
+	var recovery RecoveryMessage
+	recorder.mutex.Lock()
+	require.NoError(json.Unmarshal(recorder.bodies[1], &recovery))
+	recorder.mutex.Unlock()
+	assert.Equal(recoveryText, recovery.Text)
+	assert.Equal(recoveryNotice, recovery.Type)
+	assert.True(cutOff.CutOffAt.Equal(recovery.CutOffAt))
+	assert.True(recovery.RecoveredAt.After(cutOff.CutOffUntil))
+	assert.NotEmpty(recovery.CutOffDuration)
+	assert.EqualValues(2, recovery.DroppedCount)
+
+	// Only once.
+	queue()
+	require.Eventually(func() bool { return 2 == atomic.LoadInt32(&deliveries) }, time.Second, time.Millisecond)
+	assert.Equal(2, recorder.count())
+}
+
+func TestDelivered(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(delivered("200", nil))
+	assert.True(delivered("204", nil))
+	assert.True(delivered(streamSentCode, nil))
+	assert.False(delivered("500", nil))
+	assert.False(delivered("301", nil))
+	assert.False(delivered("", errors.New("failed")))
+}
+
+func TestNotificationRetries(t *testing.T) {
+	tests := []struct {
+		desc     string
+		config   NotificationConfig
+		respond  func(req *http.Request, attempt int32) (*http.Response, error)
+		attempts int32
+		code     string
+	}{
+		{
+			desc:   "success after retries",
+			config: NotificationConfig{RetryInterval: time.Millisecond},
+			respond: func(_ *http.Request, attempt int32) (*http.Response, error) {
+				if attempt < 3 {
+					return &http.Response{StatusCode: 503}, nil
+				}
+				return &http.Response{StatusCode: 200}, nil
+			},
+			attempts: 3,
+			code:     "200",
+		},
+		{
+			desc:   "client errors aren't retried",
+			config: NotificationConfig{RetryInterval: time.Millisecond},
+			respond: func(*http.Request, int32) (*http.Response, error) {
+				return &http.Response{StatusCode: 404}, nil
+			},
+			attempts: 1,
+			code:     "404",
+		},
+		{
+			desc:   "too many requests is retried",
+			config: NotificationConfig{Retries: 1, RetryInterval: time.Millisecond},
+			respond: func(*http.Request, int32) (*http.Response, error) {
+				return &http.Response{StatusCode: 429}, nil
+			},
+			attempts: 2,
+			code:     "429",
+		},
+		{
+			desc:   "attempts time out",
+			config: NotificationConfig{Timeout: 10 * time.Millisecond, Retries: 2, RetryInterval: time.Millisecond},
+			respond: func(req *http.Request, _ int32) (*http.Response, error) {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			},
+			attempts: 3,
+			code:     "failure",
+		},
+		{
+			desc:   "no retries",
+			config: NotificationConfig{Retries: -1},
+			respond: func(*http.Request, int32) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			attempts: 1,
+			code:     "failure",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var attempts int32
+			trans := &transport{
+				fn: func(req *http.Request, _ int) (*http.Response, error) {
+					return tc.respond(req, atomic.AddInt32(&attempts, 1))
+				},
+			}
+			obsf := simpleFactorySetup(trans, time.Second, nil)
+			obsf.Listener.Webhook.FailureURL = "http://localhost:12345/bar"
+			var err error
+			obsf.Notifications, err = newNotificationPolicy(tc.config)
+			require.NoError(err)
+
+			obs, err := obsf.New()
+			require.NoError(err)
+			cobs := obs.(*CaduceusOutboundSender)
+
+			fakeNotifications := new(mockCounter)
+			fakeNotifications.On("With", []string{"url", cobs.id, "type", cutOffNotice, "code", tc.code}).Return(fakeNotifications).Once()
+			fakeNotifications.On("Add", 1.0).Return().Once()
+			cobs.notificationCounter = fakeNotifications
+
+			cobs.queueOverflow()
+			obs.Shutdown(true)
+
+			assert.Equal(tc.attempts, atomic.LoadInt32(&attempts))
+			fakeNotifications.AssertExpectations(t)
+		})
+	}
+}
+
+func TestNotificationsDontBlock(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	release := make(chan struct{})
+	trans := &transport{
+		fn: func(req *http.Request, _ int) (*http.Response, error) {
+			select {
+			case <-release:
+				return &http.Response{StatusCode: 200}, nil
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		},
+	}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.Listener.Webhook.FailureURL = "http://localhost:12345/bar"
+	var err error
+	obsf.Notifications, err = newNotificationPolicy(NotificationConfig{Retries: 100, RetryInterval: time.Hour})
+	require.NoError(err)
+
+	obs, err := obsf.New()
+	require.NoError(err)
+
+	// A notification URL that doesn't answer doesn't hold up the cut off.
+	done := make(chan struct{})
+	go func() {
+		obs.(*CaduceusOutboundSender).queueOverflow()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("queueOverflow waited on the notification")
+	}
+
+	// And an abrupt shutdown gives up on it.
+	shutdown := make(chan struct{})
+	go func() {
+		obs.Shutdown(false)
+		close(shutdown)
+	}()
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		assert.Fail("Shutdown waited on the notification")
+		close(release)
+	}
+}
+
+func TestNewNotificationPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := newNotificationPolicy(NotificationConfig{})
+	require.NoError(t, err)
+	assert.Equal(defaultNotificationTimeout, p.timeout())
+	assert.Equal(defaultNotificationRetries, p.retries())
+	assert.Equal(defaultNotificationRetryInterval, p.retryInterval())
+
+	p, err = newNotificationPolicy(NotificationConfig{Retries: -1})
+	require.NoError(t, err)
+	assert.Zero(p.retries())
+
+	p, err = newNotificationPolicy(NotificationConfig{Timeout: -time.Second})
+	assert.Nil(p)
+	assert.Error(err)
+
+	var none *notificationPolicy
+	assert.Zero(none.timeout())
+	assert.Zero(none.retries())
+}
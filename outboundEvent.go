@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// outboundEvent is an event on its way to the senders, shared by every
+// sender the event fans out to.
+type outboundEvent struct {
+	*wrp.Message
+
+	// raw is the msgpack the event was received as, or nil if the event
+	// didn't arrive as msgpack or had to be fixed after it was decoded.
+	raw []byte
+
+	// encodings caches the event's encoding in each wrp format, so however
+	// many deliveries want a format it's only encoded once.
+	encodings [2]encoding
+
+	// payload caches the decoded JSON payload, so however many payload
+	// filters look at it it's only decoded once.
+	payload decodedPayload
+}
+
+// decodedPayload is an event's JSON payload, decoded on first use.
+type decodedPayload struct {
+	once sync.Once
+	v    interface{}
+	err  error
+}
+
+// encoding is an event encoded in one format, computed on first use.
+type encoding struct {
+	once sync.Once
+	b    []byte
+	err  error
+}
+
+// newOutboundEvent wraps msg.  raw must be the msgpack msg was decoded from,
+// or nil.
+func newOutboundEvent(msg *wrp.Message, raw []byte) *outboundEvent {
+	return &outboundEvent{Message: msg, raw: raw}
+}
+
+// msgpack returns the event as msgpack.  Events received as msgpack are
+// returned exactly as they were received, others are encoded.
+func (e *outboundEvent) msgpack() ([]byte, error) {
+	if nil != e.raw {
+		return e.raw, nil
+	}
+	return e.encoded(wrp.Msgpack)
+}
+
+// json returns the event as JSON.
+func (e *outboundEvent) json() ([]byte, error) {
+	return e.encoded(wrp.JSON)
+}
+
+// jsonPayload returns the event's payload decoded as JSON, with numbers left
+// as json.Number.  The result is shared and must not be modified.
+func (e *outboundEvent) jsonPayload() (interface{}, error) {
+	p := &e.payload
+	p.once.Do(func() {
+		decoder := json.NewDecoder(bytes.NewReader(e.Payload))
+		decoder.UseNumber()
+		p.err = decoder.Decode(&p.v)
+	})
+	return p.v, p.err
+}
+
+// encoded returns the event encoded in f.  The result is shared and must
+// not be modified.
+func (e *outboundEvent) encoded(f wrp.Format) ([]byte, error) {
+	enc := &e.encodings[f]
+	enc.once.Do(func() {
+		enc.err = wrp.NewEncoderBytes(&enc.b, f).Encode(e.Message)
+	})
+	return enc.b, enc.err
+}
@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestOutboundEventMsgpack(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := simpleRequest()
+	var raw []byte
+	require.NoError(t, wrp.NewEncoderBytes(&raw, wrp.Msgpack).Encode(msg))
+
+	// Without the received bytes the event is encoded.
+	encoded, err := newOutboundEvent(msg, nil).msgpack()
+	require.NoError(t, err)
+	assert.Equal(raw, encoded)
+
+	// The received bytes are passed on rather than encoded again.
+	received, err := newOutboundEvent(msg, raw).msgpack()
+	require.NoError(t, err)
+	assert.Same(&raw[0], &received[0])
+}
+
+func TestOutboundEventEncodesOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	e := newOutboundEvent(simpleRequest(), nil)
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = e.json()
+		}(i)
+	}
+	wg.Wait()
+
+	var expected []byte
+	require.NoError(t, wrp.NewEncoderBytes(&expected, wrp.JSON).Encode(e.Message))
+	for _, r := range results {
+		assert.Equal(expected, r)
+		// Every caller shares the same encoding.
+		assert.Same(&results[0][0], &r[0])
+	}
+
+	first, err := e.msgpack()
+	require.NoError(t, err)
+	second, err := e.msgpack()
+	require.NoError(t, err)
+	assert.Same(&first[0], &second[0])
+}
+
+func TestOutboundEventDecodesPayloadOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := simpleRequest()
+	msg.Payload = []byte(`{"state": "online", "count": 2}`)
+	e := newOutboundEvent(msg, nil)
+
+	first, err := e.jsonPayload()
+	require.NoError(t, err)
+	assert.Equal(map[string]interface{}{"state": "online", "count": json.Number("2")}, first)
+
+	// Later callers get what was decoded the first time.
+	msg.Payload = []byte(`{"state": "offline"}`)
+	second, err := e.jsonPayload()
+	require.NoError(t, err)
+	assert.Equal(first, second)
+
+	_, err = newOutboundEvent(&wrp.Message{Payload: []byte(`{`)}, nil).jsonPayload()
+	assert.Error(err)
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"bytes"
 	"container/ring"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/hex"
@@ -29,9 +30,15 @@ import (
 	"github.com/xmidt-org/webpa-common/v2/device"
 
 	"github.com/xmidt-org/webpa-common/v2/semaphore"
-	"github.com/xmidt-org/webpa-common/v2/xhttp"
 	"github.com/xmidt-org/wrp-go/v3"
-	"github.com/xmidt-org/wrp-go/v3/wrphttp"
+)
+
+// The ways Update finds a webhook registration invalid.
+var (
+	errInvalidFailureURL = errors.New("invalid failure url")
+	errInvalidEvents     = errors.New("invalid events")
+	errInvalidMatcher    = errors.New("invalid matcher item")
+	errInvalidAltURL     = errors.New("invalid alternative url")
 )
 
 // failureText is human readable text for the failure message
@@ -49,6 +56,12 @@ type FailureMessage struct {
 	CutOffPeriod string                `json:"cut_off_period"`
 	QueueSize    int                   `json:"queue_size"`
 	Workers      int                   `json:"worker_count"`
+
+	// The structured form of the notice, for consumers that act on it.
+	Type         string    `json:"type"`
+	CutOffAt     time.Time `json:"cut_off_at"`
+	CutOffUntil  time.Time `json:"cut_off_until"`
+	DroppedCount int64     `json:"dropped_count"`
 }
 
 // OutboundSenderFactory is a configurable factory for OutboundSender objects.
@@ -93,19 +106,73 @@ type OutboundSenderFactory struct {
 	// DisablePartnerIDs dictates whether or not to enforce the partner ID check.
 	DisablePartnerIDs bool
 
+	// OrderedDelivery delivers each device's events one at a time and in
+	// order, while events from different devices are still delivered in
+	// parallel.  The exception is events held through a cut off: they are
+	// queued again once it ends, behind events the device sent after it
+	// ended.
+	OrderedDelivery bool
+
+	// Priorities splits the queue into priority lanes.  When nil, all events
+	// share a single lane.
+	Priorities *priorityClassifier
+
+	// QOS makes queueing and delivery honor the WRP QualityOfService of
+	// events.  When nil, QOS is ignored.
+	QOS *qosPolicy
+
+	// Transports maps destination URL schemes to the transports that deliver
+	// to them.  When nil, DefaultTransports() is used.
+	Transports TransportRegistry
+
 	QueryLatency metrics.Histogram
+
+	// SharedWorkers, when set, limits the deliveries in flight across every
+	// OutboundSender that shares it, on top of each one's NumWorkers.
+	SharedWorkers semaphore.Interface
+
+	// Profiles holds the operator configured options of webhooks by URL.
+	Profiles *webhookProfiles
+
+	// Redaction holds the rules that redact events for webhooks by partner
+	// id and URL.
+	Redaction *redactionRules
+
+	// Verification makes http and https webhooks prove they own their URLs
+	// before events are delivered to them.  When nil, they aren't verified.
+	Verification *verificationPolicy
+
+	// ExpiryWarning configures the warning sent before the registration
+	// expires.
+	ExpiryWarning ExpiryWarningConfig
+
+	// Notifications is how cut off, recovery and expiry notifications are
+	// retried.  When nil, they are sent once.
+	Notifications *notificationPolicy
+
+	// Spill is where events that don't fit in the queue are spilled to disk
+	// before the webhook is cut off.  When nil, a full queue cuts the
+	// webhook off right away.
+	Spill *spillPolicy
+
+	// MetricsLabel is the url label of the sender's metrics.
+	// (Optional) defaults to the webhook's URL.
+	MetricsLabel string
 }
 
 type OutboundSender interface {
+	URL() string
 	Update(ancla.InternalWebhook) error
 	Shutdown(bool)
+	Retire(time.Duration)
 	RetiredSince() time.Time
-	Queue(*wrp.Message)
+	Queue(*outboundEvent)
 }
 
 // CaduceusOutboundSender is the outbound sender object.
 type CaduceusOutboundSender struct {
 	id                               string
+	metricsLabel                     string
 	urls                             *ring.Ring
 	listener                         ancla.InternalWebhook
 	deliverUntil                     time.Time
@@ -119,14 +186,24 @@ type CaduceusOutboundSender struct {
 	deliveryCounter                  metrics.Counter
 	deliveryRetryCounter             metrics.Counter
 	droppedQueueFullCounter          metrics.Counter
+	droppedPriorityCounter           metrics.Counter
 	droppedCutoffCounter             metrics.Counter
 	droppedExpiredCounter            metrics.Counter
 	droppedExpiredBeforeQueueCounter metrics.Counter
 	droppedNetworkErrCounter         metrics.Counter
+	droppedStreamWriteCounter        metrics.Counter
+	droppedSpillReadCounter          metrics.Counter
 	droppedInvalidConfig             metrics.Counter
+	droppedUnverifiedCounter         metrics.Counter
 	droppedPanic                     metrics.Counter
+	droppedQOSCounter                metrics.Counter
+	droppedPayloadCounter            metrics.Counter
+	sampledOutCounter                metrics.Counter
+	spilledCounter                   metrics.Counter
+	verificationCounter              metrics.Counter
 	cutOffCounter                    metrics.Counter
 	queueDepthGauge                  metrics.Gauge
+	spillDepthGauge                  metrics.Gauge
 	renewalTimeGauge                 metrics.Gauge
 	deliverUntilGauge                metrics.Gauge
 	dropUntilGauge                   metrics.Gauge
@@ -136,14 +213,43 @@ type CaduceusOutboundSender struct {
 	wg                               sync.WaitGroup
 	cutOffPeriod                     time.Duration
 	workers                          semaphore.Interface
+	sharedWorkers                    semaphore.Interface
+	profiles                         *webhookProfiles
+	profile                          *webhookProfile
+	redaction                        *redactionRules
+	redactor                         redactor
+	verification                     *verificationPolicy
+	verified                         bool
+	verificationFailed               bool
+	verificationURLs                 []string
+	cancelVerification               context.CancelFunc
+	expiryWarning                    ExpiryWarningConfig
+	expiryWarningFor                 time.Time
+	expiryTimer                      *time.Timer
+	notificationPolicy               *notificationPolicy
+	notificationCounter              metrics.Counter
+	notifications                    sync.WaitGroup
+	notificationsCtx                 context.Context
+	cancelNotifications              context.CancelFunc
+	notificationsClosed              bool
+	cutOffAt                         time.Time
+	cutOffDropped                    atomic.Int64
+	cutOffTimer                      *time.Timer
+	parked                           []*outboundEvent
 	maxWorkers                       int
 	failureMsg                       FailureMessage
 	logger                           *zap.Logger
 	mutex                            sync.RWMutex
 	queue                            atomic.Value
+	spill                            *spillBuffer
 	customPIDs                       []string
 	disablePartnerIDs                bool
 	clientMiddleware                 func(httpClient) httpClient
+	lanes                            *deviceLanes
+	priorities                       *priorityClassifier
+	qos                              *qosPolicy
+	scheme                           string
+	transport                        Transport
 }
 
 // New creates a new OutboundSender object from the factory, or returns an error.
@@ -171,10 +277,20 @@ func (osf OutboundSenderFactory) New() (obs OutboundSender, err error) {
 		return
 	}
 
+	if nil == osf.Transports {
+		osf.Transports = DefaultTransports()
+	}
+
+	var newTransport TransportFactory
+	if newTransport, err = osf.Transports.lookup(osf.Listener.Webhook.Config.URL); nil != err {
+		return
+	}
+
 	decoratedLogger := osf.Logger.With(zap.String("webhook.address", osf.Listener.Webhook.Address))
 
 	caduceusOutboundSender := &CaduceusOutboundSender{
 		id:               osf.Listener.Webhook.Config.URL,
+		metricsLabel:     osf.MetricsLabel,
 		listener:         osf.Listener,
 		sender:           osf.Sender,
 		queueSize:        osf.QueueSize,
@@ -185,15 +301,45 @@ func (osf OutboundSenderFactory) New() (obs OutboundSender, err error) {
 		deliveryInterval: osf.DeliveryInterval,
 		maxWorkers:       osf.NumWorkers,
 		failureMsg: FailureMessage{
+			Type:         cutOffNotice,
 			Original:     osf.Listener,
 			Text:         failureText,
 			CutOffPeriod: osf.CutOffPeriod.String(),
 			QueueSize:    osf.QueueSize,
 			Workers:      osf.NumWorkers,
 		},
-		customPIDs:        osf.CustomPIDs,
-		disablePartnerIDs: osf.DisablePartnerIDs,
-		clientMiddleware:  osf.ClientMiddleware,
+		customPIDs:         osf.CustomPIDs,
+		disablePartnerIDs:  osf.DisablePartnerIDs,
+		clientMiddleware:   osf.ClientMiddleware,
+		priorities:         osf.Priorities,
+		qos:                osf.QOS,
+		scheme:             urlScheme(osf.Listener.Webhook.Config.URL),
+		sharedWorkers:      osf.SharedWorkers,
+		profiles:           osf.Profiles,
+		redaction:          osf.Redaction,
+		verified:           true,
+		expiryWarning:      osf.ExpiryWarning,
+		notificationPolicy: osf.Notifications,
+	}
+	caduceusOutboundSender.notificationsCtx, caduceusOutboundSender.cancelNotifications = context.WithCancel(context.Background())
+	defer func() {
+		if nil != err {
+			caduceusOutboundSender.abandon()
+		}
+	}()
+	if "" == caduceusOutboundSender.metricsLabel {
+		caduceusOutboundSender.metricsLabel = caduceusOutboundSender.id
+	}
+
+	// Only http deliveries can be verified, so don't let other webhooks
+	// skip it.
+	if nil != osf.Verification {
+		if !sameTransport(caduceusOutboundSender.scheme, "http") {
+			err = fmt.Errorf("webhook '%s': %w", caduceusOutboundSender.id, errUnverifiable)
+			return
+		}
+		caduceusOutboundSender.verification = osf.Verification
+		caduceusOutboundSender.verified = false
 	}
 
 	// Don't share the secret with others when there is an error.
@@ -205,7 +351,22 @@ func (osf OutboundSenderFactory) New() (obs OutboundSender, err error) {
 	caduceusOutboundSender.queueDepthGauge.Set(0)
 	caduceusOutboundSender.currentWorkersGauge.Set(0)
 
-	caduceusOutboundSender.queue.Store(make(chan *wrp.Message, osf.QueueSize))
+	caduceusOutboundSender.queue.Store(caduceusOutboundSender.newQueue())
+
+	if osf.OrderedDelivery {
+		caduceusOutboundSender.lanes = newDeviceLanes(osf.QueueSize)
+	}
+
+	// The transport and spill are set up before Update, which can start
+	// verifying the webhook and the expiry timer.
+	if caduceusOutboundSender.transport, err = newTransport(caduceusOutboundSender); nil != err {
+		return
+	}
+
+	if caduceusOutboundSender.spill, err = osf.Spill.open(); nil != err {
+		return
+	}
+	caduceusOutboundSender.spillDepthGauge.Set(0)
 
 	if err = caduceusOutboundSender.Update(osf.Listener); nil != err {
 		return
@@ -227,6 +388,7 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.InternalWebhook) (err error)
 	// Validate the failure URL, if present
 	if "" != wh.Webhook.FailureURL {
 		if _, err = url.ParseRequestURI(wh.Webhook.FailureURL); nil != err {
+			err = fmt.Errorf("%w: %v", errInvalidFailureURL, err)
 			return
 		}
 	}
@@ -237,13 +399,14 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.InternalWebhook) (err error)
 	for _, event := range wh.Webhook.Events {
 		var re *regexp.Regexp
 		if re, err = regexp.Compile(event); nil != err {
+			err = fmt.Errorf("%w: %v", errInvalidEvents, err)
 			return
 		}
 
 		events = append(events, re)
 	}
 	if len(events) < 1 {
-		err = errors.New("events must not be empty.")
+		err = fmt.Errorf("%w: events must not be empty", errInvalidEvents)
 		return
 	}
 
@@ -258,7 +421,7 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.InternalWebhook) (err error)
 
 		var re *regexp.Regexp
 		if re, err = regexp.Compile(item); nil != err {
-			err = fmt.Errorf("invalid matcher item: '%s'", item)
+			err = fmt.Errorf("%w: '%s'", errInvalidMatcher, item)
 			return
 		}
 		matcher = append(matcher, re)
@@ -270,8 +433,19 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.InternalWebhook) (err error)
 		_, err = url.Parse(wh.Webhook.Config.AlternativeURLs[i])
 		if err != nil {
 			obs.logger.Error("failed to update url", zap.Any("url", wh.Webhook.Config.AlternativeURLs[i]), zap.Error(err))
+			err = fmt.Errorf("%w: %v", errInvalidAltURL, err)
 			return
 		}
+		if !sameTransport(obs.scheme, urlScheme(wh.Webhook.Config.AlternativeURLs[i])) {
+			err = fmt.Errorf("%w: '%s' must use the same transport as '%s'", errInvalidAltURL, wh.Webhook.Config.AlternativeURLs[i], obs.id)
+			return
+		}
+	}
+
+	profile := obs.profiles.lookup(wh)
+	if err = profile.template().validate(wh); nil != err {
+		err = fmt.Errorf("webhook profile '%s': %w", profile.name, err)
+		return
 	}
 
 	obs.renewalTimeGauge.Set(float64(time.Now().Unix()))
@@ -279,6 +453,16 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.InternalWebhook) (err error)
 	// write/update obs
 	obs.mutex.Lock()
 
+	if nil != obs.verification {
+		// Verify again when the URLs change, or when a webhook that failed
+		// verification is registered again.
+		urls := deliveryURLs(wh.Webhook.Config.URL, wh.Webhook.Config.AlternativeURLs)
+		renewed := !wh.Webhook.Until.Equal(obs.listener.Webhook.Until)
+		if !sameURLs(urls, obs.verificationURLs) || (obs.verificationFailed && renewed) {
+			obs.startVerification(urls, wh.Webhook.Config.Secret)
+		}
+	}
+
 	obs.listener = wh
 
 	obs.failureMsg.Original = wh
@@ -288,9 +472,13 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.InternalWebhook) (err error)
 	obs.listener.Webhook.FailureURL = wh.Webhook.FailureURL
 	obs.deliverUntil = wh.Webhook.Until
 	obs.deliverUntilGauge.Set(float64(obs.deliverUntil.Unix()))
+	obs.scheduleExpiryWarning(obs.deliverUntil)
 
 	obs.events = events
 
+	obs.profile = profile
+	obs.redactor = obs.redaction.lookup(wh)
+
 	obs.deliveryRetryMaxGauge.Set(float64(obs.deliveryRetries))
 
 	// if matcher list is empty set it nil for Queue() logic
@@ -324,27 +512,140 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.InternalWebhook) (err error)
 
 	obs.mutex.Unlock()
 
+	if p, ok := obs.transport.(urlPruner); ok {
+		p.prune(deliveryURLs(wh.Webhook.Config.URL, wh.Webhook.Config.AlternativeURLs))
+	}
+
 	return
 }
 
+// startVerification stops any verification in progress and starts verifying
+// urls, holding back events until they're verified.  obs.mutex must be held.
+func (obs *CaduceusOutboundSender) startVerification(urls []string, secret string) {
+	if nil != obs.cancelVerification {
+		obs.cancelVerification()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	obs.cancelVerification = cancel
+	obs.verified = false
+	obs.verificationFailed = false
+	obs.verificationURLs = urls
+
+	go obs.verify(ctx, urls, secret)
+}
+
+// verify runs the verification handshake and records the outcome, unless
+// it was superseded or the sender shut down in the meantime.
+func (obs *CaduceusOutboundSender) verify(ctx context.Context, urls []string, secret string) {
+	err := obs.verification.verify(ctx, obs.sender, urls, secret)
+
+	obs.mutex.Lock()
+	defer obs.mutex.Unlock()
+	if nil != ctx.Err() {
+		return
+	}
+
+	if nil != err {
+		obs.verificationFailed = true
+		obs.verificationCounter.With("url", obs.metricsLabel, "outcome", verificationFailedOutcome).Add(1.0)
+		obs.logger.Error("webhook verification failed, events won't be delivered until it's registered again", zap.String("id", obs.id), zap.Error(err))
+		return
+	}
+	obs.verified = true
+	obs.verificationCounter.With("url", obs.metricsLabel, "outcome", verifiedOutcome).Add(1.0)
+	obs.logger.Info("webhook verified", zap.String("id", obs.id), zap.Strings("urls", urls))
+}
+
+// abandon stops what New started for a sender it then failed to create.
+func (obs *CaduceusOutboundSender) abandon() {
+	obs.cancelNotifications()
+
+	obs.mutex.Lock()
+	if nil != obs.cancelVerification {
+		obs.cancelVerification()
+	}
+	if nil != obs.expiryTimer {
+		obs.expiryTimer.Stop()
+	}
+	obs.notificationsClosed = true
+	obs.mutex.Unlock()
+
+	if nil != obs.transport {
+		if err := obs.transport.Close(); nil != err {
+			obs.logger.Error("failed to close transport", zap.String("id", obs.id), zap.Error(err))
+		}
+	}
+	if err := obs.spill.close(); nil != err {
+		obs.logger.Error("failed to remove spilled events", zap.String("id", obs.id), zap.Error(err))
+	}
+}
+
 // Shutdown causes the CaduceusOutboundSender to stop its activities either gently or
 // abruptly based on the gentle parameter.  If gentle is false, all queued
 // messages will be dropped without an attempt to send made.
 func (obs *CaduceusOutboundSender) Shutdown(gentle bool) {
 	if !gentle {
-		// need to close the channel we're going to replace, in case it doesn't
+		// Give up on notifications that are being retried.
+		obs.cancelNotifications()
+
+		// need to close the queue we're going to replace, in case it doesn't
 		// have any events in it.
-		close(obs.queue.Load().(chan *wrp.Message))
-		obs.Empty(obs.droppedExpiredCounter)
+		obs.queue.Load().(*eventQueue).close()
+		obs.Empty(obs.droppedExpiredCounter, expiredReason)
 	}
-	close(obs.queue.Load().(chan *wrp.Message))
+	obs.queue.Load().(*eventQueue).close()
 	obs.wg.Wait()
 
+	if err := obs.transport.Close(); nil != err {
+		obs.logger.Error("failed to close transport", zap.String("id", obs.id), zap.Error(err))
+	}
+
 	obs.mutex.Lock()
+	if nil != obs.cancelVerification {
+		obs.cancelVerification()
+	}
+	if nil != obs.expiryTimer {
+		obs.expiryTimer.Stop()
+	}
+	if nil != obs.cutOffTimer {
+		obs.cutOffTimer.Stop()
+	}
+	obs.notificationsClosed = true
+	if err := obs.spill.close(); nil != err {
+		obs.logger.Error("failed to remove spilled events", zap.String("id", obs.id), zap.Error(err))
+	}
+	obs.spillDepthGauge.Set(0)
 	obs.deliverUntil = time.Time{}
 	obs.deliverUntilGauge.Set(float64(obs.deliverUntil.Unix()))
 	obs.queueDepthGauge.Set(0) //just in case
 	obs.mutex.Unlock()
+
+	obs.notifications.Wait()
+	obs.cancelNotifications()
+}
+
+// Retire shuts the CaduceusOutboundSender down after giving it up to grace to
+// deliver the events it has queued.  Whatever is still queued after that is
+// dropped.
+func (obs *CaduceusOutboundSender) Retire(grace time.Duration) {
+	if grace <= 0 {
+		obs.Shutdown(false)
+		return
+	}
+
+	timer := time.AfterFunc(grace, func() {
+		obs.Empty(obs.droppedExpiredCounter, expiredReason)
+		// Empty swaps in a fresh queue, close it too so the dispatcher
+		// finishes.
+		obs.queue.Load().(*eventQueue).close()
+	})
+	defer timer.Stop()
+	obs.Shutdown(true)
+}
+
+// URL returns the URL the CaduceusOutboundSender delivers to.
+func (obs *CaduceusOutboundSender) URL() string {
+	return obs.id
 }
 
 // RetiredSince returns the time the CaduceusOutboundSender retired (which could be in
@@ -370,21 +671,82 @@ func overlaps(sl1 []string, sl2 []string) bool {
 // Queue is given a request to evaluate and optionally enqueue in the list
 // of messages to deliver.  The request is checked to see if it matches the
 // criteria before being accepted or silently dropped.
-func (obs *CaduceusOutboundSender) Queue(msg *wrp.Message) {
+func (obs *CaduceusOutboundSender) Queue(msg *outboundEvent) {
 	obs.mutex.RLock()
 	deliverUntil := obs.deliverUntil
 	dropUntil := obs.dropUntil
-	events := obs.events
-	matcher := obs.matcher
 	obs.mutex.RUnlock()
 
 	now := time.Now()
 
-	if !obs.isValidTimeWindow(now, dropUntil, deliverUntil) {
+	if !obs.isValidTimeWindow(now, dropUntil, deliverUntil, msg.Message) {
 		obs.logger.Debug("invalid time window for event", zap.Any("now", now), zap.Any("dropUntil", dropUntil), zap.Any("deliverUntil", deliverUntil))
 		return
 	}
 
+	if !obs.accepts(msg, false) {
+		return
+	}
+
+	obs.enqueue(msg)
+}
+
+// enqueue adds an accepted event to the queue, spilling it to disk or
+// cutting the webhook off when the queue is full.
+func (obs *CaduceusOutboundSender) enqueue(msg *outboundEvent) {
+	// Once events have spilled to disk, the events after them are spilled
+	// too, so they're delivered in order.
+	if spilled, err := obs.spill.pushBehind(msg); spilled {
+		obs.spilled(msg, err)
+		return
+	}
+
+	priority := obs.priorities.lane(msg.Message)
+	q := obs.queue.Load().(*eventQueue)
+	evicted, ok := q.push(msg, priority)
+	for !ok && q.isClosed() {
+		if current := obs.queue.Load().(*eventQueue); q != current {
+			// The queue was emptied in the meantime, which isn't the
+			// queue overflowing.
+			q = current
+			evicted, ok = q.push(msg, priority)
+			continue
+		}
+
+		// The sender is shutting down.
+		obs.droppedExpiredCounter.Add(1.0)
+		obs.countQOSDrop(expiredReason, msg.Message)
+		return
+	}
+
+	switch {
+	case !ok && nil != obs.spill:
+		obs.spilled(msg, obs.spill.push(msg))
+	case !ok:
+		obs.overflowed(msg)
+	case nil != evicted:
+		// The queue depth is unchanged, a lower priority event made room.
+		obs.droppedPriorityCounter.Add(1.0)
+		obs.countQOSDrop(priorityEvictedReason, evicted.Message)
+		obs.logger.Debug("queue full. lower priority event dropped", zap.String("event.source", evicted.Source), zap.String("event.destination", evicted.Destination),
+			zap.String("priority", obs.priorities.name(priority)))
+	default:
+		obs.queueDepthGauge.Add(1.0)
+		obs.logger.Debug("event added to outbound queue", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
+	}
+}
+
+// accepts checks msg against the webhook's partner ids, events, device
+// matchers and profile, and reports whether it should be delivered.
+// replayed is set for retained events queued again.
+func (obs *CaduceusOutboundSender) accepts(msg *outboundEvent, replayed bool) bool {
+	obs.mutex.RLock()
+	events := obs.events
+	matcher := obs.matcher
+	profile := obs.profile
+	verified := obs.verified
+	obs.mutex.RUnlock()
+
 	//check the partnerIDs
 	if !obs.disablePartnerIDs {
 		if len(msg.PartnerIDs) == 0 {
@@ -392,7 +754,7 @@ func (obs *CaduceusOutboundSender) Queue(msg *wrp.Message) {
 		}
 		if !overlaps(obs.listener.PartnerIDs, msg.PartnerIDs) {
 			obs.logger.Debug("parter id check failed", zap.Strings("webhook.partnerIDs", obs.listener.PartnerIDs), zap.Strings("event.partnerIDs", msg.PartnerIDs))
-			return
+			return false
 		}
 	}
 
@@ -408,7 +770,7 @@ func (obs *CaduceusOutboundSender) Queue(msg *wrp.Message) {
 	}
 	if !matchEvent {
 		obs.logger.Debug("destination regex doesn't match", zap.Strings("webhook.events", obs.listener.Webhook.Events), zap.String("event.dest", msg.Destination))
-		return
+		return false
 	}
 
 	if matcher != nil {
@@ -423,232 +785,522 @@ func (obs *CaduceusOutboundSender) Queue(msg *wrp.Message) {
 
 	if !matchDevice {
 		obs.logger.Debug("device regex doesn't match", zap.Strings("webhook.devices", obs.listener.Webhook.Matcher.DeviceID), zap.String("event.source", msg.Source))
-		return
+		return false
 	}
 
-	select {
-	case obs.queue.Load().(chan *wrp.Message) <- msg:
-		obs.queueDepthGauge.Add(1.0)
-		obs.logger.Debug("event added to outbound queue", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
-	default:
-		obs.logger.Debug("queue full. event dropped", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
-		obs.queueOverflow()
-		obs.droppedQueueFullCounter.Add(1.0)
+	if !profile.matches(msg.Message) {
+		obs.logger.Debug("profile matcher doesn't match", zap.String("profile", profile.name), zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
+		return false
 	}
+
+	if pass, err := profile.passes(msg.Message); !pass {
+		obs.logger.Debug("filter doesn't pass", zap.String("profile", profile.name), zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination), zap.Error(err))
+		return false
+	}
+
+	if match, reason := profile.payloadMatches(msg); !match {
+		obs.logger.Debug("payload doesn't match", zap.String("profile", profile.name), zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination), zap.String("reason", reason))
+		obs.droppedPayloadCounter.With("reason", reason).Add(1.0)
+		return false
+	}
+
+	if !profile.sampled(msg.Message, replayed) {
+		obs.sampledOutCounter.Add(1.0)
+		return false
+	}
+
+	if !verified {
+		obs.logger.Debug("webhook isn't verified. event dropped", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
+		obs.droppedUnverifiedCounter.Add(1.0)
+		return false
+	}
+
+	return true
 }
 
-func (obs *CaduceusOutboundSender) isValidTimeWindow(now, dropUntil, deliverUntil time.Time) bool {
-	if !now.After(dropUntil) {
+func (obs *CaduceusOutboundSender) isValidTimeWindow(now, dropUntil, deliverUntil time.Time, msg *wrp.Message) bool {
+	if !now.After(dropUntil) && !obs.qos.survivesCutOff(msg) {
 		// client was cut off
-		obs.droppedCutoffCounter.Add(1.0)
+		obs.countCutOffDrops(1)
+		obs.countQOSDrop(cutOffReason, msg)
 		return false
 	}
 
 	if !now.Before(deliverUntil) {
 		// outside delivery window
 		obs.droppedExpiredBeforeQueueCounter.Add(1.0)
+		obs.countQOSDrop(expiredBeforeQueueingReason, msg)
 		return false
 	}
 
 	return true
 }
 
+// countQOSDrop records that msg was dropped for reason, labelled by its QOS
+// level.
+func (obs *CaduceusOutboundSender) countQOSDrop(reason string, msg *wrp.Message) {
+	obs.droppedQOSCounter.With("reason", reason, "qos", qosLabel(msg)).Add(1.0)
+}
+
+// newQueue creates an empty queue configured for this sender.
+func (obs *CaduceusOutboundSender) newQueue() *eventQueue {
+	q := newEventQueue(obs.queueSize, obs.priorities.laneWeights())
+	q.byQOS = obs.qos.enabled()
+	return q
+}
+
 // Empty is called on cutoff or shutdown and swaps out the current queue for
-// a fresh one, counting any current messages in the queue as dropped.
-// It should never close a queue, as a queue not referenced anywhere will be
-// cleaned up by the garbage collector without needing to be closed.
-func (obs *CaduceusOutboundSender) Empty(droppedCounter metrics.Counter) {
-	droppedMsgs := obs.queue.Load().(chan *wrp.Message)
-	obs.queue.Store(make(chan *wrp.Message, obs.queueSize))
-	droppedCounter.Add(float64(len(droppedMsgs)))
-	obs.queueDepthGauge.Set(0.0)
+// a fresh one, counting any current messages in the queue, waiting in device
+// lanes, parked through a cut off or spilled to disk as dropped.
+func (obs *CaduceusOutboundSender) Empty(droppedCounter metrics.Counter, reason string) {
+	_ = obs.empty(droppedCounter, reason, nil)
+
+	obs.mutex.Lock()
+	parked := obs.parked
+	obs.parked = nil
+	obs.mutex.Unlock()
+
+	dropped := len(parked)
+	for _, msg := range parked {
+		obs.countQOSDrop(reason, msg.Message)
+	}
+	for msg := obs.unspill(); nil != msg; msg = obs.unspill() {
+		dropped++
+		obs.countQOSDrop(reason, msg.Message)
+	}
+	if 0 < dropped {
+		droppedCounter.Add(float64(dropped))
+	}
+}
+
+// empty swaps out the current queue for a fresh one.  Events in the old queue
+// that keep approves of are moved to the new queue, the rest are counted as
+// dropped and their number returned, along with those waiting in device lanes
+// that keep doesn't approve of.  The old queue is closed once it is drained
+// so a dispatcher waiting on it moves on to the new one.
+func (obs *CaduceusOutboundSender) empty(droppedCounter metrics.Counter, reason string, keep func(*wrp.Message) bool) int {
+	fresh := obs.newQueue()
+	old := obs.queue.Swap(fresh).(*eventQueue)
+	events := old.drain()
+	old.close()
+
+	var dropped int
+	for _, msg := range events {
+		if nil != keep && keep(msg.Message) {
+			if _, ok := fresh.push(msg, obs.priorities.lane(msg.Message)); ok {
+				continue
+			}
+		}
+		dropped++
+		obs.countQOSDrop(reason, msg.Message)
+	}
+	for _, d := range obs.lanes.drain(keep) {
+		dropped++
+		obs.countQOSDrop(reason, d.msg.Message)
+	}
+
+	droppedCounter.Add(float64(dropped))
+	obs.queueDepthGauge.Set(float64(fresh.len() + obs.lanes.len()))
+	return dropped
 }
 
 func (obs *CaduceusOutboundSender) dispatcher() {
 	defer obs.wg.Done()
 	var (
-		msg            *wrp.Message
+		msg            *outboundEvent
 		urls           *ring.Ring
 		secret, accept string
 		ok             bool
 	)
 
-Loop:
 	for {
 		// Always pull a new queue in case we have been cutoff or are shutting
 		// down.
-		msgQueue := obs.queue.Load().(chan *wrp.Message)
-		// nolint:gosimple
-		select {
+		msgQueue := obs.queue.Load().(*eventQueue)
+		obs.unpark(msgQueue)
+		obs.refill(msgQueue)
 		// The dispatcher cannot get stuck blocking here forever (caused by an
 		// empty queue that is replaced and then Queue() starts adding to the
-		// new queue) because:
-		// 	- queue is only replaced on cutoff and shutdown
-		//  - on cutoff, the first queue is always full so we will definitely
-		//    get a message, drop it because we're cut off, then get the new
-		//    queue and block until the cut off ends and Queue() starts queueing
-		//    messages again.
+		// new queue) because a queue that is replaced is always drained and
+		// closed, which wakes us up to pull in the new queue:
+		// 	- queue is only replaced on cutoff, expiry and shutdown
 		//  - on graceful shutdown, the queue is closed and then the dispatcher
 		//    will send all messages, then break the loop, gather workers, and
 		//    exit.
 		//  - on non graceful shutdown, the queue is closed and then replaced
-		//    with a new, empty queue that is also closed.
-		//      - If the first queue is empty, we immediately break the loop,
-		//        gather workers, and exit.
-		//      - If the first queue has messages, we drop a message as expired
-		//        pull in the new queue which is empty and closed, break the
-		//        loop, gather workers, and exit.
-		case msg, ok = <-msgQueue:
-			// This is only true when a queue is empty and closed, which for us
-			// only happens on Shutdown().
-			if !ok {
-				break Loop
+		//    with a new, empty queue that is also closed, so we break the
+		//    loop, gather workers, and exit.
+		msg, ok = msgQueue.pop()
+		switch {
+		case ok && nil == msg:
+			// Woken up to look for spilled or parked events.
+			continue
+		case !ok:
+			// The queue was replaced, so carry on with the new one.
+			if msgQueue != obs.queue.Load().(*eventQueue) {
+				continue
 			}
-			obs.queueDepthGauge.Add(-1.0)
-			obs.mutex.RLock()
-			urls = obs.urls
-			// Move to the next URL to try 1st the next time.
-			// This is okay because we run a single dispatcher and it's the
-			// only one updating this field.
-			obs.urls = obs.urls.Next()
-			deliverUntil := obs.deliverUntil
-			dropUntil := obs.dropUntil
-			secret = obs.listener.Webhook.Config.Secret
-			accept = obs.listener.Webhook.Config.ContentType
-			obs.mutex.RUnlock()
-
-			now := time.Now()
-
-			if now.Before(dropUntil) {
-				obs.droppedCutoffCounter.Add(1.0)
+			// Otherwise the queue is empty and closed, which for us only
+			// happens on Shutdown().  Events spilled to disk or parked
+			// through a cut off are still delivered before we finish,
+			// once the cut off is over.
+			if until := obs.heldUntil(); !until.IsZero() {
+				msgQueue.sleep(time.Until(until))
 				continue
 			}
-			if now.After(deliverUntil) {
-				obs.Empty(obs.droppedExpiredCounter)
+			msg = obs.leftover()
+		default:
+			obs.queueDepthGauge.Add(-1.0)
+		}
+		if nil == msg {
+			break
+		}
+		obs.mutex.RLock()
+		urls = obs.urls
+		// Move to the next URL to try 1st the next time.
+		// This is okay because we run a single dispatcher and it's the
+		// only one updating this field.
+		obs.urls = obs.urls.Next()
+		deliverUntil := obs.deliverUntil
+		dropUntil := obs.dropUntil
+		secret = obs.listener.Webhook.Config.Secret
+		accept = obs.listener.Webhook.Config.ContentType
+		obs.mutex.RUnlock()
+
+		now := time.Now()
+
+		if now.Before(dropUntil) {
+			obs.holdThroughCutOff(msg)
+			continue
+		}
+		if now.After(deliverUntil) {
+			obs.countQOSDrop(expiredReason, msg.Message)
+			obs.Empty(obs.droppedExpiredCounter, expiredReason)
+			continue
+		}
+
+		d := delivery{urls: urls, secret: secret, accept: accept, msg: msg}
+		if nil != obs.lanes {
+			// The device already has a delivery in flight, so this
+			// event waits its turn behind it.
+			id := laneID(msg.Message)
+			if obs.lanes.add(id, d) {
+				obs.queueDepthGauge.Add(1.0)
 				continue
 			}
 			obs.workers.Acquire()
 			obs.currentWorkersGauge.Add(1.0)
 
-			go obs.send(urls, secret, accept, msg)
+			go obs.sendOrdered(id, d)
+			continue
 		}
+
+		obs.workers.Acquire()
+		obs.currentWorkersGauge.Add(1.0)
+
+		go obs.send(d)
 	}
 	for i := 0; i < obs.maxWorkers; i++ {
 		obs.workers.Acquire()
 	}
 }
 
-// worker is the routine that actually takes the queued messages and delivers
-// them to the listeners outside webpa
-func (obs *CaduceusOutboundSender) send(urls *ring.Ring, secret, acceptType string, msg *wrp.Message) {
-	defer func() {
-		if r := recover(); nil != r {
-			obs.droppedPanic.Add(1.0)
-			obs.logger.Error("goroutine send() panicked", zap.String("id", obs.id), zap.Any("panic", r))
+// spilled accounts for msg being spilled to disk, or being dropped if
+// spilling it failed with err.  Running out of disk budget cuts the webhook
+// off just like a full queue does when nothing is spilled.
+func (obs *CaduceusOutboundSender) spilled(msg *outboundEvent, err error) {
+	if nil == err {
+		obs.spilledCounter.Add(1.0)
+		obs.spillDepthGauge.Set(float64(obs.spill.len()))
+		obs.logger.Debug("queue full. event spilled to disk", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
+		// The dispatcher only reads events back when it comes around, which
+		// an empty queue, like the one Empty swaps in, would keep it from.
+		obs.queue.Load().(*eventQueue).wake()
+		return
+	}
+
+	if errors.Is(err, errSpillClosed) {
+		// The sender is shutting down, the webhook didn't overflow.
+		obs.droppedExpiredCounter.Add(1.0)
+		obs.countQOSDrop(expiredReason, msg.Message)
+		return
+	}
+	if !errors.Is(err, errSpillFull) {
+		obs.logger.Error("failed to spill event", zap.String("id", obs.id), zap.Error(err))
+	}
+	obs.logger.Debug("spill full", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
+	obs.overflowed(msg)
+}
+
+// overflowed handles msg not fitting in the queue.  With priority lanes, only
+// a full queue of top lane events cuts the webhook off.  Events of the lower
+// lanes are dropped instead, so a busy lane can't cut off the events that
+// matter more.
+func (obs *CaduceusOutboundSender) overflowed(msg *outboundEvent) {
+	if priority := obs.priorities.lane(msg.Message); 0 < priority && !obs.qos.enabled() {
+		obs.droppedPriorityCounter.Add(1.0)
+		obs.countQOSDrop(priorityEvictedReason, msg.Message)
+		obs.logger.Debug("queue full. lower priority event dropped", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination),
+			zap.String("priority", obs.priorities.name(priority)))
+		return
+	}
+
+	obs.logger.Debug("queue full. event dropped", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
+	obs.queueOverflow()
+	obs.droppedQueueFullCounter.Add(1.0)
+	obs.countQOSDrop(queueFullReason, msg.Message)
+}
+
+// unspill reads back the oldest event spilled to disk, or returns nil if
+// there are none.
+func (obs *CaduceusOutboundSender) unspill() *outboundEvent {
+	for {
+		msg, lost, err := obs.spill.pop()
+		if nil != err {
+			obs.droppedSpillReadCounter.Add(float64(lost))
+			obs.logger.Error("failed to read back spilled event", zap.String("id", obs.id), zap.Int("lost", lost), zap.Error(err))
+			continue
+		}
+		if nil != obs.spill {
+			obs.spillDepthGauge.Set(float64(obs.spill.len()))
+		}
+		return msg
+	}
+}
+
+// refill moves events spilled to disk back into q, in the order they were
+// spilled, once the dispatcher has emptied at least half of it.  Nothing is
+// read back while the webhook is cut off.
+func (obs *CaduceusOutboundSender) refill(q *eventQueue) {
+	if 0 == obs.spill.len() || !obs.heldUntil().IsZero() {
+		return
+	}
+	room := q.room()
+	if 0 == room || room < obs.queueSize/2 {
+		return
+	}
+
+	for ; 0 < room; room-- {
+		msg := obs.unspill()
+		if nil == msg {
+			return
+		}
+
+		if !obs.requeue(q, msg) {
+			// Events queued while the last spilled one was read back
+			// took its place.
+			obs.droppedQueueFullCounter.Add(1.0)
+			obs.countQOSDrop(queueFullReason, msg.Message)
+			return
 		}
+	}
+}
+
+// send is the worker routine that delivers a single dequeued event and then
+// returns its worker.
+func (obs *CaduceusOutboundSender) send(d delivery) {
+	defer func() {
 		obs.workers.Release()
 		obs.currentWorkersGauge.Add(-1.0)
 	}()
 
-	payload := msg.Payload
-	body := payload
-	var payloadReader *bytes.Reader
-
-	// Use the internal content type unless the accept type is wrp
-	contentType := msg.ContentType
-	switch acceptType {
-	case "wrp", wrp.MimeTypeMsgpack, wrp.MimeTypeWrp:
-		// WTS - We should pass the original, raw WRP event instead of
-		// re-encoding it.
-		contentType = wrp.MimeTypeMsgpack
-		buffer := bytes.NewBuffer([]byte{})
-		encoder := wrp.NewEncoder(buffer, wrp.Msgpack)
-		encoder.Encode(msg)
-		body = buffer.Bytes()
-	}
-	payloadReader = bytes.NewReader(body)
-
-	req, err := http.NewRequest("POST", urls.Value.(string), payloadReader)
-	if nil != err {
-		// Report drop
-		obs.droppedInvalidConfig.Add(1.0)
-		obs.logger.Error("Invalid URL", zap.String("url", urls.Value.(string)), zap.String("id", obs.id), zap.Error(err))
-		return
+	obs.deliver(d.urls, d.secret, d.accept, d.msg)
+}
+
+// sendOrdered is the worker routine used for ordered delivery.  It delivers
+// the event that opened a device's lane, then keeps the same worker to
+// deliver the device's waiting events one at a time until the lane is empty.
+func (obs *CaduceusOutboundSender) sendOrdered(id device.ID, d delivery) {
+	defer func() {
+		obs.workers.Release()
+		obs.currentWorkersGauge.Add(-1.0)
+	}()
+
+	for ok := true; ok; d, ok = obs.nextInLane(id) {
+		// Events that waited in a lane may have outlived a cut off or the
+		// registration since the dispatcher looked at them.
+		obs.mutex.RLock()
+		deliverUntil := obs.deliverUntil
+		dropUntil := obs.dropUntil
+		obs.mutex.RUnlock()
+
+		now := time.Now()
+		if now.Before(dropUntil) {
+			obs.holdThroughCutOff(d.msg)
+			continue
+		}
+		if now.After(deliverUntil) {
+			obs.droppedExpiredCounter.Add(1.0)
+			obs.countQOSDrop(expiredReason, d.msg.Message)
+			continue
+		}
+
+		obs.deliver(d.urls, d.secret, d.accept, d.msg)
 	}
+}
 
-	req.Header.Set("Content-Type", contentType)
+// nextInLane takes the next delivery waiting in the device's lane, which
+// leaves the queue depth.
+func (obs *CaduceusOutboundSender) nextInLane(id device.ID) (delivery, bool) {
+	d, ok := obs.lanes.next(id)
+	if ok {
+		obs.queueDepthGauge.Add(-1.0)
+	}
+	return d, ok
+}
 
-	// Add x-Midt-* headers
-	wrphttp.AddMessageHeaders(req.Header, msg)
+// holdThroughCutOff handles an event dequeued while the webhook is cut off.
+// Events whose QOS survives cut offs are parked until the cut off ends, on
+// disk when the sender spills and otherwise in memory, up to a queue's worth.
+// The rest are dropped.
+func (obs *CaduceusOutboundSender) holdThroughCutOff(msg *outboundEvent) {
+	if obs.qos.survivesCutOff(msg.Message) {
+		// Spilled events aren't read back during a cut off.
+		if err := obs.spill.push(msg); nil == err {
+			obs.spillDepthGauge.Set(float64(obs.spill.len()))
+			return
+		}
 
-	// Provide the old headers for now
-	req.Header.Set("X-Webpa-Event", strings.TrimPrefix(msg.Destination, "event:"))
-	req.Header.Set("X-Webpa-Transaction-Id", msg.TransactionUUID)
+		obs.mutex.Lock()
+		if len(obs.parked) < obs.queueSize {
+			obs.parked = append(obs.parked, msg)
+			obs.mutex.Unlock()
+			return
+		}
+		obs.mutex.Unlock()
+	}
 
-	// Add the device id without the trailing service
-	id, _ := device.ParseID(msg.Source)
-	req.Header.Set("X-Webpa-Device-Id", string(id))
-	req.Header.Set("X-Webpa-Device-Name", string(id))
+	obs.countCutOffDrops(1)
+	obs.countQOSDrop(cutOffReason, msg.Message)
+}
 
-	// Apply the secret
+// unpark moves the events parked in memory through a cut off back into q once
+// the cut off is over, as long as there is room for them.
+func (obs *CaduceusOutboundSender) unpark(q *eventQueue) {
+	obs.mutex.Lock()
+	defer obs.mutex.Unlock()
+	if 0 == len(obs.parked) || time.Now().Before(obs.dropUntil) {
+		return
+	}
 
-	if "" != secret {
-		s := hmac.New(sha1.New, []byte(secret))
-		s.Write(body)
-		sig := fmt.Sprintf("sha1=%s", hex.EncodeToString(s.Sum(nil)))
-		req.Header.Set("X-Webpa-Signature", sig)
+	for 0 < len(obs.parked) && obs.requeue(q, obs.parked[0]) {
+		obs.parked[0] = nil
+		obs.parked = obs.parked[1:]
 	}
+	if 0 == len(obs.parked) {
+		obs.parked = nil
+	}
+}
 
-	// find the event "short name"
-	event := msg.FindEventStringSubMatch()
+// heldUntil returns when the cut off ends if there are events spilled or
+// parked waiting for it, and the zero time otherwise.
+func (obs *CaduceusOutboundSender) heldUntil() time.Time {
+	obs.mutex.RLock()
+	defer obs.mutex.RUnlock()
+	if !time.Now().Before(obs.dropUntil) || (0 == len(obs.parked) && 0 == obs.spill.len()) {
+		return time.Time{}
+	}
+	return obs.dropUntil
+}
 
-	retryOptions := xhttp.RetryOptions{
-		Logger:   obs.logger,
-		Retries:  obs.deliveryRetries,
-		Interval: obs.deliveryInterval,
-		Counter:  obs.deliveryRetryCounter.With("url", obs.id, "event", event),
-		// Always retry on failures up to the max count.
-		ShouldRetry:       xhttp.ShouldRetry,
-		ShouldRetryStatus: xhttp.RetryCodes,
+// leftover returns the next event spilled to disk or parked through a cut
+// off, or nil when there are none.
+func (obs *CaduceusOutboundSender) leftover() *outboundEvent {
+	if msg := obs.unspill(); nil != msg {
+		return msg
 	}
 
-	// update subsequent requests with the next url in the list upon failure
-	retryOptions.UpdateRequest = func(request *http.Request) {
-		urls = urls.Next()
-		tmp, err := url.Parse(urls.Value.(string))
-		if err != nil {
-			obs.logger.Error("failed to update url", zap.String("url", urls.Value.(string)), zap.Error(err))
-			return
-		}
-		request.URL = tmp
+	obs.mutex.Lock()
+	defer obs.mutex.Unlock()
+	if 0 == len(obs.parked) {
+		return nil
 	}
+	msg := obs.parked[0]
+	obs.parked[0] = nil
+	obs.parked = obs.parked[1:]
+	return msg
+}
+
+// requeue pushes an event that already left the queue back into q, and
+// reports whether there was room for it.
+func (obs *CaduceusOutboundSender) requeue(q *eventQueue, msg *outboundEvent) bool {
+	evicted, ok := q.push(msg, obs.priorities.lane(msg.Message))
+	switch {
+	case !ok:
+		return false
+	case nil != evicted:
+		obs.droppedPriorityCounter.Add(1.0)
+		obs.countQOSDrop(priorityEvictedReason, evicted.Message)
+	default:
+		obs.queueDepthGauge.Add(1.0)
+	}
+	return true
+}
+
+// deliver is the routine that actually takes the queued messages and delivers
+// them through the sender's transport to the listeners outside webpa
+func (obs *CaduceusOutboundSender) deliver(urls *ring.Ring, secret, acceptType string, msg *outboundEvent) {
+	defer func() {
+		if r := recover(); nil != r {
+			obs.droppedPanic.Add(1.0)
+			obs.logger.Error("goroutine send() panicked", zap.String("id", obs.id), zap.Any("panic", r))
+		}
+	}()
+
+	// Redact the event before the transport encodes and signs it.
+	obs.mutex.RLock()
+	redactor := obs.redactor
+	obs.mutex.RUnlock()
+	msg = redactor.redact(msg)
+
+	// find the event "short name"
+	event := msg.FindEventStringSubMatch()
 
 	// Send it
 	obs.logger.Debug("attempting to send event", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination))
 
-	retryer := xhttp.RetryTransactor(retryOptions, obs.sender.Do)
-	client := obs.clientMiddleware(doerFunc(retryer))
-	resp, err := client.Do(req)
+	if nil != obs.sharedWorkers {
+		obs.sharedWorkers.Acquire()
+		defer obs.sharedWorkers.Release()
+	}
+	code, err := obs.transport.Deliver(urls, secret, acceptType, msg)
+	if delivered(code, err) {
+		obs.recovered()
+	}
 
-	code := "failure"
 	l := obs.logger
-	if nil != err {
+	switch {
+	case errors.Is(err, errInvalidDestination):
+		// Report drop
+		obs.droppedInvalidConfig.Add(1.0)
+		obs.logger.Error("Invalid URL", zap.String("url", urls.Value.(string)), zap.String("id", obs.id), zap.Error(err))
+		return
+	case errors.Is(err, errTemplateRender):
+		// Report drop
+		obs.droppedInvalidConfig.Add(1.0)
+		obs.logger.Error("unable to render delivery template", zap.String("id", obs.id), zap.Error(err))
+		return
+	case errors.Is(err, errSubscriptionFull):
+		// The consumer isn't keeping up, which is the same as a full queue.
+		code = "failure"
+		obs.droppedQueueFullCounter.Add(1.0)
+		obs.countQOSDrop(queueFullReason, msg.Message)
+		l = obs.logger.With(zap.Error(err))
+	case errors.Is(err, errStreamWrite):
+		// The consumer hung up, which isn't a network failure.
+		code = "failure"
+		obs.droppedStreamWriteCounter.Add(1.0)
+		obs.countQOSDrop(streamWriteReason, msg.Message)
+		l = obs.logger.With(zap.Error(err))
+	case nil != err:
 		// Report failure
+		code = "failure"
 		obs.droppedNetworkErrCounter.Add(1.0)
+		obs.countQOSDrop(networkError, msg.Message)
 		l = obs.logger.With(zap.Error(err))
-	} else {
-		// Report Result
-		code = strconv.Itoa(resp.StatusCode)
-
-		// read until the response is complete before closing to allow
-		// connection reuse
-		if nil != resp.Body {
-			io.Copy(io.Discard, resp.Body)
-			resp.Body.Close()
-		}
 	}
-	obs.deliveryCounter.With("url", obs.id, "code", code, "event", event).Add(1.0)
-	l.Debug("event sent-ish", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination), zap.String("code", code), zap.String("url", req.URL.String()))
+	obs.deliveryCounter.With("url", obs.metricsLabel, "code", code, "event", event).Add(1.0)
+	l.Debug("event sent-ish", zap.String("event.source", msg.Source), zap.String("event.destination", msg.Destination), zap.String("code", code), zap.String("id", obs.id))
 }
 
 // queueOverflow handles the logic of what to do when a queue overflows:
@@ -660,66 +1312,133 @@ func (obs *CaduceusOutboundSender) queueOverflow() {
 		obs.mutex.Unlock()
 		return
 	}
-	obs.dropUntil = time.Now().Add(obs.cutOffPeriod)
+	obs.cutOffAt = time.Now()
+	obs.dropUntil = obs.cutOffAt.Add(obs.cutOffPeriod)
 	obs.dropUntilGauge.Set(float64(obs.dropUntil.Unix()))
+	// Wake the dispatcher when the cut off ends, for the events held
+	// through it.
+	if nil != obs.cutOffTimer {
+		obs.cutOffTimer.Stop()
+	}
+	obs.cutOffTimer = time.AfterFunc(obs.cutOffPeriod, func() {
+		obs.queue.Load().(*eventQueue).wake()
+	})
 	secret := obs.listener.Webhook.Config.Secret
 	failureMsg := obs.failureMsg
+	failureMsg.CutOffAt = obs.cutOffAt
+	failureMsg.CutOffUntil = obs.dropUntil
 	failureURL := obs.listener.Webhook.FailureURL
+	obs.cutOffDropped.Store(0)
 	obs.mutex.Unlock()
 
 	obs.cutOffCounter.Add(1.0)
 
-	// We empty the queue but don't close the channel, because we're not
-	// shutting down.
-	obs.Empty(obs.droppedCutoffCounter)
+	// We empty the queue but leave the sender open, because we're not
+	// shutting down.  Events whose QOS survives cut offs stay queued.
+	failureMsg.DroppedCount = int64(obs.empty(obs.droppedCutoffCounter, cutOffReason, obs.qos.survivesCutOff))
+	obs.cutOffDropped.Add(failureMsg.DroppedCount)
+
+	// if no URL to send cut off notification to, do nothing
+	if "" == failureURL {
+		return
+	}
+
+	// Send a "you've been cut off" warning message
+	obs.notify(cutOffNotice, failureURL, secret, failureMsg)
+}
 
-	msg, err := json.Marshal(failureMsg)
+// notify POSTs msg as JSON to notifyURL, signed with secret like events are.
+// It's sent in the background, retried as the notification policy says, so
+// a slow notification URL doesn't hold up whoever is notifying.  kind is the
+// type of the notification.
+func (obs *CaduceusOutboundSender) notify(kind, notifyURL, secret string, msg interface{}) {
+	body, err := json.Marshal(msg)
 	if nil != err {
-		obs.logger.Error("Cut-off notification json.Marshal failed", zap.Any("failureMessage", obs.failureMsg), zap.String("for", obs.id), zap.Error(err))
+		obs.logger.Error(fmt.Sprintf("%s notification json.Marshal failed", kind), zap.Any("notification", msg), zap.String("for", obs.id), zap.Error(err))
 		return
 	}
 
-	// if no URL to send cut off notification to, do nothing
-	if "" == failureURL {
+	obs.mutex.Lock()
+	if obs.notificationsClosed {
+		obs.mutex.Unlock()
 		return
 	}
+	obs.notifications.Add(1)
+	obs.mutex.Unlock()
 
-	// Send a "you've been cut off" warning message
-	payload := bytes.NewReader(msg)
-	req, err := http.NewRequest("POST", failureURL, payload)
+	go func() {
+		defer obs.notifications.Done()
+		obs.sendNotification(kind, notifyURL, secret, body)
+	}()
+}
+
+// sendNotification POSTs a notification until it succeeds, the retries run
+// out or the sender shuts down abruptly, and counts the outcome.
+func (obs *CaduceusOutboundSender) sendNotification(kind, notifyURL, secret string, body []byte) {
+	var (
+		code     int
+		err      error
+		interval = obs.notificationPolicy.retryInterval()
+	)
+	for attempt := 0; ; attempt++ {
+		code, err = obs.postNotification(notifyURL, secret, body)
+		if !retryNotification(code, err) || attempt >= obs.notificationPolicy.retries() {
+			break
+		}
+
+		select {
+		case <-obs.notificationsCtx.Done():
+		case <-time.After(interval):
+			interval *= 2
+			continue
+		}
+		break
+	}
+
+	outcome := strconv.Itoa(code)
 	if nil != err {
+		outcome = "failure"
 		// Failure
-		obs.logger.Error("Unable to send cut-off notification", zap.String("notification",
-			failureURL), zap.String("for", obs.id), zap.Error(err))
-		return
+		obs.logger.Error(fmt.Sprintf("Unable to send %s notification", kind), zap.String("notification", notifyURL), zap.String("for", obs.id), zap.Error(err))
+	}
+	obs.notificationCounter.With("url", obs.metricsLabel, "type", kind, "code", outcome).Add(1.0)
+}
+
+// postNotification makes one attempt at POSTing a notification and returns
+// the response's status code.
+func (obs *CaduceusOutboundSender) postNotification(notifyURL, secret string, body []byte) (int, error) {
+	ctx := obs.notificationsCtx
+	if timeout := obs.notificationPolicy.timeout(); 0 < timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", notifyURL, bytes.NewReader(body))
+	if nil != err {
+		return 0, err
 	}
 	req.Header.Set("Content-Type", wrp.MimeTypeJson)
 
 	if "" != secret {
 		h := hmac.New(sha1.New, []byte(secret))
-		h.Write(msg)
+		h.Write(body)
 		sig := fmt.Sprintf("sha1=%s", hex.EncodeToString(h.Sum(nil)))
 		req.Header.Set("X-Webpa-Signature", sig)
 	}
 
 	resp, err := obs.sender.Do(req)
 	if nil != err {
-		// Failure
-		obs.logger.Error("Unable to send cut-off notification", zap.String("notification", failureURL), zap.String("for", obs.id), zap.Error(err))
-		return
+		return 0, err
 	}
 
 	if nil == resp {
-		// Failure
-		obs.logger.Error("Unable to send cut-off notification, nil response", zap.String("notification", failureURL))
-		return
+		return 0, errors.New("nil response")
 	}
 
-	// Success
-
 	if nil != resp.Body {
 		io.Copy(io.Discard, resp.Body)
 		resp.Body.Close()
-
 	}
+	return resp.StatusCode, nil
 }
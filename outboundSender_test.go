@@ -4,13 +4,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/xmidt-org/ancla"
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/wrp-go/v3/wrphttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
@@ -18,6 +24,10 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -113,11 +123,15 @@ func simpleFactorySetup(trans *transport, cutOffPeriod time.Duration, matcher []
 	// test dropped metric
 	fakeDroppedSlow := new(mockCounter)
 	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "queue_full"}).Return(fakeDroppedSlow)
+	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "priority_evicted"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "cut_off"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "expired"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "expired_before_queueing"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "invalid_config"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "network_err"}).Return(fakeDroppedSlow)
+	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "stream_write_err"}).Return(fakeDroppedSlow)
+	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "spill_read_err"}).Return(fakeDroppedSlow)
+	fakeDroppedSlow.On("With", []string{"url", w.Webhook.Config.URL, "reason", "unverified"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("Add", mock.Anything).Return()
 
 	// IncomingContentType cases
@@ -138,6 +152,11 @@ func simpleFactorySetup(trans *transport, cutOffPeriod time.Duration, matcher []
 	fakePanicDrop.On("With", []string{"url", w.Webhook.Config.URL}).Return(fakePanicDrop)
 	fakePanicDrop.On("Add", 1.0).Return()
 
+	// QOSDroppedMsgCounter case
+	fakeQOSDrop := new(mockCounter)
+	fakeQOSDrop.On("With", mock.Anything).Return(fakeQOSDrop)
+	fakeQOSDrop.On("Add", mock.Anything).Return()
+
 	// Fake Latency
 	fakeLatency := new(mockHistogram)
 	fakeLatency.On("With", []string{"url", w.Webhook.Config.URL, "code", "200"}).Return(fakeLatency)
@@ -155,7 +174,14 @@ func simpleFactorySetup(trans *transport, cutOffPeriod time.Duration, matcher []
 	fakeRegistry.On("NewCounter", SlowConsumerCounter).Return(fakeSlow)
 	fakeRegistry.On("NewCounter", SlowConsumerDroppedMsgCounter).Return(fakeDroppedSlow)
 	fakeRegistry.On("NewCounter", DropsDueToPanic).Return(fakePanicDrop)
+	fakeRegistry.On("NewCounter", QOSDroppedMsgCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", PayloadFilterDroppedCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", SampledOutCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", WebhookVerificationCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", NotificationCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", SpilledMsgCounter).Return(fakeQOSDrop)
 	fakeRegistry.On("NewGauge", OutgoingQueueDepth).Return(fakeQdepth)
+	fakeRegistry.On("NewGauge", SpillDepthGauge).Return(fakeQdepth)
 	fakeRegistry.On("NewGauge", DeliveryRetryMaxGauge).Return(fakeQdepth)
 	fakeRegistry.On("NewGauge", ConsumerRenewalTimeGauge).Return(fakeQdepth)
 	fakeRegistry.On("NewGauge", ConsumerDeliverUntilGauge).Return(fakeQdepth)
@@ -214,34 +240,34 @@ func TestSimpleWrp(t *testing.T) {
 	req := simpleRequestWithPartnerIDs()
 	req.Destination = "event:iot"
 	fmt.Printf("Queue case 1:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	req = simpleRequestWithPartnerIDs()
 	req.Destination = "event:test"
 	fmt.Printf("\nQueue case 2:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	// queue case 3
 	req = simpleRequestWithPartnerIDs()
 	req.Destination = "event:no-match"
 	fmt.Printf("\nQueue case 3:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	// queue case 4
 	req = simpleRequestWithPartnerIDs()
 	req.ContentType = wrp.MimeTypeJson
 	fmt.Printf("\nQueue case 3:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	req = simpleRequestWithPartnerIDs()
 	req.ContentType = "application/http"
 	fmt.Printf("\nQueue case 4:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	req = simpleRequestWithPartnerIDs()
 	req.ContentType = "unknown"
 	fmt.Printf("\nQueue case 4:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	obs.Shutdown(true)
 
@@ -264,34 +290,34 @@ func TestSimpleWrpPartnerIDsFailure(t *testing.T) {
 	req := simpleRequest()
 	req.Destination = "event:iot"
 	fmt.Printf("Queue case 1:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	req = simpleRequest()
 	req.Destination = "event:test"
 	fmt.Printf("\nQueue case 2:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	// queue case 3
 	req = simpleRequest()
 	req.Destination = "event:no-match"
 	fmt.Printf("\nQueue case 3:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	// queue case 4
 	req = simpleRequest()
 	req.ContentType = wrp.MimeTypeJson
 	fmt.Printf("\nQueue case 3:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	req = simpleRequest()
 	req.ContentType = "application/http"
 	fmt.Printf("\nQueue case 4:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	req = simpleRequest()
 	req.ContentType = "unknown"
 	fmt.Printf("\nQueue case 4:\n %v\n", spew.Sprint(req))
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	obs.Shutdown(true)
 
@@ -316,7 +342,7 @@ func TestSimpleRetry(t *testing.T) {
 	req.Source = "mac:112233445566"
 	req.TransactionUUID = "1234"
 	req.Destination = "event:iot"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	obs.Shutdown(true)
 
@@ -341,7 +367,7 @@ func Test429Retry(t *testing.T) {
 	req.Source = "mac:112233445566"
 	req.TransactionUUID = "1234"
 	req.Destination = "event:iot"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	obs.Shutdown(true)
 
@@ -385,7 +411,7 @@ func TestAltURL(t *testing.T) {
 	req.Source = "mac:112233445566"
 	req.TransactionUUID = "1234"
 	req.Destination = "event:iot"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	obs.Shutdown(true)
 
@@ -410,25 +436,25 @@ func TestSimpleWrpWithMatchers(t *testing.T) {
 	req.TransactionUUID = "1234"
 	req.Source = "mac:112233445566"
 	req.Destination = "event:iot"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	r2 := simpleRequestWithPartnerIDs()
 	r2.TransactionUUID = "1234"
 	r2.Source = "mac:112233445565"
 	r2.Destination = "event:test"
-	obs.Queue(r2)
+	obs.Queue(newOutboundEvent(r2, nil))
 
 	r3 := simpleRequest()
 	r3.TransactionUUID = "1234"
 	r3.Source = "mac:112233445560"
 	r3.Destination = "event:iot"
-	obs.Queue(r3)
+	obs.Queue(newOutboundEvent(r3, nil))
 
 	r4 := simpleRequest()
 	r4.TransactionUUID = "1234"
 	r4.Source = "mac:112233445560"
 	r4.Destination = "event:test"
-	obs.Queue(r4)
+	obs.Queue(newOutboundEvent(r4, nil))
 
 	obs.Shutdown(true)
 
@@ -451,32 +477,32 @@ func TestSimpleWrpWithWildcardMatchers(t *testing.T) {
 	req.TransactionUUID = "1234"
 	req.Source = "mac:112233445566"
 	req.Destination = "event:iot"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	r2 := simpleRequestWithPartnerIDs()
 	r2.TransactionUUID = "1234"
 	r2.Source = "mac:112233445565"
 	r2.Destination = "event:test"
-	obs.Queue(r2)
+	obs.Queue(newOutboundEvent(r2, nil))
 
 	r3 := simpleRequestWithPartnerIDs()
 	r3.TransactionUUID = "1234"
 	r3.Source = "mac:112233445560"
 	r3.Destination = "event:iot"
-	obs.Queue(r3)
+	obs.Queue(newOutboundEvent(r3, nil))
 
 	r4 := simpleRequestWithPartnerIDs()
 	r4.TransactionUUID = "1234"
 	r4.Source = "mac:112233445560"
 	r4.Destination = "event:test"
-	obs.Queue(r4)
+	obs.Queue(newOutboundEvent(r4, nil))
 
 	/* This will panic. */
 	r5 := simpleRequestWithPartnerIDs()
 	r5.TransactionUUID = "1234"
 	r5.Source = "mac:112233445560"
 	r5.Destination = "event:test\xedoops"
-	obs.Queue(r5)
+	obs.Queue(newOutboundEvent(r5, nil))
 
 	obs.Shutdown(true)
 
@@ -808,6 +834,7 @@ func TestOverflowNoFailureURL(t *testing.T) {
 	}
 
 	obs.(*CaduceusOutboundSender).queueOverflow()
+	obs.Shutdown(true)
 	assert.NotNil(output.String())
 }
 
@@ -854,6 +881,7 @@ func TestOverflowValidFailureURL(t *testing.T) {
 	}
 
 	obs.(*CaduceusOutboundSender).queueOverflow()
+	obs.Shutdown(true)
 	assert.NotNil(output.String())
 }
 
@@ -901,6 +929,7 @@ func TestOverflowValidFailureURLWithSecret(t *testing.T) {
 	}
 
 	obs.(*CaduceusOutboundSender).queueOverflow()
+	obs.Shutdown(true)
 	assert.NotNil(output.String())
 }
 
@@ -939,6 +968,7 @@ func TestOverflowValidFailureURLError(t *testing.T) {
 	}
 
 	obs.(*CaduceusOutboundSender).queueOverflow()
+	obs.Shutdown(true)
 	assert.NotNil(output.String())
 }
 
@@ -985,21 +1015,1392 @@ func TestOverflow(t *testing.T) {
 	req := simpleRequest()
 
 	req.TransactionUUID = "01234"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 	req.TransactionUUID = "01235"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 
 	// give the worker a chance to pick up one from the queue
 	time.Sleep(1 * time.Second)
 
 	req.TransactionUUID = "01236"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 	req.TransactionUUID = "01237"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 	req.TransactionUUID = "01238"
-	obs.Queue(req)
+	obs.Queue(newOutboundEvent(req, nil))
 	atomic.AddInt32(&block, 1)
 	obs.Shutdown(false)
 
 	assert.NotNil(output.String())
 }
+
+// Ordered delivery keeps each device's events in order while still
+// delivering different devices in parallel.
+func TestOrderedDelivery(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		mutex     sync.Mutex
+		delivered = map[string][]string{}
+		inFlight  = map[string]int{}
+		maxDevice int
+		maxTotal  int
+		total     int
+	)
+
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		id := req.Header.Get("X-Webpa-Device-Id")
+
+		mutex.Lock()
+		inFlight[id]++
+		total++
+		if inFlight[id] > maxDevice {
+			maxDevice = inFlight[id]
+		}
+		if total > maxTotal {
+			maxTotal = total
+		}
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mutex.Lock()
+		inFlight[id]--
+		total--
+		delivered[id] = append(delivered[id], req.Header.Get("X-Webpa-Transaction-Id"))
+		mutex.Unlock()
+
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.OrderedDelivery = true
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	devices := []string{"mac:112233445566", "mac:112233445565"}
+	expected := map[string][]string{}
+	for i := 0; i < 5; i++ {
+		for _, d := range devices {
+			req := simpleRequestWithPartnerIDs()
+			req.Source = d + "/lmlite"
+			req.Destination = "event:iot"
+			req.TransactionUUID = fmt.Sprintf("%s-%d", d, i)
+			expected[d] = append(expected[d], req.TransactionUUID)
+			obs.Queue(newOutboundEvent(req, nil))
+		}
+	}
+
+	obs.Shutdown(true)
+
+	assert.Equal(int32(10), trans.i)
+	assert.Equal(expected, delivered)
+	assert.Equal(1, maxDevice)
+	assert.Equal(2, maxTotal)
+}
+
+// An abrupt shutdown drops the events waiting in device lanes along with the
+// queued ones.
+func TestOrderedDeliveryShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	trans := &transport{}
+	trans.fn = func(*http.Request, int) (*http.Response, error) {
+		<-block
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.OrderedDelivery = true
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	cos := obs.(*CaduceusOutboundSender)
+
+	for i := 0; i < 4; i++ {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+	assert.Eventually(func() bool { return 3 == cos.lanes.len() }, time.Second, 10*time.Millisecond)
+
+	cos.Empty(cos.droppedExpiredCounter, expiredReason)
+	assert.Zero(cos.lanes.len())
+
+	close(block)
+	obs.Shutdown(false)
+	assert.Equal(int32(1), trans.i)
+}
+
+// Events held through a cut off are queued again behind events that came in
+// after it ended, even for the same device.
+func TestOrderedDeliveryAfterCutOff(t *testing.T) {
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.OrderedDelivery = true
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	defer obs.Shutdown(false)
+	cos := obs.(*CaduceusOutboundSender)
+
+	event := func(id string) *outboundEvent {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.TransactionUUID = id
+		return newOutboundEvent(req, nil)
+	}
+
+	q := cos.newQueue()
+	cos.mutex.Lock()
+	cos.parked = []*outboundEvent{event("held")}
+	cos.mutex.Unlock()
+	_, ok := q.push(event("later"), 0)
+	require.True(t, ok)
+	cos.unpark(q)
+
+	var order []string
+	for 0 < q.len() {
+		msg, _ := q.pop()
+		order = append(order, msg.TransactionUUID)
+	}
+	assert.Equal(t, []string{"later", "held"}, order)
+}
+
+// A full queue drops lower priority events before cutting off the webhook.
+func TestPriorityOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	var delivered []string
+	var mutex sync.Mutex
+
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		<-block
+		mutex.Lock()
+		delivered = append(delivered, req.Header.Get("X-Webpa-Transaction-Id"))
+		mutex.Unlock()
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	pc, err := newPriorityClassifier([]PriorityClass{{Name: "critical", QOS: []string{"critical"}}})
+	assert.Nil(err)
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.NumWorkers = 1
+	obsf.QueueSize = 2
+	obsf.Priorities = pc
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	queue := func(id string, qos wrp.QOSValue) {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.TransactionUUID = id
+		req.QualityOfService = qos
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+
+	// The only worker picks this one up and blocks, then the dispatcher
+	// picks up the next one and waits for the worker.
+	queue("in-flight", 0)
+	time.Sleep(100 * time.Millisecond)
+	queue("dispatched", 0)
+	time.Sleep(100 * time.Millisecond)
+
+	queue("low", 0)
+	queue("critical-1", 99)
+	queue("critical-2", 99)
+
+	cos := obs.(*CaduceusOutboundSender)
+	assert.True(cos.dropUntil.IsZero(), "evicting lower priority events must not cut off the webhook")
+
+	// Nothing lower priority is left to evict.
+	queue("critical-3", 99)
+	assert.False(cos.dropUntil.IsZero())
+
+	close(block)
+	obs.Shutdown(true)
+
+	assert.Equal([]string{"in-flight", "dispatched"}, delivered)
+}
+
+// A queue full of low priority events drops the next one instead of cutting
+// off the webhook, so critical events still get through.
+func TestPriorityOverflowLowestLane(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	var delivered []string
+	var mutex sync.Mutex
+
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		<-block
+		mutex.Lock()
+		delivered = append(delivered, req.Header.Get("X-Webpa-Transaction-Id"))
+		mutex.Unlock()
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	pc, err := newPriorityClassifier([]PriorityClass{{Name: "critical", QOS: []string{"critical"}}})
+	require.NoError(t, err)
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.NumWorkers = 1
+	obsf.QueueSize = 2
+	obsf.Priorities = pc
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	cos := obs.(*CaduceusOutboundSender)
+	cutOff := new(mockCounter)
+	cos.cutOffCounter = cutOff
+
+	queue := func(id string, qos wrp.QOSValue) {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.TransactionUUID = id
+		req.QualityOfService = qos
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+
+	queue("in-flight", 0)
+	time.Sleep(100 * time.Millisecond)
+	queue("dispatched", 0)
+	time.Sleep(100 * time.Millisecond)
+
+	// The queue fills up with low priority events, and one more doesn't fit.
+	queue("low-1", 0)
+	queue("low-2", 0)
+	queue("low-3", 0)
+	assert.True(cos.dropUntil.IsZero())
+
+	queue("critical", 99)
+	assert.True(cos.dropUntil.IsZero())
+
+	close(block)
+	obs.Shutdown(true)
+
+	assert.Contains(delivered, "critical")
+	assert.NotContains(delivered, "low-3")
+	cutOff.AssertNotCalled(t, "Add", mock.Anything)
+}
+
+// A full queue spills to disk, and the spilled events are delivered in order
+// once the consumer catches up, without the webhook being cut off.
+func TestSpillOverflow(t *testing.T) {
+	tests := []struct {
+		desc string
+		// catchUp waits for everything to be delivered before shutting
+		// down, rather than leaving the spilled events to the shutdown.
+		catchUp bool
+	}{
+		{desc: "consumer catches up", catchUp: true},
+		{desc: "gentle shutdown"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			block := make(chan struct{})
+			var delivered []string
+			var mutex sync.Mutex
+
+			trans := &transport{}
+			trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+				<-block
+				mutex.Lock()
+				delivered = append(delivered, req.Header.Get("X-Webpa-Transaction-Id"))
+				mutex.Unlock()
+				return &http.Response{StatusCode: 200}, nil
+			}
+
+			spill, err := newSpillPolicy(SpillConfig{Dir: t.TempDir()})
+			require.NoError(err)
+
+			obsf := simpleFactorySetup(trans, time.Second, nil)
+			obsf.NumWorkers = 1
+			obsf.QueueSize = 2
+			obsf.Spill = spill
+			obs, err := obsf.New()
+			require.NoError(err)
+			cos := obs.(*CaduceusOutboundSender)
+
+			var expected []string
+			for i := 0; i < 10; i++ {
+				req := simpleRequestWithPartnerIDs()
+				req.Destination = "event:iot"
+				req.TransactionUUID = fmt.Sprintf("%02d", i)
+				expected = append(expected, req.TransactionUUID)
+				obs.Queue(newOutboundEvent(req, nil))
+				// Let the worker and the dispatcher pick up the first two.
+				if i < 2 {
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+
+			assert.True(cos.dropUntil.IsZero(), "spilling must not cut off the webhook")
+			assert.Equal(6, cos.spill.len())
+
+			close(block)
+			if tc.catchUp {
+				require.Eventually(func() bool {
+					mutex.Lock()
+					defer mutex.Unlock()
+					return len(expected) == len(delivered)
+				}, time.Second, time.Millisecond)
+				assert.Zero(cos.spill.len())
+			}
+			obs.Shutdown(true)
+
+			assert.Equal(expected, delivered)
+			assert.NoDirExists(cos.spill.dir)
+		})
+	}
+}
+
+// Running out of disk budget cuts the webhook off.
+func TestSpillFull(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	block := make(chan struct{})
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		<-block
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	spill, err := newSpillPolicy(SpillConfig{Dir: t.TempDir(), MaxBytes: 1})
+	require.NoError(err)
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.NumWorkers = 1
+	obsf.QueueSize = 1
+	obsf.Spill = spill
+	obs, err := obsf.New()
+	require.NoError(err)
+	cos := obs.(*CaduceusOutboundSender)
+
+	for i := 0; i < 4; i++ {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		obs.Queue(newOutboundEvent(req, nil))
+		if i < 2 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	assert.False(cos.dropUntil.IsZero())
+
+	close(block)
+	obs.Shutdown(false)
+}
+
+// spillTestSender returns a sender that spills, with its dispatcher waiting
+// on an empty queue.
+func spillTestSender(t *testing.T, trans *transport) *CaduceusOutboundSender {
+	spill, err := newSpillPolicy(SpillConfig{Dir: t.TempDir()})
+	require.NoError(t, err)
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.Spill = spill
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	return obs.(*CaduceusOutboundSender)
+}
+
+// An event spilled behind the back of a dispatcher waiting on an empty
+// queue, like one swapped in by Empty, still gets delivered.
+func TestSpillWakesDispatcher(t *testing.T) {
+	var delivered int32
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		atomic.AddInt32(&delivered, 1)
+		return &http.Response{StatusCode: 200}, nil
+	}
+	cos := spillTestSender(t, trans)
+	defer cos.Shutdown(false)
+	// Let the dispatcher start waiting.
+	time.Sleep(50 * time.Millisecond)
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	msg := newOutboundEvent(req, nil)
+	require.NoError(t, cos.spill.push(msg))
+	cos.spilled(msg, nil)
+
+	assert.Eventually(t, func() bool { return 1 == atomic.LoadInt32(&delivered) }, time.Second, time.Millisecond)
+}
+
+// Events that can't be spilled because the sender is shutting down don't
+// cut the webhook off.
+func TestSpillClosed(t *testing.T) {
+	cos := spillTestSender(t, &transport{})
+	cos.Shutdown(false)
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	cos.spilled(newOutboundEvent(req, nil), errSpillClosed)
+	assert.True(t, cos.dropUntil.IsZero())
+}
+
+// Spilled events that can't be read back are counted as dropped.
+func TestUnspillUndecodable(t *testing.T) {
+	cos := spillTestSender(t, &transport{})
+	defer cos.Shutdown(false)
+
+	lost := new(mockCounter)
+	lost.On("Add", 1.0).Return().Once()
+	cos.droppedSpillReadCounter = lost
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	require.NoError(t, cos.spill.push(newOutboundEvent(req, []byte{0xc1})))
+	assert.Nil(t, cos.unspill())
+	lost.AssertExpectations(t)
+}
+
+// Higher QOS events get more delivery retries.
+func TestQOSDeliveryRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	var mutex sync.Mutex
+	attempts := map[string]int{}
+
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		mutex.Lock()
+		attempts[req.Header.Get("X-Webpa-Transaction-Id")]++
+		mutex.Unlock()
+		return &http.Response{StatusCode: 429}, nil
+	}
+
+	qos, err := newQOSPolicy(QOSConfig{Enabled: true, DeliveryRetries: map[string]int{"critical": 3}})
+	assert.Nil(err)
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.QOS = qos
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	req.TransactionUUID = "low"
+	obs.Queue(newOutboundEvent(req, nil))
+
+	req = simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	req.TransactionUUID = "critical"
+	req.QualityOfService = wrp.QOSCriticalValue
+	obs.Queue(newOutboundEvent(req, nil))
+
+	obs.Shutdown(true)
+
+	assert.Equal(map[string]int{"low": 2, "critical": 4}, attempts)
+}
+
+// Events whose QOS survives cut offs are held and delivered once the cut off
+// ends, the rest are dropped.
+func TestQOSSurviveCutOff(t *testing.T) {
+	assert := assert.New(t)
+
+	var mutex sync.Mutex
+	var delivered []string
+
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		if req.URL.String() == "http://localhost:9999/foo" {
+			mutex.Lock()
+			delivered = append(delivered, req.Header.Get("X-Webpa-Transaction-Id"))
+			mutex.Unlock()
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	qos, err := newQOSPolicy(QOSConfig{Enabled: true, SurviveCutOff: "high"})
+	assert.Nil(err)
+
+	obsf := simpleFactorySetup(trans, 500*time.Millisecond, nil)
+	obsf.QOS = qos
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	queue := func(id string, qos wrp.QOSValue) {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.TransactionUUID = id
+		req.QualityOfService = qos
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+
+	obs.(*CaduceusOutboundSender).queueOverflow()
+
+	queue("low", wrp.QOSLowValue)
+	queue("critical", wrp.QOSCriticalValue)
+
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	assert.Empty(delivered, "nothing is delivered during the cut off")
+	mutex.Unlock()
+
+	obs.Shutdown(true)
+
+	assert.Equal([]string{"critical"}, delivered)
+}
+
+// Events that survive a cut off are parked, on disk when the sender spills,
+// and delivered once it ends without holding up the dispatcher.
+func TestQOSSurviveCutOffParked(t *testing.T) {
+	for _, spill := range []bool{false, true} {
+		t.Run(fmt.Sprintf("spill %t", spill), func(t *testing.T) {
+			assert := assert.New(t)
+
+			var (
+				mutex     sync.Mutex
+				delivered []string
+			)
+			trans := &transport{}
+			trans.fn = func(req *http.Request, _ int) (*http.Response, error) {
+				if req.URL.String() == "http://localhost:9999/foo" {
+					mutex.Lock()
+					delivered = append(delivered, req.Header.Get("X-Webpa-Transaction-Id"))
+					mutex.Unlock()
+				}
+				return &http.Response{StatusCode: 200}, nil
+			}
+
+			qos, err := newQOSPolicy(QOSConfig{Enabled: true, SurviveCutOff: "high"})
+			require.NoError(t, err)
+
+			obsf := simpleFactorySetup(trans, 200*time.Millisecond, nil)
+			obsf.QOS = qos
+			if spill {
+				obsf.Spill, err = newSpillPolicy(SpillConfig{Dir: t.TempDir()})
+				require.NoError(t, err)
+			}
+			obs, err := obsf.New()
+			require.NoError(t, err)
+			defer obs.Shutdown(false)
+			cos := obs.(*CaduceusOutboundSender)
+
+			cos.queueOverflow()
+			for _, id := range []string{"1", "2"} {
+				req := simpleRequestWithPartnerIDs()
+				req.Destination = "event:iot"
+				req.TransactionUUID = id
+				req.QualityOfService = wrp.QOSCriticalValue
+				obs.Queue(newOutboundEvent(req, nil))
+			}
+
+			assert.Eventually(func() bool {
+				cos.mutex.RLock()
+				defer cos.mutex.RUnlock()
+				return 2 == len(cos.parked)+cos.spill.len()
+			}, time.Second, 5*time.Millisecond)
+			assert.Equal(spill, 0 < cos.spill.len())
+
+			assert.Eventually(func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return 2 == len(delivered)
+			}, 2*time.Second, 10*time.Millisecond)
+			assert.ElementsMatch([]string{"1", "2"}, delivered)
+		})
+	}
+}
+
+// An abrupt shutdown during a cut off drops the parked events rather than
+// waiting for it to end.
+func TestQOSSurviveCutOffShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &transport{}
+	qos, err := newQOSPolicy(QOSConfig{Enabled: true, SurviveCutOff: "high"})
+	require.NoError(t, err)
+
+	obsf := simpleFactorySetup(trans, time.Minute, nil)
+	obsf.QOS = qos
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	cos := obs.(*CaduceusOutboundSender)
+
+	cos.queueOverflow()
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	req.QualityOfService = wrp.QOSCriticalValue
+	obs.Queue(newOutboundEvent(req, nil))
+	assert.Eventually(func() bool {
+		cos.mutex.RLock()
+		defer cos.mutex.RUnlock()
+		return 1 == len(cos.parked)
+	}, time.Second, 5*time.Millisecond)
+
+	start := time.Now()
+	obs.Retire(50 * time.Millisecond)
+	assert.Less(time.Since(start), 5*time.Second)
+	assert.Empty(cos.parked)
+	assert.Zero(trans.i)
+}
+
+// Queueing onto a queue that's closed for shutdown drops the event without
+// cutting the webhook off.
+func TestQueueWhileShuttingDown(t *testing.T) {
+	assert := assert.New(t)
+
+	obs, err := simpleFactorySetup(&transport{}, time.Minute, nil).New()
+	require.NoError(t, err)
+	cos := obs.(*CaduceusOutboundSender)
+
+	cos.queue.Load().(*eventQueue).close()
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	obs.Queue(newOutboundEvent(req, nil))
+
+	assert.True(cos.dropUntil.IsZero())
+	obs.Shutdown(true)
+}
+
+func TestRetire(t *testing.T) {
+	tests := []struct {
+		desc      string
+		grace     time.Duration
+		openAfter time.Duration
+		expected  int
+	}{
+		{
+			desc:      "drained within the grace period",
+			grace:     5 * time.Second,
+			openAfter: 50 * time.Millisecond,
+			expected:  3,
+		},
+		{
+			desc:      "dropped after the grace period",
+			grace:     50 * time.Millisecond,
+			openAfter: 200 * time.Millisecond,
+			expected:  2,
+		},
+		{
+			desc:      "no grace period",
+			openAfter: 50 * time.Millisecond,
+			expected:  2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+
+			gated := &gatedTransport{gate: make(chan struct{})}
+			obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+			obsf.NumWorkers = 1
+			obsf.Transports = TransportRegistry{
+				"http": func(*CaduceusOutboundSender) (Transport, error) { return gated, nil },
+			}
+			obs, err := obsf.New()
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				req := simpleRequestWithPartnerIDs()
+				req.Destination = "event:iot"
+				obs.Queue(newOutboundEvent(req, nil))
+			}
+			// Let the worker pick up the first event and the dispatcher the
+			// second, only the third is still queued when the sender is
+			// retired.
+			time.Sleep(50 * time.Millisecond)
+
+			time.AfterFunc(tc.openAfter, func() { close(gated.gate) })
+			obs.Retire(tc.grace)
+
+			assert.Equal(tc.expected, gated.count())
+			assert.True(gated.closed)
+		})
+	}
+}
+
+func TestProfileMatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	custom := &recordingTransport{}
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+	var err error
+	obsf.Profiles, err = newWebhookProfiles([]WebhookProfile{
+		{
+			Name:    "tg",
+			URLs:    []string{"localhost:9999"},
+			Matcher: &MatcherConfig{Field: "metadata", Key: "/hw-model", Value: "^TG"},
+		},
+	})
+	require.NoError(t, err)
+
+	obs, err := obsf.New()
+	require.NoError(t, err)
+
+	for id, model := range map[string]string{"tg": "TG1682", "xb": "XB6"} {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.TransactionUUID = id
+		req.Metadata = map[string]string{"/hw-model": model}
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+	obs.Shutdown(true)
+
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.Equal([]string{"tg"}, custom.delivered)
+}
+
+func TestProfileFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	custom := &recordingTransport{}
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+	var err error
+	obsf.Profiles, err = newWebhookProfiles([]WebhookProfile{
+		{
+			Name:   "tg",
+			URLs:   []string{"localhost:9999"},
+			Filter: `metadata["/hw-model"].startsWith("TG")`,
+		},
+	})
+	require.NoError(t, err)
+
+	obs, err := obsf.New()
+	require.NoError(t, err)
+
+	for id, metadata := range map[string]map[string]string{
+		"tg":      {"/hw-model": "TG1682"},
+		"xb":      {"/hw-model": "XB6"},
+		"missing": {},
+	} {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.TransactionUUID = id
+		req.Metadata = metadata
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+	obs.Shutdown(true)
+
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.Equal([]string{"tg"}, custom.delivered)
+}
+
+func TestProfilePayload(t *testing.T) {
+	assert := assert.New(t)
+
+	custom := &recordingTransport{}
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+	var err error
+	obsf.Profiles, err = newWebhookProfiles([]WebhookProfile{
+		{
+			Name:    "online",
+			URLs:    []string{"localhost:9999"},
+			Payload: []PayloadPredicate{{Path: "$.state", Value: "^online$"}},
+		},
+	})
+	require.NoError(t, err)
+
+	obs, err := obsf.New()
+	require.NoError(t, err)
+
+	for id, payload := range map[string]string{
+		"online":  `{"state": "online"}`,
+		"offline": `{"state": "offline"}`,
+		"invalid": `{"state"`,
+	} {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.TransactionUUID = id
+		req.ContentType = wrp.MimeTypeJson
+		req.Payload = []byte(payload)
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+	obs.Shutdown(true)
+
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.Equal([]string{"online"}, custom.delivered)
+}
+
+func TestProfileSampling(t *testing.T) {
+	assert := assert.New(t)
+
+	custom := &recordingTransport{}
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+	sampling := SamplingConfig{Rate: 0.5, ByDevice: true}
+	var err error
+	obsf.Profiles, err = newWebhookProfiles([]WebhookProfile{
+		{
+			Name:     "half",
+			URLs:     []string{"localhost:9999"},
+			Sampling: &sampling,
+		},
+	})
+	require.NoError(t, err)
+
+	obs, err := obsf.New()
+	require.NoError(t, err)
+
+	sampler, err := newEventSampler(sampling)
+	require.NoError(t, err)
+
+	var expected []string
+	sampledOut := 0
+	for i := 0; i < 20; i++ {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.Source = fmt.Sprintf("mac:%012x", i)
+		req.TransactionUUID = req.Source
+		if sampler.sampled(req) {
+			expected = append(expected, req.TransactionUUID)
+		} else {
+			sampledOut++
+		}
+	}
+	require.NotEmpty(t, expected)
+	require.NotZero(t, sampledOut)
+
+	fakeSampledOut := new(mockCounter)
+	fakeSampledOut.On("Add", 1.0).Return().Times(sampledOut)
+	obs.(*CaduceusOutboundSender).sampledOutCounter = fakeSampledOut
+
+	for i := 0; i < 20; i++ {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.Source = fmt.Sprintf("mac:%012x", i)
+		req.TransactionUUID = req.Source
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+	obs.Shutdown(true)
+
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.ElementsMatch(expected, custom.delivered)
+	fakeSampledOut.AssertExpectations(t)
+}
+
+func TestVerification(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		mutex      sync.Mutex
+		challenged []string
+	)
+	release := make(chan struct{})
+	trans := &transport{
+		fn: func(req *http.Request, _ int) (*http.Response, error) {
+			<-release
+			mutex.Lock()
+			defer mutex.Unlock()
+			challenged = append(challenged, req.URL.String())
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(req.Header.Get(verificationChallengeHeader))),
+			}, nil
+		},
+	}
+	custom := &recordingTransport{}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+	var err error
+	obsf.Verification, err = newVerificationPolicy(VerificationConfig{Enabled: true})
+	require.NoError(err)
+
+	obs, err := obsf.New()
+	require.NoError(err)
+	cobs := obs.(*CaduceusOutboundSender)
+	isVerified := func() bool {
+		cobs.mutex.RLock()
+		defer cobs.mutex.RUnlock()
+		return cobs.verified
+	}
+
+	queue := func(id string) {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		req.TransactionUUID = id
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+
+	// Nothing is delivered until the URL echoes the challenge.
+	queue("before")
+	assert.False(isVerified())
+	close(release)
+	require.Eventually(isVerified, time.Second, time.Millisecond)
+	queue("verified")
+
+	// Renewing the registration doesn't verify it again.
+	w := obsf.Listener
+	w.Webhook.Until = time.Now().Add(time.Hour)
+	require.NoError(obs.Update(w))
+	assert.True(isVerified())
+
+	// Changing the URLs does.
+	w.Webhook.Config.AlternativeURLs = []string{"http://localhost:9999/alt"}
+	require.NoError(obs.Update(w))
+	require.Eventually(isVerified, time.Second, time.Millisecond)
+	queue("after")
+
+	obs.Shutdown(true)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal([]string{"http://localhost:9999/foo", "http://localhost:9999/alt"}, challenged)
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.ElementsMatch([]string{"verified", "after"}, custom.delivered)
+}
+
+func TestVerificationFailed(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var challenges int32
+	trans := &transport{
+		fn: func(req *http.Request, _ int) (*http.Response, error) {
+			atomic.AddInt32(&challenges, 1)
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("hello"))}, nil
+		},
+	}
+	custom := &recordingTransport{}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+	var err error
+	obsf.Verification, err = newVerificationPolicy(VerificationConfig{Enabled: true, Retries: 1, RetryInterval: time.Millisecond})
+	require.NoError(err)
+
+	obs, err := obsf.New()
+	require.NoError(err)
+	cobs := obs.(*CaduceusOutboundSender)
+	failed := func() bool {
+		cobs.mutex.RLock()
+		defer cobs.mutex.RUnlock()
+		return cobs.verificationFailed
+	}
+	require.Eventually(failed, time.Second, time.Millisecond)
+	assert.EqualValues(2, atomic.LoadInt32(&challenges))
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	obs.Queue(newOutboundEvent(req, nil))
+
+	// Registering again tries again.
+	w := obsf.Listener
+	w.Webhook.Until = time.Now().Add(time.Hour)
+	require.NoError(obs.Update(w))
+	require.Eventually(failed, time.Second, time.Millisecond)
+	assert.EqualValues(4, atomic.LoadInt32(&challenges))
+
+	obs.Shutdown(true)
+
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.Empty(custom.delivered)
+}
+
+func TestVerificationUnverifiable(t *testing.T) {
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Listener.Webhook.Config.URL = "grpc://localhost:9999"
+	obsf.Transports = TransportRegistry{
+		"grpc": func(*CaduceusOutboundSender) (Transport, error) { return &recordingTransport{}, nil },
+	}
+	var err error
+	obsf.Verification, err = newVerificationPolicy(VerificationConfig{Enabled: true})
+	require.NoError(t, err)
+
+	obs, err := obsf.New()
+	assert.Nil(t, obs)
+	assert.ErrorIs(t, err, errUnverifiable)
+}
+
+// A sender New fails to create doesn't start verifying its webhook.
+func TestNewFailureStartsNothing(t *testing.T) {
+	var challenges int32
+	trans := &transport{
+		fn: func(req *http.Request, _ int) (*http.Response, error) {
+			atomic.AddInt32(&challenges, 1)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(req.Header.Get(verificationChallengeHeader))),
+			}, nil
+		},
+	}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	var err error
+	obsf.Verification, err = newVerificationPolicy(VerificationConfig{Enabled: true})
+	require.NoError(t, err)
+
+	// The spill can't be opened once its dir is gone.
+	dir := filepath.Join(t.TempDir(), "spill")
+	obsf.Spill, err = newSpillPolicy(SpillConfig{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(dir))
+
+	obs, err := obsf.New()
+	assert.Nil(t, obs)
+	assert.Error(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&challenges))
+}
+
+func TestNewFailureClosesTransport(t *testing.T) {
+	custom := &recordingTransport{}
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+
+	// The spill is opened after the transport, and fails.
+	dir := filepath.Join(t.TempDir(), "spill")
+	var err error
+	obsf.Spill, err = newSpillPolicy(SpillConfig{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(dir))
+
+	obs, err := obsf.New()
+	assert.Nil(t, obs)
+	assert.Error(t, err)
+
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.True(t, custom.closed)
+}
+
+func TestProfileTemplate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		mutex       sync.Mutex
+		body        []byte
+		contentType string
+		signature   string
+	)
+	trans := &transport{
+		fn: func(req *http.Request, _ int) (*http.Response, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			body, _ = io.ReadAll(req.Body)
+			contentType = req.Header.Get("Content-Type")
+			signature = req.Header.Get("X-Webpa-Signature")
+			return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+		},
+	}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	var err error
+	obsf.Profiles, err = newWebhookProfiles([]WebhookProfile{
+		{
+			Name:     "envelope",
+			URLs:     []string{"localhost:9999"},
+			Template: `{"source": {{json .Source}}, "data": {{json .Payload}}}`,
+		},
+	})
+	require.NoError(err)
+
+	obs, err := obsf.New()
+	require.NoError(err)
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	req.ContentType = wrp.MimeTypeJson
+	req.Payload = []byte(`{"state": "online"}`)
+	obs.Queue(newOutboundEvent(req, nil))
+	obs.Shutdown(true)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.JSONEq(`{"source": "mac:112233445566/lmlite", "data": {"state": "online"}}`, string(body))
+	assert.Equal(wrp.MimeTypeJson, contentType)
+
+	// The rendered body is what's signed.
+	s := hmac.New(sha1.New, []byte("123456"))
+	s.Write(body)
+	assert.Equal("sha1="+hex.EncodeToString(s.Sum(nil)), signature)
+}
+
+func TestRedactionBeforeSigning(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		mutex     sync.Mutex
+		body      []byte
+		metadata  []string
+		signature string
+	)
+	trans := &transport{
+		fn: func(req *http.Request, _ int) (*http.Response, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			body, _ = io.ReadAll(req.Body)
+			metadata = req.Header.Values(wrphttp.MetadataHeader)
+			signature = req.Header.Get("X-Webpa-Signature")
+			return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+		},
+	}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	var err error
+	obsf.Redaction, err = newRedactionRules([]RedactionRule{
+		{
+			Name:         "comcast",
+			PartnerIDs:   []string{"comcast"},
+			DropMetadata: []string{"/serial"},
+			MaskPayload:  []string{"$.email"},
+		},
+		{
+			Name:         "someone else",
+			PartnerIDs:   []string{"acme"},
+			DropMetadata: []string{"/hw-model"},
+		},
+	})
+	require.NoError(err)
+
+	obs, err := obsf.New()
+	require.NoError(err)
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	req.ContentType = wrp.MimeTypeJson
+	req.Metadata = map[string]string{"/hw-model": "TG1682", "/serial": "ABC123"}
+	req.Payload = []byte(`{"state":"online","email":"sam@example.com"}`)
+	obs.Queue(newOutboundEvent(req, nil))
+	obs.Shutdown(true)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.JSONEq(`{"state":"online","email":"[REDACTED]"}`, string(body))
+	assert.Equal([]string{"/hw-model=TG1682"}, metadata)
+
+	// The redacted body is what's signed.
+	s := hmac.New(sha1.New, []byte("123456"))
+	s.Write(body)
+	assert.Equal("sha1="+hex.EncodeToString(s.Sum(nil)), signature)
+
+	// The queued event is shared with other senders and left alone.
+	assert.Equal("ABC123", req.Metadata["/serial"])
+	assert.Contains(string(req.Payload), "sam@example.com")
+}
+
+func TestProfileTemplateInvalid(t *testing.T) {
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	var err error
+	obsf.Profiles, err = newWebhookProfiles([]WebhookProfile{
+		{
+			Name:     "broken",
+			URLs:     []string{"localhost:9999"},
+			Template: `source={{.Source}}`,
+		},
+	})
+	require.NoError(t, err)
+
+	obs, err := obsf.New()
+	assert.Nil(t, obs)
+	assert.ErrorIs(t, err, errTemplateNotJSON)
+}
+
+func TestCloudEventsDelivery(t *testing.T) {
+	tests := []struct {
+		desc        string
+		contentType string
+		expectType  string
+		expectID    string
+		expectBody  string
+	}{
+		{
+			desc:        "binary",
+			contentType: cloudEventsBinary,
+			expectType:  wrp.MimeTypeJson,
+			expectID:    "1234",
+			expectBody:  `{"state": "online"}`,
+		},
+		{
+			desc:        "structured",
+			contentType: cloudEventsStructured,
+			expectType:  cloudEventsStructured,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var (
+				mutex sync.Mutex
+				reqs  []*http.Request
+				body  []byte
+			)
+			trans := &transport{
+				fn: func(req *http.Request, _ int) (*http.Response, error) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					body, _ = io.ReadAll(req.Body)
+					reqs = append(reqs, req)
+					return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+				},
+			}
+			obsf := simpleFactorySetup(trans, time.Second, nil)
+			obsf.Listener.Webhook.Config.ContentType = tc.contentType
+			obs, err := obsf.New()
+			require.NoError(err)
+
+			req := simpleRequestWithPartnerIDs()
+			req.Destination = "event:iot"
+			req.ContentType = wrp.MimeTypeJson
+			req.Payload = []byte(`{"state": "online"}`)
+			obs.Queue(newOutboundEvent(req, nil))
+			obs.Shutdown(true)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			require.Len(reqs, 1)
+			assert.Equal(tc.expectType, reqs[0].Header.Get("Content-Type"))
+			assert.Equal(tc.expectID, reqs[0].Header.Get("ce-id"))
+			if "" != tc.expectBody {
+				assert.JSONEq(tc.expectBody, string(body))
+				return
+			}
+
+			var doc map[string]interface{}
+			require.NoError(json.Unmarshal(body, &doc))
+			assert.Equal("1234", doc["id"])
+			assert.Equal("iot", doc["type"])
+			assert.Equal(map[string]interface{}{"state": "online"}, doc["data"])
+		})
+	}
+}
+
+func TestWrpDeliveryForwardsReceivedBytes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		mutex       sync.Mutex
+		body        []byte
+		contentType string
+	)
+	trans := &transport{
+		fn: func(req *http.Request, _ int) (*http.Response, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			body, _ = io.ReadAll(req.Body)
+			contentType = req.Header.Get("Content-Type")
+			return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+		},
+	}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.Listener.Webhook.Config.ContentType = "wrp"
+	obs, err := obsf.New()
+	require.NoError(err)
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	var raw []byte
+	require.NoError(wrp.NewEncoderBytes(&raw, wrp.Msgpack).Encode(req))
+	// Something the encoder wouldn't produce, to tell the bytes apart.
+	raw = append(raw, 0xc0)
+
+	obs.Queue(newOutboundEvent(req, raw))
+	obs.Shutdown(true)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(wrp.MimeTypeMsgpack, contentType)
+	assert.Equal(raw, body)
+}
+
+// BenchmarkFanOutEncoding compares the cost of 100 deliveries of an event to
+// webhooks that want the WRP, encoding it for each delivery versus sharing
+// one encoding or the bytes it was received as.
+func BenchmarkFanOutEncoding(b *testing.B) {
+	const deliveries = 100
+
+	msg := simpleRequestWithPartnerIDs()
+	msg.Metadata = map[string]string{"/hw-model": "TG1682", "/fw-name": "TG1682_3.14p9s6_PROD_sey"}
+	var raw []byte
+	if err := wrp.NewEncoderBytes(&raw, wrp.Msgpack).Encode(msg); nil != err {
+		b.Fatal(err)
+	}
+
+	b.Run("per delivery", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < deliveries; j++ {
+				var body []byte
+				if err := wrp.NewEncoderBytes(&body, wrp.Msgpack).Encode(msg); nil != err {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("encode once", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			e := newOutboundEvent(msg, nil)
+			for j := 0; j < deliveries; j++ {
+				if _, err := e.msgpack(); nil != err {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("received bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			e := newOutboundEvent(msg, raw)
+			for j := 0; j < deliveries; j++ {
+				if _, err := e.msgpack(); nil != err {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestSubscriptionFullCountedAsQueueFull(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	obs, err := simpleFactorySetup(&transport{}, time.Second, nil).New()
+	require.NoError(err)
+	o := obs.(*CaduceusOutboundSender)
+
+	buffer := newSubscriptionBuffer(1)
+	queueFull := new(mockCounter)
+	queueFull.On("Add", 1.0).Return().Once()
+	o.transport = &subscriptionTransport{buffer: buffer}
+	o.droppedQueueFullCounter = queueFull
+	o.droppedNetworkErrCounter = new(mockCounter)
+
+	req := simpleRequestWithPartnerIDs()
+	req.Destination = "event:iot"
+	obs.Queue(newOutboundEvent(req, nil))
+	obs.Queue(newOutboundEvent(req, nil))
+	obs.Shutdown(true)
+
+	queueFull.AssertExpectations(t)
+	assert.Len(buffer.events, 1)
+}
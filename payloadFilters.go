@@ -0,0 +1,234 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// defaultMaxPayloadParseSize is the largest payload payload predicates parse
+// unless configured otherwise.
+const defaultMaxPayloadParseSize = 64 * 1024
+
+// Reasons an event is dropped by a profile's payload predicates.
+const (
+	payloadNoMatchReason  = "no_match"
+	payloadNotJSONReason  = "not_json"
+	payloadInvalidReason  = "invalid_json"
+	payloadTooLargeReason = "too_large"
+)
+
+var errPayloadPath = errors.New("payload path must look like $.field[0].field or $.list[*].field")
+
+// PayloadPredicate is a condition on a value in a JSON payload.  Path selects
+// values with a subset of JSONPath: "$" followed by ".name", "[index]", ".*"
+// or "[*]" steps, the wildcards selecting every member of an object or list.
+// The predicate holds if any selected value matches.
+type PayloadPredicate struct {
+	// Path selects the values to check.
+	Path string
+
+	// Value is a regular expression matched against the selected strings,
+	// numbers, bools and nulls, in their JSON form without quotes.  Leaving
+	// it out only requires the path to exist.  (Optional)
+	Value string
+}
+
+// pathStep is one step of a payload path.  An empty name and a negative
+// index is a wildcard.
+type pathStep struct {
+	name  string
+	index int
+	field bool
+}
+
+type payloadPredicate struct {
+	path  []pathStep
+	value *regexp.Regexp
+}
+
+// payloadFilter checks JSON payloads against a list of predicates that must
+// all hold.
+type payloadFilter struct {
+	predicates []payloadPredicate
+	maxSize    int
+}
+
+// newPayloadFilter compiles predicates, parsing payloads up to maxSize bytes.
+// A maxSize of 0 uses the default.  No predicates results in a nil filter.
+func newPayloadFilter(predicates []PayloadPredicate, maxSize int) (*payloadFilter, error) {
+	if 0 == len(predicates) {
+		return nil, nil
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxPayloadParseSize
+	}
+
+	f := &payloadFilter{maxSize: maxSize}
+	for _, p := range predicates {
+		path, err := parsePayloadPath(p.Path)
+		if nil != err {
+			return nil, fmt.Errorf("invalid payload path '%s': %w", p.Path, err)
+		}
+		pp := payloadPredicate{path: path}
+		if "" != p.Value {
+			if pp.value, err = regexp.Compile(p.Value); nil != err {
+				return nil, fmt.Errorf("invalid payload value '%s': %w", p.Value, err)
+			}
+		}
+		f.predicates = append(f.predicates, pp)
+	}
+	return f, nil
+}
+
+func parsePayloadPath(path string) ([]pathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errPayloadPath
+	}
+
+	var steps []pathStep
+	rest := path[1:]
+	for "" != rest {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if 0 == end {
+				end = len(rest)
+			}
+			name := rest[1:end]
+			if "" == name {
+				return nil, errPayloadPath
+			}
+			if "*" == name {
+				name = ""
+			}
+			steps = append(steps, pathStep{name: name, index: -1, field: true})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errPayloadPath
+			}
+			step := pathStep{index: -1}
+			if inner := rest[1:end]; "*" != inner {
+				i, err := strconv.Atoi(inner)
+				if nil != err || i < 0 {
+					return nil, errPayloadPath
+				}
+				step.index = i
+			}
+			steps = append(steps, step)
+			rest = rest[end+1:]
+		default:
+			return nil, errPayloadPath
+		}
+	}
+	return steps, nil
+}
+
+// matches reports whether msg's payload meets every predicate, and if not,
+// the reason it was dropped.  A nil filter matches everything.  Payloads
+// that aren't JSON or are bigger than the parse limit never match.
+func (f *payloadFilter) matches(msg *outboundEvent) (bool, string) {
+	if nil == f {
+		return true, ""
+	}
+	if !isJSONContentType(msg.ContentType) {
+		return false, payloadNotJSONReason
+	}
+	if len(msg.Payload) > f.maxSize {
+		return false, payloadTooLargeReason
+	}
+
+	payload, err := msg.jsonPayload()
+	if nil != err {
+		return false, payloadInvalidReason
+	}
+
+	for _, p := range f.predicates {
+		if !p.matches(payload) {
+			return false, payloadNoMatchReason
+		}
+	}
+	return true, ""
+}
+
+func (p payloadPredicate) matches(payload interface{}) bool {
+	for _, v := range selectPath(payload, p.path) {
+		if nil == p.value {
+			return true
+		}
+		if s, ok := scalarString(v); ok && p.value.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectPath returns the values path selects from v.
+func selectPath(v interface{}, path []pathStep) []interface{} {
+	values := []interface{}{v}
+	for _, step := range path {
+		var next []interface{}
+		for _, v := range values {
+			switch node := v.(type) {
+			case map[string]interface{}:
+				if !step.field {
+					continue
+				}
+				if "" == step.name {
+					for _, member := range node {
+						next = append(next, member)
+					}
+				} else if member, ok := node[step.name]; ok {
+					next = append(next, member)
+				}
+			case []interface{}:
+				if step.field && "" != step.name {
+					continue
+				}
+				if step.index < 0 {
+					next = append(next, node...)
+				} else if step.index < len(node) {
+					next = append(next, node[step.index])
+				}
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+// scalarString returns the JSON form of a string, number, bool or null, with
+// strings unquoted.
+func scalarString(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case json.Number:
+		return s.String(), true
+	case bool:
+		return strconv.FormatBool(s), true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
+
+// isJSONContentType reports whether contentType is JSON, including the
+// +json structured syntax suffix.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if nil != err {
+		return false
+	}
+	return wrp.MimeTypeJson == mediaType || strings.HasSuffix(mediaType, "+json")
+}
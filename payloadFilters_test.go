@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func payloadTestMessage(payload string) *wrp.Message {
+	return &wrp.Message{
+		ContentType: wrp.MimeTypeJson,
+		Payload:     []byte(payload),
+	}
+}
+
+func TestPayloadFilter(t *testing.T) {
+	const payload = `{
+		"status": {"state": "online", "uptime": 1234, "healthy": true, "reason": null},
+		"interfaces": [{"name": "wan0", "up": true}, {"name": "lan0", "up": false}],
+		"tags": ["a", "b"]
+	}`
+
+	tests := []struct {
+		desc       string
+		predicates []PayloadPredicate
+		msg        *wrp.Message
+		expected   bool
+		reason     string
+	}{
+		{desc: "string", predicates: []PayloadPredicate{{Path: "$.status.state", Value: "^online$"}}, expected: true},
+		{desc: "number", predicates: []PayloadPredicate{{Path: "$.status.uptime", Value: "^1234$"}}, expected: true},
+		{desc: "bool", predicates: []PayloadPredicate{{Path: "$.status.healthy", Value: "^true$"}}, expected: true},
+		{desc: "null", predicates: []PayloadPredicate{{Path: "$.status.reason", Value: "^null$"}}, expected: true},
+		{desc: "exists", predicates: []PayloadPredicate{{Path: "$.status"}}, expected: true},
+		{desc: "missing", predicates: []PayloadPredicate{{Path: "$.status.missing"}}, reason: payloadNoMatchReason},
+		{desc: "mismatch", predicates: []PayloadPredicate{{Path: "$.status.state", Value: "^offline$"}}, reason: payloadNoMatchReason},
+		{desc: "object value", predicates: []PayloadPredicate{{Path: "$.status", Value: ".*"}}, reason: payloadNoMatchReason},
+		{desc: "index", predicates: []PayloadPredicate{{Path: "$.interfaces[1].name", Value: "^lan0$"}}, expected: true},
+		{desc: "index out of range", predicates: []PayloadPredicate{{Path: "$.interfaces[2].name"}}, reason: payloadNoMatchReason},
+		{desc: "list wildcard", predicates: []PayloadPredicate{{Path: "$.interfaces[*].up", Value: "^false$"}}, expected: true},
+		{desc: "member wildcard", predicates: []PayloadPredicate{{Path: "$.status.*", Value: "^online$"}}, expected: true},
+		{desc: "field of a list", predicates: []PayloadPredicate{{Path: "$.tags.name"}}, reason: payloadNoMatchReason},
+		{desc: "index of an object", predicates: []PayloadPredicate{{Path: "$.status[0]"}}, reason: payloadNoMatchReason},
+		{
+			desc: "all must hold",
+			predicates: []PayloadPredicate{
+				{Path: "$.status.state", Value: "^online$"},
+				{Path: "$.tags[*]", Value: "^c$"},
+			},
+			reason: payloadNoMatchReason,
+		},
+		{
+			desc:       "not json",
+			predicates: []PayloadPredicate{{Path: "$.status"}},
+			msg:        &wrp.Message{ContentType: wrp.MimeTypeMsgpack, Payload: []byte(payload)},
+			reason:     payloadNotJSONReason,
+		},
+		{
+			desc:       "json suffix",
+			predicates: []PayloadPredicate{{Path: "$.status"}},
+			msg:        &wrp.Message{ContentType: "application/vnd.example+json; charset=utf-8", Payload: []byte(payload)},
+			expected:   true,
+		},
+		{
+			desc:       "invalid json",
+			predicates: []PayloadPredicate{{Path: "$.status"}},
+			msg:        payloadTestMessage(`{"status":`),
+			reason:     payloadInvalidReason,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			f, err := newPayloadFilter(tc.predicates, 0)
+			require.NoError(t, err)
+
+			msg := tc.msg
+			if nil == msg {
+				msg = payloadTestMessage(payload)
+			}
+			match, reason := f.matches(newOutboundEvent(msg, nil))
+			assert.Equal(tc.expected, match)
+			assert.Equal(tc.reason, reason)
+		})
+	}
+}
+
+func TestPayloadFilterMaxSize(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := newPayloadFilter([]PayloadPredicate{{Path: "$.a"}}, 16)
+	require.NoError(t, err)
+
+	match, reason := f.matches(newOutboundEvent(payloadTestMessage(`{"a": 1}`), nil))
+	assert.True(match)
+	assert.Empty(reason)
+
+	match, reason = f.matches(newOutboundEvent(payloadTestMessage(`{"a": "`+strings.Repeat("x", 16)+`"}`), nil))
+	assert.False(match)
+	assert.Equal(payloadTooLargeReason, reason)
+
+	var none *payloadFilter
+	match, _ = none.matches(newOutboundEvent(&wrp.Message{}, nil))
+	assert.True(match)
+}
+
+func TestPayloadFilterInvalid(t *testing.T) {
+	tests := []struct {
+		desc      string
+		predicate PayloadPredicate
+		expectErr error
+	}{
+		{desc: "no root", predicate: PayloadPredicate{Path: "status"}, expectErr: errPayloadPath},
+		{desc: "empty field", predicate: PayloadPredicate{Path: "$..status"}, expectErr: errPayloadPath},
+		{desc: "unclosed index", predicate: PayloadPredicate{Path: "$.list[0"}, expectErr: errPayloadPath},
+		{desc: "bad index", predicate: PayloadPredicate{Path: "$.list[-1]"}, expectErr: errPayloadPath},
+		{desc: "junk", predicate: PayloadPredicate{Path: "$.list[0]x"}, expectErr: errPayloadPath},
+		{desc: "bad regex", predicate: PayloadPredicate{Path: "$.a", Value: "[[:123"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			f, err := newPayloadFilter([]PayloadPredicate{tc.predicate}, 0)
+			assert.Nil(f)
+			assert.Error(err)
+			if nil != tc.expectErr {
+				assert.ErrorIs(err, tc.expectErr)
+			}
+		})
+	}
+
+	f, err := newPayloadFilter(nil, 0)
+	assert.Nil(t, f)
+	assert.NoError(t, err)
+}
@@ -60,7 +60,7 @@ type JWTValidator struct {
 	Leeway bascule.Leeway
 }
 
-func NewPrimaryHandler(l *zap.Logger, v *viper.Viper, registry xmetrics.Registry, sw *ServerHandler, webhookSvc ancla.Service, router *mux.Router, prevVersionSupport bool) (*mux.Router, error) {
+func NewPrimaryHandler(l *zap.Logger, v *viper.Viper, registry xmetrics.Registry, sw *ServerHandler, streams http.Handler, subscriptions *subscriptionHandler, replays http.Handler, webhookSvc ancla.Service, router *mux.Router, prevVersionSupport bool) (*mux.Router, error) {
 	auth, err := authenticationMiddleware(v, l, registry)
 	if err != nil {
 		// nolint:errorlint
@@ -76,6 +76,20 @@ func NewPrimaryHandler(l *zap.Logger, v *viper.Viper, registry xmetrics.Registry
 
 	router.Handle(urlPrefix+"/notify", auth.Then(sw)).Methods("POST")
 
+	if nil != streams {
+		router.Handle(urlPrefix+"/stream", auth.Then(streams)).Methods("GET")
+	}
+
+	if nil != subscriptions {
+		router.Handle(urlPrefix+"/subscriptions", auth.ThenFunc(subscriptions.create)).Methods("POST")
+		router.Handle(urlPrefix+"/subscriptions/{name}/events", auth.ThenFunc(subscriptions.poll)).Methods("GET")
+		router.Handle(urlPrefix+"/subscriptions/{name}", auth.ThenFunc(subscriptions.delete)).Methods("DELETE")
+	}
+
+	if nil != replays {
+		router.Handle(urlPrefix+"/replay", auth.Then(replays)).Methods("POST")
+	}
+
 	return router, nil
 }
 
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// defaultPriorityClass is the name of the implicit, lowest priority class that
+// holds every event not claimed by a configured class.
+const defaultPriorityClass = "default"
+
+var errNoPriorityClassSelector = errors.New("priority class must have events or qos levels")
+
+// PriorityClass configures one priority lane of each outbound sender's queue.
+type PriorityClass struct {
+	// Name identifies the class in logs.
+	Name string
+
+	// Events is the list of regular expressions an event's destination is
+	// matched against to place it in this class.
+	Events []string
+
+	// QOS is the list of WRP quality of service levels (low, medium, high,
+	// critical) that place an event in this class.
+	QOS []string
+
+	// Weight is the share of dispatch this class receives relative to the
+	// other classes that have events waiting.  Defaults to 1.
+	Weight int
+}
+
+type priorityClass struct {
+	name   string
+	events []*regexp.Regexp
+	qos    map[wrp.QOSLevel]bool
+}
+
+// priorityClassifier assigns events to the lanes of an eventQueue.  Classes
+// are listed from highest priority to lowest and the first one an event
+// matches wins.  Events that match no class go in the last lane.
+type priorityClassifier struct {
+	classes []priorityClass
+	weights []int
+}
+
+// newPriorityClassifier compiles the configured classes.  No classes results
+// in a nil classifier, which places every event in a single lane.
+func newPriorityClassifier(config []PriorityClass) (*priorityClassifier, error) {
+	if 0 == len(config) {
+		return nil, nil
+	}
+
+	pc := &priorityClassifier{
+		classes: make([]priorityClass, 0, len(config)),
+		weights: make([]int, 0, len(config)+1),
+	}
+
+	for _, c := range config {
+		if 0 == len(c.Events) && 0 == len(c.QOS) {
+			return nil, fmt.Errorf("priority class '%s': %w", c.Name, errNoPriorityClassSelector)
+		}
+
+		class := priorityClass{
+			name: c.Name,
+			qos:  make(map[wrp.QOSLevel]bool),
+		}
+		for _, event := range c.Events {
+			re, err := regexp.Compile(event)
+			if nil != err {
+				return nil, fmt.Errorf("priority class '%s': invalid event regex '%s': %w", c.Name, event, err)
+			}
+			class.events = append(class.events, re)
+		}
+		for _, name := range c.QOS {
+			level, err := parseQOSLevel(name)
+			if nil != err {
+				return nil, fmt.Errorf("priority class '%s': %w", c.Name, err)
+			}
+			class.qos[level] = true
+		}
+
+		weight := c.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		pc.classes = append(pc.classes, class)
+		pc.weights = append(pc.weights, weight)
+	}
+
+	// The default class always gets the smallest possible share.
+	pc.weights = append(pc.weights, 1)
+
+	return pc, nil
+}
+
+// parseQOSLevel converts a QOS level name into a wrp.QOSLevel.
+func parseQOSLevel(name string) (wrp.QOSLevel, error) {
+	for _, level := range []wrp.QOSLevel{wrp.QOSLow, wrp.QOSMedium, wrp.QOSHigh, wrp.QOSCritical} {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return wrp.QOSLow, fmt.Errorf("invalid qos level '%s'", name)
+}
+
+// lane returns the queue lane for msg.
+func (pc *priorityClassifier) lane(msg *wrp.Message) int {
+	if nil == pc {
+		return 0
+	}
+
+	level := msg.QualityOfService.Level()
+	event := strings.TrimPrefix(msg.Destination, "event:")
+	for i, class := range pc.classes {
+		if class.qos[level] {
+			return i
+		}
+		for _, re := range class.events {
+			if re.MatchString(event) {
+				return i
+			}
+		}
+	}
+	return len(pc.classes)
+}
+
+// name returns the name of the class for a lane.
+func (pc *priorityClassifier) name(lane int) string {
+	if nil == pc || lane >= len(pc.classes) {
+		return defaultPriorityClass
+	}
+	return pc.classes[lane].name
+}
+
+// laneWeights returns the dispatch weight of each lane, for use with
+// newEventQueue.
+func (pc *priorityClassifier) laneWeights() []int {
+	if nil == pc {
+		return nil
+	}
+	return pc.weights
+}
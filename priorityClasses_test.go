@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestNewPriorityClassifier(t *testing.T) {
+	tests := []struct {
+		desc      string
+		classes   []PriorityClass
+		expectNil bool
+		expectErr bool
+	}{
+		{
+			desc:      "no classes",
+			expectNil: true,
+		},
+		{
+			desc:    "valid",
+			classes: []PriorityClass{{Name: "status", Events: []string{"^device-status/"}, QOS: []string{"Critical", "high"}}},
+		},
+		{
+			desc:      "no selectors",
+			classes:   []PriorityClass{{Name: "empty", Weight: 3}},
+			expectErr: true,
+		},
+		{
+			desc:      "bad regex",
+			classes:   []PriorityClass{{Name: "bad", Events: []string{"[[:123"}}},
+			expectErr: true,
+		},
+		{
+			desc:      "bad qos",
+			classes:   []PriorityClass{{Name: "bad", QOS: []string{"urgent"}}},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			pc, err := newPriorityClassifier(tc.classes)
+			if tc.expectErr {
+				assert.Error(err)
+				assert.Nil(pc)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expectNil, nil == pc)
+		})
+	}
+}
+
+func TestPriorityClassifierLane(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	pc, err := newPriorityClassifier([]PriorityClass{
+		{Name: "critical", QOS: []string{"critical"}, Weight: 4},
+		{Name: "status", Events: []string{"^device-status/", "^online$"}, Weight: 2},
+	})
+	require.NoError(err)
+
+	assert.Equal([]int{4, 2, 1}, pc.laneWeights())
+
+	assert.Equal(0, pc.lane(&wrp.Message{Destination: "event:iot", QualityOfService: 80}))
+	assert.Equal(1, pc.lane(&wrp.Message{Destination: "event:device-status/mac:112233445566/online"}))
+	assert.Equal(1, pc.lane(&wrp.Message{Destination: "event:online", QualityOfService: 30}))
+	assert.Equal(2, pc.lane(&wrp.Message{Destination: "event:iot", QualityOfService: 30}))
+
+	assert.Equal("critical", pc.name(0))
+	assert.Equal("status", pc.name(1))
+	assert.Equal(defaultPriorityClass, pc.name(2))
+
+	// A nil classifier places everything in a single lane.
+	var none *priorityClassifier
+	assert.Equal(0, none.lane(&wrp.Message{Destination: "event:iot", QualityOfService: 80}))
+	assert.Nil(none.laneWeights())
+	assert.Equal(defaultPriorityClass, none.name(0))
+}
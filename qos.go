@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// QOSConfig configures how the WRP QualityOfService value of an event changes
+// the way it is queued and delivered.
+type QOSConfig struct {
+	// Enabled turns on QOS aware queueing and delivery.  When a queue is full,
+	// the lowest QOS events are dropped first to make room.
+	Enabled bool
+
+	// DeliveryRetries is the number of delivery retries for events of each
+	// QOS level (low, medium, high, critical).  Levels not listed use the
+	// sender's deliveryRetries.
+	DeliveryRetries map[string]int
+
+	// SurviveCutOff is the lowest QOS level whose events are kept through a
+	// cut off and delivered once it ends instead of being dropped.
+	// (Optional) when empty, every event is dropped on cut off.
+	SurviveCutOff string
+}
+
+// qosPolicy is the compiled form of QOSConfig.  A nil policy ignores QOS.
+type qosPolicy struct {
+	retries        map[wrp.QOSLevel]int
+	survive        wrp.QOSLevel
+	surviveCutOffs bool
+}
+
+func newQOSPolicy(c QOSConfig) (*qosPolicy, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	p := &qosPolicy{
+		retries: make(map[wrp.QOSLevel]int),
+	}
+	for name, retries := range c.DeliveryRetries {
+		level, err := parseQOSLevel(name)
+		if nil != err {
+			return nil, fmt.Errorf("qos delivery retries: %w", err)
+		}
+		if retries < 0 {
+			return nil, fmt.Errorf("qos delivery retries for '%s' must not be negative", name)
+		}
+		p.retries[level] = retries
+	}
+
+	if "" != c.SurviveCutOff {
+		level, err := parseQOSLevel(c.SurviveCutOff)
+		if nil != err {
+			return nil, fmt.Errorf("qos survive cut off: %w", err)
+		}
+		p.survive = level
+		p.surviveCutOffs = true
+	}
+
+	return p, nil
+}
+
+// deliveryRetries returns the number of retries to use for msg, falling back
+// to retries when the policy has nothing to say about its level.
+func (p *qosPolicy) deliveryRetries(msg *wrp.Message, retries int) int {
+	if nil == p {
+		return retries
+	}
+	if r, ok := p.retries[msg.QualityOfService.Level()]; ok {
+		return r
+	}
+	return retries
+}
+
+// survivesCutOff reports whether msg should be held through a cut off.
+func (p *qosPolicy) survivesCutOff(msg *wrp.Message) bool {
+	if nil == p || !p.surviveCutOffs {
+		return false
+	}
+	return msg.QualityOfService.Level() >= p.survive
+}
+
+// enabled reports whether QOS aware queueing is on.
+func (p *qosPolicy) enabled() bool {
+	return nil != p
+}
+
+// qosLabel is the metric label value for the QOS level of msg.
+func qosLabel(msg *wrp.Message) string {
+	return strings.ToLower(msg.QualityOfService.Level().String())
+}
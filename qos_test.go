@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestNewQOSPolicy(t *testing.T) {
+	tests := []struct {
+		desc      string
+		config    QOSConfig
+		expectNil bool
+		expectErr bool
+	}{
+		{
+			desc:      "disabled",
+			config:    QOSConfig{DeliveryRetries: map[string]int{"bogus": 1}},
+			expectNil: true,
+		},
+		{
+			desc:   "valid",
+			config: QOSConfig{Enabled: true, DeliveryRetries: map[string]int{"critical": 5}, SurviveCutOff: "high"},
+		},
+		{
+			desc:      "bad retries level",
+			config:    QOSConfig{Enabled: true, DeliveryRetries: map[string]int{"urgent": 5}},
+			expectErr: true,
+		},
+		{
+			desc:      "negative retries",
+			config:    QOSConfig{Enabled: true, DeliveryRetries: map[string]int{"low": -1}},
+			expectErr: true,
+		},
+		{
+			desc:      "bad survive level",
+			config:    QOSConfig{Enabled: true, SurviveCutOff: "urgent"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			p, err := newQOSPolicy(tc.config)
+			if tc.expectErr {
+				assert.Error(err)
+				assert.Nil(p)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expectNil, nil == p)
+		})
+	}
+}
+
+func TestQOSPolicy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	p, err := newQOSPolicy(QOSConfig{
+		Enabled:         true,
+		DeliveryRetries: map[string]int{"high": 3, "critical": 5},
+		SurviveCutOff:   "high",
+	})
+	require.NoError(err)
+	assert.True(p.enabled())
+
+	low := &wrp.Message{QualityOfService: wrp.QOSLowValue}
+	medium := &wrp.Message{QualityOfService: wrp.QOSMediumValue}
+	high := &wrp.Message{QualityOfService: wrp.QOSHighValue}
+	critical := &wrp.Message{QualityOfService: 99}
+
+	assert.Equal(1, p.deliveryRetries(low, 1))
+	assert.Equal(1, p.deliveryRetries(medium, 1))
+	assert.Equal(3, p.deliveryRetries(high, 1))
+	assert.Equal(5, p.deliveryRetries(critical, 1))
+
+	assert.False(p.survivesCutOff(low))
+	assert.False(p.survivesCutOff(medium))
+	assert.True(p.survivesCutOff(high))
+	assert.True(p.survivesCutOff(critical))
+
+	assert.Equal("low", qosLabel(low))
+	assert.Equal("critical", qosLabel(critical))
+
+	// A nil policy ignores QOS.
+	var none *qosPolicy
+	assert.False(none.enabled())
+	assert.Equal(2, none.deliveryRetries(critical, 2))
+	assert.False(none.survivesCutOff(critical))
+}
@@ -0,0 +1,344 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// defaultRedactionMask replaces masked payload values unless configured
+// otherwise.
+const defaultRedactionMask = "[REDACTED]"
+
+var errEmptyRedactionRule = errors.New("redaction rule must drop, hash, mask or strip something")
+
+// RedactionRule removes or obscures event data before it's delivered to the
+// webhooks it selects, so data can be minimized for each consumer without
+// changing the devices that produce it.  Every rule that selects a webhook
+// applies, in order.
+type RedactionRule struct {
+	// Name identifies the rule in errors.
+	Name string
+
+	// PartnerIDs selects webhooks registered with any of these partner ids.
+	// (Optional)
+	PartnerIDs []string
+
+	// URLs selects webhooks with a URL matching any of these regular
+	// expressions.  A rule with neither PartnerIDs nor URLs selects every
+	// webhook.  (Optional)
+	URLs []string
+
+	// DropMetadata lists metadata keys removed from events.  (Optional)
+	DropMetadata []string
+
+	// HashMetadata lists metadata keys whose values are replaced with their
+	// hex SHA-256, so consumers can still correlate events.  (Optional)
+	HashMetadata []string
+
+	// HashKey makes HashMetadata use HMAC-SHA256 with this key, so the
+	// hashes of short values like MAC addresses can't be reversed by trying
+	// them all.  (Optional)
+	HashKey string
+
+	// MaskPayload lists paths, in the same syntax as payload predicates, of
+	// JSON payload values replaced with Mask.  Payloads that aren't JSON are
+	// removed, since there's no telling what they hold.  (Optional)
+	MaskPayload []string
+
+	// Mask replaces masked payload values.
+	// (Optional) defaults to "[REDACTED]".
+	Mask string
+
+	// StripHeaders lists WRP headers removed from events, by the name before
+	// their first ':', ignoring case.  (Optional)
+	StripHeaders []string
+}
+
+type redactionRule struct {
+	name         string
+	partnerIDs   []string
+	urls         []*regexp.Regexp
+	dropMetadata []string
+	hashMetadata []string
+	hashKey      []byte
+	maskPayload  [][]pathStep
+	mask         string
+	stripHeaders []string
+}
+
+// redactionRules picks the rules that apply to each webhook.  A nil
+// redactionRules has no rules.
+type redactionRules struct {
+	rules []*redactionRule
+}
+
+// newRedactionRules compiles the configured rules.  No rules results in a
+// nil redactionRules.
+func newRedactionRules(config []RedactionRule) (*redactionRules, error) {
+	if 0 == len(config) {
+		return nil, nil
+	}
+
+	rr := &redactionRules{
+		rules: make([]*redactionRule, 0, len(config)),
+	}
+	for _, c := range config {
+		if 0 == len(c.DropMetadata)+len(c.HashMetadata)+len(c.MaskPayload)+len(c.StripHeaders) {
+			return nil, fmt.Errorf("redaction rule '%s': %w", c.Name, errEmptyRedactionRule)
+		}
+
+		r := &redactionRule{
+			name:         c.Name,
+			partnerIDs:   c.PartnerIDs,
+			dropMetadata: c.DropMetadata,
+			hashMetadata: c.HashMetadata,
+			mask:         c.Mask,
+		}
+		if "" != c.HashKey {
+			r.hashKey = []byte(c.HashKey)
+		}
+		if "" == r.mask {
+			r.mask = defaultRedactionMask
+		}
+
+		for _, u := range c.URLs {
+			re, err := regexp.Compile(u)
+			if nil != err {
+				return nil, fmt.Errorf("redaction rule '%s': invalid url regex '%s': %w", c.Name, u, err)
+			}
+			r.urls = append(r.urls, re)
+		}
+
+		for _, p := range c.MaskPayload {
+			path, err := parsePayloadPath(p)
+			if nil != err {
+				return nil, fmt.Errorf("redaction rule '%s': invalid payload path '%s': %w", c.Name, p, err)
+			}
+			r.maskPayload = append(r.maskPayload, path)
+		}
+
+		for _, h := range c.StripHeaders {
+			r.stripHeaders = append(r.stripHeaders, strings.ToLower(h))
+		}
+
+		rr.rules = append(rr.rules, r)
+	}
+	return rr, nil
+}
+
+// lookup returns the redactor for a webhook, which is nil when no rule
+// selects it.
+func (rr *redactionRules) lookup(wh ancla.InternalWebhook) redactor {
+	if nil == rr {
+		return nil
+	}
+
+	var r redactor
+	for _, rule := range rr.rules {
+		if rule.selects(wh) {
+			r = append(r, rule)
+		}
+	}
+	return r
+}
+
+// selects reports whether the rule applies to wh.
+func (r *redactionRule) selects(wh ancla.InternalWebhook) bool {
+	if 0 == len(r.partnerIDs) && 0 == len(r.urls) {
+		return true
+	}
+	if overlaps(r.partnerIDs, wh.PartnerIDs) {
+		return true
+	}
+	for _, re := range r.urls {
+		if re.MatchString(wh.Webhook.Config.URL) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactor is the list of rules that apply to a webhook.  A nil redactor
+// leaves events alone.
+type redactor []*redactionRule
+
+// redact returns e with the rules applied.  Events are shared by every
+// sender they fan out to, so a redacted copy is returned when a rule
+// changes something and e itself otherwise.
+func (r redactor) redact(e *outboundEvent) *outboundEvent {
+	if 0 == len(r) {
+		return e
+	}
+
+	msg := *e.Message
+	if nil != msg.Metadata {
+		msg.Metadata = make(map[string]string, len(e.Metadata))
+		for k, v := range e.Metadata {
+			msg.Metadata[k] = v
+		}
+	}
+
+	changed := false
+	for _, rule := range r {
+		if rule.apply(&msg) {
+			changed = true
+		}
+	}
+	if !changed {
+		return e
+	}
+	return newOutboundEvent(&msg, nil)
+}
+
+// apply redacts msg in place and reports whether anything changed.  The
+// metadata must already be a copy, the headers and payload are replaced
+// rather than modified.
+func (r *redactionRule) apply(msg *wrp.Message) bool {
+	changed := false
+
+	for _, k := range r.dropMetadata {
+		if _, ok := msg.Metadata[k]; ok {
+			delete(msg.Metadata, k)
+			changed = true
+		}
+	}
+
+	for _, k := range r.hashMetadata {
+		if v, ok := msg.Metadata[k]; ok {
+			msg.Metadata[k] = r.hash(v)
+			changed = true
+		}
+	}
+
+	if 0 < len(r.stripHeaders) && 0 < len(msg.Headers) {
+		headers := make([]string, 0, len(msg.Headers))
+		for _, h := range msg.Headers {
+			if !r.strips(h) {
+				headers = append(headers, h)
+			}
+		}
+		if len(headers) != len(msg.Headers) {
+			msg.Headers = headers
+			changed = true
+		}
+	}
+
+	if 0 < len(r.maskPayload) && 0 < len(msg.Payload) {
+		if payload, masked := r.maskJSON(msg); masked {
+			msg.Payload = payload
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func (r *redactionRule) hash(v string) string {
+	if nil == r.hashKey {
+		sum := sha256.Sum256([]byte(v))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// strips reports whether the WRP header h is one of the stripped headers.
+func (r *redactionRule) strips(h string) bool {
+	name := h
+	if i := strings.IndexByte(h, ':'); 0 <= i {
+		name = h[:i]
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, s := range r.stripHeaders {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// maskJSON returns msg's payload with the masked values replaced, and
+// whether that changed it.  A payload that isn't JSON can't be masked, so
+// it's dropped and nil is returned.
+func (r *redactionRule) maskJSON(msg *wrp.Message) ([]byte, bool) {
+	if !isJSONContentType(msg.ContentType) {
+		return nil, true
+	}
+
+	var payload interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msg.Payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); nil != err {
+		return nil, true
+	}
+
+	masked := false
+	for _, path := range r.maskPayload {
+		var m bool
+		payload, m = maskPath(payload, path, r.mask)
+		masked = masked || m
+	}
+	if !masked {
+		return msg.Payload, false
+	}
+
+	b, err := json.Marshal(payload)
+	if nil != err {
+		return nil, true
+	}
+	return b, true
+}
+
+// maskPath replaces the values path selects from v with mask, the same
+// values selectPath would return, and reports whether it replaced any.
+func maskPath(v interface{}, path []pathStep, mask string) (interface{}, bool) {
+	if 0 == len(path) {
+		return mask, true
+	}
+
+	step, rest := path[0], path[1:]
+	masked := false
+	replace := func(member interface{}) interface{} {
+		member, m := maskPath(member, rest, mask)
+		masked = masked || m
+		return member
+	}
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if !step.field {
+			break
+		}
+		if "" == step.name {
+			for k, member := range node {
+				node[k] = replace(member)
+			}
+		} else if member, ok := node[step.name]; ok {
+			node[step.name] = replace(member)
+		}
+	case []interface{}:
+		if step.field && "" != step.name {
+			break
+		}
+		if step.index < 0 {
+			for i, member := range node {
+				node[i] = replace(member)
+			}
+		} else if step.index < len(node) {
+			node[step.index] = replace(node[step.index])
+		}
+	}
+	return v, masked
+}
@@ -0,0 +1,244 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func redactionTestWebhook(url string, partnerIDs ...string) ancla.InternalWebhook {
+	wh := ancla.InternalWebhook{PartnerIDs: partnerIDs}
+	wh.Webhook.Config.URL = url
+	return wh
+}
+
+func redactionTestEvent() *outboundEvent {
+	return newOutboundEvent(&wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "mac:112233445566",
+		Destination: "event:device-status",
+		ContentType: wrp.MimeTypeJson,
+		Headers:     []string{"X-Region: east", "X-Account:1234", "flag"},
+		Metadata: map[string]string{
+			"/hw-model":   "TG1682",
+			"/hw-serial":  "ABC123",
+			"/wan-mac":    "112233445566",
+			"/fw-version": "1.2.3",
+		},
+		Payload: []byte(`{"id":"abc","user":{"name":"Sam","email":"sam@example.com"},"clients":[{"mac":"aa","rssi":-40},{"mac":"bb","rssi":-50}],"count":2}`),
+	}, []byte("received"))
+}
+
+func TestRedactionRules(t *testing.T) {
+	assert := assert.New(t)
+
+	rr, err := newRedactionRules([]RedactionRule{
+		{
+			Name:         "everyone",
+			DropMetadata: []string{"/hw-serial"},
+		},
+		{
+			Name:         "partner",
+			PartnerIDs:   []string{"acme"},
+			HashMetadata: []string{"/wan-mac"},
+			StripHeaders: []string{"x-account"},
+		},
+		{
+			Name:        "url",
+			URLs:        []string{"^https://third\\.example\\.com/"},
+			MaskPayload: []string{"$.user.email", "$.clients[*].mac"},
+		},
+	})
+	require.NoError(t, err)
+
+	var names []string
+	for _, r := range rr.lookup(redactionTestWebhook("https://third.example.com/hook", "comcast", "acme")) {
+		names = append(names, r.name)
+	}
+	assert.Equal([]string{"everyone", "partner", "url"}, names)
+
+	assert.Len(rr.lookup(redactionTestWebhook("https://other.example.com/hook", "comcast")), 1)
+
+	var none *redactionRules
+	assert.Nil(none.lookup(redactionTestWebhook("https://third.example.com/hook", "acme")))
+}
+
+func TestRedact(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rr, err := newRedactionRules([]RedactionRule{
+		{
+			DropMetadata: []string{"/hw-serial", "/missing"},
+			HashMetadata: []string{"/wan-mac"},
+			StripHeaders: []string{"X-ACCOUNT", "flag"},
+			MaskPayload:  []string{"$.user.email", "$.clients[*].mac", "$.nothing"},
+		},
+	})
+	require.NoError(err)
+
+	e := redactionTestEvent()
+	redacted := rr.lookup(redactionTestWebhook("https://example.com")).redact(e)
+	require.NotSame(e, redacted)
+
+	sum := sha256.Sum256([]byte("112233445566"))
+	assert.Equal(map[string]string{
+		"/hw-model":   "TG1682",
+		"/wan-mac":    hex.EncodeToString(sum[:]),
+		"/fw-version": "1.2.3",
+	}, redacted.Metadata)
+	assert.Equal([]string{"X-Region: east"}, redacted.Headers)
+	assert.JSONEq(`{"id":"abc","user":{"name":"Sam","email":"[REDACTED]"},"clients":[{"mac":"[REDACTED]","rssi":-40},{"mac":"[REDACTED]","rssi":-50}],"count":2}`, string(redacted.Payload))
+	assert.Nil(redacted.raw)
+
+	// The shared event is left alone.
+	original := redactionTestEvent()
+	assert.Equal(original.Metadata, e.Metadata)
+	assert.Equal(original.Headers, e.Headers)
+	assert.Equal(original.Payload, e.Payload)
+	assert.Equal([]byte("received"), e.raw)
+}
+
+func TestRedactHashKey(t *testing.T) {
+	rr, err := newRedactionRules([]RedactionRule{
+		{HashMetadata: []string{"/wan-mac"}, HashKey: "secret"},
+	})
+	require.NoError(t, err)
+
+	redacted := rr.lookup(redactionTestWebhook("https://example.com")).redact(redactionTestEvent())
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("112233445566"))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), redacted.Metadata["/wan-mac"])
+}
+
+func TestRedactPayload(t *testing.T) {
+	tests := []struct {
+		desc        string
+		contentType string
+		payload     string
+		paths       []string
+		mask        string
+		expected    string
+	}{
+		{
+			desc:        "wildcard field",
+			contentType: wrp.MimeTypeJson,
+			payload:     `{"a":{"x":1,"y":2},"b":3}`,
+			paths:       []string{"$.a.*"},
+			expected:    `{"a":{"x":"[REDACTED]","y":"[REDACTED]"},"b":3}`,
+		},
+		{
+			desc:        "index and custom mask",
+			contentType: "application/vnd.device+json",
+			payload:     `{"list":["a","b","c"]}`,
+			paths:       []string{"$.list[1]", "$.list[7]"},
+			mask:        "***",
+			expected:    `{"list":["a","***","c"]}`,
+		},
+		{
+			desc:        "whole payload",
+			contentType: wrp.MimeTypeJson,
+			payload:     `{"a":1}`,
+			paths:       []string{"$"},
+			expected:    `"[REDACTED]"`,
+		},
+		{
+			desc:        "path through the wrong type",
+			contentType: wrp.MimeTypeJson,
+			payload:     `{"a":[1,2],"b":{"0":1}}`,
+			paths:       []string{"$.a.name", "$.b[0]"},
+			expected:    `{"a":[1,2],"b":{"0":1}}`,
+		},
+		{
+			desc:        "big numbers survive",
+			contentType: wrp.MimeTypeJson,
+			payload:     `{"id":12345678901234567890,"secret":"x"}`,
+			paths:       []string{"$.secret"},
+			expected:    `{"id":12345678901234567890,"secret":"[REDACTED]"}`,
+		},
+		{
+			desc:        "not json",
+			contentType: "text/plain",
+			payload:     `email=sam@example.com`,
+			paths:       []string{"$.email"},
+		},
+		{
+			desc:        "invalid json",
+			contentType: wrp.MimeTypeJson,
+			payload:     `{"email":`,
+			paths:       []string{"$.email"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr, err := newRedactionRules([]RedactionRule{{MaskPayload: tc.paths, Mask: tc.mask}})
+			require.NoError(t, err)
+
+			e := newOutboundEvent(&wrp.Message{ContentType: tc.contentType, Payload: []byte(tc.payload)}, nil)
+			redacted := rr.lookup(redactionTestWebhook("https://example.com")).redact(e)
+			if "" == tc.expected {
+				assert.Empty(t, redacted.Payload)
+				return
+			}
+			assert.JSONEq(t, tc.expected, string(redacted.Payload))
+		})
+	}
+}
+
+func TestRedactUnchanged(t *testing.T) {
+	rr, err := newRedactionRules([]RedactionRule{
+		{DropMetadata: []string{"/missing"}, StripHeaders: []string{"x-missing"}, MaskPayload: []string{"$.user"}},
+	})
+	require.NoError(t, err)
+
+	// Nothing to redact leaves the shared event and its encodings alone.
+	e := redactionTestEvent()
+	e.Payload = nil
+	assert.Same(t, e, rr.lookup(redactionTestWebhook("https://example.com")).redact(e))
+
+	// Neither does a JSON payload without the masked paths, whose bytes
+	// would otherwise be reformatted.
+	e = redactionTestEvent()
+	e.Payload = []byte(`{"name": "sam",  "id": 1}`)
+	assert.Same(t, e, rr.lookup(redactionTestWebhook("https://example.com")).redact(e))
+
+	var none redactor
+	assert.Same(t, e, none.redact(e))
+}
+
+func TestRedactionRulesInvalid(t *testing.T) {
+	tests := []struct {
+		desc      string
+		config    []RedactionRule
+		expectErr error
+	}{
+		{desc: "nothing to do", config: []RedactionRule{{Name: "empty", PartnerIDs: []string{"acme"}}}, expectErr: errEmptyRedactionRule},
+		{desc: "bad url regex", config: []RedactionRule{{Name: "bad", URLs: []string{"[[:123"}, DropMetadata: []string{"/a"}}}},
+		{desc: "bad payload path", config: []RedactionRule{{Name: "bad", MaskPayload: []string{"user.email"}}}, expectErr: errPayloadPath},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr, err := newRedactionRules(tc.config)
+			assert.Nil(t, rr)
+			require.Error(t, err)
+			if nil != tc.expectErr {
+				assert.ErrorIs(t, err, tc.expectErr)
+			}
+		})
+	}
+
+	rr, err := newRedactionRules(nil)
+	assert.Nil(t, rr)
+	assert.NoError(t, err)
+}
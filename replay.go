@@ -0,0 +1,214 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// replayPollInterval is how often a replay waiting for room in a sender's
+// queue checks again.
+const replayPollInterval = 10 * time.Millisecond
+
+var (
+	errInvalidReplay     = errors.New("invalid replay")
+	errReplayNotFound    = errors.New("webhook not found")
+	errReplayUnavailable = errors.New("webhook is cut off or expired")
+)
+
+// ReplayRequest is the body of a replay request.  The events retained from
+// From up to To are delivered again to the webhooks registered for URL.
+// To defaults to now.
+type ReplayRequest struct {
+	URL  string    `json:"url"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// ReplayResult is the response to a replay request.  Each retained event is
+// offered to every registration for the URL: Replayed counts the times one
+// was queued for delivery, and Skipped the times a registration's partner
+// ids, events, matchers or profile turned one down.
+type ReplayResult struct {
+	Replayed int `json:"replayed"`
+	Skipped  int `json:"skipped"`
+}
+
+// eventReplayer queues retained events for delivery again.  It is
+// implemented by CaduceusOutboundSender.
+type eventReplayer interface {
+	replay(ctx context.Context, msg *outboundEvent) (bool, error)
+}
+
+// replaySenders finds the senders that replayed events are queued on.  It is
+// implemented by CaduceusSenderWrapper.
+type replaySenders interface {
+	replaySenders(url string, partnerIDs []string) []eventReplayer
+}
+
+// replay queues a retained event for delivery again if the webhook accepts
+// it, exactly as Queue would, and reports whether it did.  Rather than
+// overflowing the queue, replay waits for room in it until ctx is done.
+func (obs *CaduceusOutboundSender) replay(ctx context.Context, msg *outboundEvent) (bool, error) {
+	if !obs.available() {
+		return false, errReplayUnavailable
+	}
+	if !obs.accepts(msg, true) {
+		return false, nil
+	}
+
+	priority := obs.priorities.lane(msg.Message)
+	for {
+		// Replayed events don't jump ahead of spilled ones.
+		q := obs.queue.Load().(*eventQueue)
+		if 0 < q.room() && 0 == obs.spill.len() {
+			evicted, ok := q.push(msg, priority)
+			switch {
+			case ok && nil != evicted:
+				obs.droppedPriorityCounter.Add(1.0)
+				obs.countQOSDrop(priorityEvictedReason, evicted.Message)
+				return true, nil
+			case ok:
+				obs.queueDepthGauge.Add(1.0)
+				return true, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(replayPollInterval):
+		}
+		if !obs.available() {
+			return false, errReplayUnavailable
+		}
+	}
+}
+
+// available reports whether the webhook is neither cut off nor expired.
+func (obs *CaduceusOutboundSender) available() bool {
+	obs.mutex.RLock()
+	defer obs.mutex.RUnlock()
+	now := time.Now()
+	return !now.Before(obs.dropUntil) && now.Before(obs.deliverUntil)
+}
+
+// replaySenders returns the senders of the registrations for url that share
+// a partner id with partnerIDs, or of all of them when partner ids are
+// disabled.
+func (sw *CaduceusSenderWrapper) replaySenders(url string, partnerIDs []string) []eventReplayer {
+	sw.mutex.RLock()
+	defer sw.mutex.RUnlock()
+
+	var senders []eventReplayer
+	for id, listener := range sw.listeners {
+		if url != listener.Webhook.Config.URL {
+			continue
+		}
+		if !sw.disablePartnerIDs && !overlaps(listener.PartnerIDs, partnerIDs) {
+			continue
+		}
+		if r, ok := sw.senders[id].(eventReplayer); ok {
+			senders = append(senders, r)
+		}
+	}
+	return senders
+}
+
+// replayHandler serves the replay endpoint.  Replays only see the events
+// retained by the instance they're sent to.
+type replayHandler struct {
+	store             *retentionStore
+	senders           replaySenders
+	logger            *zap.Logger
+	disablePartnerIDs bool
+}
+
+func newReplayHandler(store *retentionStore, senders replaySenders, logger *zap.Logger, disablePartnerIDs bool) *replayHandler {
+	return &replayHandler{
+		store:             store,
+		senders:           senders,
+		logger:            logger,
+		disablePartnerIDs: disablePartnerIDs,
+	}
+}
+
+// ServeHTTP handles POST /replay.  The response is sent once every event
+// has been queued, so a large replay takes as long as the webhook needs to
+// work through all but the last queue full of it.
+func (h *replayHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	var rr ReplayRequest
+	if err := json.NewDecoder(request.Body).Decode(&rr); nil != err {
+		h.respond(response, http.StatusBadRequest, fmt.Errorf("%w: %v", errInvalidReplay, err))
+		return
+	}
+	if rr.To.IsZero() {
+		rr.To = time.Now()
+	}
+	if "" == rr.URL || rr.From.IsZero() || !rr.From.Before(rr.To) {
+		h.respond(response, http.StatusBadRequest, fmt.Errorf("%w: url and a from before to are required", errInvalidReplay))
+		return
+	}
+
+	partnerIDs, err := streamPartnerIDs(request)
+	if nil != err && !h.disablePartnerIDs {
+		h.respond(response, http.StatusBadRequest, err)
+		return
+	}
+
+	senders := h.senders.replaySenders(rr.URL, partnerIDs)
+	if 0 == len(senders) {
+		h.respond(response, http.StatusNotFound, errReplayNotFound)
+		return
+	}
+
+	var (
+		result    ReplayResult
+		replayErr error
+	)
+	err = h.store.scan(request.Context(), rr.From, rr.To, func(e retainedEvent) bool {
+		for _, s := range senders {
+			var queued bool
+			if queued, replayErr = s.replay(request.Context(), e.msg); nil != replayErr {
+				return false
+			}
+			if queued {
+				result.Replayed++
+			} else {
+				result.Skipped++
+			}
+		}
+		return true
+	})
+	if nil == err {
+		err = replayErr
+	}
+	switch {
+	case errors.Is(err, errReplayUnavailable):
+		h.respond(response, http.StatusConflict, err)
+		return
+	case nil != err:
+		h.logger.Error("replay failed", zap.String("url", rr.URL), zap.Error(err))
+		h.respond(response, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.logger.Info("events replayed", zap.String("url", rr.URL), zap.Time("from", rr.From), zap.Time("to", rr.To),
+		zap.Int("replayed", result.Replayed), zap.Int("skipped", result.Skipped))
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(result)
+}
+
+func (h *replayHandler) respond(response http.ResponseWriter, code int, err error) {
+	h.logger.Debug("replay request failed", zap.Int("code", code), zap.Error(err))
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(code)
+	json.NewEncoder(response).Encode(map[string]string{"message": err.Error()})
+}
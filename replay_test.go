@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/ancla"
+	"go.uber.org/zap"
+)
+
+// fixedReplaySenders replays to the same senders whatever the request.
+type fixedReplaySenders []eventReplayer
+
+func (f fixedReplaySenders) replaySenders(string, []string) []eventReplayer {
+	return f
+}
+
+// replayableSender is an OutboundSender that accepts every replayed event.
+type replayableSender struct {
+	nopSender
+}
+
+func (replayableSender) replay(context.Context, *outboundEvent) (bool, error) {
+	return true, nil
+}
+
+func replayRequest(t *testing.T, h http.Handler, body string) (int, ReplayResult) {
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/api/v4/replay", strings.NewReader(body)))
+
+	var result ReplayResult
+	if http.StatusOK == response.Code {
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+	}
+	return response.Code, result
+}
+
+// Replayed events go through the webhook's filters and are signed like any
+// other, and a replay bigger than the queue waits for room rather than
+// cutting the webhook off.
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		mutex     sync.Mutex
+		delivered []string
+	)
+	trans := &transport{}
+	trans.fn = func(req *http.Request, _ int) (*http.Response, error) {
+		assert.NotEmpty(req.Header.Get("X-Webpa-Signature"))
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		delivered = append(delivered, req.Header.Get("X-Webpa-Transaction-Id"))
+		mutex.Unlock()
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.NumWorkers = 1
+	obsf.QueueSize = 2
+	obs, err := obsf.New()
+	require.NoError(err)
+	cos := obs.(*CaduceusOutboundSender)
+
+	store, err := newRetentionStore(RetentionConfig{Enabled: true, Dir: t.TempDir()}, discard.NewCounter(), zap.NewNop())
+	require.NoError(err)
+	defer store.close()
+
+	from := time.Now()
+	var expected []string
+	for i := 0; i < 8; i++ {
+		msg := simpleRequestWithPartnerIDs()
+		msg.TransactionUUID = fmt.Sprintf("%02d", i)
+		msg.Destination = "event:iot"
+		if 0 == i%4 {
+			// Not one of the webhook's events.
+			msg.Destination = "event:other"
+		} else {
+			expected = append(expected, msg.TransactionUUID)
+		}
+		store.retain(newOutboundEvent(msg, nil))
+	}
+	to := time.Now().Add(time.Millisecond)
+	settle(t, store)
+
+	h := newReplayHandler(store, fixedReplaySenders{cos}, zap.NewNop(), true)
+	code, result := replayRequest(t, h, fmt.Sprintf(`{"url": %q, "from": %q, "to": %q}`,
+		cos.id, from.Format(time.RFC3339Nano), to.Format(time.RFC3339Nano)))
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(ReplayResult{Replayed: 6, Skipped: 2}, result)
+
+	obs.Shutdown(true)
+	assert.Equal(expected, delivered)
+	assert.True(cos.dropUntil.IsZero())
+}
+
+func TestReplayHandlerErrors(t *testing.T) {
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	defer obs.Shutdown(false)
+	cos := obs.(*CaduceusOutboundSender)
+
+	store, err := newRetentionStore(RetentionConfig{Enabled: true, Dir: t.TempDir()}, discard.NewCounter(), zap.NewNop())
+	require.NoError(t, err)
+	defer store.close()
+
+	from := time.Now()
+	store.retain(newOutboundEvent(simpleRequestWithPartnerIDs(), nil))
+	settle(t, store)
+	valid := fmt.Sprintf(`{"url": %q, "from": %q}`, cos.id, from.Format(time.RFC3339Nano))
+
+	tests := []struct {
+		desc     string
+		senders  fixedReplaySenders
+		body     string
+		cutOff   bool
+		expected int
+	}{
+		{desc: "invalid body", senders: fixedReplaySenders{cos}, body: `{`, expected: http.StatusBadRequest},
+		{desc: "no from", senders: fixedReplaySenders{cos}, body: fmt.Sprintf(`{"url": %q}`, cos.id), expected: http.StatusBadRequest},
+		{
+			desc:     "to before from",
+			senders:  fixedReplaySenders{cos},
+			body:     fmt.Sprintf(`{"url": %q, "from": %q, "to": %q}`, cos.id, from.Format(time.RFC3339Nano), from.Add(-time.Minute).Format(time.RFC3339Nano)),
+			expected: http.StatusBadRequest,
+		},
+		{desc: "unknown webhook", body: valid, expected: http.StatusNotFound},
+		{desc: "cut off", senders: fixedReplaySenders{cos}, body: valid, cutOff: true, expected: http.StatusConflict},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.cutOff {
+				cos.mutex.Lock()
+				cos.dropUntil = time.Now().Add(time.Minute)
+				cos.mutex.Unlock()
+			}
+
+			h := newReplayHandler(store, tc.senders, zap.NewNop(), true)
+			code, _ := replayRequest(t, h, tc.body)
+			assert.Equal(t, tc.expected, code)
+		})
+	}
+}
+
+func TestReplaySenders(t *testing.T) {
+	assert := assert.New(t)
+
+	const url = "http://localhost:9999/foo"
+	a, b, c := &replayableSender{}, &replayableSender{}, &replayableSender{}
+	webhook := func(url string, partnerIDs ...string) ancla.InternalWebhook {
+		return ancla.InternalWebhook{
+			Webhook:    ancla.Webhook{Config: ancla.DeliveryConfig{URL: url}},
+			PartnerIDs: partnerIDs,
+		}
+	}
+	sw := &CaduceusSenderWrapper{
+		senders: map[string]OutboundSender{
+			"a": a,
+			"b": b,
+			"c": c,
+			"d": nopSender{},
+		},
+		listeners: map[string]ancla.InternalWebhook{
+			"a": webhook(url, "comcast"),
+			"b": webhook(url, "sky"),
+			"c": webhook("http://localhost:8888/foo", "comcast"),
+			"d": webhook(url, "comcast"),
+		},
+	}
+
+	assert.Equal([]eventReplayer{a}, sw.replaySenders(url, []string{"comcast"}))
+	assert.Empty(sw.replaySenders(url, []string{"other"}))
+
+	sw.disablePartnerIDs = true
+	assert.ElementsMatch([]eventReplayer{a, b}, sw.replaySenders(url, nil))
+}
+
+func TestReplayWaitsForRoom(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	trans := &transport{}
+	trans.fn = func(*http.Request, int) (*http.Response, error) {
+		<-block
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.NumWorkers = 1
+	obsf.QueueSize = 1
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	cos := obs.(*CaduceusOutboundSender)
+
+	msg := func() *outboundEvent {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = "event:iot"
+		return newOutboundEvent(req, nil)
+	}
+
+	// One in flight, one waiting on the worker and one queued.
+	for i := 0; i < 3; i++ {
+		queued, err := cos.replay(context.Background(), msg())
+		assert.True(queued)
+		assert.NoError(err)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	queued, err := cos.replay(ctx, msg())
+	assert.False(queued)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.True(cos.dropUntil.IsZero())
+
+	close(block)
+	obs.Shutdown(true)
+
+	queued, err = cos.replay(context.Background(), msg())
+	assert.False(queued)
+	assert.ErrorIs(err, errReplayUnavailable)
+}
@@ -0,0 +1,483 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRetentionWindow          = time.Hour
+	defaultRetentionSegmentDuration = 5 * time.Minute
+	defaultRetentionMaxBytes        = 1 << 30
+	defaultRetentionQueueSize       = 10000
+
+	// retentionSegmentExt ends the names of segment files, which start with
+	// the time their first event was retained at, in unix nanoseconds.
+	retentionSegmentExt = ".events"
+
+	// retentionRecordHeader is the size of the time and length in front of
+	// each retained event.
+	retentionRecordHeader = 12
+)
+
+var errNoRetentionDir = errors.New("retention dir is required")
+
+// RetentionConfig configures keeping the events caduceus accepts on local
+// disk for a while, so they can be replayed to webhooks that missed them.
+type RetentionConfig struct {
+	// Enabled retains events and adds the replay endpoint to the primary
+	// router.
+	Enabled bool
+
+	// Dir is the directory events are retained in.  Retained events survive
+	// restarts, so it must not be shared with other caduceus instances.
+	Dir string
+
+	// Window is how long events are retained.
+	// (Optional) defaults to 1h.
+	Window time.Duration
+
+	// SegmentDuration is the span of time each segment file covers.  Events
+	// are removed a segment at a time once all of them are older than the
+	// window.  (Optional) defaults to 5m.
+	SegmentDuration time.Duration
+
+	// MaxBytes limits the disk space retained events use.  The oldest
+	// segments are removed early to stay under it.
+	// (Optional) defaults to 1GiB.
+	MaxBytes int64
+
+	// QueueSize is the number of events waiting to be written to disk.
+	// Events are written in the background so a slow disk doesn't hold up
+	// the events coming in, and those that don't fit are dropped from the
+	// store, though they're still delivered.
+	// (Optional) defaults to 10000.
+	QueueSize int
+}
+
+// retentionStore keeps accepted events in a series of append only segment
+// files, each holding the events retained over SegmentDuration.  Events are
+// queued for a background writer.  A nil retentionStore retains nothing.
+type retentionStore struct {
+	mutex           sync.Mutex
+	dir             string
+	window          time.Duration
+	segmentDuration time.Duration
+	segmentBytes    int64
+	maxBytes        int64
+	segments        []*retentionSegment
+	bytes           int64
+	logger          *zap.Logger
+	closed          bool
+
+	pending chan retentionRecord
+	stop    chan struct{}
+	done    chan struct{}
+	dropped metrics.Counter
+
+	// backlog is the number of events queued and not yet written.
+	backlog atomic.Int64
+}
+
+// retentionRecord is an event waiting to be written, encoded as msgpack.
+type retentionRecord struct {
+	at time.Time
+	b  []byte
+}
+
+// retentionSegment is one of the files of a retentionStore.  Only the last
+// segment is open, for appending.
+type retentionSegment struct {
+	path  string
+	start time.Time
+	last  time.Time
+	size  int64
+	file  *os.File
+}
+
+// retainedEvent is an event read back from a retentionStore.
+type retainedEvent struct {
+	at  time.Time
+	msg *outboundEvent
+}
+
+// newRetentionStore opens the store in the configured directory, picking up
+// the events retained before a restart, and starts its writer.  Events that
+// don't fit in its queue are counted by dropped.  It returns nil when
+// retention isn't enabled.
+func newRetentionStore(c RetentionConfig, dropped metrics.Counter, logger *zap.Logger) (*retentionStore, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	if "" == c.Dir {
+		return nil, errNoRetentionDir
+	}
+	if c.Window < 0 || c.SegmentDuration < 0 || c.MaxBytes < 0 || c.QueueSize < 0 {
+		return nil, errors.New("retention window, segment duration, max bytes and queue size must not be negative")
+	}
+	if 0 == c.QueueSize {
+		c.QueueSize = defaultRetentionQueueSize
+	}
+
+	s := &retentionStore{
+		dir:             c.Dir,
+		window:          c.Window,
+		segmentDuration: c.SegmentDuration,
+		maxBytes:        c.MaxBytes,
+		logger:          logger,
+		pending:         make(chan retentionRecord, c.QueueSize),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+		dropped:         dropped,
+	}
+	if 0 == s.window {
+		s.window = defaultRetentionWindow
+	}
+	if 0 == s.segmentDuration {
+		s.segmentDuration = defaultRetentionSegmentDuration
+	}
+	if 0 == s.maxBytes {
+		s.maxBytes = defaultRetentionMaxBytes
+	}
+	// Segments are also cut by size so removing the oldest one gives back
+	// a useful share of the disk budget.
+	s.segmentBytes = s.maxBytes / 8
+
+	if err := os.MkdirAll(s.dir, 0o700); nil != err {
+		return nil, err
+	}
+	if err := s.load(); nil != err {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.prune(time.Now())
+	s.mutex.Unlock()
+
+	go s.writer()
+	return s, nil
+}
+
+// load finds the segments in the store's directory.  A segment cut short by
+// a crash is truncated after its last whole event.
+func (s *retentionStore) load() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+retentionSegmentExt))
+	if nil != err {
+		return err
+	}
+
+	for _, name := range names {
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), retentionSegmentExt), 10, 64)
+		if nil != err {
+			continue
+		}
+
+		seg := &retentionSegment{
+			path:  name,
+			start: time.Unix(0, nanos),
+		}
+		if err = seg.recover(); nil != err {
+			return fmt.Errorf("loading retained events from '%s': %w", name, err)
+		}
+		if 0 == seg.size {
+			os.Remove(name)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.bytes += seg.size
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].start.Before(s.segments[j].start)
+	})
+	return nil
+}
+
+// recover finds the time of the segment's last event and its size up to the
+// end of that event, dropping anything after it.
+func (seg *retentionSegment) recover() error {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header [retentionRecordHeader]byte
+	for {
+		if _, err = io.ReadFull(r, header[:]); nil != err {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(header[8:]))
+		if _, err = r.Discard(int(n)); nil != err {
+			break
+		}
+		seg.last = time.Unix(0, int64(binary.BigEndian.Uint64(header[:8])))
+		seg.size += retentionRecordHeader + n
+	}
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return f.Truncate(seg.size)
+}
+
+// retain queues e to be added to the store.  Failing to retain an event
+// doesn't stop it being delivered, so errors are only logged, and events are
+// dropped rather than waiting when the queue is full.
+func (s *retentionStore) retain(e *outboundEvent) {
+	if nil == s {
+		return
+	}
+
+	// Senders may still change the event as they accept it, so its shared
+	// encoding is left for them.
+	b := e.raw
+	if nil == b {
+		if err := wrp.NewEncoderBytes(&b, wrp.Msgpack).Encode(e.Message); nil != err {
+			s.logger.Error("unable to encode event for retention", zap.Error(err))
+			return
+		}
+	}
+
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+
+	s.backlog.Add(1)
+	select {
+	case s.pending <- retentionRecord{at: time.Now(), b: b}:
+	default:
+		s.backlog.Add(-1)
+		s.dropped.Add(1.0)
+		s.logger.Debug("retention queue full. event not retained", zap.String("event.source", e.Source), zap.String("event.destination", e.Destination))
+	}
+}
+
+// writer writes the queued events until the store is closed, then writes
+// what's left in the queue.
+func (s *retentionStore) writer() {
+	defer close(s.done)
+	for {
+		select {
+		case r := <-s.pending:
+			s.store(r)
+		case <-s.stop:
+			for {
+				select {
+				case r := <-s.pending:
+					s.store(r)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// store writes a queued event and prunes what has gone out of the window.
+func (s *retentionStore) store(r retentionRecord) {
+	defer s.backlog.Add(-1)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.write(r.at, r.b); nil != err {
+		s.logger.Error("unable to retain event", zap.String("dir", s.dir), zap.Error(err))
+	}
+	s.prune(r.at)
+}
+
+// write appends an event retained at now to the last segment, starting a
+// new segment when the last one is old or big enough.  s.mutex must be held.
+func (s *retentionStore) write(now time.Time, b []byte) error {
+	n := int64(retentionRecordHeader + len(b))
+
+	var tail *retentionSegment
+	if 0 < len(s.segments) {
+		tail = s.segments[len(s.segments)-1]
+	}
+	if nil == tail || nil == tail.file ||
+		s.segmentDuration <= now.Sub(tail.start) ||
+		(0 < tail.size && s.segmentBytes < tail.size+n) {
+		if nil != tail && nil != tail.file {
+			tail.file.Close()
+			tail.file = nil
+		}
+
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", now.UnixNano(), retentionSegmentExt))
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if nil != err {
+			return err
+		}
+		tail = &retentionSegment{path: path, start: now, file: f}
+		s.segments = append(s.segments, tail)
+	}
+
+	record := make([]byte, n)
+	binary.BigEndian.PutUint64(record, uint64(now.UnixNano()))
+	binary.BigEndian.PutUint32(record[8:], uint32(len(b)))
+	copy(record[retentionRecordHeader:], b)
+	// A failed write is overwritten by the next one.
+	if _, err := tail.file.WriteAt(record, tail.size); nil != err {
+		return err
+	}
+	tail.size += n
+	tail.last = now
+	s.bytes += n
+	return nil
+}
+
+// prune removes the segments whose events are all older than the window,
+// and the oldest ones while the store is over its disk budget.  s.mutex must
+// be held.
+func (s *retentionStore) prune(now time.Time) {
+	cutOff := now.Add(-s.window)
+	for 0 < len(s.segments) {
+		head := s.segments[0]
+		if !head.last.Before(cutOff) && (s.bytes <= s.maxBytes || 1 == len(s.segments)) {
+			return
+		}
+
+		if nil != head.file {
+			head.file.Close()
+		}
+		if err := os.Remove(head.path); nil != err && !os.IsNotExist(err) {
+			s.logger.Error("unable to remove retained events", zap.String("segment", head.path), zap.Error(err))
+		}
+		s.bytes -= head.size
+		s.segments[0] = nil
+		s.segments = s.segments[1:]
+	}
+}
+
+// scan calls fn with each event retained from from up to, but not
+// including, to, oldest first, until fn returns false or ctx is done.
+// Events retained while scanning may or may not be included.
+func (s *retentionStore) scan(ctx context.Context, from, to time.Time, fn func(retainedEvent) bool) error {
+	if nil == s {
+		return nil
+	}
+
+	type snapshot struct {
+		path string
+		size int64
+	}
+	var segments []snapshot
+	s.mutex.Lock()
+	for _, seg := range s.segments {
+		if seg.last.Before(from) || !seg.start.Before(to) {
+			continue
+		}
+		segments = append(segments, snapshot{path: seg.path, size: seg.size})
+	}
+	s.mutex.Unlock()
+
+	for _, seg := range segments {
+		more, err := scanSegment(ctx, seg.path, seg.size, from, to, fn)
+		if nil != err || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanSegment calls fn with the events in the first size bytes of a segment
+// that were retained in [from, to).  It reports whether the scan should go
+// on to the next segment.  A segment pruned in the meantime is skipped.
+func scanSegment(ctx context.Context, path string, size int64, from, to time.Time, fn func(retainedEvent) bool) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if nil != err {
+		return false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.LimitReader(f, size))
+	var header [retentionRecordHeader]byte
+	for {
+		if err = ctx.Err(); nil != err {
+			return false, err
+		}
+		if _, err = io.ReadFull(r, header[:]); nil != err {
+			if errors.Is(err, io.EOF) {
+				return true, nil
+			}
+			return false, err
+		}
+
+		at := time.Unix(0, int64(binary.BigEndian.Uint64(header[:8])))
+		n := int(binary.BigEndian.Uint32(header[8:]))
+		if at.Before(from) {
+			if _, err = r.Discard(n); nil != err {
+				return false, err
+			}
+			continue
+		}
+		if !at.Before(to) {
+			return false, nil
+		}
+
+		b := make([]byte, n)
+		if _, err = io.ReadFull(r, b); nil != err {
+			return false, err
+		}
+		var msg wrp.Message
+		if err = wrp.NewDecoderBytes(b, wrp.Msgpack).Decode(&msg); nil != err {
+			return false, fmt.Errorf("decoding retained event: %w", err)
+		}
+		if !fn(retainedEvent{at: at, msg: newOutboundEvent(&msg, b)}) {
+			return false, nil
+		}
+	}
+}
+
+// close stops retaining events once the queued ones are written.  The
+// retained events stay on disk for the next start.
+func (s *retentionStore) close() error {
+	if nil == s {
+		return nil
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mutex.Unlock()
+
+	close(s.stop)
+	<-s.done
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if 0 < len(s.segments) {
+		if tail := s.segments[len(s.segments)-1]; nil != tail.file {
+			err := tail.file.Close()
+			tail.file = nil
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+func retentionTestEvent(i int) *outboundEvent {
+	return newOutboundEvent(&wrp.Message{
+		Type:            wrp.SimpleEventMessageType,
+		Source:          "mac:112233445566/lmlite",
+		Destination:     "event:iot",
+		TransactionUUID: fmt.Sprintf("%04d", i),
+		PartnerIDs:      []string{"comcast"},
+	}, nil)
+}
+
+// settle waits for the events queued in s to be written.
+func settle(t *testing.T, s *retentionStore) {
+	require.Eventually(t, func() bool { return 0 == s.backlog.Load() }, time.Second, time.Millisecond)
+}
+
+// scanned returns the transaction uuids of the events retained in [from, to).
+func scanned(t *testing.T, s *retentionStore, from, to time.Time) []string {
+	var ids []string
+	err := s.scan(context.Background(), from, to, func(e retainedEvent) bool {
+		ids = append(ids, e.msg.TransactionUUID)
+		return true
+	})
+	require.NoError(t, err)
+	return ids
+}
+
+func retentionSegments(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+retentionSegmentExt))
+	require.NoError(t, err)
+	return files
+}
+
+func TestRetentionStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	// Small enough that the events span a few segments.
+	s, err := newRetentionStore(RetentionConfig{Enabled: true, Dir: dir, MaxBytes: 8 * 1024}, discard.NewCounter(), zap.NewNop())
+	require.NoError(err)
+
+	start := time.Now()
+	var first, second []string
+	for i := 0; i < 20; i++ {
+		s.retain(retentionTestEvent(i))
+		first = append(first, fmt.Sprintf("%04d", i))
+	}
+	time.Sleep(time.Millisecond)
+	mid := time.Now()
+	for i := 20; i < 40; i++ {
+		s.retain(retentionTestEvent(i))
+		second = append(second, fmt.Sprintf("%04d", i))
+	}
+	end := time.Now().Add(time.Millisecond)
+	settle(t, s)
+
+	assert.Less(1, len(retentionSegments(t, dir)))
+	assert.Equal(append(append([]string{}, first...), second...), scanned(t, s, start, end))
+	assert.Equal(first, scanned(t, s, start, mid))
+	assert.Equal(second, scanned(t, s, mid, end))
+	assert.Empty(scanned(t, s, end, end.Add(time.Hour)))
+
+	// Scans stop when asked to.
+	var ids []string
+	require.NoError(s.scan(context.Background(), start, end, func(e retainedEvent) bool {
+		ids = append(ids, e.msg.TransactionUUID)
+		return len(ids) < 3
+	}))
+	assert.Equal(first[:3], ids)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(s.scan(ctx, start, end, func(retainedEvent) bool { return true }), context.Canceled)
+
+	// Retained events survive a restart, even a crash in the middle of a
+	// write.
+	require.NoError(s.close())
+	segments := retentionSegments(t, dir)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	s, err = newRetentionStore(RetentionConfig{Enabled: true, Dir: dir, MaxBytes: 8 * 1024}, discard.NewCounter(), zap.NewNop())
+	require.NoError(err)
+	defer s.close()
+	s.retain(retentionTestEvent(40))
+	settle(t, s)
+	assert.Equal(append(append(append([]string{}, first...), second...), "0040"), scanned(t, s, start, time.Now().Add(time.Millisecond)))
+}
+
+func TestRetentionStorePrune(t *testing.T) {
+	t.Run("window", func(t *testing.T) {
+		assert := assert.New(t)
+
+		dir := t.TempDir()
+		s, err := newRetentionStore(RetentionConfig{Enabled: true, Dir: dir, Window: 50 * time.Millisecond, SegmentDuration: 10 * time.Millisecond}, discard.NewCounter(), zap.NewNop())
+		require.NoError(t, err)
+		defer s.close()
+
+		start := time.Now()
+		s.retain(retentionTestEvent(0))
+		time.Sleep(100 * time.Millisecond)
+		s.retain(retentionTestEvent(1))
+		settle(t, s)
+
+		assert.Equal([]string{"0001"}, scanned(t, s, start, time.Now().Add(time.Millisecond)))
+		assert.Len(retentionSegments(t, dir), 1)
+	})
+
+	t.Run("max bytes", func(t *testing.T) {
+		assert := assert.New(t)
+
+		dir := t.TempDir()
+		s, err := newRetentionStore(RetentionConfig{Enabled: true, Dir: dir, MaxBytes: 4 * 1024}, discard.NewCounter(), zap.NewNop())
+		require.NoError(t, err)
+		defer s.close()
+
+		start := time.Now()
+		for i := 0; i < 200; i++ {
+			s.retain(retentionTestEvent(i))
+		}
+		settle(t, s)
+
+		assert.LessOrEqual(s.bytes, s.maxBytes)
+		ids := scanned(t, s, start, time.Now().Add(time.Millisecond))
+		assert.Less(len(ids), 200)
+		assert.Equal("0199", ids[len(ids)-1], "the newest events are kept")
+	})
+}
+
+func TestNewRetentionStore(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newRetentionStore(RetentionConfig{Dir: t.TempDir()}, discard.NewCounter(), zap.NewNop())
+	assert.Nil(s)
+	assert.NoError(err)
+
+	// A disabled store does nothing.
+	s.retain(retentionTestEvent(0))
+	assert.NoError(s.scan(context.Background(), time.Time{}, time.Now(), func(retainedEvent) bool {
+		assert.Fail("nothing is retained")
+		return true
+	}))
+	assert.NoError(s.close())
+
+	_, err = newRetentionStore(RetentionConfig{Enabled: true}, discard.NewCounter(), zap.NewNop())
+	assert.ErrorIs(err, errNoRetentionDir)
+
+	_, err = newRetentionStore(RetentionConfig{Enabled: true, Dir: t.TempDir(), Window: -time.Second}, discard.NewCounter(), zap.NewNop())
+	assert.Error(err)
+
+	s, err = newRetentionStore(RetentionConfig{Enabled: true, Dir: t.TempDir()}, discard.NewCounter(), zap.NewNop())
+	require.NoError(t, err)
+	defer s.close()
+	assert.Equal(defaultRetentionWindow, s.window)
+	assert.Equal(defaultRetentionSegmentDuration, s.segmentDuration)
+	assert.Equal(int64(defaultRetentionMaxBytes), s.maxBytes)
+	assert.Equal(defaultRetentionQueueSize, cap(s.pending))
+}
+
+func TestRetentionStoreQueueFull(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dropped := generic.NewCounter("dropped")
+	s, err := newRetentionStore(RetentionConfig{Enabled: true, Dir: t.TempDir(), QueueSize: 1}, dropped, zap.NewNop())
+	require.NoError(err)
+
+	// Hold up the writer so the queue fills up.
+	s.mutex.Lock()
+	start := time.Now()
+	s.retain(retentionTestEvent(0))
+	require.Eventually(func() bool { return 0 == len(s.pending) }, time.Second, time.Millisecond)
+	s.retain(retentionTestEvent(1))
+	s.retain(retentionTestEvent(2))
+	s.mutex.Unlock()
+
+	// Closing writes what was queued.
+	require.NoError(s.close())
+	assert.Equal(1.0, dropped.Value())
+	assert.Zero(s.backlog.Load())
+
+	s, err = newRetentionStore(RetentionConfig{Enabled: true, Dir: s.dir}, discard.NewCounter(), zap.NewNop())
+	require.NoError(err)
+	defer s.close()
+	assert.Equal([]string{"0000", "0001"}, scanned(t, s, start, time.Now()))
+
+	// Nothing is retained once the store is closed.
+	require.NoError(s.close())
+	s.retain(retentionTestEvent(3))
+	assert.Zero(s.backlog.Load())
+}
@@ -0,0 +1,292 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"math/bits"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// senderSet is a set of positions in a routingIndex's senders.
+type senderSet []uint64
+
+func newSenderSet(size int) senderSet {
+	return make(senderSet, (size+63)/64)
+}
+
+func (s senderSet) add(i int) {
+	s[i/64] |= 1 << (uint(i) % 64)
+}
+
+func (s senderSet) union(other senderSet) {
+	for i := range s {
+		s[i] |= other[i]
+	}
+}
+
+func (s senderSet) intersect(other senderSet) {
+	for i := range s {
+		s[i] &= other[i]
+	}
+}
+
+// each calls fn with every position in the set, in order.
+func (s senderSet) each(fn func(int)) {
+	for i, word := range s {
+		for 0 != word {
+			bit := bits.TrailingZeros64(word)
+			fn(i*64 + bit)
+			word &= word - 1
+		}
+	}
+}
+
+// routePattern is an event regular expression along with the senders of every
+// registration that uses it.  Registrations often share patterns, so each
+// distinct pattern is only run once per event.
+type routePattern struct {
+	re *regexp.Regexp
+
+	// literal is text every destination the pattern matches contains, or
+	// starts with when the pattern is anchored.  Destinations without it are
+	// skipped without running the pattern.
+	literal  string
+	anchored bool
+
+	// all is set for patterns that match every destination.
+	all bool
+
+	members senderSet
+}
+
+// prefixNode is a node of the trie of the literal prefixes of the anchored
+// patterns.
+type prefixNode struct {
+	children map[byte]*prefixNode
+	patterns []*routePattern
+}
+
+// routingIndex narrows down the senders an event could go to, so Queue
+// doesn't have to offer every event to every sender.  It is conservative:
+// every sender that would accept an event is a candidate, and the senders
+// still make the final decision.  The index is immutable, Update builds a new
+// one whenever the registrations change.
+type routingIndex struct {
+	senders []OutboundSender
+
+	// everyEvent holds the senders that have to see every event, because
+	// one of their patterns matches everything or doesn't compile.
+	everyEvent senderSet
+
+	prefixes   *prefixNode
+	unanchored []*routePattern
+	patterns   map[string]*routePattern
+
+	// partners maps partner ids to the senders registered for them.  It is
+	// nil when partner ids aren't checked.
+	partners   map[string]senderSet
+	customPIDs []string
+}
+
+// route is what the index needs to know about a registration.
+type route struct {
+	sender   OutboundSender
+	listener ancla.InternalWebhook
+}
+
+// newRoutingIndex builds the index for routes.  Patterns already compiled by
+// prev are reused.
+func newRoutingIndex(prev *routingIndex, routes []route, checkPartnerIDs bool, customPIDs []string) *routingIndex {
+	idx := &routingIndex{
+		senders:    make([]OutboundSender, len(routes)),
+		everyEvent: newSenderSet(len(routes)),
+		prefixes:   &prefixNode{},
+		patterns:   make(map[string]*routePattern),
+		customPIDs: customPIDs,
+	}
+	if checkPartnerIDs {
+		idx.partners = make(map[string]senderSet)
+	}
+
+	for i, r := range routes {
+		idx.senders[i] = r.sender
+
+		if nil != idx.partners {
+			for _, pid := range r.listener.PartnerIDs {
+				set, ok := idx.partners[pid]
+				if !ok {
+					set = newSenderSet(len(routes))
+					idx.partners[pid] = set
+				}
+				set.add(i)
+			}
+		}
+
+		for _, event := range r.listener.Webhook.Events {
+			p, ok := idx.patterns[event]
+			if !ok {
+				p = newRoutePattern(prev, event)
+				if nil == p {
+					// The sender will reject the registration, but it
+					// may still be using an older one.
+					idx.everyEvent.add(i)
+					continue
+				}
+				p.members = newSenderSet(len(routes))
+				idx.patterns[event] = p
+				idx.addPattern(p)
+			}
+			p.members.add(i)
+		}
+	}
+
+	for _, p := range idx.patterns {
+		if p.all {
+			idx.everyEvent.union(p.members)
+		}
+	}
+	return idx
+}
+
+// newRoutePattern compiles and analyzes an event pattern, returning nil if it
+// doesn't compile.
+func newRoutePattern(prev *routingIndex, event string) *routePattern {
+	if nil != prev {
+		if p, ok := prev.patterns[event]; ok {
+			return &routePattern{re: p.re, literal: p.literal, anchored: p.anchored, all: p.all}
+		}
+	}
+
+	re, err := regexp.Compile(event)
+	if nil != err {
+		return nil
+	}
+	p := &routePattern{re: re}
+
+	parsed, err := syntax.Parse(event, syntax.Perl)
+	if nil != err {
+		return nil
+	}
+	parsed = parsed.Simplify()
+
+	switch {
+	case !hasAssertion(parsed) && re.MatchString(""):
+		// Matching the empty string anywhere matches every string.
+		p.all = true
+	case syntax.OpConcat == parsed.Op && syntax.OpBeginText == parsed.Sub[0].Op:
+		p.anchored = true
+		p.literal = literalPrefix(parsed.Sub[1:])
+	default:
+		p.literal, _ = re.LiteralPrefix()
+	}
+	return p
+}
+
+// hasAssertion reports whether re contains anything that only matches at
+// certain positions.
+func hasAssertion(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasAssertion(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// literalPrefix returns the case sensitive literal text subs start with.
+func literalPrefix(subs []*syntax.Regexp) string {
+	var b strings.Builder
+	for _, sub := range subs {
+		if syntax.OpLiteral != sub.Op || 0 != sub.Flags&syntax.FoldCase {
+			break
+		}
+		b.WriteString(string(sub.Rune))
+	}
+	return b.String()
+}
+
+func (idx *routingIndex) addPattern(p *routePattern) {
+	switch {
+	case p.all:
+	case p.anchored:
+		node := idx.prefixes
+		for i := 0; i < len(p.literal); i++ {
+			next, ok := node.children[p.literal[i]]
+			if !ok {
+				if nil == node.children {
+					node.children = make(map[byte]*prefixNode)
+				}
+				next = &prefixNode{}
+				node.children[p.literal[i]] = next
+			}
+			node = next
+		}
+		node.patterns = append(node.patterns, p)
+	default:
+		idx.unanchored = append(idx.unanchored, p)
+	}
+}
+
+// candidates returns the senders msg could go to.
+func (idx *routingIndex) candidates(msg *wrp.Message) senderSet {
+	dest := strings.TrimPrefix(msg.Destination, "event:")
+
+	set := newSenderSet(len(idx.senders))
+	set.union(idx.everyEvent)
+
+	match := func(p *routePattern) {
+		if p.re.MatchString(dest) {
+			set.union(p.members)
+		}
+	}
+
+	// Only the anchored patterns whose prefix dest starts with can match.
+	node := idx.prefixes
+	for i := 0; nil != node; i++ {
+		for _, p := range node.patterns {
+			match(p)
+		}
+		if i == len(dest) {
+			break
+		}
+		node = node.children[dest[i]]
+	}
+
+	for _, p := range idx.unanchored {
+		if strings.Contains(dest, p.literal) {
+			match(p)
+		}
+	}
+
+	if nil != idx.partners {
+		pids := msg.PartnerIDs
+		if 0 == len(pids) {
+			pids = idx.customPIDs
+		}
+		partners := newSenderSet(len(idx.senders))
+		for _, pid := range pids {
+			if s, ok := idx.partners[pid]; ok {
+				partners.union(s)
+			}
+		}
+		set.intersect(partners)
+	}
+	return set
+}
+
+// queue offers msg to every sender it could go to.
+func (idx *routingIndex) queue(msg *outboundEvent) {
+	idx.candidates(msg.Message).each(func(i int) {
+		idx.senders[i].Queue(msg)
+	})
+}
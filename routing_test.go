@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+func TestRoutePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		all      bool
+		anchored bool
+		literal  string
+	}{
+		{pattern: ".*", all: true},
+		{pattern: "", all: true},
+		{pattern: "a*", all: true},
+		{pattern: "^.*", anchored: true},
+		{pattern: "iot", literal: "iot"},
+		{pattern: "device-status/.*/online", literal: "device-status/"},
+		{pattern: "^device-status/.*", anchored: true, literal: "device-status/"},
+		{pattern: "^(?i)device", anchored: true},
+		{pattern: "^$", anchored: true},
+		{pattern: "(?m)^iot"},
+		{pattern: "online$", literal: "online"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.pattern, func(t *testing.T) {
+			assert := assert.New(t)
+			p := newRoutePattern(nil, tc.pattern)
+			require.NotNil(t, p)
+			assert.Equal(tc.all, p.all)
+			assert.Equal(tc.anchored, p.anchored)
+			assert.Equal(tc.literal, p.literal)
+		})
+	}
+
+	assert.Nil(t, newRoutePattern(nil, "[[:123"))
+}
+
+// nopSender is an OutboundSender that ignores everything.
+type nopSender struct{}
+
+func (nopSender) URL() string                        { return "" }
+func (nopSender) Update(ancla.InternalWebhook) error { return nil }
+func (nopSender) Shutdown(bool)                      {}
+func (nopSender) Retire(time.Duration)               {}
+func (nopSender) RetiredSince() time.Time            { return time.Time{} }
+func (nopSender) Queue(*outboundEvent)               {}
+
+func TestRoutingIndexCandidates(t *testing.T) {
+	listeners := []ancla.InternalWebhook{
+		{Webhook: ancla.Webhook{Events: []string{".*"}}, PartnerIDs: []string{"comcast"}},
+		{Webhook: ancla.Webhook{Events: []string{"iot"}}, PartnerIDs: []string{"comcast", "sky"}},
+		{Webhook: ancla.Webhook{Events: []string{"^device-status/.*/online"}}, PartnerIDs: []string{"sky"}},
+		{Webhook: ancla.Webhook{Events: []string{"^device-status/.*/offline", "iot"}}, PartnerIDs: []string{"comcast"}},
+		{Webhook: ancla.Webhook{Events: []string{"^device"}}, PartnerIDs: []string{"comcast"}},
+		{Webhook: ancla.Webhook{Events: []string{"^$"}}, PartnerIDs: []string{"comcast"}},
+		{Webhook: ancla.Webhook{Events: []string{"(?i)IOT"}}, PartnerIDs: []string{"comcast"}},
+		{Webhook: ancla.Webhook{Events: []string{"[[:123"}}, PartnerIDs: []string{"sky"}},
+	}
+	destinations := []string{
+		"event:iot",
+		"event:device-status/mac:112233445566/online",
+		"event:device-status/mac:112233445566/offline",
+		"event:device",
+		"event:",
+		"mac:112233445566/event/iot",
+		"event:node-change",
+	}
+	partnerIDs := [][]string{nil, {"comcast"}, {"sky"}, {"comcast", "sky"}, {"other"}}
+
+	routes := make([]route, len(listeners))
+	for i, l := range listeners {
+		routes[i] = route{sender: nopSender{}, listener: l}
+	}
+
+	// What a sender would decide, an invalid pattern sees everything.
+	expected := func(l ancla.InternalWebhook, msg *wrp.Message, checkPartnerIDs bool, customPIDs []string) bool {
+		if checkPartnerIDs {
+			pids := msg.PartnerIDs
+			if 0 == len(pids) {
+				pids = customPIDs
+			}
+			if !overlaps(l.PartnerIDs, pids) {
+				return false
+			}
+		}
+		for _, event := range l.Webhook.Events {
+			re, err := regexp.Compile(event)
+			if nil != err || re.MatchString(strings.TrimPrefix(msg.Destination, "event:")) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, checkPartnerIDs := range []bool{true, false} {
+		idx := newRoutingIndex(nil, routes, checkPartnerIDs, []string{"sky"})
+		for _, dest := range destinations {
+			for _, pids := range partnerIDs {
+				msg := &wrp.Message{Destination: dest, PartnerIDs: pids}
+
+				var got []int
+				idx.candidates(msg).each(func(i int) { got = append(got, i) })
+
+				var want []int
+				for i, l := range listeners {
+					if expected(l, msg, checkPartnerIDs, idx.customPIDs) {
+						want = append(want, i)
+					}
+				}
+				assert.Equal(t, want, got, "destination %q, partner ids %v, checked %v", dest, pids, checkPartnerIDs)
+			}
+		}
+	}
+}
+
+func TestRoutingIndexReusesPatterns(t *testing.T) {
+	assert := assert.New(t)
+
+	routes := []route{{sender: nopSender{}, listener: ancla.InternalWebhook{Webhook: ancla.Webhook{Events: []string{"iot"}}}}}
+	first := newRoutingIndex(nil, routes, false, nil)
+	second := newRoutingIndex(first, routes, false, nil)
+	assert.Same(first.patterns["iot"].re, second.patterns["iot"].re)
+	assert.NotSame(first.patterns["iot"], second.patterns["iot"])
+}
+
+func TestSenderSet(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newSenderSet(130)
+	for _, i := range []int{0, 63, 64, 129} {
+		a.add(i)
+	}
+	b := newSenderSet(130)
+	for _, i := range []int{1, 64, 129} {
+		b.add(i)
+	}
+
+	var got []int
+	a.each(func(i int) { got = append(got, i) })
+	assert.Equal([]int{0, 63, 64, 129}, got)
+
+	a.intersect(b)
+	got = nil
+	a.each(func(i int) { got = append(got, i) })
+	assert.Equal([]int{64, 129}, got)
+
+	a.union(b)
+	got = nil
+	a.each(func(i int) { got = append(got, i) })
+	assert.Equal([]int{1, 64, 129}, got)
+}
+
+// discardTransport is a Transport that accepts everything.
+type discardTransport struct{}
+
+func (discardTransport) Deliver(*ring.Ring, string, string, *outboundEvent) (string, error) {
+	return "200", nil
+}
+
+func (discardTransport) Close() error {
+	return nil
+}
+
+// newFanOutWrapper returns a sender wrapper with n registrations.  Most have
+// their own patterns, some share one and a few want every event.
+func newFanOutWrapper(b *testing.B, n int) *CaduceusSenderWrapper {
+	registry, err := xmetrics.NewRegistry(nil, Metrics)
+	require.NoError(b, err)
+
+	sw, err := SenderWrapperFactory{
+		NumWorkersPerSender: 1,
+		QueueSizePerSender:  1000,
+		CutOffPeriod:        time.Second,
+		Linger:              time.Hour,
+		MetricsRegistry:     registry,
+		Logger:              zap.NewNop(),
+		Sender:              doerFunc(http.DefaultClient.Do),
+		Transports: TransportRegistry{
+			"http": func(*CaduceusOutboundSender) (Transport, error) { return discardTransport{}, nil },
+		},
+	}.New()
+	require.NoError(b, err)
+
+	list := make([]ancla.InternalWebhook, n)
+	for i := range list {
+		var event string
+		switch {
+		case 0 == i%50:
+			event = ".*"
+		case 0 == i%3:
+			event = fmt.Sprintf("^device-status/mac:%012x/online", i)
+		case 1 == i%3:
+			event = fmt.Sprintf("node-change-%d", i)
+		default:
+			event = "device-status/.*/offline"
+		}
+		list[i] = ancla.InternalWebhook{
+			Webhook: ancla.Webhook{
+				Config: ancla.DeliveryConfig{
+					URL:         fmt.Sprintf("http://localhost/%d", i),
+					ContentType: wrp.MimeTypeJson,
+				},
+				Events: []string{event},
+				Until:  time.Now().Add(time.Hour),
+			},
+			PartnerIDs: []string{fmt.Sprintf("partner-%d", i%100)},
+		}
+	}
+	sw.Update(list)
+	csw := sw.(*CaduceusSenderWrapper)
+	require.Len(b, csw.senders, n)
+	return csw
+}
+
+func BenchmarkFanOut(b *testing.B) {
+	sw := newFanOutWrapper(b, 10000)
+	defer sw.Shutdown(false)
+
+	msg := &wrp.Message{
+		Type:            wrp.SimpleEventMessageType,
+		Source:          "mac:000000000003",
+		Destination:     "event:device-status/mac:000000000003/online",
+		TransactionUUID: "1234",
+		ContentType:     wrp.MimeTypeJson,
+		PartnerIDs:      []string{"partner-3"},
+	}
+
+	// scan is what Queue used to do, offer the event to every sender.
+	b.Run("scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sw.mutex.RLock()
+			for _, v := range sw.senders {
+				v.Queue(newOutboundEvent(msg, nil))
+			}
+			sw.mutex.RUnlock()
+		}
+	})
+
+	b.Run("indexed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sw.Queue(newOutboundEvent(msg, nil))
+		}
+	})
+}
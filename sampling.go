@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+var errSampleRate = errors.New("sampling rate must be more than 0 and at most 1")
+
+// SamplingConfig delivers a statistical sample of the events a webhook would
+// otherwise receive, for consumers that don't need every event.
+type SamplingConfig struct {
+	// Rate is the fraction of events delivered, more than 0 and at most 1.
+	Rate float64
+
+	// ByDevice samples devices instead of events: every event of a sampled
+	// device is delivered and none of the others.  Which devices are sampled
+	// only depends on their id and the rate, so it doesn't change between
+	// events, restarts or instances.  (Optional)
+	ByDevice bool
+}
+
+// eventSampler picks the events that are sampled in.  A nil sampler samples
+// in every event.
+type eventSampler struct {
+	// threshold is the rate scaled to the uint64 range, what device hashes
+	// are compared against.
+	threshold uint64
+	rate      float64
+	byDevice  bool
+}
+
+// newEventSampler compiles c.  A rate of 1 samples in everything and results
+// in a nil sampler.
+func newEventSampler(c SamplingConfig) (*eventSampler, error) {
+	if !(0 < c.Rate && c.Rate <= 1) {
+		return nil, errSampleRate
+	}
+	if 1 == c.Rate {
+		return nil, nil
+	}
+	return &eventSampler{
+		threshold: uint64(c.Rate * math.MaxUint64),
+		rate:      c.Rate,
+		byDevice:  c.ByDevice,
+	}, nil
+}
+
+// sampled reports whether msg is sampled in.
+func (s *eventSampler) sampled(msg *wrp.Message) bool {
+	if nil == s {
+		return true
+	}
+	if !s.byDevice {
+		return rand.Float64() < s.rate
+	}
+
+	id := msg.Source
+	if parsed, err := device.ParseID(msg.Source); nil == err {
+		id = string(parsed)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return mix64(h.Sum64()) < s.threshold
+}
+
+// mix64 is the murmur3 finalizer.  FNV leaves the high bits of ids that only
+// differ at the end, like consecutive MACs, close together, and it's the
+// high bits that are compared against the threshold.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
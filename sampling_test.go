@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func samplingTestMessage(i int) *wrp.Message {
+	return &wrp.Message{
+		Source:      fmt.Sprintf("mac:%012x/service-%d", i, i%3),
+		Destination: "event:device-status",
+	}
+}
+
+func TestEventSampler(t *testing.T) {
+	const events = 20000
+
+	tests := []struct {
+		desc     string
+		config   SamplingConfig
+		expected float64
+	}{
+		{desc: "uniform", config: SamplingConfig{Rate: 0.25}, expected: 0.25},
+		{desc: "by device", config: SamplingConfig{Rate: 0.1, ByDevice: true}, expected: 0.1},
+		{desc: "everything", config: SamplingConfig{Rate: 1}, expected: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			s, err := newEventSampler(tc.config)
+			require.NoError(t, err)
+
+			in := 0
+			for i := 0; i < events; i++ {
+				if s.sampled(samplingTestMessage(i)) {
+					in++
+				}
+			}
+			assert.InDelta(t, tc.expected, float64(in)/events, 0.02)
+		})
+	}
+}
+
+func TestEventSamplerByDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newEventSampler(SamplingConfig{Rate: 0.5, ByDevice: true})
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		msg := samplingTestMessage(i)
+		expected := s.sampled(msg)
+
+		// Every event of a device gets the same answer, whichever service it
+		// comes from.
+		for j := 0; j < 5; j++ {
+			other := samplingTestMessage(i)
+			other.Source = fmt.Sprintf("mac:%012x/other-%d", i, j)
+			assert.Equal(expected, s.sampled(other), msg.Source)
+		}
+
+		// And so does a sampler built the same way somewhere else.
+		again, err := newEventSampler(SamplingConfig{Rate: 0.5, ByDevice: true})
+		require.NoError(t, err)
+		assert.Equal(expected, again.sampled(msg))
+	}
+
+	// Consecutive ids don't all land on the same side.
+	in := 0
+	for i := 0; i < 20; i++ {
+		if s.sampled(samplingTestMessage(i)) {
+			in++
+		}
+	}
+	assert.InDelta(10, in, 6)
+
+	// Devices sampled at a rate are also sampled at any higher rate.
+	higher, err := newEventSampler(SamplingConfig{Rate: 0.75, ByDevice: true})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		if s.sampled(samplingTestMessage(i)) {
+			assert.True(higher.sampled(samplingTestMessage(i)))
+		}
+	}
+}
+
+func TestEventSamplerInvalid(t *testing.T) {
+	for _, rate := range []float64{0, -0.5, 1.5} {
+		s, err := newEventSampler(SamplingConfig{Rate: rate})
+		assert.Nil(t, s)
+		assert.ErrorIs(t, err, errSampleRate)
+	}
+
+	var none *eventSampler
+	assert.True(t, none.sampled(samplingTestMessage(0)))
+}
@@ -3,13 +3,16 @@
 package main
 
 import (
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/metrics"
 	"github.com/xmidt-org/ancla"
-	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/webpa-common/v2/semaphore"
 	"go.uber.org/zap"
 )
 
@@ -54,11 +57,65 @@ type SenderWrapperFactory struct {
 
 	// DisablePartnerIDs dictates whether or not to enforce the partner ID check.
 	DisablePartnerIDs bool
+
+	// OrderedDelivery makes every OutboundSender deliver each device's events
+	// sequentially.
+	OrderedDelivery bool
+
+	// PriorityClasses splits each OutboundSender's queue into priority lanes,
+	// listed from highest priority to lowest.
+	PriorityClasses []PriorityClass
+
+	// QOS configures how the WRP QualityOfService of events affects their
+	// queueing and delivery.
+	QOS QOSConfig
+
+	// Transports maps destination URL schemes to the transports that deliver
+	// to them.  (Optional) defaults to DefaultTransports().
+	Transports TransportRegistry
+
+	// RemovalGracePeriod is how long the OutboundSender of a webhook that is
+	// no longer registered gets to deliver the events it has queued before
+	// they are dropped.  Zero drops them right away.
+	RemovalGracePeriod time.Duration
+
+	// ShareURLWorkers makes registrations that target the same URL share
+	// one pool of NumWorkersPerSender delivery workers, so adding
+	// registrations doesn't add load on the URL.
+	ShareURLWorkers bool
+
+	// Profiles configures options for the webhooks registered for matching
+	// URLs.
+	Profiles []WebhookProfile
+
+	// Redaction is the list of rules that redact events for the webhooks
+	// and streams they select.
+	Redaction []RedactionRule
+
+	// Verification configures the handshake webhooks go through before
+	// events are delivered to them.
+	Verification VerificationConfig
+
+	// ExpiryWarning configures the warning webhooks get before their
+	// registration expires.
+	ExpiryWarning ExpiryWarningConfig
+
+	// Notifications configures how cut off, recovery and expiry
+	// notifications are sent.
+	Notifications NotificationConfig
+
+	// Spill configures spilling the events that don't fit in a sender's
+	// queue to disk.
+	Spill SpillConfig
+
+	// Retention keeps the queued events so they can be replayed.  When nil,
+	// events aren't retained.
+	Retention *retentionStore
 }
 
 type SenderWrapper interface {
 	Update([]ancla.InternalWebhook)
-	Queue(*wrp.Message)
+	Queue(*outboundEvent)
 	Shutdown(bool)
 }
 
@@ -71,16 +128,37 @@ type CaduceusSenderWrapper struct {
 	deliveryInterval    time.Duration
 	cutOffPeriod        time.Duration
 	linger              time.Duration
+	removalGracePeriod  time.Duration
 	logger              *zap.Logger
 	mutex               sync.RWMutex
 	senders             map[string]OutboundSender
+	listeners           map[string]ancla.InternalWebhook
+	labels              map[string]string
+	index               *routingIndex
+	streams             map[string]OutboundSender
 	metricsRegistry     CaduceusMetricsRegistry
 	eventType           metrics.Counter
+	removedCounter      metrics.Counter
+	rejectedCounter     metrics.Counter
+	rejected            map[string]struct{}
 	queryLatency        metrics.Histogram
 	wg                  sync.WaitGroup
 	shutdown            chan struct{}
 	customPIDs          []string
 	disablePartnerIDs   bool
+	orderedDelivery     bool
+	priorities          *priorityClassifier
+	qos                 *qosPolicy
+	transports          TransportRegistry
+	shareURLWorkers     bool
+	urlWorkers          map[string]semaphore.Interface
+	profiles            *webhookProfiles
+	redaction           *redactionRules
+	verification        *verificationPolicy
+	expiryWarning       ExpiryWarningConfig
+	notifications       *notificationPolicy
+	spill               *spillPolicy
+	retention           *retentionStore
 }
 
 // New produces a new SenderWrapper implemented by CaduceusSenderWrapper
@@ -94,10 +172,16 @@ func (swf SenderWrapperFactory) New() (sw SenderWrapper, err error) {
 		deliveryInterval:    swf.DeliveryInterval,
 		cutOffPeriod:        swf.CutOffPeriod,
 		linger:              swf.Linger,
+		removalGracePeriod:  swf.RemovalGracePeriod,
 		logger:              swf.Logger,
 		metricsRegistry:     swf.MetricsRegistry,
 		customPIDs:          swf.CustomPIDs,
 		disablePartnerIDs:   swf.DisablePartnerIDs,
+		orderedDelivery:     swf.OrderedDelivery,
+		transports:          swf.Transports,
+		shareURLWorkers:     swf.ShareURLWorkers,
+		expiryWarning:       swf.ExpiryWarning,
+		retention:           swf.Retention,
 	}
 
 	if swf.Linger <= 0 {
@@ -106,10 +190,53 @@ func (swf SenderWrapperFactory) New() (sw SenderWrapper, err error) {
 		return
 	}
 
+	if caduceusSenderWrapper.priorities, err = newPriorityClassifier(swf.PriorityClasses); nil != err {
+		sw = nil
+		return
+	}
+
+	if caduceusSenderWrapper.qos, err = newQOSPolicy(swf.QOS); nil != err {
+		sw = nil
+		return
+	}
+
+	if caduceusSenderWrapper.profiles, err = newWebhookProfiles(swf.Profiles); nil != err {
+		sw = nil
+		return
+	}
+
+	if caduceusSenderWrapper.redaction, err = newRedactionRules(swf.Redaction); nil != err {
+		sw = nil
+		return
+	}
+
+	if caduceusSenderWrapper.verification, err = newVerificationPolicy(swf.Verification); nil != err {
+		sw = nil
+		return
+	}
+
+	if caduceusSenderWrapper.notifications, err = newNotificationPolicy(swf.Notifications); nil != err {
+		sw = nil
+		return
+	}
+
+	if caduceusSenderWrapper.spill, err = newSpillPolicy(swf.Spill); nil != err {
+		sw = nil
+		return
+	}
+
 	caduceusSenderWrapper.queryLatency = NewMetricWrapperMeasures(swf.MetricsRegistry)
 	caduceusSenderWrapper.eventType = swf.MetricsRegistry.NewCounter(IncomingEventTypeCounter)
+	caduceusSenderWrapper.removedCounter = swf.MetricsRegistry.NewCounter(WebhookRemovedCounter)
+	caduceusSenderWrapper.rejectedCounter = swf.MetricsRegistry.NewCounter(WebhookRejectedCounter)
+	caduceusSenderWrapper.rejected = make(map[string]struct{})
 
 	caduceusSenderWrapper.senders = make(map[string]OutboundSender)
+	caduceusSenderWrapper.listeners = make(map[string]ancla.InternalWebhook)
+	caduceusSenderWrapper.labels = make(map[string]string)
+	caduceusSenderWrapper.reindex()
+	caduceusSenderWrapper.streams = make(map[string]OutboundSender)
+	caduceusSenderWrapper.urlWorkers = make(map[string]semaphore.Interface)
 	caduceusSenderWrapper.shutdown = make(chan struct{})
 
 	caduceusSenderWrapper.wg.Add(1)
@@ -120,66 +247,349 @@ func (swf SenderWrapperFactory) New() (sw SenderWrapper, err error) {
 }
 
 // Update is called when we get changes to our webhook listeners with either
-// additions, or updates.  This code takes care of building new OutboundSenders
-// and maintaining the existing OutboundSenders.
+// additions, updates or removals.  This code takes care of building new
+// OutboundSenders, maintaining the existing OutboundSenders and retiring the
+// ones whose webhooks are no longer in the list.  OutboundSenders are kept
+// per registration, see registrationID, so registrations that share a URL
+// don't overwrite each other.  A registration that replaces another one for
+// the same URL and partner ids takes over its OutboundSender, so changing the
+// secret or filters keeps the queue, cut off and verification state.
 func (sw *CaduceusSenderWrapper) Update(list []ancla.InternalWebhook) {
 	// We'll like need this, so let's get one ready
-	osf := OutboundSenderFactory{
-		Sender:            sw.sender,
-		CutOffPeriod:      sw.cutOffPeriod,
-		NumWorkers:        sw.numWorkersPerSender,
-		QueueSize:         sw.queueSizePerSender,
-		MetricsRegistry:   sw.metricsRegistry,
-		DeliveryRetries:   sw.deliveryRetries,
-		DeliveryInterval:  sw.deliveryInterval,
-		Logger:            sw.logger,
-		CustomPIDs:        sw.customPIDs,
-		DisablePartnerIDs: sw.disablePartnerIDs,
-		QueryLatency:      sw.queryLatency,
-	}
+	osf := sw.outboundSenderFactory()
 
 	ids := make([]struct {
 		Listener ancla.InternalWebhook
 		ID       string
 	}, len(list))
 
+	current := make(map[string]struct{}, len(list))
 	for i, v := range list {
 		ids[i].Listener = v
-		ids[i].ID = v.Webhook.Config.URL
+		ids[i].ID = registrationID(v)
+		current[ids[i].ID] = struct{}{}
 	}
 
 	sw.mutex.Lock()
-	defer sw.mutex.Unlock()
-
 	for _, inValue := range ids {
 		sender, ok := sw.senders[inValue.ID]
 		if !ok {
+			if prev, found := sw.replaced(inValue.Listener, current); found {
+				sender = sw.senders[prev]
+				sw.senders[inValue.ID] = sender
+				sw.listeners[inValue.ID] = sw.listeners[prev]
+				sw.labels[inValue.ID] = sw.labels[prev]
+				delete(sw.senders, prev)
+				delete(sw.listeners, prev)
+				delete(sw.labels, prev)
+				ok = true
+			}
+		}
+		if !ok {
+			url := inValue.Listener.Webhook.Config.URL
+			label := sw.metricsLabel(url, inValue.ID)
 			osf.Listener = inValue.Listener
-			metricWrapper, err := newMetricWrapper(time.Now, osf.QueryLatency.With("url", inValue.ID))
+			osf.SharedWorkers = sw.sharedWorkers(url)
+			osf.MetricsLabel = label
+			metricWrapper, err := newMetricWrapper(time.Now, osf.QueryLatency.With("url", label))
 
 			if err != nil {
 				continue
 			}
 			osf.ClientMiddleware = metricWrapper.roundTripper
 			obs, err := osf.New()
-			if nil == err {
-				sw.senders[inValue.ID] = obs
+			if nil != err {
+				sw.reject(inValue.ID, url, err)
+				continue
 			}
+			sw.senders[inValue.ID] = obs
+			sw.listeners[inValue.ID] = inValue.Listener
+			sw.labels[inValue.ID] = label
+			continue
+		}
+		// A sender that rejects an update keeps going with what it had, so
+		// route to it that way too.
+		if err := sender.Update(inValue.Listener); nil != err {
+			sw.reject(inValue.ID, inValue.Listener.Webhook.Config.URL, err)
+			continue
+		}
+		sw.listeners[inValue.ID] = inValue.Listener
+	}
+	for k := range sw.rejected {
+		if _, ok := current[k]; !ok {
+			delete(sw.rejected, k)
+		}
+	}
+
+	// Stop sending events to the senders of webhooks that have gone away
+	// right away, but shut them down outside of the lock.
+	removed := make(map[string]OutboundSender)
+	for k, v := range sw.senders {
+		if _, ok := current[k]; !ok {
+			removed[k] = v
+			delete(sw.senders, k)
+			delete(sw.listeners, k)
+			delete(sw.labels, k)
+		}
+	}
+	sw.pruneSharedWorkers()
+	sw.reindex()
+	sw.mutex.Unlock()
+
+	for k, v := range removed {
+		sw.logger.Info("webhook removed", zap.String("id", k), zap.String("url", v.URL()), zap.Duration("gracePeriod", sw.removalGracePeriod))
+		sw.removedCounter.With("url", v.URL()).Add(1)
+		go v.Retire(sw.removalGracePeriod)
+	}
+}
+
+// reject logs and counts a registration that couldn't be applied.  The
+// registration keeps coming back with every update until it is fixed or
+// removed, so it's only counted the first time.  The caller must hold the
+// mutex.
+func (sw *CaduceusSenderWrapper) reject(id, url string, err error) {
+	if _, ok := sw.rejected[id]; ok {
+		return
+	}
+	sw.rejected[id] = struct{}{}
+
+	reason := rejectionReason(err)
+	sw.logger.Error("webhook registration rejected", zap.String("url", url), zap.String("reason", reason), zap.Error(err))
+	sw.rejectedCounter.With("url", url, "reason", reason).Add(1)
+}
+
+// rejectionReason returns the reason label for a registration rejected with
+// err.
+func rejectionReason(err error) string {
+	switch {
+	case errors.Is(err, errInvalidFailureURL):
+		return invalidFailureURLReason
+	case errors.Is(err, errInvalidEvents):
+		return invalidEventsReason
+	case errors.Is(err, errInvalidMatcher):
+		return invalidMatcherReason
+	case errors.Is(err, errInvalidAltURL):
+		return invalidAltURLReason
+	case errors.Is(err, errTemplateRender), errors.Is(err, errTemplateNotJSON):
+		return invalidProfileReason
+	case errors.Is(err, errUnsupportedScheme):
+		return unsupportedSchemeReason
+	case errors.Is(err, errUnverifiable):
+		return unverifiableReason
+	}
+	return invalidReason
+}
+
+// reindex rebuilds the routing index from the current senders.  The caller
+// must hold the mutex.
+func (sw *CaduceusSenderWrapper) reindex() {
+	routes := make([]route, 0, len(sw.senders))
+	for k, v := range sw.senders {
+		routes = append(routes, route{sender: v, listener: sw.listeners[k]})
+	}
+	sw.index = newRoutingIndex(sw.index, routes, !sw.disablePartnerIDs, sw.customPIDs)
+}
+
+// registrationID identifies a webhook registration.  Registrations for the
+// same URL are separate registrations when they differ in partner ids,
+// filters or secret.  Everything else about a registration, like its
+// expiration, can be updated in place.
+func registrationID(iw ancla.InternalWebhook) string {
+	h := sha256.New()
+	field := func(values ...string) {
+		for _, v := range sortedCopy(values) {
+			fmt.Fprintf(h, "%d:%s", len(v), v)
+		}
+		h.Write([]byte{0})
+	}
+
+	field(iw.Webhook.Config.URL)
+	field(iw.Webhook.Config.Secret)
+	field(iw.PartnerIDs...)
+	field(iw.Webhook.Events...)
+	field(iw.Webhook.Matcher.DeviceID...)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// replaced finds the registration that iw replaces: one for the same URL and
+// partner ids that isn't in the current list anymore.  When there are several,
+// one with the same events is preferred, and ties go to the lowest
+// registration id so every instance picks the same one.  The caller must hold
+// the mutex.
+func (sw *CaduceusSenderWrapper) replaced(iw ancla.InternalWebhook, current map[string]struct{}) (string, bool) {
+	partners := sortedCopy(iw.PartnerIDs)
+	var candidates []string
+	for k, v := range sw.listeners {
+		if _, ok := current[k]; ok {
 			continue
 		}
-		sender.Update(inValue.Listener)
+		if v.Webhook.Config.URL == iw.Webhook.Config.URL && sameURLs(sortedCopy(v.PartnerIDs), partners) {
+			candidates = append(candidates, k)
+		}
+	}
+	if 0 == len(candidates) {
+		return "", false
+	}
+
+	sort.Strings(candidates)
+	events := sortedCopy(iw.Webhook.Events)
+	for _, k := range candidates {
+		if sameURLs(sortedCopy(sw.listeners[k].Webhook.Events), events) {
+			return k, true
+		}
+	}
+	return candidates[0], true
+}
+
+func sortedCopy(values []string) []string {
+	values = append([]string{}, values...)
+	sort.Strings(values)
+	return values
+}
+
+// metricsLabel returns the url label of the metrics of a new sender for the
+// registration id.  That's the URL, unless another registration's sender
+// already uses it, then the start of the registration id is added to keep
+// their metrics apart.  The caller must hold the mutex.
+func (sw *CaduceusSenderWrapper) metricsLabel(url, id string) string {
+	for _, v := range sw.labels {
+		if v == url {
+			return url + "#" + id[:8]
+		}
+	}
+	return url
+}
+
+// sharedWorkers returns the worker pool shared by the registrations for url,
+// or nil when they don't share workers.  The caller must hold the mutex.
+func (sw *CaduceusSenderWrapper) sharedWorkers(url string) semaphore.Interface {
+	if !sw.shareURLWorkers {
+		return nil
+	}
+	workers, ok := sw.urlWorkers[url]
+	if !ok {
+		workers = semaphore.New(sw.numWorkersPerSender)
+		sw.urlWorkers[url] = workers
+	}
+	return workers
+}
+
+// pruneSharedWorkers forgets the worker pools of URLs no registration
+// targets anymore.  Senders that are still winding down keep using theirs.
+// The caller must hold the mutex.
+func (sw *CaduceusSenderWrapper) pruneSharedWorkers() {
+	if 0 == len(sw.urlWorkers) {
+		return
+	}
+	inUse := make(map[string]bool, len(sw.senders))
+	for _, v := range sw.senders {
+		inUse[v.URL()] = true
+	}
+	for url := range sw.urlWorkers {
+		if !inUse[url] {
+			delete(sw.urlWorkers, url)
+		}
+	}
+}
+
+// outboundSenderFactory returns a factory for OutboundSenders configured the
+// way this wrapper configures all of its senders.
+func (sw *CaduceusSenderWrapper) outboundSenderFactory() OutboundSenderFactory {
+	return OutboundSenderFactory{
+		Sender:            sw.sender,
+		CutOffPeriod:      sw.cutOffPeriod,
+		NumWorkers:        sw.numWorkersPerSender,
+		QueueSize:         sw.queueSizePerSender,
+		MetricsRegistry:   sw.metricsRegistry,
+		DeliveryRetries:   sw.deliveryRetries,
+		DeliveryInterval:  sw.deliveryInterval,
+		Logger:            sw.logger,
+		CustomPIDs:        sw.customPIDs,
+		DisablePartnerIDs: sw.disablePartnerIDs,
+		OrderedDelivery:   sw.orderedDelivery,
+		Priorities:        sw.priorities,
+		QOS:               sw.qos,
+		Transports:        sw.transports,
+		QueryLatency:      sw.queryLatency,
+		Profiles:          sw.profiles,
+		Redaction:         sw.redaction,
+		Verification:      sw.verification,
+		ExpiryWarning:     sw.expiryWarning,
+		Notifications:     sw.notifications,
+		Spill:             sw.spill,
+	}
+}
+
+// attach creates an OutboundSender for a streaming consumer that delivers
+// through t, and fans events out to it until it is detached.  Streaming
+// senders aren't webhooks, so Update and the undertaker leave them alone.
+// A non-nil profile is used instead of the configured webhook profiles, and a
+// non-empty metricsLabel instead of the listener's URL.
+func (sw *CaduceusSenderWrapper) attach(listener ancla.InternalWebhook, t Transport, queueSize int, profile *webhookProfile, metricsLabel string) (OutboundSender, error) {
+	osf := sw.outboundSenderFactory()
+	osf.Listener = listener
+	osf.MetricsLabel = metricsLabel
+	if nil != profile {
+		osf.Profiles = singleProfile(profile)
+	}
+	// A single worker keeps the events on the connection in order.
+	osf.NumWorkers = 1
+	// Streams are cut off as soon as their queue is full, rather than
+	// spilling to disk for a connection that may be gone.
+	osf.Spill = nil
+	// Streaming consumers are authenticated instead of verified.
+	osf.Verification = nil
+	if 0 < queueSize {
+		osf.QueueSize = queueSize
+	}
+	osf.Transports = TransportRegistry{
+		urlScheme(listener.Webhook.Config.URL): func(*CaduceusOutboundSender) (Transport, error) {
+			return t, nil
+		},
+	}
+
+	obs, err := osf.New()
+	if nil != err {
+		return nil, err
+	}
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	select {
+	case <-sw.shutdown:
+		obs.Shutdown(false)
+		return nil, errors.New("sender wrapper is shut down")
+	default:
+	}
+	sw.streams[listener.Webhook.Config.URL] = obs
+	return obs, nil
+}
+
+// detach stops fanning events out to a streaming sender and shuts it down,
+// dropping anything still queued for it.
+func (sw *CaduceusSenderWrapper) detach(id string) {
+	sw.mutex.Lock()
+	obs, ok := sw.streams[id]
+	delete(sw.streams, id)
+	sw.mutex.Unlock()
+
+	if ok {
+		obs.Shutdown(false)
 	}
 }
 
 // Queue is used to send all the possible outbound senders a request.  This
 // function performs the fan-out and filtering to multiple possible endpoints.
-func (sw *CaduceusSenderWrapper) Queue(msg *wrp.Message) {
+func (sw *CaduceusSenderWrapper) Queue(msg *outboundEvent) {
+	sw.retention.retain(msg)
+
 	sw.mutex.RLock()
 	defer sw.mutex.RUnlock()
 
 	sw.eventType.With("event", msg.FindEventStringSubMatch()).Add(1)
 
-	for _, v := range sw.senders {
+	sw.index.queue(msg)
+	for _, v := range sw.streams {
 		v.Queue(msg)
 	}
 }
@@ -193,6 +603,13 @@ func (sw *CaduceusSenderWrapper) Shutdown(gentle bool) {
 	for k, v := range sw.senders {
 		v.Shutdown(gentle)
 		delete(sw.senders, k)
+		delete(sw.listeners, k)
+		delete(sw.labels, k)
+	}
+	sw.reindex()
+	for k, v := range sw.streams {
+		v.Shutdown(gentle)
+		delete(sw.streams, k)
 	}
 	close(sw.shutdown)
 }
@@ -238,7 +655,13 @@ func createDeadlist(sw *CaduceusSenderWrapper, threshold time.Time) map[string]O
 		if threshold.After(retired) {
 			deadList[k] = v
 			delete(sw.senders, k)
+			delete(sw.listeners, k)
+			delete(sw.labels, k)
 		}
 	}
+	if 0 < len(deadList) {
+		sw.pruneSharedWorkers()
+		sw.reindex()
+	}
 	return deadList
 }
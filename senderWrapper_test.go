@@ -4,6 +4,7 @@ package main
 
 import (
 	"bytes"
+	"container/ring"
 	"net/http"
 	"sync"
 	"sync/atomic"
@@ -11,8 +12,11 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/xmidt-org/ancla"
 	"github.com/xmidt-org/webpa-common/v2/adapter"
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
 
 	"github.com/xmidt-org/wrp-go/v3"
 )
@@ -78,16 +82,24 @@ func getFakeFactory() *SenderWrapperFactory {
 		On("With", []string{"url", "http://localhost:9999/foo", "event", "unknown"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "cut_off"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "queue_full"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "reason", "priority_evicted"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "expired"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "expired_before_queueing"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "network_err"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "reason", "stream_write_err"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "reason", "spill_read_err"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "invalid_config"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "reason", "unverified"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "cut_off"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "queue_full"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:9999/foo", "reason", "priority_evicted"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "expired"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "expired_before_queueing"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "network_err"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:9999/foo", "reason", "stream_write_err"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:9999/foo", "reason", "spill_read_err"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "invalid_config"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:9999/foo", "reason", "unverified"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "code", "200", "event", "unknown"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "code", "200", "event", "unknown"}).Return(fakeIgnore).
 		On("With", []string{"event", "iot"}).Return(fakeIgnore).
@@ -99,6 +111,14 @@ func getFakeFactory() *SenderWrapperFactory {
 		On("With", []string{"content_type", "http"}).Return(fakeIgnore).
 		On("With", []string{"content_type", "other"}).Return(fakeIgnore)
 
+	fakeQOSDrop := new(mockCounter)
+	fakeQOSDrop.On("With", mock.Anything).Return(fakeQOSDrop)
+	fakeQOSDrop.On("Add", mock.Anything).Return()
+
+	fakeRemoved := new(mockCounter)
+	fakeRemoved.On("With", mock.Anything).Return(fakeRemoved)
+	fakeRemoved.On("Add", mock.Anything).Return()
+
 	fakeRegistry := new(mockCaduceusMetricsRegistry)
 	fakeRegistry.On("NewCounter", DropsDueToInvalidPayload).Return(fakeDDTIP)
 	fakeRegistry.On("NewCounter", DeliveryRetryCounter).Return(fakeIgnore)
@@ -107,7 +127,16 @@ func getFakeFactory() *SenderWrapperFactory {
 	fakeRegistry.On("NewCounter", SlowConsumerDroppedMsgCounter).Return(fakeIgnore)
 	fakeRegistry.On("NewCounter", IncomingEventTypeCounter).Return(fakeIgnore)
 	fakeRegistry.On("NewCounter", DropsDueToPanic).Return(fakeIgnore)
+	fakeRegistry.On("NewCounter", QOSDroppedMsgCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", PayloadFilterDroppedCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", SampledOutCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", WebhookVerificationCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", NotificationCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", SpilledMsgCounter).Return(fakeQOSDrop)
+	fakeRegistry.On("NewCounter", WebhookRemovedCounter).Return(fakeRemoved)
+	fakeRegistry.On("NewCounter", WebhookRejectedCounter).Return(fakeRemoved)
 	fakeRegistry.On("NewGauge", OutgoingQueueDepth).Return(fakeGauge)
+	fakeRegistry.On("NewGauge", SpillDepthGauge).Return(fakeGauge)
 	fakeRegistry.On("NewGauge", DeliveryRetryMaxGauge).Return(fakeGauge)
 	fakeRegistry.On("NewGauge", ConsumerRenewalTimeGauge).Return(fakeGauge)
 	fakeRegistry.On("NewGauge", ConsumerDeliverUntilGauge).Return(fakeGauge)
@@ -135,6 +164,17 @@ func TestInvalidLinger(t *testing.T) {
 	assert.NotNil(err)
 }
 
+func TestInvalidPriorityClasses(t *testing.T) {
+	swf := getFakeFactory()
+	swf.Linger = time.Second
+	swf.PriorityClasses = []PriorityClass{{Name: "bad", Events: []string{"[[:123"}}}
+	sw, err := swf.New()
+
+	assert := assert.New(t)
+	assert.Nil(sw)
+	assert.NotNil(err)
+}
+
 // Commenting this test out is accumulating technical debt.
 // The reason this code doesn't work now is because the timeout in webpa-common
 // is hard coded to 5min at this point.  The ways to address this are:
@@ -173,9 +213,9 @@ func TestSwSimple(t *testing.T) {
 	assert.NotNil(sw)
 
 	// No listeners
-	sw.Queue(iot)
-	sw.Queue(iot)
-	sw.Queue(iot)
+	sw.Queue(newOutboundEvent(iot, nil))
+	sw.Queue(newOutboundEvent(iot, nil))
+	sw.Queue(newOutboundEvent(iot, nil))
 
 	assert.Equal(int32(0), trans.i)
 
@@ -210,13 +250,13 @@ func TestSwSimple(t *testing.T) {
 
 	// Send iot message
 
-	sw.Queue(iot)
+	sw.Queue(newOutboundEvent(iot, nil))
 
 	// Send test message
-	sw.Queue(test)
+	sw.Queue(newOutboundEvent(test, nil))
 
 	// Send it again
-	sw.Queue(test)
+	sw.Queue(newOutboundEvent(test, nil))
 
 	w3 := ancla.InternalWebhook{
 		Webhook: ancla.Webhook{},
@@ -230,8 +270,461 @@ func TestSwSimple(t *testing.T) {
 	time.Sleep(time.Second)
 
 	// Send iot
-	sw.Queue(iot)
+	sw.Queue(newOutboundEvent(iot, nil))
 
 	sw.Shutdown(true)
 	//assert.Equal(int32(4), atomic.LoadInt32(&trans.i))
 }
+
+func TestSwRemovesMissingWebhooks(t *testing.T) {
+	assert := assert.New(t)
+
+	delivered := map[string]*recordingTransport{}
+	swf := getFakeFactory()
+	swf.Sender = doerFunc((&http.Client{}).Do)
+	swf.Linger = time.Minute
+	swf.RemovalGracePeriod = time.Second
+	swf.Transports = TransportRegistry{
+		"http": func(obs *CaduceusOutboundSender) (Transport, error) {
+			rt := &recordingTransport{}
+			delivered[obs.id] = rt
+			return rt, nil
+		},
+	}
+	sw, err := swf.New()
+	require.NoError(t, err)
+	defer sw.Shutdown(false)
+
+	webhook := func(url string) ancla.InternalWebhook {
+		w := ancla.InternalWebhook{
+			Webhook: ancla.Webhook{
+				Until:  time.Now().Add(time.Minute),
+				Events: []string{"iot"},
+			},
+		}
+		w.Webhook.Config.URL = url
+		w.Webhook.Config.ContentType = wrp.MimeTypeJson
+		return w
+	}
+
+	kept, removed := "http://localhost:9999/foo", "http://localhost:8888/foo"
+	sw.Update([]ancla.InternalWebhook{webhook(kept), webhook(removed)})
+
+	// The removed webhook doesn't wait for its registration to expire.
+	sw.Update([]ancla.InternalWebhook{webhook(kept)})
+
+	csw := sw.(*CaduceusSenderWrapper)
+	csw.mutex.RLock()
+	assert.Len(csw.senders, 1)
+	assert.Contains(csw.senders, registrationID(webhook(kept)))
+	csw.mutex.RUnlock()
+
+	assert.Eventually(func() bool {
+		rt := delivered[removed]
+		rt.mutex.Lock()
+		defer rt.mutex.Unlock()
+		return rt.closed
+	}, 2*time.Second, 10*time.Millisecond)
+
+	fakeRemoved := swf.MetricsRegistry.NewCounter(WebhookRemovedCounter).(*mockCounter)
+	fakeRemoved.AssertCalled(t, "With", []string{"url", removed})
+	fakeRemoved.AssertNumberOfCalls(t, "Add", 1)
+}
+
+func TestRegistrationID(t *testing.T) {
+	base := func() ancla.InternalWebhook {
+		w := ancla.InternalWebhook{
+			Webhook: ancla.Webhook{
+				Until:  time.Now().Add(time.Minute),
+				Events: []string{"iot", "test"},
+			},
+			PartnerIDs: []string{"comcast", "sky"},
+		}
+		w.Webhook.Config.URL = "http://localhost:9999/foo"
+		w.Webhook.Config.Secret = "123456"
+		w.Webhook.Matcher.DeviceID = []string{"mac:112233445566"}
+		return w
+	}
+
+	tests := []struct {
+		desc   string
+		change func(*ancla.InternalWebhook)
+		same   bool
+	}{
+		{desc: "identical", change: func(*ancla.InternalWebhook) {}, same: true},
+		{
+			desc:   "renewed",
+			change: func(w *ancla.InternalWebhook) { w.Webhook.Until = time.Now().Add(time.Hour) },
+			same:   true,
+		},
+		{
+			desc:   "content type",
+			change: func(w *ancla.InternalWebhook) { w.Webhook.Config.ContentType = wrp.MimeTypeMsgpack },
+			same:   true,
+		},
+		{
+			desc: "reordered",
+			change: func(w *ancla.InternalWebhook) {
+				w.Webhook.Events = []string{"test", "iot"}
+				w.PartnerIDs = []string{"sky", "comcast"}
+			},
+			same: true,
+		},
+		{desc: "url", change: func(w *ancla.InternalWebhook) { w.Webhook.Config.URL = "http://localhost:8888/foo" }},
+		{desc: "secret", change: func(w *ancla.InternalWebhook) { w.Webhook.Config.Secret = "654321" }},
+		{desc: "partner ids", change: func(w *ancla.InternalWebhook) { w.PartnerIDs = []string{"comcast"} }},
+		{desc: "events", change: func(w *ancla.InternalWebhook) { w.Webhook.Events = []string{"iot"} }},
+		{desc: "device ids", change: func(w *ancla.InternalWebhook) { w.Webhook.Matcher.DeviceID = nil }},
+		{
+			// Values can't run together across fields.
+			desc: "shifted values",
+			change: func(w *ancla.InternalWebhook) {
+				w.PartnerIDs = []string{"comcast"}
+				w.Webhook.Events = []string{"iot", "sky", "test"}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := base()
+			tc.change(&w)
+			if tc.same {
+				assert.Equal(t, registrationID(base()), registrationID(w))
+			} else {
+				assert.NotEqual(t, registrationID(base()), registrationID(w))
+			}
+		})
+	}
+}
+
+func TestSwSameURLRegistrations(t *testing.T) {
+	assert := assert.New(t)
+
+	var mutex sync.Mutex
+	delivered := map[string]*recordingTransport{}
+	labels := map[string]string{}
+	registry, err := xmetrics.NewRegistry(nil, Metrics)
+	require.NoError(t, err)
+	swf := getFakeFactory()
+	swf.MetricsRegistry = registry
+	swf.Sender = doerFunc((&http.Client{}).Do)
+	swf.Linger = time.Minute
+	swf.DisablePartnerIDs = true
+	swf.Transports = TransportRegistry{
+		"http": func(obs *CaduceusOutboundSender) (Transport, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			rt := &recordingTransport{}
+			delivered[obs.listener.Webhook.Config.Secret] = rt
+			labels[obs.listener.Webhook.Config.Secret] = obs.metricsLabel
+			return rt, nil
+		},
+	}
+	sw, err := swf.New()
+	require.NoError(t, err)
+
+	webhook := func(secret, event string) ancla.InternalWebhook {
+		w := ancla.InternalWebhook{
+			Webhook: ancla.Webhook{
+				Until:  time.Now().Add(time.Minute),
+				Events: []string{event},
+			},
+		}
+		w.Webhook.Config.URL = "http://localhost:9999/foo"
+		w.Webhook.Config.ContentType = wrp.MimeTypeJson
+		w.Webhook.Config.Secret = secret
+		return w
+	}
+
+	// Updating again doesn't have one registration replace the other.
+	list := []ancla.InternalWebhook{webhook("iot-secret", "iot"), webhook("test-secret", "test")}
+	sw.Update(list)
+	sw.Update(list)
+
+	for _, dest := range []string{"mac:112233445566/event/iot", "mac:112233445566/event/test"} {
+		req := simpleRequest()
+		req.Destination = dest
+		req.TransactionUUID = dest
+		sw.Queue(newOutboundEvent(req, nil))
+	}
+	sw.Shutdown(true)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, delivered, 2)
+	assert.Equal([]string{"mac:112233445566/event/iot"}, delivered["iot-secret"].delivered)
+	assert.Equal([]string{"mac:112233445566/event/test"}, delivered["test-secret"].delivered)
+
+	// Their metrics are kept apart.
+	assert.NotEqual(labels["iot-secret"], labels["test-secret"])
+	assert.Contains([]string{labels["iot-secret"], labels["test-secret"]}, "http://localhost:9999/foo")
+}
+
+func TestSwReplacedRegistration(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	registry, err := xmetrics.NewRegistry(nil, Metrics)
+	require.NoError(err)
+	swf := getFakeFactory()
+	swf.MetricsRegistry = registry
+	swf.Sender = doerFunc((&http.Client{}).Do)
+	swf.Linger = time.Minute
+	swf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) {
+			return &recordingTransport{}, nil
+		},
+	}
+	sw, err := swf.New()
+	require.NoError(err)
+	defer sw.Shutdown(false)
+	csw := sw.(*CaduceusSenderWrapper)
+
+	webhook := func(partner, secret, event string) ancla.InternalWebhook {
+		w := ancla.InternalWebhook{
+			Webhook: ancla.Webhook{
+				Until:  time.Now().Add(time.Minute),
+				Events: []string{event},
+			},
+			PartnerIDs: []string{partner},
+		}
+		w.Webhook.Config.URL = "http://localhost:9999/foo"
+		w.Webhook.Config.ContentType = wrp.MimeTypeJson
+		w.Webhook.Config.Secret = secret
+		return w
+	}
+	sender := func(w ancla.InternalWebhook) OutboundSender {
+		csw.mutex.RLock()
+		defer csw.mutex.RUnlock()
+		return csw.senders[registrationID(w)]
+	}
+
+	old, other := webhook("comcast", "old", "iot"), webhook("other", "other", "iot")
+	sw.Update([]ancla.InternalWebhook{old, other})
+	kept, replaced := sender(old), sender(other)
+	require.NotNil(kept)
+	require.NotNil(replaced)
+
+	// A new secret and events for the same URL and partner ids keep the
+	// sender, but new partner ids are a different registration.
+	updated, moved := webhook("comcast", "new", "test"), webhook("moved", "other", "iot")
+	sw.Update([]ancla.InternalWebhook{updated, moved})
+	assert.Same(kept, sender(updated))
+	assert.NotNil(sender(moved))
+	assert.NotSame(replaced, sender(moved))
+
+	csw.mutex.RLock()
+	defer csw.mutex.RUnlock()
+	assert.Len(csw.senders, 2)
+	assert.Equal("new", csw.listeners[registrationID(updated)].Webhook.Config.Secret)
+	assert.Equal("http://localhost:9999/foo", csw.labels[registrationID(updated)])
+}
+
+// Invalid registrations are counted by reason, once until they change.
+func TestSwRejectedRegistration(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	registry, err := xmetrics.NewRegistry(nil, Metrics)
+	require.NoError(err)
+	swf := getFakeFactory()
+	swf.MetricsRegistry = registry
+	swf.Sender = doerFunc((&http.Client{}).Do)
+	swf.Linger = time.Minute
+	sw, err := swf.New()
+	require.NoError(err)
+	defer sw.Shutdown(false)
+	csw := sw.(*CaduceusSenderWrapper)
+
+	rejected := new(mockCounter)
+	rejected.On("With", []string{"url", "http://localhost:9999/foo", "reason", invalidMatcherReason}).Return(rejected).Once()
+	rejected.On("With", []string{"url", "http://localhost:9999/foo", "reason", invalidEventsReason}).Return(rejected).Once()
+	rejected.On("With", []string{"url", "ftp://localhost:9999/foo", "reason", unsupportedSchemeReason}).Return(rejected).Once()
+	rejected.On("Add", 1.0).Return().Times(3)
+	csw.rejectedCounter = rejected
+
+	webhook := func(url string, events []string, deviceIDs []string) ancla.InternalWebhook {
+		w := ancla.InternalWebhook{
+			Webhook: ancla.Webhook{
+				Until:   time.Now().Add(time.Minute),
+				Events:  events,
+				Matcher: ancla.MetadataMatcherConfig{DeviceID: deviceIDs},
+			},
+		}
+		w.Webhook.Config.URL = url
+		w.Webhook.Config.ContentType = wrp.MimeTypeJson
+		return w
+	}
+
+	valid := webhook("http://localhost:9999/foo", []string{"iot"}, nil)
+	badMatcher := webhook("http://localhost:9999/foo", []string{"iot"}, []string{"mac:[1-"})
+	badEvents := webhook("http://localhost:9999/foo", []string{"*"}, nil)
+	badScheme := webhook("ftp://localhost:9999/foo", []string{"iot"}, nil)
+	list := []ancla.InternalWebhook{valid, badMatcher, badEvents, badScheme}
+
+	// Only the first update that sees them counts them.
+	sw.Update(list)
+	sw.Update(list)
+
+	csw.mutex.RLock()
+	assert.Len(csw.senders, 1)
+	assert.NotNil(csw.senders[registrationID(valid)])
+	csw.mutex.RUnlock()
+	rejected.AssertExpectations(t)
+
+	// Once gone, they're forgotten.
+	sw.Update([]ancla.InternalWebhook{valid})
+	csw.mutex.RLock()
+	assert.Empty(csw.rejected)
+	csw.mutex.RUnlock()
+}
+
+// With several registrations it could replace, a registration takes over the
+// one with the same events, or else the one with the lowest id.
+func TestSwReplacedCandidates(t *testing.T) {
+	webhook := func(secret, event string) ancla.InternalWebhook {
+		w := ancla.InternalWebhook{
+			Webhook: ancla.Webhook{
+				Until:  time.Now().Add(time.Minute),
+				Events: []string{event},
+			},
+			PartnerIDs: []string{"comcast"},
+		}
+		w.Webhook.Config.URL = "http://localhost:9999/foo"
+		w.Webhook.Config.ContentType = wrp.MimeTypeJson
+		w.Webhook.Config.Secret = secret
+		return w
+	}
+
+	a, b, c := webhook("a", "iot"), webhook("b", "test"), webhook("c", "other")
+	lowest := a
+	for _, w := range []ancla.InternalWebhook{b, c} {
+		if registrationID(w) < registrationID(lowest) {
+			lowest = w
+		}
+	}
+
+	tests := []struct {
+		desc     string
+		update   ancla.InternalWebhook
+		expected ancla.InternalWebhook
+	}{
+		{desc: "same events", update: webhook("new", "test"), expected: b},
+		{desc: "lowest id", update: webhook("new", "unknown"), expected: lowest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			// Map order changes from run to run, so try a few times.
+			for i := 0; i < 10; i++ {
+				registry, err := xmetrics.NewRegistry(nil, Metrics)
+				require.NoError(t, err)
+				swf := getFakeFactory()
+				swf.MetricsRegistry = registry
+				swf.Sender = doerFunc((&http.Client{}).Do)
+				swf.Linger = time.Minute
+				swf.Transports = TransportRegistry{
+					"http": func(*CaduceusOutboundSender) (Transport, error) {
+						return &recordingTransport{}, nil
+					},
+				}
+				sw, err := swf.New()
+				require.NoError(t, err)
+				csw := sw.(*CaduceusSenderWrapper)
+
+				sw.Update([]ancla.InternalWebhook{a, b, c})
+				csw.mutex.RLock()
+				expected := csw.senders[registrationID(tc.expected)]
+				csw.mutex.RUnlock()
+				require.NotNil(t, expected)
+
+				sw.Update([]ancla.InternalWebhook{tc.update})
+				csw.mutex.RLock()
+				assert.Same(t, expected, csw.senders[registrationID(tc.update)])
+				csw.mutex.RUnlock()
+				sw.Shutdown(false)
+			}
+		})
+	}
+}
+
+// concurrencyTransport tracks the most deliveries it has had in flight.
+type concurrencyTransport struct {
+	inFlight *int32
+	max      *int32
+}
+
+func (t concurrencyTransport) Deliver(*ring.Ring, string, string, *outboundEvent) (string, error) {
+	n := atomic.AddInt32(t.inFlight, 1)
+	defer atomic.AddInt32(t.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(t.max)
+		if n <= max || atomic.CompareAndSwapInt32(t.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return "200", nil
+}
+
+func (t concurrencyTransport) Close() error {
+	return nil
+}
+
+func TestSwShareURLWorkers(t *testing.T) {
+	tests := []struct {
+		desc     string
+		share    bool
+		expected int32
+	}{
+		{desc: "separate workers", expected: 4},
+		{desc: "shared workers", share: true, expected: 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var inFlight, max int32
+			registry, err := xmetrics.NewRegistry(nil, Metrics)
+			require.NoError(t, err)
+			swf := getFakeFactory()
+			swf.MetricsRegistry = registry
+			swf.Sender = doerFunc((&http.Client{}).Do)
+			swf.Linger = time.Minute
+			swf.NumWorkersPerSender = 2
+			swf.DisablePartnerIDs = true
+			swf.ShareURLWorkers = tc.share
+			swf.Transports = TransportRegistry{
+				"http": func(*CaduceusOutboundSender) (Transport, error) {
+					return concurrencyTransport{inFlight: &inFlight, max: &max}, nil
+				},
+			}
+			sw, err := swf.New()
+			require.NoError(t, err)
+
+			var list []ancla.InternalWebhook
+			for _, secret := range []string{"one", "two"} {
+				w := ancla.InternalWebhook{
+					Webhook: ancla.Webhook{
+						Until:  time.Now().Add(time.Minute),
+						Events: []string{"iot"},
+					},
+				}
+				w.Webhook.Config.URL = "http://localhost:9999/foo"
+				w.Webhook.Config.ContentType = wrp.MimeTypeJson
+				w.Webhook.Config.Secret = secret
+				list = append(list, w)
+			}
+			sw.Update(list)
+
+			for i := 0; i < 8; i++ {
+				req := simpleRequest()
+				req.Destination = "mac:112233445566/event/iot"
+				sw.Queue(newOutboundEvent(req, nil))
+			}
+			sw.Shutdown(true)
+
+			assert.Equal(t, tc.expected, atomic.LoadInt32(&max))
+		})
+	}
+}
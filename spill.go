@@ -0,0 +1,306 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	defaultSpillMaxBytes = 64 << 20
+
+	// maxSpillSegment is the most each spill file holds, so the disk space
+	// of events that have been read back is given back a file at a time.
+	maxSpillSegment = 4 << 20
+
+	// spillDirPattern names the directory each sender spills to.
+	spillDirPattern = "sender-*"
+
+	// spillRecordHeader is the size of the length in front of each spilled
+	// event.
+	spillRecordHeader = 4
+)
+
+var (
+	errSpillFull   = errors.New("spill buffer is full")
+	errSpillClosed = errors.New("spill buffer is closed")
+)
+
+// SpillConfig configures spilling the events that don't fit in a sender's
+// queue to a local disk buffer, instead of cutting the webhook off right
+// away.  Spilled events are read back into the queue in order as the
+// consumer catches up, and the webhook is only cut off once the buffer is
+// full.
+type SpillConfig struct {
+	// Dir is the directory senders spill to, each in a directory of its own.
+	// It must not be shared with other caduceus instances, since whatever
+	// is left in it from before is removed on start.  (Optional) when empty,
+	// events aren't spilled.
+	Dir string
+
+	// MaxBytes limits the disk space each sender's spilled events use.
+	// (Optional) defaults to 64MiB.
+	MaxBytes int64
+}
+
+// spillPolicy is the compiled form of SpillConfig.  A nil policy doesn't
+// spill.
+type spillPolicy struct {
+	dir      string
+	maxBytes int64
+}
+
+func newSpillPolicy(c SpillConfig) (*spillPolicy, error) {
+	if "" == c.Dir {
+		return nil, nil
+	}
+	if c.MaxBytes < 0 {
+		return nil, errors.New("spill max bytes must not be negative")
+	}
+
+	p := &spillPolicy{
+		dir:      c.Dir,
+		maxBytes: c.MaxBytes,
+	}
+	if 0 == p.maxBytes {
+		p.maxBytes = defaultSpillMaxBytes
+	}
+
+	if err := os.MkdirAll(p.dir, 0o700); nil != err {
+		return nil, err
+	}
+
+	// Spilled events don't outlive the process that spilled them, so
+	// whatever an earlier one left behind is removed.
+	stale, err := filepath.Glob(filepath.Join(p.dir, spillDirPattern))
+	if nil != err {
+		return nil, err
+	}
+	for _, dir := range stale {
+		if err = os.RemoveAll(dir); nil != err {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// open creates the spill buffer of a sender, or returns nil when the policy
+// doesn't spill.
+func (p *spillPolicy) open() (*spillBuffer, error) {
+	if nil == p {
+		return nil, nil
+	}
+
+	dir, err := os.MkdirTemp(p.dir, spillDirPattern)
+	if nil != err {
+		return nil, err
+	}
+
+	segmentSize := p.maxBytes / 4
+	if maxSpillSegment < segmentSize {
+		segmentSize = maxSpillSegment
+	}
+	return &spillBuffer{
+		dir:         dir,
+		maxBytes:    p.maxBytes,
+		segmentSize: segmentSize,
+	}, nil
+}
+
+// spillBuffer is a FIFO of events on disk.  Events are appended as length
+// prefixed msgpack to a series of segment files, and each file is removed
+// once every event in it has been read back.  A nil spillBuffer is always
+// empty.
+type spillBuffer struct {
+	mutex       sync.Mutex
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	segments    []*spillSegment
+	bytes       int64
+	count       int
+	next        int
+	closed      bool
+}
+
+// spillSegment is one of the files of a spillBuffer.
+type spillSegment struct {
+	file *os.File
+	size int64
+	read int64
+}
+
+// len returns the number of events spilled and not yet read back.
+func (s *spillBuffer) len() int {
+	if nil == s {
+		return 0
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+// push spills e.  errSpillFull is returned when e doesn't fit in what's
+// left of the disk budget.
+func (s *spillBuffer) push(e *outboundEvent) error {
+	if nil == s {
+		return errSpillClosed
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(e)
+}
+
+// pushBehind spills e only if there are spilled events waiting already, so
+// it isn't delivered ahead of them.  It reports whether e had to be spilled,
+// and the error if spilling it failed.
+func (s *spillBuffer) pushBehind(e *outboundEvent) (bool, error) {
+	if nil == s {
+		return false, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if 0 == s.count {
+		return false, nil
+	}
+	return true, s.write(e)
+}
+
+// write appends e to the last segment, starting a new one when it's full.
+// s.mutex must be held.
+func (s *spillBuffer) write(e *outboundEvent) error {
+	if s.closed {
+		return errSpillClosed
+	}
+
+	b, err := e.msgpack()
+	if nil != err {
+		return err
+	}
+	n := int64(spillRecordHeader + len(b))
+	if s.maxBytes < s.bytes+n {
+		return errSpillFull
+	}
+
+	var tail *spillSegment
+	if 0 < len(s.segments) {
+		tail = s.segments[len(s.segments)-1]
+	}
+	if nil == tail || (0 < tail.size && s.segmentSize < tail.size+n) {
+		name := filepath.Join(s.dir, fmt.Sprintf("%08d.spill", s.next))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if nil != err {
+			return err
+		}
+		s.next++
+		tail = &spillSegment{file: f}
+		s.segments = append(s.segments, tail)
+	}
+
+	record := make([]byte, n)
+	binary.BigEndian.PutUint32(record, uint32(len(b)))
+	copy(record[spillRecordHeader:], b)
+	// A failed write is overwritten by the next one.
+	if _, err = tail.file.WriteAt(record, tail.size); nil != err {
+		return err
+	}
+	tail.size += n
+	s.bytes += n
+	s.count++
+	return nil
+}
+
+// pop reads back the oldest spilled event, or returns nil if there are none.
+// An event that can't be decoded is skipped and the error returned.  If the
+// files can't be read, every spilled event is lost.  When there's an error,
+// pop also returns the number of events lost.
+func (s *spillBuffer) pop() (*outboundEvent, int, error) {
+	if nil == s {
+		return nil, 0, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed || 0 == s.count {
+		return nil, 0, nil
+	}
+
+	// There are events left, so a segment that has been read to the end
+	// has another after it.
+	head := s.segments[0]
+	for head.read == head.size {
+		s.removeHead()
+		head = s.segments[0]
+	}
+
+	var header [spillRecordHeader]byte
+	if _, err := head.file.ReadAt(header[:], head.read); nil != err {
+		return s.fail(err)
+	}
+	b := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := head.file.ReadAt(b, head.read+spillRecordHeader); nil != err {
+		return s.fail(err)
+	}
+	head.read += int64(spillRecordHeader + len(b))
+	s.count--
+	if 0 == s.count {
+		s.removeAll()
+	}
+
+	var msg wrp.Message
+	if err := wrp.NewDecoderBytes(b, wrp.Msgpack).Decode(&msg); nil != err {
+		return nil, 1, fmt.Errorf("decoding spilled event: %w", err)
+	}
+	return newOutboundEvent(&msg, b), 0, nil
+}
+
+// fail gives up on the spilled events after a read error.  s.mutex must be
+// held.
+func (s *spillBuffer) fail(err error) (*outboundEvent, int, error) {
+	lost := s.count
+	s.removeAll()
+	return nil, lost, fmt.Errorf("reading spilled events, %d lost: %w", lost, err)
+}
+
+// removeHead removes the first segment.  s.mutex must be held.
+func (s *spillBuffer) removeHead() {
+	head := s.segments[0]
+	head.file.Close()
+	os.Remove(head.file.Name())
+	s.bytes -= head.size
+	s.segments[0] = nil
+	s.segments = s.segments[1:]
+}
+
+// removeAll removes every segment.  s.mutex must be held.
+func (s *spillBuffer) removeAll() {
+	for 0 < len(s.segments) {
+		s.removeHead()
+	}
+	s.segments = nil
+	s.bytes = 0
+	s.count = 0
+}
+
+// close drops whatever is still spilled and removes the buffer's directory.
+func (s *spillBuffer) close() error {
+	if nil == s {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	s.removeAll()
+	return os.RemoveAll(s.dir)
+}
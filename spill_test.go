@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func spillTestEvent(i int) *outboundEvent {
+	return newOutboundEvent(&wrp.Message{
+		Type:            wrp.SimpleEventMessageType,
+		Source:          "mac:112233445566",
+		Destination:     "event:iot",
+		TransactionUUID: fmt.Sprintf("%04d", i),
+		Payload:         []byte("payload"),
+	}, nil)
+}
+
+func spillTestBuffer(t *testing.T, maxBytes int64) *spillBuffer {
+	p, err := newSpillPolicy(SpillConfig{Dir: t.TempDir(), MaxBytes: maxBytes})
+	require.NoError(t, err)
+	s, err := p.open()
+	require.NoError(t, err)
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+func segmentFiles(t *testing.T, s *spillBuffer) []string {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.spill"))
+	require.NoError(t, err)
+	return files
+}
+
+func TestSpillBuffer(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Small enough that the events span a few segments.
+	s := spillTestBuffer(t, 1024)
+
+	spilled, err := s.pushBehind(spillTestEvent(0))
+	assert.False(spilled, "nothing is spilled behind an empty buffer")
+	assert.NoError(err)
+
+	var pushed int
+	for ; ; pushed++ {
+		if err = s.push(spillTestEvent(pushed)); nil != err {
+			break
+		}
+	}
+	assert.ErrorIs(err, errSpillFull)
+	assert.Equal(pushed, s.len())
+	assert.LessOrEqual(s.bytes, s.maxBytes)
+	assert.Less(1, len(segmentFiles(t, s)))
+
+	spilled, err = s.pushBehind(spillTestEvent(pushed))
+	assert.True(spilled)
+	assert.ErrorIs(err, errSpillFull)
+
+	// Events come back in order, and the disk space of each segment is given
+	// back once it has been read.
+	for i := 0; i < pushed; i++ {
+		e, _, err := s.pop()
+		require.NoError(err)
+		require.NotNil(e)
+		assert.Equal(fmt.Sprintf("%04d", i), e.TransactionUUID)
+		assert.Equal([]byte("payload"), e.Payload)
+
+		raw, err := e.msgpack()
+		assert.NoError(err)
+		expected, _ := spillTestEvent(i).msgpack()
+		assert.Equal(expected, raw)
+
+		if i == pushed/2 {
+			assert.Less(s.bytes, s.maxBytes)
+			require.NoError(s.push(spillTestEvent(pushed)))
+			pushed++
+		}
+	}
+	assert.Zero(s.len())
+	assert.Zero(s.bytes)
+	assert.Empty(segmentFiles(t, s))
+
+	e, _, err := s.pop()
+	assert.Nil(e)
+	assert.NoError(err)
+}
+
+func TestSpillBufferUndecodable(t *testing.T) {
+	assert := assert.New(t)
+
+	s := spillTestBuffer(t, 0)
+
+	// Events are spilled as they were received, which needn't decode.
+	assert.NoError(s.push(newOutboundEvent(spillTestEvent(0).Message, []byte{0xc1})))
+	assert.NoError(s.push(spillTestEvent(1)))
+
+	e, lost, err := s.pop()
+	assert.Nil(e)
+	assert.Equal(1, lost)
+	assert.Error(err)
+
+	e, lost, err = s.pop()
+	assert.NoError(err)
+	assert.Zero(lost)
+	if assert.NotNil(e) {
+		assert.Equal("0001", e.TransactionUUID)
+	}
+}
+
+func TestSpillBufferClose(t *testing.T) {
+	assert := assert.New(t)
+
+	s := spillTestBuffer(t, 0)
+	assert.NoError(s.push(spillTestEvent(0)))
+	assert.NoError(s.close())
+
+	_, err := os.Stat(s.dir)
+	assert.True(os.IsNotExist(err))
+	assert.ErrorIs(s.push(spillTestEvent(1)), errSpillClosed)
+	e, _, err := s.pop()
+	assert.Nil(e)
+	assert.NoError(err)
+
+	var none *spillBuffer
+	assert.Zero(none.len())
+	assert.NoError(none.close())
+	spilled, err := none.pushBehind(spillTestEvent(0))
+	assert.False(spilled)
+	assert.NoError(err)
+}
+
+func TestNewSpillPolicy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	p, err := newSpillPolicy(SpillConfig{})
+	assert.Nil(p)
+	assert.NoError(err)
+	s, err := p.open()
+	assert.Nil(s)
+	assert.NoError(err)
+
+	_, err = newSpillPolicy(SpillConfig{Dir: t.TempDir(), MaxBytes: -1})
+	assert.Error(err)
+
+	// What an earlier run left behind is removed, anything else is kept.
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "sender-1234")
+	require.NoError(os.Mkdir(stale, 0o700))
+	require.NoError(os.WriteFile(filepath.Join(stale, "00000000.spill"), []byte("old"), 0o600))
+	other := filepath.Join(dir, "other")
+	require.NoError(os.WriteFile(other, nil, 0o600))
+
+	p, err = newSpillPolicy(SpillConfig{Dir: dir})
+	require.NoError(err)
+	assert.Equal(int64(defaultSpillMaxBytes), p.maxBytes)
+	_, err = os.Stat(stale)
+	assert.True(os.IsNotExist(err))
+	assert.FileExists(other)
+
+	s, err = p.open()
+	require.NoError(err)
+	defer s.close()
+	assert.Equal(int64(maxSpillSegment), s.segmentSize)
+	assert.Equal(dir, filepath.Dir(s.dir))
+}
@@ -0,0 +1,391 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/bascule"
+	"github.com/xmidt-org/bascule/basculechecks"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStreamKeepAlive   = 15 * time.Second
+	defaultStreamMaxDuration = time.Hour
+
+	// streamScheme is the scheme of the ids given to streaming senders, and
+	// the url label of their metrics.  Every connection gets a new id, so
+	// labelling their metrics with it would never stop adding series.
+	streamScheme = "stream"
+
+	// streamSentCode is the delivery metric code for events written to a
+	// streaming connection.
+	streamSentCode = "sent"
+)
+
+var (
+	errNoStreamEvents    = errors.New("at least one events filter is required")
+	errStreamPartnerIDs  = errors.New("unable to get partner ids")
+	errStreamUnsupported = errors.New("streaming is not supported by the connection")
+	errStreamWrite       = errors.New("unable to write to the stream")
+)
+
+// StreamConfig configures the endpoint that pull style consumers use to
+// receive events over Server-Sent Events or a WebSocket.
+type StreamConfig struct {
+	// Enabled adds the stream endpoint to the primary router.
+	Enabled bool
+
+	// KeepAlive is how often an idle connection is sent a keep alive so
+	// proxies don't close it.  (Optional) defaults to 15s.
+	KeepAlive time.Duration
+
+	// MaxDuration is how long a connection is served before it is closed
+	// and the consumer has to reconnect.  (Optional) defaults to 1h.
+	MaxDuration time.Duration
+
+	// QueueSize is the queue depth of each connection.
+	// (Optional) defaults to the sender's queueSizePerSender.
+	QueueSize int
+}
+
+// streamSenders creates and removes the OutboundSenders that feed streaming
+// connections.  It is implemented by CaduceusSenderWrapper.
+type streamSenders interface {
+	attach(listener ancla.InternalWebhook, t Transport, queueSize int, profile *webhookProfile, metricsLabel string) (OutboundSender, error)
+	detach(id string)
+}
+
+// streamHandler serves the stream endpoint.  A connection's query parameters
+// are the equivalent of a webhook registration:
+//
+//	events - a regular expression events must match, may be repeated
+//	device - a regular expression the device id must match, may be repeated
+//	filter - a CEL expression events must pass, see newFilterEnv
+//
+// Matching events are delivered through an OutboundSender, so connections
+// get the same queueing, cut off and metrics behavior as webhooks.  The
+// partner ids come from the request's credentials, the same way they do for
+// webhook registrations.
+type streamHandler struct {
+	senders           streamSenders
+	logger            *zap.Logger
+	config            StreamConfig
+	disablePartnerIDs bool
+	upgrader          websocket.Upgrader
+}
+
+func newStreamHandler(c StreamConfig, senders streamSenders, logger *zap.Logger, disablePartnerIDs bool) *streamHandler {
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = defaultStreamKeepAlive
+	}
+	if c.MaxDuration <= 0 {
+		c.MaxDuration = defaultStreamMaxDuration
+	}
+	return &streamHandler{
+		senders:           senders,
+		logger:            logger,
+		config:            c,
+		disablePartnerIDs: disablePartnerIDs,
+	}
+}
+
+func (h *streamHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	listener, profile, err := h.listener(request)
+	if nil != err {
+		h.logger.Debug("invalid stream request", zap.Error(err))
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), h.config.MaxDuration)
+	defer cancel()
+
+	var w eventWriter
+	if websocket.IsWebSocketUpgrade(request) {
+		conn, err := h.upgrader.Upgrade(response, request, nil)
+		if nil != err {
+			// The upgrader has already responded.
+			h.logger.Debug("websocket upgrade failed", zap.Error(err))
+			return
+		}
+		defer conn.Close()
+
+		ws := &wsWriter{conn: conn, binary: "msgpack" == request.URL.Query().Get("format")}
+		go ws.discardReads(cancel)
+		w = ws
+	} else {
+		sse, err := newSSEWriter(response)
+		if nil != err {
+			http.Error(response, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w = sse
+	}
+
+	// The stream has to be open before the sender can write events to it.
+	w.open()
+	if _, err := h.senders.attach(listener, &streamTransport{w: w}, h.config.QueueSize, profile, streamScheme); nil != err {
+		h.logger.Debug("unable to create stream sender", zap.Error(err))
+		w.fail(err)
+		return
+	}
+	id := listener.Webhook.Config.URL
+	// Detaching shuts the sender down and waits for its worker, so nothing
+	// writes to the connection once we return.
+	defer h.senders.detach(id)
+
+	h.logger.Info("stream opened", zap.String("id", id), zap.Strings("events", listener.Webhook.Events), zap.Strings("partnerIDs", listener.PartnerIDs))
+
+	ticker := time.NewTicker(h.config.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.logger.Info("stream closed", zap.String("id", id))
+			return
+		case <-ticker.C:
+			if err := w.keepAlive(); nil != err {
+				cancel()
+			}
+		}
+	}
+}
+
+// listener builds the registration equivalent to a stream request, along
+// with the profile applying its filter expression.
+func (h *streamHandler) listener(request *http.Request) (ancla.InternalWebhook, *webhookProfile, error) {
+	query := request.URL.Query()
+
+	events := query["events"]
+	if 0 == len(events) {
+		return ancla.InternalWebhook{}, nil, errNoStreamEvents
+	}
+
+	// Check the filters now, once the stream is open it's too late to
+	// respond with an error.
+	for _, filter := range append(events, query["device"]...) {
+		if _, err := regexp.Compile(filter); nil != err {
+			return ancla.InternalWebhook{}, nil, fmt.Errorf("invalid filter '%s': %w", filter, err)
+		}
+	}
+	profile, err := filterProfile(query.Get("filter"))
+	if nil != err {
+		return ancla.InternalWebhook{}, nil, err
+	}
+
+	partnerIDs, err := streamPartnerIDs(request)
+	if nil != err && !h.disablePartnerIDs {
+		return ancla.InternalWebhook{}, nil, err
+	}
+
+	listener := ancla.InternalWebhook{
+		Webhook: ancla.Webhook{
+			Address: request.RemoteAddr,
+			Config: ancla.DeliveryConfig{
+				URL:         fmt.Sprintf("%s://%s", streamScheme, uuid.NewV4().String()),
+				ContentType: wrp.MimeTypeJson,
+			},
+			Events:   events,
+			Duration: h.config.MaxDuration,
+			Until:    time.Now().Add(h.config.MaxDuration),
+		},
+		PartnerIDs: partnerIDs,
+	}
+	listener.Webhook.Matcher.DeviceID = query["device"]
+	return listener, profile, nil
+}
+
+// streamPartnerIDs finds the partner ids of the credentials used to open a
+// stream.  Basic auth credentials name theirs in the X-Xmidt-Partner-Ids
+// header, JWTs carry them as a claim.
+func streamPartnerIDs(request *http.Request) ([]string, error) {
+	auth, ok := bascule.FromContext(request.Context())
+	if !ok || nil == auth.Token {
+		return nil, errStreamPartnerIDs
+	}
+
+	var partners []string
+	switch auth.Token.Type() {
+	case "basic":
+		for _, value := range request.Header.Values(ancla.DefaultBasicPartnerIDsHeader) {
+			for _, field := range strings.Split(value, ",") {
+				partners = append(partners, strings.TrimSpace(field))
+			}
+		}
+	case "jwt":
+		attr, ok := bascule.GetNestedAttribute(auth.Token.Attributes(), basculechecks.PartnerKeys()...)
+		if !ok {
+			return nil, errStreamPartnerIDs
+		}
+		switch vals := attr.(type) {
+		case []string:
+			partners = vals
+		case []interface{}:
+			for _, v := range vals {
+				s, ok := v.(string)
+				if !ok {
+					return nil, errStreamPartnerIDs
+				}
+				partners = append(partners, s)
+			}
+		default:
+			return nil, errStreamPartnerIDs
+		}
+	default:
+		return nil, errStreamPartnerIDs
+	}
+	return partners, nil
+}
+
+// eventWriter writes to a streaming connection.
+type eventWriter interface {
+	// open tells the consumer the stream is ready.
+	open()
+
+	// fail tells the consumer the stream couldn't be set up after it was
+	// opened.
+	fail(error)
+
+	writeEvent(*outboundEvent) error
+	keepAlive() error
+}
+
+// streamTransport is the Transport of a streaming sender.
+type streamTransport struct {
+	w eventWriter
+}
+
+func (t *streamTransport) Deliver(_ *ring.Ring, _, _ string, msg *outboundEvent) (string, error) {
+	if err := t.w.writeEvent(msg); nil != err {
+		return "", fmt.Errorf("%w: %v", errStreamWrite, err)
+	}
+	return streamSentCode, nil
+}
+
+// Close does nothing, the connection belongs to the stream handler.
+func (t *streamTransport) Close() error {
+	return nil
+}
+
+// sseWriter writes events as Server-Sent Events.  Each event is named after
+// the event type, has the transaction uuid as its id and the JSON encoded WRP
+// message as its data.
+type sseWriter struct {
+	mutex    sync.Mutex
+	response http.ResponseWriter
+	flusher  http.Flusher
+}
+
+func newSSEWriter(response http.ResponseWriter) (*sseWriter, error) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		return nil, errStreamUnsupported
+	}
+	return &sseWriter{response: response, flusher: flusher}, nil
+}
+
+func (w *sseWriter) open() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	header := w.response.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	w.response.WriteHeader(http.StatusOK)
+	w.flusher.Flush()
+}
+
+func (w *sseWriter) fail(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	fmt.Fprintf(w.response, "event: error\ndata: %s\n\n", err)
+	w.flusher.Flush()
+}
+
+func (w *sseWriter) writeEvent(msg *outboundEvent) error {
+	data, err := msg.json()
+	if nil != err {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, err := fmt.Fprintf(w.response, "event: %s\nid: %s\ndata: %s\n\n", msg.FindEventStringSubMatch(), msg.TransactionUUID, data); nil != err {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+func (w *sseWriter) keepAlive() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, err := fmt.Fprint(w.response, ": keep-alive\n\n"); nil != err {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+// wsWriter writes events as WebSocket messages, JSON encoded text messages by
+// default or msgpack encoded binary messages when binary is set.
+type wsWriter struct {
+	mutex  sync.Mutex
+	conn   *websocket.Conn
+	binary bool
+}
+
+func (w *wsWriter) open() {}
+
+func (w *wsWriter) fail(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+}
+
+func (w *wsWriter) writeEvent(msg *outboundEvent) error {
+	encode, messageType := msg.json, websocket.TextMessage
+	if w.binary {
+		encode, messageType = msg.msgpack, websocket.BinaryMessage
+	}
+
+	data, err := encode()
+	if nil != err {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.conn.WriteMessage(messageType, data)
+}
+
+func (w *wsWriter) keepAlive() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+}
+
+// discardReads reads the connection so control messages are handled, and
+// calls done once the consumer goes away.
+func (w *wsWriter) discardReads(done func()) {
+	defer done()
+	for {
+		if _, _, err := w.conn.NextReader(); nil != err {
+			return
+		}
+	}
+}
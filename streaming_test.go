@@ -0,0 +1,226 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/bascule"
+	"github.com/xmidt-org/webpa-common/v2/xmetrics"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+func newStreamTestWrapper(t *testing.T) *CaduceusSenderWrapper {
+	registry, err := xmetrics.NewRegistry(nil, Metrics)
+	require.NoError(t, err)
+
+	sw, err := SenderWrapperFactory{
+		NumWorkersPerSender: 10,
+		QueueSizePerSender:  10,
+		CutOffPeriod:        time.Second,
+		Linger:              time.Second,
+		MetricsRegistry:     registry,
+		Logger:              zap.NewNop(),
+		Sender:              doerFunc(http.DefaultClient.Do),
+		DisablePartnerIDs:   true,
+	}.New()
+	require.NoError(t, err)
+	return sw.(*CaduceusSenderWrapper)
+}
+
+func streamCount(sw *CaduceusSenderWrapper) int {
+	sw.mutex.RLock()
+	defer sw.mutex.RUnlock()
+	return len(sw.streams)
+}
+
+func streamEvent(dest, id string) *outboundEvent {
+	return newOutboundEvent(&wrp.Message{
+		Type:            wrp.SimpleEventMessageType,
+		Source:          "mac:112233445566",
+		Destination:     dest,
+		TransactionUUID: id,
+		ContentType:     wrp.MimeTypeJson,
+		Payload:         []byte(`{"hello":"world"}`),
+	}, nil)
+}
+
+func TestStreamSSE(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sw := newStreamTestWrapper(t)
+	defer sw.Shutdown(false)
+
+	server := httptest.NewServer(newStreamHandler(StreamConfig{}, sw, zap.NewNop(), true))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?events=iot&device=mac:112233445566")
+	require.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	require.Eventually(func() bool { return 1 == streamCount(sw) }, time.Second, 10*time.Millisecond)
+	sw.mutex.RLock()
+	for _, obs := range sw.streams {
+		assert.Equal(streamScheme, obs.(*CaduceusOutboundSender).metricsLabel)
+	}
+	sw.mutex.RUnlock()
+	sw.Queue(streamEvent("event:test", "skipped"))
+	sw.Queue(streamEvent("event:iot", "delivered"))
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		require.NoError(err)
+		if line = strings.TrimSpace(line); "" != line {
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal("event: iot", lines[0])
+	assert.Equal("id: delivered", lines[1])
+	require.True(strings.HasPrefix(lines[2], "data: "))
+
+	var msg wrp.Message
+	require.NoError(wrp.NewDecoderBytes([]byte(strings.TrimPrefix(lines[2], "data: ")), wrp.JSON).Decode(&msg))
+	assert.Equal("event:iot", msg.Destination)
+
+	// Hanging up removes the stream's sender.
+	resp.Body.Close()
+	assert.Eventually(func() bool { return 0 == streamCount(sw) }, 2*time.Second, 10*time.Millisecond)
+}
+
+type failingEventWriter struct{}
+
+func (failingEventWriter) open()      {}
+func (failingEventWriter) fail(error) {}
+
+func (failingEventWriter) writeEvent(*outboundEvent) error {
+	return errors.New("broken pipe")
+}
+
+func (failingEventWriter) keepAlive() error {
+	return nil
+}
+
+func TestStreamTransportWriteError(t *testing.T) {
+	code, err := (&streamTransport{w: failingEventWriter{}}).Deliver(nil, "", "", streamEvent("event:iot", "lost"))
+	assert.Empty(t, code)
+	assert.ErrorIs(t, err, errStreamWrite)
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sw := newStreamTestWrapper(t)
+	defer sw.Shutdown(false)
+
+	server := httptest.NewServer(newStreamHandler(StreamConfig{}, sw, zap.NewNop(), true))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?events=iot&format=msgpack", nil)
+	require.NoError(err)
+
+	require.Eventually(func() bool { return 1 == streamCount(sw) }, time.Second, 10*time.Millisecond)
+	sw.Queue(streamEvent("event:iot", "delivered"))
+
+	messageType, data, err := conn.ReadMessage()
+	require.NoError(err)
+	assert.Equal(websocket.BinaryMessage, messageType)
+
+	var msg wrp.Message
+	require.NoError(wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&msg))
+	assert.Equal("delivered", msg.TransactionUUID)
+
+	conn.Close()
+	assert.Eventually(func() bool { return 0 == streamCount(sw) }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestStreamBadRequest(t *testing.T) {
+	tests := []struct {
+		desc  string
+		query string
+	}{
+		{desc: "no events", query: "?device=.*"},
+		{desc: "bad event regex", query: "?events=[[:123"},
+		{desc: "bad device regex", query: "?events=iot&device=[[:123"},
+		{desc: "bad filter", query: "?events=iot&filter=payload_size"},
+	}
+
+	h := newStreamHandler(StreamConfig{}, nil, zap.NewNop(), true)
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v4/stream"+tc.query, nil))
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+		})
+	}
+}
+
+func TestStreamPartnerIDs(t *testing.T) {
+	tests := []struct {
+		desc      string
+		token     bascule.Token
+		header    []string
+		expected  []string
+		expectErr bool
+	}{
+		{
+			desc:      "no auth",
+			expectErr: true,
+		},
+		{
+			desc:     "basic",
+			token:    bascule.NewToken("basic", "user", bascule.NewAttributes(nil)),
+			header:   []string{"comcast, sky", "other"},
+			expected: []string{"comcast", "sky", "other"},
+		},
+		{
+			desc: "jwt",
+			token: bascule.NewToken("jwt", "user", bascule.NewAttributes(map[string]interface{}{
+				"allowedResources": map[string]interface{}{
+					"allowedPartners": []interface{}{"comcast"},
+				},
+			})),
+			expected: []string{"comcast"},
+		},
+		{
+			desc:      "jwt without partners",
+			token:     bascule.NewToken("jwt", "user", bascule.NewAttributes(nil)),
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			r := httptest.NewRequest("GET", "/api/v4/stream", nil)
+			for _, h := range tc.header {
+				r.Header.Add("X-Xmidt-Partner-Ids", h)
+			}
+			if nil != tc.token {
+				r = r.WithContext(bascule.WithAuthentication(r.Context(), bascule.Authentication{Token: tc.token}))
+			}
+
+			partners, err := streamPartnerIDs(r)
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expected, partners)
+		})
+	}
+}
@@ -0,0 +1,448 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/bascule"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSubscriptionBufferSize  = 1000
+	defaultMaxSubscriptions        = 100
+	defaultSubscriptionIdleTimeout = 5 * time.Minute
+	defaultSubscriptionMaxWait     = 30 * time.Second
+	defaultSubscriptionMaxBatch    = 100
+
+	// subscriptionScheme is the scheme of the ids given to subscription
+	// senders.
+	subscriptionScheme = "subscription"
+
+	// subscriptionBufferedCode is the delivery metric code for events added
+	// to a subscription's buffer.
+	subscriptionBufferedCode = "buffered"
+)
+
+var (
+	errSubscriptionFull      = errors.New("subscription buffer is full")
+	errSubscriptionExists    = errors.New("subscription already exists")
+	errTooManySubscriptions  = errors.New("too many subscriptions")
+	errSubscriptionNotFound  = errors.New("subscription not found")
+	errInvalidSubscription   = errors.New("invalid subscription")
+	validSubscriptionNameExp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+)
+
+// SubscriptionConfig configures the long-poll subscription API, where a
+// consumer creates a named subscription and then fetches the events that
+// matched it.
+type SubscriptionConfig struct {
+	// Enabled adds the subscription endpoints to the primary router.
+	Enabled bool
+
+	// BufferSize is the number of unacknowledged events held for each
+	// subscription.  Events that don't fit are dropped.
+	// (Optional) defaults to 1000.
+	BufferSize int
+
+	// MaxSubscriptions limits the number of subscriptions on this instance.
+	// (Optional) defaults to 100.
+	MaxSubscriptions int
+
+	// IdleTimeout is how long a subscription lives without being polled.
+	// (Optional) defaults to 5m.
+	IdleTimeout time.Duration
+
+	// MaxWait caps how long a poll waits for events.
+	// (Optional) defaults to 30s.
+	MaxWait time.Duration
+
+	// MaxBatch caps the number of events returned by a poll.
+	// (Optional) defaults to 100.
+	MaxBatch int
+}
+
+// SubscriptionRequest is the body used to create a subscription.
+type SubscriptionRequest struct {
+	Name    string   `json:"name"`
+	Events  []string `json:"events"`
+	Matcher struct {
+		DeviceID []string `json:"device_id"`
+	} `json:"matcher"`
+
+	// Filter is a CEL expression events must pass, see newFilterEnv.
+	Filter string `json:"filter"`
+}
+
+// SubscriptionEvents is the response to a poll.  Cursor is the value to pass
+// with the next poll, which acknowledges the events returned by this one.
+type SubscriptionEvents struct {
+	Events []json.RawMessage `json:"events"`
+	Cursor uint64            `json:"cursor"`
+}
+
+// bufferedEvent is an event waiting in a subscription's buffer.
+type bufferedEvent struct {
+	seq uint64
+	msg *outboundEvent
+}
+
+// subscriptionBuffer holds a subscription's events until they are
+// acknowledged.  Events are numbered from 1 and a cursor is the number of the
+// next event the consumer wants.
+type subscriptionBuffer struct {
+	mutex  sync.Mutex
+	events []bufferedEvent
+	next   uint64
+	size   int
+	ready  chan struct{}
+}
+
+func newSubscriptionBuffer(size int) *subscriptionBuffer {
+	return &subscriptionBuffer{
+		next:  1,
+		size:  size,
+		ready: make(chan struct{}),
+	}
+}
+
+// push adds msg to the buffer, failing if it is full.
+func (b *subscriptionBuffer) push(msg *outboundEvent) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.events) >= b.size {
+		return errSubscriptionFull
+	}
+	b.events = append(b.events, bufferedEvent{seq: b.next, msg: msg})
+	b.next++
+
+	// Wake up any waiting polls.
+	close(b.ready)
+	b.ready = make(chan struct{})
+	return nil
+}
+
+// fetch acknowledges every event before cursor, then returns up to max
+// events from cursor on along with the cursor for the next fetch.  When there
+// are no events, fetch waits for one until ctx is done.
+func (b *subscriptionBuffer) fetch(ctx context.Context, cursor uint64, max int) ([]bufferedEvent, uint64) {
+	for {
+		b.mutex.Lock()
+		if cursor > b.next {
+			// Don't let a bogus cursor acknowledge events not seen yet.
+			cursor = b.next
+		}
+		i := 0
+		for i < len(b.events) && b.events[i].seq < cursor {
+			i++
+		}
+		b.events = b.events[i:]
+
+		if 0 < len(b.events) {
+			n := len(b.events)
+			if max < n {
+				n = max
+			}
+			batch := append([]bufferedEvent{}, b.events[:n]...)
+			b.mutex.Unlock()
+			return batch, batch[n-1].seq + 1
+		}
+
+		ready := b.ready
+		next := b.next
+		b.mutex.Unlock()
+
+		if cursor < next {
+			// Nothing has been skipped, so the consumer is caught up.
+			cursor = next
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, cursor
+		}
+	}
+}
+
+// subscriptionTransport is the Transport of a subscription's sender.
+type subscriptionTransport struct {
+	buffer *subscriptionBuffer
+}
+
+func (t *subscriptionTransport) Deliver(_ *ring.Ring, _, _ string, msg *outboundEvent) (string, error) {
+	if err := t.buffer.push(msg); nil != err {
+		return "", err
+	}
+	return subscriptionBufferedCode, nil
+}
+
+// Close does nothing, the buffer belongs to the subscription.
+func (t *subscriptionTransport) Close() error {
+	return nil
+}
+
+type subscription struct {
+	name     string
+	owner    string
+	listener ancla.InternalWebhook
+	sender   OutboundSender
+	buffer   *subscriptionBuffer
+	idle     *time.Timer
+}
+
+// subscriptionHandler serves the subscription API.  Subscriptions live in
+// memory on the instance that created them, so consumers must keep talking
+// to the same instance.
+type subscriptionHandler struct {
+	senders           streamSenders
+	logger            *zap.Logger
+	config            SubscriptionConfig
+	disablePartnerIDs bool
+
+	mutex         sync.Mutex
+	subscriptions map[string]*subscription
+}
+
+func newSubscriptionHandler(c SubscriptionConfig, senders streamSenders, logger *zap.Logger, disablePartnerIDs bool) *subscriptionHandler {
+	if c.BufferSize <= 0 {
+		c.BufferSize = defaultSubscriptionBufferSize
+	}
+	if c.MaxSubscriptions <= 0 {
+		c.MaxSubscriptions = defaultMaxSubscriptions
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = defaultSubscriptionIdleTimeout
+	}
+	if c.MaxWait <= 0 {
+		c.MaxWait = defaultSubscriptionMaxWait
+	}
+	if c.MaxBatch <= 0 {
+		c.MaxBatch = defaultSubscriptionMaxBatch
+	}
+	return &subscriptionHandler{
+		senders:           senders,
+		logger:            logger,
+		config:            c,
+		disablePartnerIDs: disablePartnerIDs,
+		subscriptions:     make(map[string]*subscription),
+	}
+}
+
+// create handles POST /subscriptions.
+func (h *subscriptionHandler) create(response http.ResponseWriter, request *http.Request) {
+	var sr SubscriptionRequest
+	if err := json.NewDecoder(request.Body).Decode(&sr); nil != err {
+		h.respond(response, http.StatusBadRequest, fmt.Errorf("%w: %v", errInvalidSubscription, err))
+		return
+	}
+	if !validSubscriptionNameExp.MatchString(sr.Name) {
+		h.respond(response, http.StatusBadRequest, fmt.Errorf("%w: name must match %s", errInvalidSubscription, validSubscriptionNameExp))
+		return
+	}
+	if 0 == len(sr.Events) {
+		h.respond(response, http.StatusBadRequest, fmt.Errorf("%w: %v", errInvalidSubscription, errNoStreamEvents))
+		return
+	}
+
+	profile, err := filterProfile(sr.Filter)
+	if nil != err {
+		h.respond(response, http.StatusBadRequest, fmt.Errorf("%w: %v", errInvalidSubscription, err))
+		return
+	}
+
+	partnerIDs, err := streamPartnerIDs(request)
+	if nil != err && !h.disablePartnerIDs {
+		h.respond(response, http.StatusBadRequest, err)
+		return
+	}
+
+	listener := ancla.InternalWebhook{
+		Webhook: ancla.Webhook{
+			Address: request.RemoteAddr,
+			Config: ancla.DeliveryConfig{
+				URL:         fmt.Sprintf("%s://%s", subscriptionScheme, sr.Name),
+				ContentType: wrp.MimeTypeJson,
+			},
+			Events:   sr.Events,
+			Duration: h.config.IdleTimeout,
+			Until:    time.Now().Add(h.config.IdleTimeout),
+		},
+		PartnerIDs: partnerIDs,
+	}
+	listener.Webhook.Matcher.DeviceID = sr.Matcher.DeviceID
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.subscriptions[sr.Name]; ok {
+		h.respond(response, http.StatusConflict, errSubscriptionExists)
+		return
+	}
+	if len(h.subscriptions) >= h.config.MaxSubscriptions {
+		h.respond(response, http.StatusTooManyRequests, errTooManySubscriptions)
+		return
+	}
+
+	s := &subscription{
+		name:     sr.Name,
+		owner:    owner(request),
+		listener: listener,
+		buffer:   newSubscriptionBuffer(h.config.BufferSize),
+	}
+	s.sender, err = h.senders.attach(listener, &subscriptionTransport{buffer: s.buffer}, 0, profile, subscriptionScheme)
+	if nil != err {
+		h.respond(response, http.StatusBadRequest, fmt.Errorf("%w: %v", errInvalidSubscription, err))
+		return
+	}
+	s.idle = time.AfterFunc(h.config.IdleTimeout, func() {
+		h.logger.Info("subscription expired", zap.String("name", s.name))
+		h.remove(s)
+	})
+	h.subscriptions[sr.Name] = s
+
+	h.logger.Info("subscription created", zap.String("name", s.name), zap.Strings("events", sr.Events), zap.Strings("partnerIDs", partnerIDs))
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusCreated)
+	json.NewEncoder(response).Encode(map[string]string{"name": s.name})
+}
+
+// poll handles GET /subscriptions/{name}/events.  The optional cursor query
+// parameter acknowledges every earlier event, max limits the batch size and
+// wait is how long to wait for events when there are none.
+func (h *subscriptionHandler) poll(response http.ResponseWriter, request *http.Request) {
+	s, err := h.lookup(request)
+	if nil != err {
+		h.respond(response, http.StatusNotFound, err)
+		return
+	}
+
+	query := request.URL.Query()
+	var cursor uint64
+	if v := query.Get("cursor"); "" != v {
+		if cursor, err = strconv.ParseUint(v, 10, 64); nil != err {
+			h.respond(response, http.StatusBadRequest, fmt.Errorf("invalid cursor '%s'", v))
+			return
+		}
+	}
+	max := h.config.MaxBatch
+	if v := query.Get("max"); "" != v {
+		if n, err := strconv.Atoi(v); nil == err && 0 < n && n < max {
+			max = n
+		}
+	}
+	wait := h.config.MaxWait
+	if v := query.Get("wait"); "" != v {
+		if d, err := time.ParseDuration(v); nil == err && 0 <= d && d < wait {
+			wait = d
+		}
+	}
+
+	// Polling keeps the subscription alive.
+	h.renew(s)
+
+	ctx, cancel := context.WithTimeout(request.Context(), wait)
+	defer cancel()
+	events, next := s.buffer.fetch(ctx, cursor, max)
+
+	body := SubscriptionEvents{
+		Events: make([]json.RawMessage, 0, len(events)),
+		Cursor: next,
+	}
+	for _, e := range events {
+		data, err := e.msg.json()
+		if nil != err {
+			h.logger.Error("unable to encode subscription event", zap.String("name", s.name), zap.Error(err))
+			continue
+		}
+		body.Events = append(body.Events, data)
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(body)
+}
+
+// delete handles DELETE /subscriptions/{name}.
+func (h *subscriptionHandler) delete(response http.ResponseWriter, request *http.Request) {
+	s, err := h.lookup(request)
+	if nil != err {
+		h.respond(response, http.StatusNotFound, err)
+		return
+	}
+
+	h.remove(s)
+	h.logger.Info("subscription deleted", zap.String("name", s.name))
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// lookup finds the subscription named by the request, which must belong to
+// the request's owner.
+func (h *subscriptionHandler) lookup(request *http.Request) (*subscription, error) {
+	name := mux.Vars(request)["name"]
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.subscriptions[name]
+	if !ok || s.owner != owner(request) {
+		return nil, errSubscriptionNotFound
+	}
+	return s, nil
+}
+
+// renew pushes back the subscription's expiry.
+func (h *subscriptionHandler) renew(s *subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.subscriptions[s.name] != s {
+		return
+	}
+	s.idle.Reset(h.config.IdleTimeout)
+	s.listener.Webhook.Until = time.Now().Add(h.config.IdleTimeout)
+	if err := s.sender.Update(s.listener); nil != err {
+		h.logger.Error("unable to renew subscription", zap.String("name", s.name), zap.Error(err))
+	}
+}
+
+func (h *subscriptionHandler) remove(s *subscription) {
+	h.mutex.Lock()
+	if h.subscriptions[s.name] != s {
+		h.mutex.Unlock()
+		return
+	}
+	delete(h.subscriptions, s.name)
+	s.idle.Stop()
+	h.mutex.Unlock()
+
+	h.senders.detach(s.listener.Webhook.Config.URL)
+}
+
+func (h *subscriptionHandler) respond(response http.ResponseWriter, code int, err error) {
+	h.logger.Debug("subscription request failed", zap.Int("code", code), zap.Error(err))
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(code)
+	json.NewEncoder(response).Encode(map[string]string{"message": err.Error()})
+}
+
+// owner returns the principal that authenticated the request, if any.
+func owner(request *http.Request) string {
+	if auth, ok := bascule.FromContext(request.Context()); ok && nil != auth.Token {
+		return auth.Token.Principal()
+	}
+	return ""
+}
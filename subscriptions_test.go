@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+func TestSubscriptionBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newSubscriptionBuffer(3)
+	for _, id := range []string{"1", "2", "3"} {
+		assert.NoError(b.push(newOutboundEvent(&wrp.Message{TransactionUUID: id}, nil)))
+	}
+	assert.ErrorIs(b.push(newOutboundEvent(&wrp.Message{TransactionUUID: "4"}, nil)), errSubscriptionFull)
+
+	ctx := context.Background()
+	events, cursor := b.fetch(ctx, 0, 2)
+	assert.Equal([]string{"1", "2"}, bufferedIDs(events))
+	assert.Equal(uint64(3), cursor)
+
+	// Fetching again without acknowledging returns the same events.
+	events, _ = b.fetch(ctx, 0, 2)
+	assert.Equal([]string{"1", "2"}, bufferedIDs(events))
+
+	// Acknowledging makes room.
+	events, cursor = b.fetch(ctx, cursor, 2)
+	assert.Equal([]string{"3"}, bufferedIDs(events))
+	assert.NoError(b.push(newOutboundEvent(&wrp.Message{TransactionUUID: "4"}, nil)))
+
+	events, cursor = b.fetch(ctx, cursor, 2)
+	assert.Equal([]string{"4"}, bufferedIDs(events))
+	assert.Equal(uint64(5), cursor)
+
+	// Nothing left, so the fetch waits.
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	events, next := b.fetch(ctx, cursor, 2)
+	assert.Empty(events)
+	assert.Equal(cursor, next)
+}
+
+func TestSubscriptionBufferWakesFetch(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newSubscriptionBuffer(3)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.push(newOutboundEvent(&wrp.Message{TransactionUUID: "late"}, nil))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, cursor := b.fetch(ctx, 0, 10)
+	assert.Equal([]string{"late"}, bufferedIDs(events))
+	assert.Equal(uint64(2), cursor)
+}
+
+func bufferedIDs(events []bufferedEvent) []string {
+	ids := make([]string, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.msg.TransactionUUID)
+	}
+	return ids
+}
+
+func newSubscriptionTestRouter(h *subscriptionHandler) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/subscriptions", h.create).Methods("POST")
+	r.HandleFunc("/subscriptions/{name}/events", h.poll).Methods("GET")
+	r.HandleFunc("/subscriptions/{name}", h.delete).Methods("DELETE")
+	return r
+}
+
+func subscriptionRequest(t *testing.T, r http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rr
+}
+
+func pollSubscription(t *testing.T, r http.Handler, target string) SubscriptionEvents {
+	rr := subscriptionRequest(t, r, "GET", target, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var se SubscriptionEvents
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&se))
+	return se
+}
+
+func TestSubscriptions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sw := newStreamTestWrapper(t)
+	defer sw.Shutdown(false)
+
+	h := newSubscriptionHandler(SubscriptionConfig{MaxWait: time.Second}, sw, zap.NewNop(), true)
+	r := newSubscriptionTestRouter(h)
+
+	rr := subscriptionRequest(t, r, "POST", "/subscriptions", `{"name": "mine", "events": ["iot"]}`)
+	require.Equal(http.StatusCreated, rr.Code)
+	rr = subscriptionRequest(t, r, "POST", "/subscriptions", `{"name": "mine", "events": ["iot"]}`)
+	assert.Equal(http.StatusConflict, rr.Code)
+
+	// Subscription senders share one metrics label rather than each getting
+	// their own.
+	h.mutex.Lock()
+	assert.Equal(subscriptionScheme, h.subscriptions["mine"].sender.(*CaduceusOutboundSender).metricsLabel)
+	h.mutex.Unlock()
+
+	// Nothing has happened yet.
+	se := pollSubscription(t, r, "/subscriptions/mine/events?wait=10ms")
+	assert.Empty(se.Events)
+	assert.Equal(uint64(1), se.Cursor)
+
+	sw.Queue(streamEvent("event:test", "skipped"))
+	sw.Queue(streamEvent("event:iot", "first"))
+	sw.Queue(streamEvent("event:iot", "second"))
+
+	var ids []string
+	cursor := se.Cursor
+	for len(ids) < 2 {
+		se = pollSubscription(t, r, "/subscriptions/mine/events?cursor="+strconv.FormatUint(cursor, 10))
+		for _, e := range se.Events {
+			var msg wrp.Message
+			require.NoError(wrp.NewDecoderBytes(e, wrp.JSON).Decode(&msg))
+			ids = append(ids, msg.TransactionUUID)
+		}
+		cursor = se.Cursor
+	}
+	assert.Equal([]string{"first", "second"}, ids)
+	assert.Equal(uint64(3), cursor)
+
+	rr = subscriptionRequest(t, r, "DELETE", "/subscriptions/mine", "")
+	assert.Equal(http.StatusNoContent, rr.Code)
+	assert.Equal(0, streamCount(sw))
+
+	rr = subscriptionRequest(t, r, "GET", "/subscriptions/mine/events", "")
+	assert.Equal(http.StatusNotFound, rr.Code)
+}
+
+func TestSubscriptionBadRequests(t *testing.T) {
+	sw := newStreamTestWrapper(t)
+	defer sw.Shutdown(false)
+
+	h := newSubscriptionHandler(SubscriptionConfig{MaxSubscriptions: 1}, sw, zap.NewNop(), true)
+	r := newSubscriptionTestRouter(h)
+
+	tests := []struct {
+		desc     string
+		body     string
+		expected int
+	}{
+		{desc: "not json", body: `{`, expected: http.StatusBadRequest},
+		{desc: "bad name", body: `{"name": "no/slashes", "events": ["iot"]}`, expected: http.StatusBadRequest},
+		{desc: "no events", body: `{"name": "none"}`, expected: http.StatusBadRequest},
+		{desc: "bad regex", body: `{"name": "bad", "events": ["[[:123"]}`, expected: http.StatusBadRequest},
+		{desc: "bad filter", body: `{"name": "bad", "events": ["iot"], "filter": "qos +"}`, expected: http.StatusBadRequest},
+		{desc: "first", body: `{"name": "first", "events": ["iot"]}`, expected: http.StatusCreated},
+		{desc: "too many", body: `{"name": "second", "events": ["iot"]}`, expected: http.StatusTooManyRequests},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			rr := subscriptionRequest(t, r, "POST", "/subscriptions", tc.body)
+			assert.Equal(t, tc.expected, rr.Code)
+		})
+	}
+
+	rr := subscriptionRequest(t, r, "GET", "/subscriptions/first/events?cursor=abc", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestSubscriptionIdleTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	sw := newStreamTestWrapper(t)
+	defer sw.Shutdown(false)
+
+	h := newSubscriptionHandler(SubscriptionConfig{IdleTimeout: 50 * time.Millisecond}, sw, zap.NewNop(), true)
+	r := newSubscriptionTestRouter(h)
+
+	rr := subscriptionRequest(t, r, "POST", "/subscriptions", `{"name": "idle", "events": ["iot"]}`)
+	assert.Equal(http.StatusCreated, rr.Code)
+	assert.Equal(1, streamCount(sw))
+
+	// Polling would renew it, so only watch the sender go away.
+	assert.Eventually(func() bool { return 0 == streamCount(sw) }, 2*time.Second, 10*time.Millisecond)
+	rr = subscriptionRequest(t, r, "GET", "/subscriptions/idle/events?wait=0s", "")
+	assert.Equal(http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+var (
+	errTemplateRender  = errors.New("delivery template failed")
+	errTemplateNotJSON = errors.New("delivery template output isn't valid JSON")
+	errTemplateDict    = errors.New("dict needs key and value pairs with string keys")
+)
+
+// templateFuncs are the functions delivery templates can use on top of the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	// json encodes a value as JSON.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// dict builds a map from key and value pairs, to build objects or
+	// rename keys.
+	"dict": func(pairs ...interface{}) (map[string]interface{}, error) {
+		if 0 != len(pairs)%2 {
+			return nil, errTemplateDict
+		}
+		m := make(map[string]interface{}, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			key, ok := pairs[i].(string)
+			if !ok {
+				return nil, errTemplateDict
+			}
+			m[key] = pairs[i+1]
+		}
+		return m, nil
+	},
+	// omit returns a copy of an object without the named keys.
+	"omit": func(v interface{}, keys ...string) interface{} {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		out := make(map[string]interface{}, len(m))
+		for k, val := range m {
+			out[k] = val
+		}
+		for _, k := range keys {
+			delete(out, k)
+		}
+		return out
+	},
+	// base64 encodes a string with standard base64.
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+}
+
+// templateData is what a delivery template renders.  Payload is the decoded
+// payload of JSON events and nil otherwise, RawPayload always has the bytes.
+type templateData struct {
+	Source          string
+	Destination     string
+	Event           string
+	TransactionUUID string
+	ContentType     string
+	PartnerIDs      []string
+	Headers         []string
+	Metadata        map[string]string
+	Timestamp       time.Time
+	Payload         interface{}
+	RawPayload      string
+}
+
+// deliveryTemplate reshapes the body delivered to http webhooks.
+type deliveryTemplate struct {
+	tmpl        *template.Template
+	contentType string
+}
+
+// newDeliveryTemplate parses text, whose output is delivered with
+// contentType.  An empty contentType is JSON, which the output is checked to
+// be when the template is validated.
+func newDeliveryTemplate(name, text, contentType string) (*deliveryTemplate, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if nil != err {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	if "" == contentType {
+		contentType = wrp.MimeTypeJson
+	}
+	return &deliveryTemplate{tmpl: tmpl, contentType: contentType}, nil
+}
+
+// render executes the template for e.  A JSON payload is decoded through the
+// event, so it's only decoded once for every webhook rendering it.
+func (t *deliveryTemplate) render(e *outboundEvent) ([]byte, error) {
+	msg := e.Message
+	data := templateData{
+		Source:          msg.Source,
+		Destination:     msg.Destination,
+		Event:           strings.TrimPrefix(msg.Destination, "event:"),
+		TransactionUUID: msg.TransactionUUID,
+		ContentType:     msg.ContentType,
+		PartnerIDs:      msg.PartnerIDs,
+		Headers:         msg.Headers,
+		Metadata:        msg.Metadata,
+		Timestamp:       time.Now().UTC(),
+		RawPayload:      string(msg.Payload),
+	}
+	if isJSONContentType(msg.ContentType) {
+		// A payload that doesn't decode is left nil, RawPayload has it.
+		if payload, err := e.jsonPayload(); nil == err {
+			data.Payload = payload
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); nil != err {
+		return nil, fmt.Errorf("%w: %v", errTemplateRender, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// validate renders the template for a sample event the webhook could
+// receive, so templates that fail or don't produce the content type they
+// claim are found when the webhook is registered.
+func (t *deliveryTemplate) validate(wh ancla.InternalWebhook) error {
+	if nil == t {
+		return nil
+	}
+
+	sample := &wrp.Message{
+		Type:            wrp.SimpleEventMessageType,
+		Source:          "mac:112233445566",
+		Destination:     "event:sample",
+		TransactionUUID: "00000000-0000-0000-0000-000000000000",
+		ContentType:     wrp.MimeTypeJson,
+		PartnerIDs:      wh.PartnerIDs,
+		Metadata:        map[string]string{},
+		Payload:         []byte(`{}`),
+	}
+	body, err := t.render(newOutboundEvent(sample, nil))
+	if nil != err {
+		return err
+	}
+	if isJSONContentType(t.contentType) && !json.Valid(body) {
+		return errTemplateNotJSON
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestDeliveryTemplate(t *testing.T) {
+	tests := []struct {
+		desc     string
+		text     string
+		msg      *wrp.Message
+		expected string
+	}{
+		{
+			desc:     "envelope",
+			text:     `{"source": {{json .Source}}, "event": {{json .Event}}, "model": {{json (index .Metadata "/hw-model")}}, "data": {{json .Payload}}}`,
+			expected: `{"source": "mac:112233445566", "event": "device-status/mac:112233445566/online", "model": "TG1682", "data": {"id": "112233445566"}}`,
+		},
+		{
+			desc:     "drop fields",
+			text:     `{{json (omit .Payload "id")}}`,
+			expected: `{}`,
+		},
+		{
+			desc:     "rename keys",
+			text:     `{{json (dict "deviceId" .Payload.id "partners" .PartnerIDs)}}`,
+			expected: `{"deviceId": "112233445566", "partners": ["comcast", "sky"]}`,
+		},
+		{
+			desc:     "missing metadata",
+			text:     `{{json (index .Metadata "/missing")}}`,
+			expected: `""`,
+		},
+		{
+			desc: "raw payload",
+			text: `{"payload": {{json (base64 .RawPayload)}}, "decoded": {{json .Payload}}}`,
+			msg: &wrp.Message{
+				ContentType: wrp.MimeTypeOctetStream,
+				Payload:     []byte("hi"),
+			},
+			expected: `{"payload": "aGk=", "decoded": null}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			tmpl, err := newDeliveryTemplate(tc.desc, tc.text, "")
+			require.NoError(t, err)
+			require.NoError(t, tmpl.validate(ancla.InternalWebhook{}))
+
+			msg := tc.msg
+			if nil == msg {
+				msg = matcherTestMessage()
+			}
+			body, err := tmpl.render(newOutboundEvent(msg, nil))
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(body))
+		})
+	}
+}
+
+// The payload is decoded once per event, however many webhooks render it.
+func TestDeliveryTemplateSharesPayload(t *testing.T) {
+	tmpl, err := newDeliveryTemplate("shared", `{"decoded": {{json .Payload}}}`, "")
+	require.NoError(t, err)
+
+	e := newOutboundEvent(matcherTestMessage(), nil)
+	decoded, err := e.jsonPayload()
+	require.NoError(t, err)
+	// Mark the cached decoding to see that render uses it.
+	decoded.(map[string]interface{})["marker"] = "cached"
+
+	body, err := tmpl.render(e)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"marker":"cached"`)
+}
+
+func TestDeliveryTemplateTimestamp(t *testing.T) {
+	tmpl, err := newDeliveryTemplate("ts", `{"ts": {{json .Timestamp}}}`, "")
+	require.NoError(t, err)
+
+	body, err := tmpl.render(newOutboundEvent(matcherTestMessage(), nil))
+	require.NoError(t, err)
+
+	var out map[string]string
+	require.NoError(t, json.Unmarshal(body, &out))
+	assert.NotEmpty(t, out["ts"])
+}
+
+func TestDeliveryTemplateInvalid(t *testing.T) {
+	tests := []struct {
+		desc        string
+		text        string
+		contentType string
+		expectErr   error
+	}{
+		{desc: "parse error", text: `{{.Source`},
+		{desc: "unknown function", text: `{{nope .Source}}`},
+		{desc: "render error", text: `{{.Payload.a.b}}`, expectErr: errTemplateRender},
+		{desc: "bad dict", text: `{{json (dict "a")}}`, expectErr: errTemplateRender},
+		{desc: "not json", text: `source={{.Source}}`, expectErr: errTemplateNotJSON},
+		{desc: "json suffix", text: `{`, contentType: "application/cloudevents+json", expectErr: errTemplateNotJSON},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			tmpl, err := newDeliveryTemplate(tc.desc, tc.text, tc.contentType)
+			if nil == err {
+				err = tmpl.validate(ancla.InternalWebhook{})
+			}
+			assert.Error(t, err)
+			if nil != tc.expectErr {
+				assert.ErrorIs(t, err, tc.expectErr)
+			}
+		})
+	}
+
+	// Other content types only have to render.
+	tmpl, err := newDeliveryTemplate("text", `source={{.Source}}`, "text/plain")
+	require.NoError(t, err)
+	assert.NoError(t, tmpl.validate(ancla.InternalWebhook{}))
+
+	var none *deliveryTemplate
+	assert.NoError(t, none.validate(ancla.InternalWebhook{}))
+}
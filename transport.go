@@ -0,0 +1,255 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"container/ring"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xmidt-org/webpa-common/v2/device"
+	"github.com/xmidt-org/webpa-common/v2/xhttp"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/wrp-go/v3/wrphttp"
+	"go.uber.org/zap"
+)
+
+var (
+	errUnsupportedScheme  = errors.New("no transport for url scheme")
+	errInvalidDestination = errors.New("invalid destination")
+)
+
+// Transport delivers events to a webhook's destination.  The outbound sender
+// takes care of matching, partner ID checks, queueing, cut offs and metrics,
+// and hands every event that should be delivered to its Transport.
+type Transport interface {
+	// Deliver sends msg to the first of urls, moving on to the next ones
+	// when the transport retries.  The returned code labels the delivery
+	// metric.  An error wrapping errInvalidDestination is counted as a
+	// configuration problem, any other error as a network failure.
+	Deliver(urls *ring.Ring, secret, acceptType string, msg *outboundEvent) (code string, err error)
+
+	// Close releases the transport's resources once its sender has shut
+	// down.
+	Close() error
+}
+
+// urlPruner is implemented by transports that keep a connection or file open
+// per url, so they can let go of the ones a webhook no longer delivers to
+// when its registration changes.
+type urlPruner interface {
+	prune(urls []string)
+}
+
+// TransportFactory creates the Transport for an outbound sender.
+type TransportFactory func(obs *CaduceusOutboundSender) (Transport, error)
+
+// TransportRegistry maps destination URL schemes to the transports that
+// deliver to them.
+type TransportRegistry map[string]TransportFactory
+
+// DefaultTransports returns the registry used when none is configured.  The
+// file transport is left out, it has to be enabled by the operator.
+func DefaultTransports() TransportRegistry {
+	grpcTransport := NewGRPCTransportFactory(GRPCConfig{})
+	return TransportRegistry{
+		"http":  newHTTPTransport,
+		"https": newHTTPTransport,
+		"grpc":  grpcTransport,
+		"grpcs": grpcTransport,
+		"ws":    newWSTransport,
+		"wss":   newWSTransport,
+	}
+}
+
+// lookup finds the factory for the scheme of rawURL.
+func (r TransportRegistry) lookup(rawURL string) (TransportFactory, error) {
+	scheme := urlScheme(rawURL)
+	if factory, ok := r[scheme]; ok {
+		return factory, nil
+	}
+	return nil, fmt.Errorf("%w: '%s'", errUnsupportedScheme, scheme)
+}
+
+// urlScheme returns the lower case scheme of rawURL, or an empty string if it
+// can't be parsed.
+func urlScheme(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if nil != err {
+		return ""
+	}
+	return strings.ToLower(u.Scheme)
+}
+
+// plainSchemes maps the TLS variant of a scheme to its plain text one.
+var plainSchemes = map[string]string{
+	"https": "http",
+	"grpcs": "grpc",
+	"wss":   "ws",
+}
+
+// sameTransport reports whether urls with the two schemes can be delivered by
+// the same transport, which alternative urls must be.
+func sameTransport(a, b string) bool {
+	if plain, ok := plainSchemes[a]; ok {
+		a = plain
+	}
+	if plain, ok := plainSchemes[b]; ok {
+		b = plain
+	}
+	return a == b
+}
+
+// signature returns the X-Webpa-Signature style HMAC of body keyed with a
+// webhook's secret.
+func signature(secret string, body []byte) string {
+	s := hmac.New(sha1.New, []byte(secret))
+	s.Write(body)
+	return fmt.Sprintf("sha1=%s", hex.EncodeToString(s.Sum(nil)))
+}
+
+// httpTransport POSTs events to http and https webhooks.
+type httpTransport struct {
+	obs *CaduceusOutboundSender
+}
+
+func newHTTPTransport(obs *CaduceusOutboundSender) (Transport, error) {
+	return &httpTransport{obs: obs}, nil
+}
+
+func (t *httpTransport) Deliver(urls *ring.Ring, secret, acceptType string, msg *outboundEvent) (string, error) {
+	obs := t.obs
+
+	payload := msg.Payload
+	body := payload
+	var payloadReader *bytes.Reader
+
+	// Use the internal content type unless the accept type is wrp
+	contentType := msg.ContentType
+	switch acceptType {
+	case "wrp", wrp.MimeTypeMsgpack, wrp.MimeTypeWrp:
+		// Pass the event as it was received whenever possible.
+		contentType = wrp.MimeTypeMsgpack
+		var err error
+		if body, err = msg.msgpack(); nil != err {
+			return "", err
+		}
+	}
+
+	// A profile's template replaces the body, and the rendered body is
+	// what gets signed.  CloudEvents carry it as their data.
+	obs.mutex.RLock()
+	tmpl := obs.profile.template()
+	obs.mutex.RUnlock()
+	if nil != tmpl {
+		rendered, err := tmpl.render(msg)
+		if nil != err {
+			return "", err
+		}
+		body = rendered
+		contentType = tmpl.contentType
+	}
+
+	ceHeaders := http.Header{}
+	if isCloudEvents(acceptType) {
+		ce := newCloudEvent(msg.Message)
+		ce.data = body
+		if "" != contentType {
+			ce.attributes["datacontenttype"] = contentType
+		}
+
+		if cloudEventsBinary == acceptType {
+			body, contentType = ce.binary(ceHeaders)
+		} else {
+			var err error
+			if body, err = ce.structured(); nil != err {
+				return "", err
+			}
+			contentType = cloudEventsStructured
+		}
+	}
+	payloadReader = bytes.NewReader(body)
+
+	req, err := http.NewRequest("POST", urls.Value.(string), payloadReader)
+	if nil != err {
+		return "", fmt.Errorf("%w: %v", errInvalidDestination, err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range ceHeaders {
+		req.Header[k] = v
+	}
+
+	// Add x-Midt-* headers
+	wrphttp.AddMessageHeaders(req.Header, msg.Message)
+
+	// Provide the old headers for now
+	req.Header.Set("X-Webpa-Event", strings.TrimPrefix(msg.Destination, "event:"))
+	req.Header.Set("X-Webpa-Transaction-Id", msg.TransactionUUID)
+
+	// Add the device id without the trailing service
+	id, _ := device.ParseID(msg.Source)
+	req.Header.Set("X-Webpa-Device-Id", string(id))
+	req.Header.Set("X-Webpa-Device-Name", string(id))
+
+	// Apply the secret
+
+	if "" != secret {
+		req.Header.Set("X-Webpa-Signature", signature(secret, body))
+	}
+
+	// find the event "short name"
+	event := msg.FindEventStringSubMatch()
+
+	retryOptions := xhttp.RetryOptions{
+		Logger:   obs.logger,
+		Retries:  obs.qos.deliveryRetries(msg.Message, obs.deliveryRetries),
+		Interval: obs.deliveryInterval,
+		Counter:  obs.deliveryRetryCounter.With("url", obs.metricsLabel, "event", event),
+		// Always retry on failures up to the max count.
+		ShouldRetry:       xhttp.ShouldRetry,
+		ShouldRetryStatus: xhttp.RetryCodes,
+	}
+
+	// update subsequent requests with the next url in the list upon failure
+	retryOptions.UpdateRequest = func(request *http.Request) {
+		urls = urls.Next()
+		tmp, err := url.Parse(urls.Value.(string))
+		if err != nil {
+			obs.logger.Error("failed to update url", zap.String("url", urls.Value.(string)), zap.Error(err))
+			return
+		}
+		request.URL = tmp
+	}
+
+	retryer := xhttp.RetryTransactor(retryOptions, obs.sender.Do)
+	client := obs.clientMiddleware(doerFunc(retryer))
+	resp, err := client.Do(req)
+	if nil != err {
+		return "", err
+	}
+
+	// read until the response is complete before closing to allow
+	// connection reuse
+	if nil != resp.Body {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	obs.logger.Debug("event posted", zap.String("event.source", msg.Source), zap.String("url", req.URL.String()))
+	return strconv.Itoa(resp.StatusCode), nil
+}
+
+// Close does nothing, the http client is shared by every sender.
+func (t *httpTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,196 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTransport is a Transport that remembers what it delivered.
+type recordingTransport struct {
+	mutex     sync.Mutex
+	delivered []string
+	closed    bool
+}
+
+func (t *recordingTransport) Deliver(urls *ring.Ring, _, _ string, msg *outboundEvent) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.delivered = append(t.delivered, msg.TransactionUUID)
+	return "200", nil
+}
+
+func (t *recordingTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	return nil
+}
+
+func TestTransportRegistryLookup(t *testing.T) {
+	tests := []struct {
+		desc      string
+		url       string
+		expectErr error
+	}{
+		{desc: "http", url: "http://localhost/foo"},
+		{desc: "https upper case", url: "HTTPS://localhost/foo"},
+		{desc: "grpc", url: "grpc://localhost:9090"},
+		{desc: "grpcs", url: "grpcs://localhost:9090"},
+		{desc: "ws", url: "ws://localhost:8080/events"},
+		{desc: "wss", url: "wss://localhost:8443/events"},
+		{desc: "file is opt in", url: "file:///tmp/events.jsonl", expectErr: errUnsupportedScheme},
+		{desc: "unknown scheme", url: "ftp://localhost/foo", expectErr: errUnsupportedScheme},
+		{desc: "no scheme", url: "localhost/foo", expectErr: errUnsupportedScheme},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			factory, err := DefaultTransports().lookup(tc.url)
+			if nil != tc.expectErr {
+				assert.ErrorIs(err, tc.expectErr)
+				assert.Nil(factory)
+				return
+			}
+			assert.NoError(err)
+			assert.NotNil(factory)
+		})
+	}
+}
+
+func TestSameTransport(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(sameTransport("http", "http"))
+	assert.True(sameTransport("http", "https"))
+	assert.True(sameTransport("grpcs", "grpc"))
+	assert.True(sameTransport("ws", "wss"))
+	assert.True(sameTransport("file", "file"))
+	assert.False(sameTransport("grpc", "http"))
+	assert.False(sameTransport("http", "file"))
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	assert := assert.New(t)
+
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Listener.Webhook.Config.URL = "ftp://localhost:9999/foo"
+	obs, err := obsf.New()
+	assert.Nil(obs)
+	assert.ErrorIs(err, errUnsupportedScheme)
+}
+
+func TestAltURLTransportMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	w := obsf.Listener
+	obs, err := obsf.New()
+	require.NoError(t, err)
+
+	w.Webhook.Config.AlternativeURLs = []string{"https://localhost:9999/bar"}
+	assert.NoError(obs.Update(w))
+
+	w.Webhook.Config.AlternativeURLs = []string{"file:///tmp/bar.jsonl"}
+	assert.Error(obs.Update(w))
+
+	obs.Shutdown(true)
+}
+
+func TestCustomTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	custom := &recordingTransport{}
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+	obs, err := obsf.New()
+	require.NoError(t, err)
+
+	// Events that fail the sender's matching never reach the transport.
+	for _, dest := range []string{"event:iot", "event:no-match", "event:test"} {
+		req := simpleRequestWithPartnerIDs()
+		req.Destination = dest
+		req.TransactionUUID = dest
+		obs.Queue(newOutboundEvent(req, nil))
+	}
+
+	obs.Shutdown(true)
+
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.ElementsMatch([]string{"event:iot", "event:test"}, custom.delivered)
+	assert.True(custom.closed)
+}
+
+func TestTransportFactoryError(t *testing.T) {
+	assert := assert.New(t)
+
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return nil, errors.New("no way") },
+	}
+	obs, err := obsf.New()
+	assert.Nil(obs)
+	assert.Error(err)
+}
+
+// pruningTransport is a recordingTransport that remembers the urls it was
+// last pruned to.
+type pruningTransport struct {
+	recordingTransport
+	pruned []string
+}
+
+func (t *pruningTransport) prune(urls []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pruned = urls
+}
+
+func TestUpdatePrunesTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	custom := &pruningTransport{}
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.Transports = TransportRegistry{
+		"http": func(*CaduceusOutboundSender) (Transport, error) { return custom, nil },
+	}
+	w := obsf.Listener
+	obs, err := obsf.New()
+	require.NoError(t, err)
+	defer obs.Shutdown(false)
+
+	w.Webhook.Config.AlternativeURLs = []string{"http://localhost:9999/bar", "http://localhost:9999/baz"}
+	require.NoError(t, obs.Update(w))
+
+	custom.mutex.Lock()
+	defer custom.mutex.Unlock()
+	assert.Equal(w.Webhook.Config.AlternativeURLs, custom.pruned)
+}
+
+// gatedTransport is a recordingTransport that holds deliveries until it is
+// opened.
+type gatedTransport struct {
+	recordingTransport
+	gate chan struct{}
+}
+
+func (t *gatedTransport) Deliver(urls *ring.Ring, secret, acceptType string, msg *outboundEvent) (string, error) {
+	<-t.gate
+	return t.recordingTransport.Deliver(urls, secret, acceptType, msg)
+}
+
+func (t *gatedTransport) count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.delivered)
+}
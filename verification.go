@@ -0,0 +1,217 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	defaultVerificationTimeout       = 10 * time.Second
+	defaultVerificationRetries       = 3
+	defaultVerificationRetryInterval = 30 * time.Second
+
+	// verificationChallengeHeader carries the challenge on top of the body,
+	// for endpoints that would rather not parse it.
+	verificationChallengeHeader = "X-Webpa-Challenge"
+
+	// maxVerificationResponse is the most of a response read looking for
+	// the challenge.
+	maxVerificationResponse = 4 * 1024
+
+	verificationType = "webhook.verification"
+)
+
+// Outcomes of verifying a webhook.
+const (
+	verifiedOutcome           = "verified"
+	verificationFailedOutcome = "failed"
+)
+
+var (
+	errVerificationEcho = errors.New("verification response didn't echo the challenge")
+	errUnverifiable     = errors.New("only http and https webhooks can be verified")
+)
+
+// VerificationConfig configures the handshake that proves a webhook's owner
+// controls the URLs it registered before any events are delivered to them.
+type VerificationConfig struct {
+	// Enabled turns on verification of http and https webhooks.  Each URL
+	// is sent a signed challenge, and events are only delivered once every
+	// URL responds with a 2xx echoing it.  Events that arrive before then
+	// are dropped.
+	Enabled bool
+
+	// Timeout limits each challenge request.
+	// (Optional) defaults to 10s.
+	Timeout time.Duration
+
+	// Retries is the number of times a failed challenge is retried before
+	// the webhook is left unverified until it is registered again.
+	// (Optional) defaults to 3.
+	Retries int
+
+	// RetryInterval is the time before the first retry, doubled for each
+	// one after that.  (Optional) defaults to 30s.
+	RetryInterval time.Duration
+}
+
+// VerificationChallenge is the body of a challenge request.  The endpoint
+// proves it received it by responding with the challenge, either as the
+// whole body or as the challenge field of a JSON object.
+type VerificationChallenge struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	URL       string `json:"url"`
+}
+
+// verificationPolicy is the compiled form of VerificationConfig.  A nil
+// policy doesn't verify.
+type verificationPolicy struct {
+	timeout       time.Duration
+	retries       int
+	retryInterval time.Duration
+}
+
+func newVerificationPolicy(c VerificationConfig) (*verificationPolicy, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	if c.Timeout < 0 || c.Retries < 0 || c.RetryInterval < 0 {
+		return nil, errors.New("verification timeout, retries and retry interval must not be negative")
+	}
+
+	p := &verificationPolicy{
+		timeout:       c.Timeout,
+		retries:       c.Retries,
+		retryInterval: c.RetryInterval,
+	}
+	if 0 == p.timeout {
+		p.timeout = defaultVerificationTimeout
+	}
+	if 0 == p.retries {
+		p.retries = defaultVerificationRetries
+	}
+	if 0 == p.retryInterval {
+		p.retryInterval = defaultVerificationRetryInterval
+	}
+	return p, nil
+}
+
+// verify challenges every url, retrying each failed one, and returns an
+// error unless they all echoed their challenge.  It gives up early when ctx
+// is done.
+func (p *verificationPolicy) verify(ctx context.Context, client httpClient, urls []string, secret string) error {
+	for _, u := range urls {
+		interval := p.retryInterval
+		err := p.challenge(ctx, client, u, secret)
+		for i := 0; nil != err && i < p.retries; i++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+			interval *= 2
+			err = p.challenge(ctx, client, u, secret)
+		}
+		if nil != err {
+			return fmt.Errorf("verifying '%s': %w", u, err)
+		}
+	}
+	return nil
+}
+
+// challenge sends u a new challenge and checks the response echoes it.
+func (p *verificationPolicy) challenge(ctx context.Context, client httpClient, u, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	challenge := uuid.NewV4().String()
+	body, err := json.Marshal(VerificationChallenge{
+		Type:      verificationType,
+		Challenge: challenge,
+		URL:       u,
+	})
+	if nil != err {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if nil != err {
+		return fmt.Errorf("%w: %v", errInvalidDestination, err)
+	}
+	req.Header.Set("Content-Type", wrp.MimeTypeJson)
+	req.Header.Set(verificationChallengeHeader, challenge)
+	if "" != secret {
+		h := hmac.New(sha1.New, []byte(secret))
+		h.Write(body)
+		req.Header.Set("X-Webpa-Signature", "sha1="+hex.EncodeToString(h.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if nil != err {
+		return err
+	}
+	if nil == resp.Body {
+		return errVerificationEcho
+	}
+	defer resp.Body.Close()
+
+	echo, err := io.ReadAll(io.LimitReader(resp.Body, maxVerificationResponse))
+	if nil != err {
+		return err
+	}
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		return fmt.Errorf("%w: status %d", errVerificationEcho, resp.StatusCode)
+	}
+	if !echoes(echo, challenge) {
+		return errVerificationEcho
+	}
+	return nil
+}
+
+// echoes reports whether a response body holds the challenge.
+func echoes(body []byte, challenge string) bool {
+	body = bytes.TrimSpace(body)
+	if string(body) == challenge {
+		return true
+	}
+	var v struct {
+		Challenge string `json:"challenge"`
+	}
+	return nil == json.Unmarshal(body, &v) && v.Challenge == challenge
+}
+
+// deliveryURLs returns the URLs a webhook's events are delivered to, its
+// alternative URLs when it has any and its URL otherwise.
+func deliveryURLs(url string, alternatives []string) []string {
+	if 0 < len(alternatives) {
+		return alternatives
+	}
+	return []string{url}
+}
+
+func sameURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoClient answers challenges with the body respond returns for them.
+func echoClient(status int, respond func(challenge string) string) (httpClient, *[]*http.Request) {
+	var (
+		mutex    sync.Mutex
+		requests []*http.Request
+	)
+	return doerFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		requests = append(requests, req)
+		mutex.Unlock()
+		return &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(strings.NewReader(respond(req.Header.Get(verificationChallengeHeader)))),
+		}, nil
+	}), &requests
+}
+
+func TestVerificationChallenge(t *testing.T) {
+	tests := []struct {
+		desc      string
+		status    int
+		respond   func(string) string
+		expectErr error
+	}{
+		{desc: "plain echo", status: 200, respond: func(c string) string { return c + "\n" }},
+		{desc: "json echo", status: 202, respond: func(c string) string { return `{"challenge": "` + c + `"}` }},
+		{desc: "wrong echo", status: 200, respond: func(string) string { return "nope" }, expectErr: errVerificationEcho},
+		{desc: "no echo", status: 200, respond: func(string) string { return "" }, expectErr: errVerificationEcho},
+		{desc: "error status", status: 404, respond: func(c string) string { return c }, expectErr: errVerificationEcho},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			p, err := newVerificationPolicy(VerificationConfig{Enabled: true})
+			require.NoError(t, err)
+
+			client, requests := echoClient(tc.status, tc.respond)
+			err = p.challenge(context.Background(), client, "https://example.com/hook", "secret")
+			if nil != tc.expectErr {
+				assert.ErrorIs(err, tc.expectErr)
+			} else {
+				assert.NoError(err)
+			}
+
+			require.Len(t, *requests, 1)
+			req := (*requests)[0]
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+
+			var challenge VerificationChallenge
+			require.NoError(t, json.Unmarshal(body, &challenge))
+			assert.Equal(verificationType, challenge.Type)
+			assert.Equal("https://example.com/hook", challenge.URL)
+			assert.Equal(req.Header.Get(verificationChallengeHeader), challenge.Challenge)
+			assert.NotEmpty(challenge.Challenge)
+
+			h := hmac.New(sha1.New, []byte("secret"))
+			h.Write(body)
+			assert.Equal("sha1="+hex.EncodeToString(h.Sum(nil)), req.Header.Get("X-Webpa-Signature"))
+		})
+	}
+}
+
+func TestVerificationRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := newVerificationPolicy(VerificationConfig{Enabled: true, Retries: 2, RetryInterval: time.Millisecond})
+	require.NoError(t, err)
+
+	var (
+		mutex    sync.Mutex
+		attempts = map[string]int{}
+	)
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts[req.URL.String()]++
+		if attempts[req.URL.String()] < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(strings.NewReader(req.Header.Get(verificationChallengeHeader))),
+		}, nil
+	})
+
+	// Each url gets its own retries.
+	urls := []string{"https://a.example.com", "https://b.example.com"}
+	assert.NoError(p.verify(context.Background(), client, urls, ""))
+	assert.Equal(map[string]int{"https://a.example.com": 3, "https://b.example.com": 3}, attempts)
+
+	// Running out of retries fails.
+	attempts = map[string]int{"https://a.example.com": -1}
+	assert.Error(p.verify(context.Background(), client, urls, ""))
+	assert.Equal(map[string]int{"https://a.example.com": 2}, attempts)
+}
+
+func TestVerificationCanceled(t *testing.T) {
+	p, err := newVerificationPolicy(VerificationConfig{Enabled: true, RetryInterval: time.Hour})
+	require.NoError(t, err)
+
+	client, _ := echoClient(500, func(string) string { return "" })
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	assert.ErrorIs(t, p.verify(ctx, client, []string{"https://example.com"}, ""), context.Canceled)
+}
+
+func TestNewVerificationPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := newVerificationPolicy(VerificationConfig{})
+	assert.Nil(p)
+	assert.NoError(err)
+
+	p, err = newVerificationPolicy(VerificationConfig{Enabled: true})
+	require.NoError(t, err)
+	assert.Equal(&verificationPolicy{
+		timeout:       defaultVerificationTimeout,
+		retries:       defaultVerificationRetries,
+		retryInterval: defaultVerificationRetryInterval,
+	}, p)
+
+	p, err = newVerificationPolicy(VerificationConfig{Enabled: true, Retries: -1})
+	assert.Nil(p)
+	assert.Error(err)
+}
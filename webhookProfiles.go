@@ -0,0 +1,235 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+var errNoProfileURLs = errors.New("webhook profile must have urls")
+
+// WebhookProfile configures delivery options for the webhook registrations
+// with matching URLs and partner ids.  Registrations reach caduceus as
+// ancla.Webhook, which drops any field it doesn't know about, so all a
+// registration can match on is its events and device id regexes.  Those are
+// checked when the registration is applied, and a registration with invalid
+// ones is rejected and counted by WebhookRejectedCounter.  Options that don't
+// fit in the registration are set up here by the operator.
+type WebhookProfile struct {
+	// Name identifies the profile in logs.
+	Name string
+
+	// URLs is the list of regular expressions a webhook's URL is matched
+	// against to use this profile.  The first profile that matches wins.
+	URLs []string
+
+	// PartnerIDs limits the profile to registrations with one of these
+	// partner ids, so registrations from different partners for the same
+	// URL can use different profiles.  (Optional) defaults to any partner.
+	PartnerIDs []string
+
+	// Matcher is a condition events have to meet, on top of the
+	// registration's events and device ids, to be delivered.  (Optional)
+	Matcher *MatcherConfig
+
+	// Filter is a CEL expression events have to pass to be delivered, see
+	// newFilterEnv for what it can use.  (Optional)
+	Filter string
+
+	// FilterCostLimit limits the work Filter does for each event.
+	// (Optional) defaults to 10000.
+	FilterCostLimit uint64
+
+	// Payload is a list of conditions on the JSON payload that must all
+	// hold.  They are checked after everything else, events that aren't
+	// JSON never meet them.  (Optional)
+	Payload []PayloadPredicate
+
+	// MaxPayloadParseSize is the largest payload Payload parses, bigger
+	// events are dropped.  (Optional) defaults to 64KiB.
+	MaxPayloadParseSize int
+
+	// Template is a text/template that renders the body delivered to http
+	// webhooks in place of the payload, see templateData for what it can
+	// use.  The body is signed after it's rendered.  (Optional)
+	Template string
+
+	// TemplateContentType is the content type of what Template renders.
+	// (Optional) defaults to application/json.
+	TemplateContentType string
+
+	// Sampling delivers only a sample of the events that get through
+	// everything else.  Events left out are counted as sampled out rather
+	// than dropped.  (Optional)
+	Sampling *SamplingConfig
+}
+
+type webhookProfile struct {
+	name       string
+	urls       []*regexp.Regexp
+	partnerIDs []string
+	matcher    eventMatcher
+	filter     *eventFilter
+	payload    *payloadFilter
+	tmpl       *deliveryTemplate
+	sampler    *eventSampler
+}
+
+// webhookProfiles finds the profile of a webhook.
+type webhookProfiles struct {
+	profiles []*webhookProfile
+}
+
+// newWebhookProfiles compiles the configured profiles.  No profiles results
+// in a nil webhookProfiles, which has no profile for any webhook.
+func newWebhookProfiles(config []WebhookProfile) (*webhookProfiles, error) {
+	if 0 == len(config) {
+		return nil, nil
+	}
+
+	wp := &webhookProfiles{
+		profiles: make([]*webhookProfile, 0, len(config)),
+	}
+	for _, c := range config {
+		if 0 == len(c.URLs) {
+			return nil, fmt.Errorf("webhook profile '%s': %w", c.Name, errNoProfileURLs)
+		}
+
+		p := &webhookProfile{name: c.Name, partnerIDs: c.PartnerIDs}
+		for _, u := range c.URLs {
+			re, err := regexp.Compile(u)
+			if nil != err {
+				return nil, fmt.Errorf("webhook profile '%s': invalid url regex '%s': %w", c.Name, u, err)
+			}
+			p.urls = append(p.urls, re)
+		}
+
+		if nil != c.Matcher {
+			m, err := newEventMatcher(*c.Matcher)
+			if nil != err {
+				return nil, fmt.Errorf("webhook profile '%s': %w", c.Name, err)
+			}
+			p.matcher = m
+		}
+
+		if "" != c.Filter {
+			f, err := newEventFilter(c.Filter, c.FilterCostLimit)
+			if nil != err {
+				return nil, fmt.Errorf("webhook profile '%s': %w", c.Name, err)
+			}
+			p.filter = f
+		}
+
+		pf, err := newPayloadFilter(c.Payload, c.MaxPayloadParseSize)
+		if nil != err {
+			return nil, fmt.Errorf("webhook profile '%s': %w", c.Name, err)
+		}
+		p.payload = pf
+
+		if "" != c.Template {
+			if p.tmpl, err = newDeliveryTemplate(c.Name, c.Template, c.TemplateContentType); nil != err {
+				return nil, fmt.Errorf("webhook profile '%s': %w", c.Name, err)
+			}
+		}
+
+		if nil != c.Sampling {
+			if p.sampler, err = newEventSampler(*c.Sampling); nil != err {
+				return nil, fmt.Errorf("webhook profile '%s': %w", c.Name, err)
+			}
+		}
+
+		wp.profiles = append(wp.profiles, p)
+	}
+	return wp, nil
+}
+
+// singleProfile returns a webhookProfiles that uses p for every webhook.
+func singleProfile(p *webhookProfile) *webhookProfiles {
+	if nil == p {
+		return nil
+	}
+	return &webhookProfiles{profiles: []*webhookProfile{p}}
+}
+
+// lookup returns the profile for a webhook registration, or nil if there
+// isn't one.  Profiles without urls, which only come from singleProfile,
+// match every registration.
+func (wp *webhookProfiles) lookup(wh ancla.InternalWebhook) *webhookProfile {
+	if nil == wp {
+		return nil
+	}
+	for _, p := range wp.profiles {
+		if p.selects(wh) {
+			return p
+		}
+	}
+	return nil
+}
+
+// selects reports whether the profile applies to wh.
+func (p *webhookProfile) selects(wh ancla.InternalWebhook) bool {
+	if 0 < len(p.partnerIDs) && !overlaps(p.partnerIDs, wh.PartnerIDs) {
+		return false
+	}
+	if 0 == len(p.urls) {
+		return true
+	}
+	for _, re := range p.urls {
+		if re.MatchString(wh.Webhook.Config.URL) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether msg meets the profile's matcher.
+func (p *webhookProfile) matches(msg *wrp.Message) bool {
+	if nil == p || nil == p.matcher {
+		return true
+	}
+	return p.matcher(msg)
+}
+
+// passes reports whether msg passes the profile's filter.
+func (p *webhookProfile) passes(msg *wrp.Message) (bool, error) {
+	if nil == p {
+		return true, nil
+	}
+	return p.filter.matches(msg)
+}
+
+// payloadMatches reports whether msg's payload meets the profile's payload
+// conditions, and if not, the reason it was dropped.
+func (p *webhookProfile) payloadMatches(msg *outboundEvent) (bool, string) {
+	if nil == p {
+		return true, ""
+	}
+	return p.payload.matches(msg)
+}
+
+// sampled reports whether msg is in the profile's sample.  Replayed events
+// aren't sampled uniformly again, which would leave out a different share of
+// them than the first time, but a device stays in or out of a sample by
+// device.
+func (p *webhookProfile) sampled(msg *wrp.Message, replayed bool) bool {
+	if nil == p || nil == p.sampler {
+		return true
+	}
+	if replayed && !p.sampler.byDevice {
+		return true
+	}
+	return p.sampler.sampled(msg)
+}
+
+// template returns the profile's delivery template, or nil if it has none.
+func (p *webhookProfile) template() *deliveryTemplate {
+	if nil == p {
+		return nil
+	}
+	return p.tmpl
+}
@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/ancla"
+)
+
+func profileTestWebhook(url string, partnerIDs ...string) ancla.InternalWebhook {
+	w := ancla.InternalWebhook{PartnerIDs: partnerIDs}
+	w.Webhook.Config.URL = url
+	return w
+}
+
+func TestWebhookProfiles(t *testing.T) {
+	assert := assert.New(t)
+
+	wp, err := newWebhookProfiles([]WebhookProfile{
+		{
+			Name:    "tg",
+			URLs:    []string{"^https://tg\\.example\\.com/"},
+			Matcher: &MatcherConfig{Field: "metadata", Key: "/hw-model", Value: "^TG"},
+		},
+		{
+			Name:       "partner",
+			URLs:       []string{"example\\.com"},
+			PartnerIDs: []string{"partner"},
+		},
+		{
+			Name: "catch all",
+			URLs: []string{"example\\.com"},
+		},
+	})
+	require.NoError(t, err)
+
+	tg := wp.lookup(profileTestWebhook("https://tg.example.com/events"))
+	require.NotNil(t, tg)
+	assert.Equal("tg", tg.name)
+	assert.True(tg.matches(matcherTestMessage()))
+
+	msg := matcherTestMessage()
+	msg.Metadata["/hw-model"] = "XB6"
+	assert.False(tg.matches(msg))
+
+	other := wp.lookup(profileTestWebhook("https://other.example.com/events", "comcast"))
+	require.NotNil(t, other)
+	assert.Equal("catch all", other.name)
+	assert.True(other.matches(msg))
+
+	// Registrations for the same URL from another partner use its profile.
+	partner := wp.lookup(profileTestWebhook("https://other.example.com/events", "comcast", "partner"))
+	require.NotNil(t, partner)
+	assert.Equal("partner", partner.name)
+
+	none := wp.lookup(profileTestWebhook("https://localhost/events", "partner"))
+	assert.Nil(none)
+	assert.True(none.matches(msg))
+
+	var empty *webhookProfiles
+	assert.Nil(empty.lookup(profileTestWebhook("https://tg.example.com/events")))
+}
+
+func TestWebhookProfilesInvalid(t *testing.T) {
+	tests := []struct {
+		desc      string
+		config    []WebhookProfile
+		expectErr error
+	}{
+		{desc: "no urls", config: []WebhookProfile{{Name: "none"}}, expectErr: errNoProfileURLs},
+		{desc: "bad url regex", config: []WebhookProfile{{Name: "bad", URLs: []string{"[[:123"}}}},
+		{
+			desc:      "bad matcher",
+			config:    []WebhookProfile{{Name: "bad", URLs: []string{".*"}, Matcher: &MatcherConfig{Field: "nope"}}},
+			expectErr: errMatcherUnknown,
+		},
+		{
+			desc:      "bad filter",
+			config:    []WebhookProfile{{Name: "bad", URLs: []string{".*"}, Filter: "qos"}},
+			expectErr: errFilterNotBool,
+		},
+		{
+			desc:      "bad sampling rate",
+			config:    []WebhookProfile{{Name: "bad", URLs: []string{".*"}, Sampling: &SamplingConfig{Rate: 2}}},
+			expectErr: errSampleRate,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			wp, err := newWebhookProfiles(tc.config)
+			assert.Nil(wp)
+			assert.Error(err)
+			if nil != tc.expectErr {
+				assert.ErrorIs(err, tc.expectErr)
+			}
+		})
+	}
+
+	wp, err := newWebhookProfiles(nil)
+	assert.Nil(t, wp)
+	assert.NoError(t, err)
+}
+
+func TestWebhookProfileSamplingReplayed(t *testing.T) {
+	assert := assert.New(t)
+
+	wp, err := newWebhookProfiles([]WebhookProfile{
+		{Name: "uniform", URLs: []string{"uniform"}, Sampling: &SamplingConfig{Rate: 0.000001}},
+		{Name: "device", URLs: []string{"device"}, Sampling: &SamplingConfig{Rate: 0.5, ByDevice: true}},
+	})
+	require.NoError(t, err)
+
+	uniform := wp.lookup(profileTestWebhook("https://uniform.example.com/events"))
+	msg := matcherTestMessage()
+	assert.False(uniform.sampled(msg, false))
+	assert.True(uniform.sampled(msg, true), "replays aren't sampled uniformly again")
+
+	device := wp.lookup(profileTestWebhook("https://device.example.com/events"))
+	for i := 0; i < 10; i++ {
+		msg.Source = fmt.Sprintf("mac:%012x", i)
+		assert.Equal(device.sampled(msg, false), device.sampled(msg, true), msg.Source)
+	}
+
+	var none *webhookProfile
+	assert.True(none.sampled(msg, true))
+}
@@ -0,0 +1,209 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// wsSentCode is the delivery metric code for events written to a
+	// websocket.
+	wsSentCode = "sent"
+
+	wsHandshakeTimeout = 10 * time.Second
+	wsWriteTimeout     = 10 * time.Second
+)
+
+// wsTransport delivers events to ws:// and wss:// webhooks.  Each sender
+// dials one websocket per destination and writes every event to it as a
+// binary message holding the same msgpack encoded StreamEvent the gRPC
+// transport sends, so it carries the signature.  Consumers don't ack events,
+// an event is delivered once it's written.  A connection that fails a write
+// is dropped and dialed again by the next delivery.
+type wsTransport struct {
+	obs    *CaduceusOutboundSender
+	dialer *websocket.Dialer
+	mutex  sync.Mutex
+	conns  map[string]*wsConn
+	closed chan struct{}
+}
+
+func newWSTransport(obs *CaduceusOutboundSender) (Transport, error) {
+	return &wsTransport{
+		obs: obs,
+		dialer: &websocket.Dialer{
+			Proxy:            websocket.DefaultDialer.Proxy,
+			HandshakeTimeout: wsHandshakeTimeout,
+		},
+		conns:  make(map[string]*wsConn),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// wsConn serializes writes, which a websocket doesn't allow concurrently.
+type wsConn struct {
+	mutex  sync.Mutex
+	conn   *websocket.Conn
+	nextID uint64
+}
+
+func (t *wsTransport) Deliver(urls *ring.Ring, secret, _ string, msg *outboundEvent) (string, error) {
+	event, err := msg.msgpack()
+	if nil != err {
+		return "", err
+	}
+
+	var sig string
+	if "" != secret {
+		sig = signature(secret, event)
+	}
+
+	retries := t.obs.qos.deliveryRetries(msg.Message, t.obs.deliveryRetries)
+	for attempt := 0; ; attempt++ {
+		target := urls.Value.(string)
+		err = t.send(target, StreamEvent{Event: event, Signature: sig})
+		if nil == err {
+			return wsSentCode, nil
+		}
+		if attempt >= retries {
+			return "", err
+		}
+
+		t.obs.deliveryRetryCounter.With("url", t.obs.metricsLabel, "event", msg.FindEventStringSubMatch()).Add(1.0)
+		t.obs.logger.Debug("retrying event", zap.String("url", target), zap.Error(err))
+		select {
+		case <-t.closed:
+			return "", errTransportEnded
+		case <-time.After(t.obs.deliveryInterval):
+		}
+		urls = urls.Next()
+	}
+}
+
+// send writes event to the websocket for target, dialing it if needed.
+func (t *wsTransport) send(target string, event StreamEvent) error {
+	c, err := t.conn(target)
+	if nil != err {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextID++
+	event.ID = c.nextID
+	data, err := wrpCodec{}.Marshal(&event)
+	if nil != err {
+		return err
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err = c.conn.WriteMessage(websocket.BinaryMessage, data); nil != err {
+		t.drop(target, c)
+	}
+	return err
+}
+
+// conn returns the connection to target, dialing it if needed.
+func (t *wsTransport) conn(target string) (*wsConn, error) {
+	t.mutex.Lock()
+	c, ok := t.conns[target]
+	t.mutex.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	u, err := url.Parse(target)
+	if nil != err {
+		return nil, fmt.Errorf("%w: %v", errInvalidDestination, err)
+	}
+	if "" == u.Host {
+		return nil, fmt.Errorf("%w: websocket url '%s' has no host", errInvalidDestination, target)
+	}
+
+	conn, resp, err := t.dialer.Dial(target, nil)
+	if nil != resp && nil != resp.Body {
+		resp.Body.Close()
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	select {
+	case <-t.closed:
+		conn.Close()
+		return nil, errTransportEnded
+	default:
+	}
+	if c, ok = t.conns[target]; ok {
+		// Another delivery dialed it first.
+		conn.Close()
+		return c, nil
+	}
+	c = &wsConn{conn: conn}
+	t.conns[target] = c
+	return c, nil
+}
+
+// drop closes c, if it's still target's connection.
+func (t *wsTransport) drop(target string, c *wsConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.conns[target] == c {
+		delete(t.conns, target)
+	}
+	c.conn.Close()
+}
+
+// prune closes the websockets to destinations that aren't in urls.
+func (t *wsTransport) prune(urls []string) {
+	keep := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		keep[u] = true
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for target, c := range t.conns {
+		if !keep[target] {
+			c.conn.Close()
+			delete(t.conns, target)
+		}
+	}
+}
+
+// Close closes every websocket.
+func (t *wsTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	select {
+	case <-t.closed:
+		return nil
+	default:
+		close(t.closed)
+	}
+
+	var err error
+	for target, c := range t.conns {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+		if cerr := c.conn.Close(); nil == err {
+			err = cerr
+		}
+		delete(t.conns, target)
+	}
+	return err
+}
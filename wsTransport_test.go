@@ -0,0 +1,196 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"container/ring"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+)
+
+// wsConsumer is a websocket consumer that records the events it receives.
+// Its connections can be dropped to simulate the consumer restarting.
+type wsConsumer struct {
+	mutex      sync.Mutex
+	received   []string
+	signatures []string
+	conns      []*websocket.Conn
+}
+
+func (c *wsConsumer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if nil != err {
+		return
+	}
+	c.mutex.Lock()
+	c.conns = append(c.conns, conn)
+	c.mutex.Unlock()
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if nil != err {
+			return
+		}
+		if websocket.BinaryMessage != messageType {
+			continue
+		}
+
+		var event StreamEvent
+		if err := (wrpCodec{}).Unmarshal(data, &event); nil != err {
+			return
+		}
+		var msg wrp.Message
+		if err := wrp.NewDecoderBytes(event.Event, wrp.Msgpack).Decode(&msg); nil != err {
+			return
+		}
+
+		c.mutex.Lock()
+		c.received = append(c.received, msg.TransactionUUID)
+		c.signatures = append(c.signatures, event.Signature)
+		c.mutex.Unlock()
+	}
+}
+
+func (c *wsConsumer) events() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.received...)
+}
+
+func (c *wsConsumer) drop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+}
+
+func newTestWSTransport(t *testing.T, retries int) Transport {
+	obs := &CaduceusOutboundSender{
+		id:                   "ws://consumer",
+		metricsLabel:         "ws://consumer",
+		logger:               zap.NewNop(),
+		deliveryRetries:      retries,
+		deliveryInterval:     10 * time.Millisecond,
+		deliveryRetryCounter: discard.NewCounter(),
+	}
+	wt, err := newWSTransport(obs)
+	require.NoError(t, err)
+	return wt
+}
+
+func wsURLs(server *httptest.Server) *ring.Ring {
+	urls := ring.New(1)
+	urls.Value = "ws" + strings.TrimPrefix(server.URL, "http")
+	return urls
+}
+
+func TestWSTransportDeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &wsConsumer{}
+	server := httptest.NewServer(consumer)
+	defer server.Close()
+
+	wt := newTestWSTransport(t, 0)
+
+	// Deliver from several workers at once over the one connection.
+	var wg sync.WaitGroup
+	for _, id := range []string{"1", "2", "3", "4"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			code, err := wt.Deliver(wsURLs(server), "", "", newOutboundEvent(grpcRequest(id), nil))
+			assert.NoError(err)
+			assert.Equal(wsSentCode, code)
+		}(id)
+	}
+	wg.Wait()
+
+	assert.Eventually(func() bool { return 4 == len(consumer.events()) }, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch([]string{"1", "2", "3", "4"}, consumer.events())
+	assert.NoError(wt.Close())
+}
+
+func TestWSTransportSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &wsConsumer{}
+	server := httptest.NewServer(consumer)
+	defer server.Close()
+
+	wt := newTestWSTransport(t, 0)
+	defer wt.Close()
+
+	msg := newOutboundEvent(grpcRequest("1"), nil)
+	_, err := wt.Deliver(wsURLs(server), "123456", "", msg)
+	assert.NoError(err)
+	_, err = wt.Deliver(wsURLs(server), "", "", newOutboundEvent(grpcRequest("2"), nil))
+	assert.NoError(err)
+
+	event, err := msg.msgpack()
+	require.NoError(t, err)
+	assert.Eventually(func() bool { return 2 == len(consumer.events()) }, 5*time.Second, 10*time.Millisecond)
+
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	assert.Equal([]string{signature("123456", event), ""}, consumer.signatures)
+}
+
+func TestWSTransportReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	consumer := &wsConsumer{}
+	server := httptest.NewServer(consumer)
+	defer server.Close()
+
+	wt := newTestWSTransport(t, 3)
+	defer wt.Close()
+
+	_, err := wt.Deliver(wsURLs(server), "", "", newOutboundEvent(grpcRequest("before"), nil))
+	assert.NoError(err)
+	assert.Eventually(func() bool { return 1 == len(consumer.events()) }, 5*time.Second, 10*time.Millisecond)
+
+	// Writes to the dropped connection fail, and the event is retried on a
+	// new one.
+	consumer.drop()
+	assert.Eventually(func() bool {
+		_, err := wt.Deliver(wsURLs(server), "", "", newOutboundEvent(grpcRequest("after"), nil))
+		return nil == err && 2 <= len(consumer.events())
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Contains(consumer.events(), "after")
+}
+
+func TestWSTransportInvalidDestination(t *testing.T) {
+	wt := newTestWSTransport(t, 0)
+	defer wt.Close()
+
+	urls := ring.New(1)
+	urls.Value = "ws://"
+	_, err := wt.Deliver(urls, "", "", newOutboundEvent(grpcRequest("1"), nil))
+	assert.ErrorIs(t, err, errInvalidDestination)
+}
+
+func TestWSTransportClosed(t *testing.T) {
+	consumer := &wsConsumer{}
+	server := httptest.NewServer(consumer)
+	defer server.Close()
+
+	wt := newTestWSTransport(t, 0)
+	require.NoError(t, wt.Close())
+
+	_, err := wt.Deliver(wsURLs(server), "", "", newOutboundEvent(grpcRequest("1"), nil))
+	assert.ErrorIs(t, err, errTransportEnded)
+}